@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/ksurent/lfs-server-go/meta"
+)
+
+// The /user endpoints let meta store users manage their own account. Users
+// known only to other authenticators, e.g. LDAP, have nothing to manage here.
+
+// accountUser returns the meta store user making the request, or writes an
+// error and returns its status. Users of other authenticators don't get the
+// account of a meta store user that happens to have the same name.
+func (a *App) accountUser(w http.ResponseWriter, r *http.Request) (*meta.User, int) {
+	id := identity(r)
+	if !managedUser(id) {
+		writeMessage(w, r, http.StatusNotFound, "Your account is not managed by this server")
+		return nil, http.StatusNotFound
+	}
+
+	user, err := a.metaStore.GetUser(id.Name)
+	switch err {
+	case nil:
+		return user, 0
+	case meta.ErrUserNotFound:
+		writeMessage(w, r, http.StatusNotFound, "Your account is not managed by this server")
+		return nil, http.StatusNotFound
+	default:
+		return nil, internalError(w, r, err)
+	}
+}
+
+// AccountHandler shows the profile of the user making the request
+func (a *App) AccountHandler(w http.ResponseWriter, r *http.Request) int {
+	user, status := a.accountUser(w, r)
+	if user == nil {
+		return status
+	}
+
+	return writeJSON(w, http.StatusOK, newAdminUser(user))
+}
+
+// UpdateAccountHandler changes the profile of the user making the request.
+// The request body is {"display_name": "...", "email": "..."}, fields that
+// are left out don't change.
+func (a *App) UpdateAccountHandler(w http.ResponseWriter, r *http.Request) int {
+	var req struct {
+		DisplayName *string `json:"display_name"`
+		Email       *string `json:"email"`
+	}
+	if status := decodeRequest(w, r, &req); status != 0 {
+		return status
+	}
+
+	user, status := a.accountUser(w, r)
+	if user == nil {
+		return status
+	}
+
+	update := &meta.UserUpdate{DisplayName: req.DisplayName, Email: req.Email}
+	if err := a.metaStore.UpdateUser(user.Name, update); err != nil {
+		return internalError(w, r, err)
+	}
+	update.Apply(user)
+
+	return writeJSON(w, http.StatusOK, newAdminUser(user))
+}
+
+// ChangePasswordHandler changes the password of the user making the request.
+// The request body is {"current_password": "...", "password": "..."}, the
+// current password is asked for even though the request is authenticated so
+// that a leaked session or token can't be used to take over the account.
+func (a *App) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) int {
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		Password        string `json:"password"`
+	}
+	if status := decodeRequest(w, r, &req); status != 0 {
+		return status
+	}
+
+	user, status := a.accountUser(w, r)
+	if user == nil {
+		return status
+	}
+
+	ok, err := a.metaStore.Authenticate(user.Name, req.CurrentPassword)
+	if err != nil {
+		return internalError(w, r, err)
+	}
+	if !ok {
+		writeMessage(w, r, http.StatusForbidden, "The current password is wrong")
+		return http.StatusForbidden
+	}
+
+	if err := a.passwordPolicy.Check(user.Name, req.Password); err != nil {
+		return badRequest(w, r, err.Error())
+	}
+
+	if err := a.metaStore.UpdateUser(user.Name, &meta.UserUpdate{Password: &req.Password}); err != nil {
+		return internalError(w, r, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ksurent/lfs-server-go/auth"
+	"github.com/ksurent/lfs-server-go/config"
+	"github.com/ksurent/lfs-server-go/meta"
+
+	"github.com/gorilla/mux"
+)
+
+// bootstrapAdmin makes sure the configured admin user exists and has the
+// admin role.
+func (a *App) bootstrapAdmin() error {
+	if a.config.AdminPass == "" {
+		return errors.New("AdminPass is not set")
+	}
+
+	if err := a.metaStore.AddUser(a.config.AdminUser, a.config.AdminPass); err != nil {
+		return err
+	}
+
+	return a.metaStore.SetRole(a.config.AdminUser, meta.RoleAdmin)
+}
+
+// managedUser returns true if the meta store vouched for id, either with the
+// user's password or with one of their tokens. Other sources may assert any
+// name, including that of a meta store user.
+func managedUser(id *auth.Identity) bool {
+	return id != nil && (id.Source == "metastore" || id.Source == "token")
+}
+
+// isAdmin returns true if id is one of the configured admins, belongs to one
+// of the configured admin groups, or is a meta store user with the admin
+// role. The role is only honoured if the meta store vouched for the user.
+func (a *App) isAdmin(id *auth.Identity) bool {
+	if id == nil {
+		return false
+	}
+
+	for _, admin := range config.SplitList(a.config.Admins) {
+		if admin == id.Name {
+			return true
+		}
+
+		for _, group := range id.Groups {
+			if admin == group {
+				return true
+			}
+		}
+	}
+
+	if a.metaStore == nil || !managedUser(id) {
+		return false
+	}
+
+	user, err := a.metaStore.GetUser(id.Name)
+	if err != nil {
+		if err != meta.ErrUserNotFound {
+			log.Println(err)
+		}
+		return false
+	}
+
+	return user.IsAdmin()
+}
+
+// decodeRequest decodes the JSON body of an admin or account request into
+// v, or writes the error response and returns its status. Browsers send the
+// credentials of a logged in admin along with cross-site requests: plain
+// forms can't send JSON, and requests that tell where they come from have to
+// come from the server itself.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) int {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeMessage(w, r, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+		return http.StatusUnsupportedMediaType
+	}
+
+	if r.Header.Get("Origin") != "" || r.Header.Get("Referer") != "" {
+		if !sameOrigin(r) {
+			return forbidden(w, r)
+		}
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return badRequest(w, r, "Invalid request body: "+err.Error())
+	}
+
+	return 0
+}
+
+// UnlockHandler lifts the lockout of a user or a client address. Only admins
+// get here, but as it undoes a protection it checks for itself.
+func (a *App) UnlockHandler(w http.ResponseWriter, r *http.Request) int {
+	if !a.isAdmin(identity(r)) {
+		return forbidden(w, r)
+	}
+
+	if a.lockout == nil || !a.lockout.Unlock(mux.Vars(r)["name"]) {
+		return notFound(w, r)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent
+}
+
+// adminUser is a meta store user as seen through the admin API, without the
+// password
+type adminUser struct {
+	Name        string `json:"name"`
+	Role        string `json:"role"`
+	DisplayName string `json:"display_name"`
+	Email       string `json:"email"`
+	Disabled    bool   `json:"disabled"`
+}
+
+func newAdminUser(u *meta.User) *adminUser {
+	return &adminUser{
+		Name:        u.Name,
+		Role:        u.Role,
+		DisplayName: u.DisplayName,
+		Email:       u.Email,
+		Disabled:    u.Disabled,
+	}
+}
+
+// adminObject is object metadata as seen through the admin API
+type adminObject struct {
+	Oid          string   `json:"oid"`
+	Size         int64    `json:"size"`
+	ProjectNames []string `json:"project_names"`
+	Pending      bool     `json:"pending"`
+}
+
+func newAdminObject(m *meta.Object) *adminObject {
+	return &adminObject{
+		Oid:          m.Oid,
+		Size:         m.Size,
+		ProjectNames: m.ProjectNames,
+		Pending:      !m.Existing,
+	}
+}
+
+// ListUsersHandler lists the meta store users and their roles
+func (a *App) ListUsersHandler(w http.ResponseWriter, r *http.Request) int {
+	users, err := a.metaStore.Users()
+	if err != nil {
+		return internalError(w, r, err)
+	}
+
+	list := make([]*adminUser, 0, len(users))
+	for _, user := range users {
+		list = append(list, newAdminUser(user))
+	}
+
+	return writeJSON(w, http.StatusOK, list)
+}
+
+// GetUserHandler shows a single meta store user
+func (a *App) GetUserHandler(w http.ResponseWriter, r *http.Request) int {
+	user, err := a.metaStore.GetUser(mux.Vars(r)["name"])
+	if err != nil {
+		if err == meta.ErrUserNotFound {
+			return notFound(w, r)
+		}
+		return internalError(w, r, err)
+	}
+
+	return writeJSON(w, http.StatusOK, newAdminUser(user))
+}
+
+// CreateUserHandler adds a meta store user. The request body is
+// {"name": "...", "password": "...", "role": "...", "display_name": "...",
+// "email": "..."}, only the name and the password are required and the role
+// defaults to a regular user.
+func (a *App) CreateUserHandler(w http.ResponseWriter, r *http.Request) int {
+	var req struct {
+		Name        string `json:"name"`
+		Password    string `json:"password"`
+		Role        string `json:"role"`
+		DisplayName string `json:"display_name"`
+		Email       string `json:"email"`
+	}
+	if status := decodeRequest(w, r, &req); status != 0 {
+		return status
+	}
+
+	if req.Name == "" || req.Password == "" {
+		return badRequest(w, r, "User name and password are required")
+	}
+
+	if err := a.passwordPolicy.Check(req.Name, req.Password); err != nil {
+		return badRequest(w, r, err.Error())
+	}
+
+	if req.Role == "" {
+		req.Role = meta.RoleUser
+	}
+	if !meta.ValidRole(req.Role) {
+		return badRequest(w, r, meta.ErrInvalidRole.Error())
+	}
+
+	if _, err := a.metaStore.GetUser(req.Name); err == nil {
+		return conflict(w, r, "User already exists")
+	} else if err != meta.ErrUserNotFound {
+		return internalError(w, r, err)
+	}
+
+	if err := a.metaStore.AddUser(req.Name, req.Password); err != nil {
+		return internalError(w, r, err)
+	}
+
+	if err := a.metaStore.SetRole(req.Name, req.Role); err != nil {
+		return internalError(w, r, err)
+	}
+
+	if req.DisplayName != "" || req.Email != "" {
+		update := &meta.UserUpdate{DisplayName: &req.DisplayName, Email: &req.Email}
+		if err := a.metaStore.UpdateUser(req.Name, update); err != nil {
+			return internalError(w, r, err)
+		}
+	}
+
+	return writeJSON(w, http.StatusCreated, &adminUser{
+		Name:        req.Name,
+		Role:        req.Role,
+		DisplayName: req.DisplayName,
+		Email:       req.Email,
+	})
+}
+
+// UpdateUserHandler changes the profile of a meta store user or resets their
+// password. The request body is a meta.UserUpdate, fields that are left out
+// don't change.
+func (a *App) UpdateUserHandler(w http.ResponseWriter, r *http.Request) int {
+	var update meta.UserUpdate
+	if status := decodeRequest(w, r, &update); status != 0 {
+		return status
+	}
+
+	name := mux.Vars(r)["name"]
+
+	if update.Password != nil {
+		if err := a.passwordPolicy.Check(name, *update.Password); err != nil {
+			return badRequest(w, r, err.Error())
+		}
+	}
+
+	if err := a.metaStore.UpdateUser(name, &update); err != nil {
+		if err == meta.ErrUserNotFound {
+			return notFound(w, r)
+		}
+		return internalError(w, r, err)
+	}
+
+	user, err := a.metaStore.GetUser(name)
+	if err != nil {
+		return internalError(w, r, err)
+	}
+
+	return writeJSON(w, http.StatusOK, newAdminUser(user))
+}
+
+// DeleteUserHandler removes a meta store user
+func (a *App) DeleteUserHandler(w http.ResponseWriter, r *http.Request) int {
+	name := mux.Vars(r)["name"]
+
+	if _, err := a.metaStore.GetUser(name); err != nil {
+		if err == meta.ErrUserNotFound {
+			return notFound(w, r)
+		}
+		return internalError(w, r, err)
+	}
+
+	if err := a.metaStore.DeleteUser(name); err != nil {
+		return internalError(w, r, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent
+}
+
+// SetRoleHandler changes the role of a meta store user. The request body is
+// {"role": "..."}.
+func (a *App) SetRoleHandler(w http.ResponseWriter, r *http.Request) int {
+	var req struct {
+		Role string `json:"role"`
+	}
+	if status := decodeRequest(w, r, &req); status != 0 {
+		return status
+	}
+
+	if !meta.ValidRole(req.Role) {
+		return badRequest(w, r, meta.ErrInvalidRole.Error())
+	}
+
+	user, err := a.metaStore.GetUser(mux.Vars(r)["name"])
+	if err != nil {
+		if err == meta.ErrUserNotFound {
+			return notFound(w, r)
+		}
+		return internalError(w, r, err)
+	}
+
+	if err := a.metaStore.SetRole(user.Name, req.Role); err != nil {
+		return internalError(w, r, err)
+	}
+	user.Role = req.Role
+
+	return writeJSON(w, http.StatusOK, newAdminUser(user))
+}
+
+// ListProjectsHandler lists the projects known to the meta store, a page at
+// a time
+func (a *App) ListProjectsHandler(w http.ResponseWriter, r *http.Request) int {
+	after, limit, err := pageParams(r)
+	if err != nil {
+		return badRequest(w, r, err.Error())
+	}
+
+	list := []*meta.Project{}
+	err = a.metaStore.ForEachProject(after, func(p *meta.Project) error {
+		list = append(list, p)
+		return pageDone(len(list), limit)
+	})
+	if err != nil && err != errPageDone {
+		return internalError(w, r, err)
+	}
+
+	if err == errPageDone {
+		setNextLink(w, r, list[len(list)-1].Name, limit)
+	}
+
+	return writeJSON(w, http.StatusOK, list)
+}
+
+// GetProjectHandler shows a single project and its objects
+func (a *App) GetProjectHandler(w http.ResponseWriter, r *http.Request) int {
+	project, err := a.metaStore.GetProject(mux.Vars(r)["name"])
+	if err != nil {
+		if err == meta.ErrProjectNotFound {
+			return notFound(w, r)
+		}
+		return internalError(w, r, err)
+	}
+
+	return writeJSON(w, http.StatusOK, project)
+}
+
+// CreateProjectHandler adds a project. The request body is a meta.Project
+// without the OIDs, the name and namespace are required. The owner defaults
+// to the admin creating the project.
+func (a *App) CreateProjectHandler(w http.ResponseWriter, r *http.Request) int {
+	var project meta.Project
+	if status := decodeRequest(w, r, &project); status != 0 {
+		return status
+	}
+
+	// a project without a namespace can't be reached under any
+	if project.Namespace == "" {
+		return badRequest(w, r, meta.ErrNoProjectNamespace.Error())
+	}
+	if strings.Contains(project.Name, "/") || strings.Contains(project.Namespace, "/") {
+		return badRequest(w, r, "Project and namespace names can't contain slashes")
+	}
+
+	project.Oids = []string{}
+	if project.Owner == "" {
+		project.Owner = identity(r).Name
+	}
+
+	// requests for aliases go to the renamed project, a new one would be
+	// unreachable
+	switch _, err := a.metaStore.ProjectAlias(project.Name); err {
+	case nil:
+		return conflict(w, r, "Project name is an alias of a renamed project")
+	case meta.ErrProjectNotFound:
+	default:
+		return internalError(w, r, err)
+	}
+
+	switch err := a.metaStore.AddProject(&project); err {
+	case nil:
+		return writeJSON(w, http.StatusCreated, &project)
+	case meta.ErrNoProjectName, meta.ErrInvalidVisibility:
+		return badRequest(w, r, err.Error())
+	case meta.ErrProjectExists:
+		return conflict(w, r, err.Error())
+	default:
+		return internalError(w, r, err)
+	}
+}
+
+// MoveProjectHandler renames a project, moves it to another namespace or
+// transfers it to another owner. The request body is a meta.ProjectMove.
+func (a *App) MoveProjectHandler(w http.ResponseWriter, r *http.Request) int {
+	var move meta.ProjectMove
+	if status := decodeRequest(w, r, &move); status != 0 {
+		return status
+	}
+
+	if strings.Contains(move.Name, "/") || strings.Contains(move.Namespace, "/") {
+		return badRequest(w, r, "Project and namespace names can't contain slashes")
+	}
+
+	project, err := a.metaStore.MoveProject(mux.Vars(r)["name"], &move)
+	switch err {
+	case nil:
+		return writeJSON(w, http.StatusOK, project)
+	case meta.ErrProjectNotFound:
+		return notFound(w, r)
+	case meta.ErrProjectExists:
+		return conflict(w, r, err.Error())
+	default:
+		return internalError(w, r, err)
+	}
+}
+
+// UpdateProjectHandler changes the settings of a project: its description,
+// visibility and maximum object size. The request body is a
+// meta.ProjectUpdate, fields that are left out don't change.
+func (a *App) UpdateProjectHandler(w http.ResponseWriter, r *http.Request) int {
+	var update meta.ProjectUpdate
+	if status := decodeRequest(w, r, &update); status != 0 {
+		return status
+	}
+
+	project, err := a.metaStore.UpdateProject(mux.Vars(r)["name"], &update)
+	switch err {
+	case nil:
+		return writeJSON(w, http.StatusOK, project)
+	case meta.ErrProjectNotFound:
+		return notFound(w, r)
+	case meta.ErrInvalidVisibility, meta.ErrInvalidMaxObjectSize:
+		return badRequest(w, r, err.Error())
+	default:
+		return internalError(w, r, err)
+	}
+}
+
+// DeleteProjectHandler removes a project. Only projects without objects can
+// be deleted, objects are never removed through the admin API.
+func (a *App) DeleteProjectHandler(w http.ResponseWriter, r *http.Request) int {
+	switch err := a.metaStore.DeleteProject(mux.Vars(r)["name"]); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+		return http.StatusNoContent
+	case meta.ErrProjectNotFound:
+		return notFound(w, r)
+	case meta.ErrProjectNotEmpty:
+		return conflict(w, r, err.Error())
+	default:
+		return internalError(w, r, err)
+	}
+}
+
+// ListPermissionsHandler lists the permissions of a project ordered by user
+func (a *App) ListPermissionsHandler(w http.ResponseWriter, r *http.Request) int {
+	project, err := a.metaStore.GetProject(mux.Vars(r)["name"])
+	if err != nil {
+		if err == meta.ErrProjectNotFound {
+			return notFound(w, r)
+		}
+		return internalError(w, r, err)
+	}
+
+	permissions, err := a.metaStore.Permissions(project.Name)
+	if err != nil {
+		return internalError(w, r, err)
+	}
+
+	if permissions == nil {
+		permissions = []*meta.Permission{}
+	}
+
+	return writeJSON(w, http.StatusOK, permissions)
+}
+
+// SetPermissionHandler gives a user read or write access to a project, on
+// top of what the authorizer allows. The request body is
+// {"access": "read|write"}.
+func (a *App) SetPermissionHandler(w http.ResponseWriter, r *http.Request) int {
+	var req struct {
+		Access string `json:"access"`
+	}
+	if status := decodeRequest(w, r, &req); status != 0 {
+		return status
+	}
+
+	vars := mux.Vars(r)
+	permission := &meta.Permission{User: vars["user"], Access: req.Access}
+
+	switch err := a.metaStore.SetPermission(vars["name"], permission); err {
+	case nil:
+		return writeJSON(w, http.StatusOK, permission)
+	case meta.ErrProjectNotFound:
+		return notFound(w, r)
+	case meta.ErrInvalidAccess:
+		return badRequest(w, r, err.Error())
+	default:
+		return internalError(w, r, err)
+	}
+}
+
+// DeletePermissionHandler takes the access to a project away from a user
+func (a *App) DeletePermissionHandler(w http.ResponseWriter, r *http.Request) int {
+	vars := mux.Vars(r)
+
+	switch err := a.metaStore.DeletePermission(vars["name"], vars["user"]); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+		return http.StatusNoContent
+	case meta.ErrPermissionNotFound:
+		return notFound(w, r)
+	default:
+		return internalError(w, r, err)
+	}
+}
+
+// ListObjectsHandler lists all objects, committed or not, a page at a time
+func (a *App) ListObjectsHandler(w http.ResponseWriter, r *http.Request) int {
+	after, limit, err := pageParams(r)
+	if err != nil {
+		return badRequest(w, r, err.Error())
+	}
+
+	list, next, err := a.objectPage(after, limit)
+	if err != nil {
+		return internalError(w, r, err)
+	}
+
+	if next != "" {
+		setNextLink(w, r, next, limit)
+	}
+
+	return writeJSON(w, http.StatusOK, list)
+}
+
+// GetObjectHandler shows a single object, committed or not
+func (a *App) GetObjectHandler(w http.ResponseWriter, r *http.Request) int {
+	rv := &meta.RequestVars{Oid: mux.Vars(r)["oid"]}
+
+	m, err := a.metaStore.Get(rv)
+	if meta.IsObjectNotFound(err) {
+		m, err = a.metaStore.GetPending(rv)
+	}
+	if err != nil {
+		if meta.IsObjectNotFound(err) {
+			return notFound(w, r)
+		}
+		return internalError(w, r, err)
+	}
+
+	return writeJSON(w, http.StatusOK, newAdminObject(m))
+}
+
+// Listings are paginated with the after and limit query parameters: a page
+// holds up to limit entries following the one named by after, in the order
+// of the meta store. If there may be more, the response has a Link header
+// with rel="next" pointing at the following page.
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// errPageDone stops iterating over the meta store once a page is full
+var errPageDone = errors.New("page done")
+
+func pageDone(n, limit int) error {
+	if n >= limit {
+		return errPageDone
+	}
+	return nil
+}
+
+func pageParams(r *http.Request) (string, int, error) {
+	q := r.URL.Query()
+
+	limit := defaultPageLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return "", 0, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		limit = n
+	}
+
+	return q.Get("after"), limit, nil
+}
+
+func setNextLink(w http.ResponseWriter, r *http.Request, after string, limit int) {
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", nextPage(r, after, limit)))
+}
+
+// nextPage returns the URI of the page following after
+func nextPage(r *http.Request, after string, limit int) string {
+	u := *r.URL
+	q := u.Query()
+	q.Set("after", after)
+	q.Set("limit", strconv.Itoa(limit))
+	u.RawQuery = q.Encode()
+
+	return u.RequestURI()
+}
+
+// objectPage returns up to limit objects following after and the cursor of
+// the next page, empty if this was the last one
+func (a *App) objectPage(after string, limit int) ([]*adminObject, string, error) {
+	list := []*adminObject{}
+	err := a.metaStore.ForEachObject(after, func(m *meta.Object) error {
+		list = append(list, newAdminObject(m))
+		return pageDone(len(list), limit)
+	})
+
+	switch err {
+	case nil:
+		return list, "", nil
+	case errPageDone:
+		return list, list[len(list)-1].Oid, nil
+	default:
+		return nil, "", err
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ksurent/lfs-server-go/audit"
+	"github.com/ksurent/lfs-server-go/auth"
+	"github.com/ksurent/lfs-server-go/config"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+func newAuditLog(cfg *config.Configuration) *audit.Log {
+	if cfg.Audit == nil || cfg.Audit.File == "" {
+		return nil
+	}
+
+	l, err := audit.Open(cfg.Audit.File)
+	if err != nil {
+		log.Println("Could not open the audit log:", err)
+		return nil
+	}
+
+	return l
+}
+
+// setAudit marks the request to be recorded in the audit log once it has
+// been handled. The handler fills in what only it knows, like the bytes
+// transferred.
+func setAudit(r *http.Request, action, oid string) *audit.Event {
+	e := &audit.Event{Action: action, Oid: oid}
+	context.Set(r, "Audit", e)
+	return e
+}
+
+// auditEvent returns the event the handler set, or one for requests that
+// change the configuration or an account
+func auditEvent(r *http.Request, op auth.Operation) *audit.Event {
+	if e, ok := context.Get(r, "Audit").(*audit.Event); ok {
+		return e
+	}
+
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return nil
+	}
+
+	switch op {
+	case auth.Admin:
+		return &audit.Event{Action: audit.Admin}
+	case auth.Account:
+		return &audit.Event{Action: audit.Account}
+	default:
+		return nil
+	}
+}
+
+// recordAudit completes e with the details of the request and appends it to
+// the audit log, if there is one
+func (a *App) recordAudit(r *http.Request, e *audit.Event, status int) {
+	if a.auditLog == nil || e == nil {
+		return
+	}
+
+	if id := identity(r); id != nil {
+		e.User = id.Name
+	} else if user, _, ok := r.BasicAuth(); ok {
+		// the name failed authentication, which is worth knowing
+		e.User = user
+	}
+
+	e.RemoteAddr = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		e.RemoteAddr = host
+	}
+
+	vars := mux.Vars(r)
+	e.Request = r.Method + " " + r.URL.Path
+	e.Namespace = vars["namespace"]
+	e.Project = vars["repo"]
+	if e.Oid == "" {
+		e.Oid = vars["oid"]
+	}
+	e.Status = status
+
+	if err := a.auditLog.Record(e); err != nil {
+		log.Println("Could not write to the audit log:", err)
+	}
+}
+
+// AuditHandler searches the audit log. Events can be selected by the user,
+// project, oid and action query parameters, and by time with since and
+// until in RFC 3339 format. The last limit events are returned, oldest
+// first.
+func (a *App) AuditHandler(w http.ResponseWriter, r *http.Request) int {
+	if a.auditLog == nil {
+		writeMessage(w, r, http.StatusNotFound, "The audit log is not enabled")
+		return http.StatusNotFound
+	}
+
+	params := r.URL.Query()
+	q := &audit.Query{
+		User:    params.Get("user"),
+		Project: params.Get("project"),
+		Oid:     params.Get("oid"),
+		Action:  params.Get("action"),
+	}
+
+	for _, v := range []struct {
+		name string
+		dest *time.Time
+	}{
+		{"since", &q.Since},
+		{"until", &q.Until},
+	} {
+		if s := params.Get(v.name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return badRequest(w, r, v.name+" must be a time in RFC 3339 format")
+			}
+			*v.dest = t
+		}
+	}
+
+	limit := defaultPageLimit
+	if s := params.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return badRequest(w, r, "limit must be between 1 and "+strconv.Itoa(maxPageLimit))
+		}
+		limit = n
+	}
+
+	events, err := a.auditLog.Search(q, limit)
+	if err != nil {
+		return internalError(w, r, err)
+	}
+
+	return writeJSON(w, http.StatusOK, events)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,170 @@
+// Package audit records who transferred which objects, failed to
+// authenticate or changed the server's configuration, in an append-only
+// file of JSON lines.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Actions of the events
+const (
+	Download    = "download"
+	Upload      = "upload"
+	AuthFailure = "auth_failure"
+	LockedOut   = "locked_out"
+	Forbidden   = "forbidden"
+	Admin       = "admin"
+	Account     = "account"
+)
+
+// Event is a single entry of the audit log. Request is the method and path
+// of the HTTP request, Status its response status.
+type Event struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Action     string    `json:"action"`
+	Request    string    `json:"request"`
+	Namespace  string    `json:"namespace,omitempty"`
+	Project    string    `json:"project,omitempty"`
+	Oid        string    `json:"oid,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	Status     int       `json:"status"`
+}
+
+// Query selects events, empty fields match any event
+type Query struct {
+	User    string
+	Project string
+	Oid     string
+	Action  string
+	Since   time.Time
+	Until   time.Time
+}
+
+// Matches returns true if e is selected by q
+func (q *Query) Matches(e *Event) bool {
+	switch {
+	case q.User != "" && e.User != q.User:
+		return false
+	case q.Project != "" && e.Project != q.Project:
+		return false
+	case q.Oid != "" && e.Oid != q.Oid:
+		return false
+	case q.Action != "" && e.Action != q.Action:
+		return false
+	case !q.Since.IsZero() && e.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !e.Time.Before(q.Until):
+		return false
+	}
+
+	return true
+}
+
+// Log appends events to a file. The file is only ever appended to, so it
+// can be rotated by copying and truncating it.
+type Log struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// Open opens the audit log at path, creating it if needed
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := endLine(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Log{path: path, file: f}, nil
+}
+
+// endLine ends the last line of f if a crash cut it short, so that the next
+// event starts a line of its own
+func endLine(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil || fi.Size() == 0 {
+		return err
+	}
+
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, fi.Size()-1); err != nil {
+		return err
+	}
+
+	if last[0] != '\n' {
+		_, err = f.Write([]byte{'\n'})
+	}
+	return err
+}
+
+// Record appends e to the log, setting its time if it has none
+func (l *Log) Record(e *Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// a single write, so that concurrent writers can't interleave lines
+	_, err = l.file.Write(append(b, '\n'))
+	return err
+}
+
+// Search returns the last limit events selected by q, oldest first. Lines
+// that can't be decoded, such as one cut short by a crash, are skipped.
+func (l *Log) Search(q *Query, limit int) ([]*Event, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	found := []*Event{}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		var e Event
+		if len(line) > 0 && json.Unmarshal(line, &e) == nil && q.Matches(&e) {
+			found = append(found, &e)
+			if len(found) > limit {
+				found = found[1:]
+			}
+		}
+
+		if err == io.EOF {
+			return found, nil
+		}
+	}
+}
+
+// Close closes the log file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Close()
+}
@@ -0,0 +1,90 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("expected Open() to succeed, got: %s", err)
+	}
+
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, e := range []*Event{
+		{User: "alice", Action: Upload, Project: "repo", Oid: "aaa", Bytes: 10},
+		{User: "bob", Action: Download, Project: "repo", Oid: "aaa", Bytes: 10},
+		{User: "bob", Action: Download, Project: "other", Oid: "bbb", Bytes: 20},
+		{User: "mallory", Action: AuthFailure},
+	} {
+		e.Time = start.Add(time.Duration(i) * time.Minute)
+		if err := l.Record(e); err != nil {
+			t.Fatalf("expected Record() to succeed, got: %s", err)
+		}
+	}
+	l.Close()
+
+	// a line cut short by a crash doesn't hide the ones after it
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"user": "tru`)
+	f.Close()
+
+	if l, err = Open(path); err != nil {
+		t.Fatalf("expected Open() to succeed again, got: %s", err)
+	}
+	defer l.Close()
+
+	if err := l.Record(&Event{User: "alice", Action: Admin}); err != nil {
+		t.Fatalf("expected Record() to succeed, got: %s", err)
+	}
+
+	for _, tc := range []struct {
+		q        Query
+		limit    int
+		expected []string
+	}{
+		{Query{}, 10, []string{"alice", "bob", "bob", "mallory", "alice"}},
+		{Query{}, 2, []string{"mallory", "alice"}},
+		{Query{User: "bob"}, 10, []string{"bob", "bob"}},
+		{Query{Project: "repo"}, 10, []string{"alice", "bob"}},
+		{Query{Oid: "bbb"}, 10, []string{"bob"}},
+		{Query{Action: AuthFailure}, 10, []string{"mallory"}},
+		{Query{Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)}, 10, []string{"bob", "bob"}},
+	} {
+		events, err := l.Search(&tc.q, tc.limit)
+		if err != nil {
+			t.Fatalf("expected Search(%+v) to succeed, got: %s", tc.q, err)
+		}
+
+		var users []string
+		for _, e := range events {
+			users = append(users, e.User)
+		}
+
+		if len(users) != len(tc.expected) {
+			t.Errorf("expected Search(%+v) to find %v, got: %v", tc.q, tc.expected, users)
+			continue
+		}
+		for i := range users {
+			if users[i] != tc.expected[i] {
+				t.Errorf("expected Search(%+v) to find %v, got: %v", tc.q, tc.expected, users)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+)
+
+var (
+	// ErrNoCredentials is returned by authenticators when the request doesn't
+	// carry any credentials they understand.
+	ErrNoCredentials = errors.New("No credentials")
+	// ErrBadCredentials is returned by authenticators when the credentials
+	// are not valid.
+	ErrBadCredentials = errors.New("Bad credentials")
+)
+
+// Metrics holds per authenticator counters, keyed by <name>.<result>
+var Metrics = expvar.NewMap("auth")
+
+// IsUnauthorized returns true if err means that the request should be
+// challenged for (other) credentials.
+func IsUnauthorized(err error) bool {
+	return err == ErrNoCredentials || err == ErrBadCredentials
+}
+
+// Identity is an authenticated user as seen by request handlers
+type Identity struct {
+	Name string
+	// Source is the name of the authenticator that vouched for the user
+	Source string
+	Groups []string
+}
+
+// Authenticator verifies the credentials a request carries.
+type Authenticator interface {
+	Name() string
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Chain asks each of its authenticators in turn and returns the first
+// identity established.
+type Chain struct {
+	authenticators []Authenticator
+}
+
+func NewChain(authenticators ...Authenticator) *Chain {
+	for _, a := range authenticators {
+		for _, result := range []string{"success", "failure", "error", "skipped"} {
+			if Metrics.Get(a.Name()+"."+result) == nil {
+				Metrics.Set(a.Name()+"."+result, new(expvar.Int))
+			}
+		}
+	}
+
+	return &Chain{authenticators}
+}
+
+func (c *Chain) Name() string {
+	return "chain"
+}
+
+// Authenticate returns ErrNoCredentials if none of the authenticators found
+// credentials, ErrBadCredentials if some of them did but rejected them, or
+// the first unexpected error if nobody accepted the credentials.
+func (c *Chain) Authenticate(r *http.Request) (*Identity, error) {
+	result := ErrNoCredentials
+
+	for _, a := range c.authenticators {
+		id, err := a.Authenticate(r)
+		switch {
+		case err == nil:
+			Metrics.Add(a.Name()+".success", 1)
+			if id.Source == "" {
+				id.Source = a.Name()
+			}
+			return id, nil
+		case err == ErrNoCredentials:
+			Metrics.Add(a.Name()+".skipped", 1)
+		case err == ErrBadCredentials:
+			Metrics.Add(a.Name()+".failure", 1)
+			if result == ErrNoCredentials {
+				result = err
+			}
+		default:
+			Metrics.Add(a.Name()+".error", 1)
+			if IsUnauthorized(result) {
+				result = err
+			}
+		}
+	}
+
+	return nil, result
+}
+
+// Basic authenticates requests carrying HTTP Basic credentials with verify.
+type Basic struct {
+	name   string
+	verify VerifyFunc
+}
+
+func NewBasic(name string, verify VerifyFunc) *Basic {
+	return &Basic{name, verify}
+}
+
+func (b *Basic) Name() string {
+	return b.name
+}
+
+func (b *Basic) Authenticate(r *http.Request) (*Identity, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	ok, err := b.verify(user, pass)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrBadCredentials
+	}
+
+	return &Identity{Name: user, Source: b.name}, nil
+}
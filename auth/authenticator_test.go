@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+type fixedAuthenticator struct {
+	name string
+	id   *Identity
+	err  error
+}
+
+func (f *fixedAuthenticator) Name() string {
+	return f.name
+}
+
+func (f *fixedAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	return f.id, f.err
+}
+
+func TestChainOrder(t *testing.T) {
+	first := &fixedAuthenticator{name: "test-first", err: ErrNoCredentials}
+	second := &fixedAuthenticator{name: "test-second", id: &Identity{Name: "admin"}}
+	third := &fixedAuthenticator{name: "test-third", id: &Identity{Name: "other"}}
+
+	id, err := NewChain(first, second, third).Authenticate(newRequest())
+	if err != nil {
+		t.Fatalf("expected Authenticate() to succeed, got: %s", err)
+	}
+
+	if id.Name != "admin" || id.Source != "test-second" {
+		t.Errorf("expected admin to be authenticated by test-second, got: %#v", id)
+	}
+
+	if n := Metrics.Get("test-first.skipped").String(); n != "1" {
+		t.Errorf("expected test-first to be skipped once, got: %s", n)
+	}
+	if n := Metrics.Get("test-second.success").String(); n != "1" {
+		t.Errorf("expected test-second to succeed once, got: %s", n)
+	}
+	if n := Metrics.Get("test-third.success").String(); n != "0" {
+		t.Errorf("expected test-third to not be asked, got: %s", n)
+	}
+}
+
+func TestChainErrors(t *testing.T) {
+	none := &fixedAuthenticator{name: "test-none", err: ErrNoCredentials}
+	bad := &fixedAuthenticator{name: "test-bad", err: ErrBadCredentials}
+	down := &fixedAuthenticator{name: "test-down", err: errors.New("LDAP is down")}
+	good := &fixedAuthenticator{name: "test-good", id: &Identity{Name: "admin"}}
+
+	for _, v := range []struct {
+		chain    *Chain
+		expected error
+	}{
+		{NewChain(), ErrNoCredentials},
+		{NewChain(none), ErrNoCredentials},
+		{NewChain(none, bad), ErrBadCredentials},
+		{NewChain(bad, down), down.err},
+		{NewChain(down, bad), down.err},
+		{NewChain(down, good), nil},
+	} {
+		if _, err := v.chain.Authenticate(newRequest()); err != v.expected {
+			t.Errorf("expected Authenticate() to return %v, got: %v", v.expected, err)
+		}
+	}
+}
+
+func TestBasic(t *testing.T) {
+	b := NewBasic("test-basic", func(user, pass string) (bool, error) {
+		return user == "admin" && pass == "admin", nil
+	})
+
+	if _, err := b.Authenticate(newRequest()); err != ErrNoCredentials {
+		t.Errorf("expected a request without credentials to be skipped, got: %v", err)
+	}
+
+	r := newRequest()
+	r.SetBasicAuth("admin", "wrong")
+	if _, err := b.Authenticate(r); err != ErrBadCredentials {
+		t.Errorf("expected wrong credentials to be rejected, got: %v", err)
+	}
+
+	r.SetBasicAuth("admin", "admin")
+	id, err := b.Authenticate(r)
+	if err != nil {
+		t.Fatalf("expected Authenticate() to succeed, got: %s", err)
+	}
+	if id.Name != "admin" || id.Source != "test-basic" {
+		t.Errorf("expected admin to be authenticated by test-basic, got: %#v", id)
+	}
+}
+
+func newRequest() *http.Request {
+	r, _ := http.NewRequest("GET", "http://localhost/", nil)
+	return r
+}
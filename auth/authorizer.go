@@ -0,0 +1,65 @@
+package auth
+
+// Operation is what an authenticated user is trying to do with a repository.
+type Operation int
+
+const (
+	Read Operation = iota
+	Write
+	// Admin is server administration, it isn't tied to any repository
+	Admin
+	// Account is users managing their own account, anybody who
+	// authenticates may do it
+	Account
+)
+
+func (o Operation) String() string {
+	switch o {
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	case Admin:
+		return "admin"
+	case Account:
+		return "account"
+	default:
+		return "unknown"
+	}
+}
+
+// Authorizer decides whether an identity is allowed to perform an operation
+// on a repository.
+type Authorizer interface {
+	Authorize(id *Identity, namespace, repo string, op Operation) (bool, error)
+}
+
+// AllowAll lets every authenticated user do anything.
+type AllowAll struct{}
+
+func (AllowAll) Authorize(id *Identity, namespace, repo string, op Operation) (bool, error) {
+	return id != nil, nil
+}
+
+// NamespaceAuthorizer gives users access to the namespace named after them
+// and to the namespaces named after their groups. Requests that are not
+// scoped to a namespace are allowed.
+type NamespaceAuthorizer struct{}
+
+func (NamespaceAuthorizer) Authorize(id *Identity, namespace, repo string, op Operation) (bool, error) {
+	if id == nil {
+		return false, nil
+	}
+
+	if namespace == "" || namespace == id.Name {
+		return true, nil
+	}
+
+	for _, group := range id.Groups {
+		if namespace == group {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
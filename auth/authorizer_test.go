@@ -0,0 +1,28 @@
+package auth
+
+import "testing"
+
+func TestNamespaceAuthorizer(t *testing.T) {
+	id := &Identity{Name: "admin", Groups: []string{"developers"}}
+
+	for _, v := range []struct {
+		id        *Identity
+		namespace string
+		expected  bool
+	}{
+		{id, "admin", true},
+		{id, "developers", true},
+		{id, "", true},
+		{id, "others", false},
+		{nil, "admin", false},
+	} {
+		ok, err := NamespaceAuthorizer{}.Authorize(v.id, v.namespace, "repo", Write)
+		if err != nil {
+			t.Fatalf("expected Authorize() to succeed, got: %s", err)
+		}
+
+		if ok != v.expected {
+			t.Errorf("expected Authorize() for namespace %q to return %v, got: %v", v.namespace, v.expected, ok)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"expvar"
+	"sync"
+	"time"
+)
+
+var (
+	cacheHits          = expvar.NewInt("auth_cache_hits")
+	cacheMisses        = expvar.NewInt("auth_cache_misses")
+	cacheEvictions     = expvar.NewInt("auth_cache_evictions")
+	cacheInvalidations = expvar.NewInt("auth_cache_invalidations")
+	cacheSize          = expvar.NewInt("auth_cache_size")
+)
+
+// VerifyFunc checks user credentials against the authoritative source.
+type VerifyFunc func(user, pass string) (bool, error)
+
+// CredentialCache remembers successful authentications for a limited time so
+// that expensive checks (bcrypt, LDAP binds) don't have to be repeated for
+// every request. Credentials are never stored in clear, entries are keyed by
+// a salted hash of the user name and the password.
+type CredentialCache struct {
+	ttl     time.Duration
+	maxSize int
+	salt    []byte
+	now     func() time.Time
+
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+	generation uint64
+}
+
+type cacheEntry struct {
+	key     string
+	user    string
+	expires time.Time
+}
+
+// NewCredentialCache creates a cache holding at most maxSize entries, each
+// valid for ttl.
+func NewCredentialCache(ttl time.Duration, maxSize int) (*CredentialCache, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return &CredentialCache{
+		ttl:     ttl,
+		maxSize: maxSize,
+		salt:    salt,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}, nil
+}
+
+// Authenticate returns true if the credentials were successfully verified
+// recently, otherwise it calls verify and caches a positive result.
+func (c *CredentialCache) Authenticate(user, pass string, verify VerifyFunc) (bool, error) {
+	return c.authenticate("", user, pass, verify)
+}
+
+// Wrap returns a VerifyFunc that consults the cache before calling verify.
+// Entries are kept apart from those of other sources, so that credentials
+// accepted by one of them are never taken for granted by another.
+func (c *CredentialCache) Wrap(source string, verify VerifyFunc) VerifyFunc {
+	return func(user, pass string) (bool, error) {
+		return c.authenticate(source, user, pass, verify)
+	}
+}
+
+func (c *CredentialCache) authenticate(source, user, pass string, verify VerifyFunc) (bool, error) {
+	key := c.key(source, user, pass)
+
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		if c.now().Before(el.Value.(*cacheEntry).expires) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+
+			cacheHits.Add(1)
+			return true, nil
+		}
+
+		c.remove(el)
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	cacheMisses.Add(1)
+
+	ok, err := verify(user, pass)
+	if !ok || err != nil {
+		return ok, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The user may have been removed while we were verifying them, don't
+	// resurrect them
+	if generation != c.generation {
+		return true, nil
+	}
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{
+		key:     key,
+		user:    user,
+		expires: c.now().Add(c.ttl),
+	})
+	cacheSize.Add(1)
+
+	for c.lru.Len() > c.maxSize {
+		c.remove(c.lru.Back())
+		cacheEvictions.Add(1)
+	}
+
+	return true, nil
+}
+
+// Invalidate forgets all cached credentials of user.
+func (c *CredentialCache) Invalidate(user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*cacheEntry).user == user {
+			c.remove(el)
+			cacheInvalidations.Add(1)
+		}
+		el = next
+	}
+}
+
+// Len returns the number of cached entries, including expired ones that
+// haven't been looked up since.
+func (c *CredentialCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+func (c *CredentialCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+	cacheSize.Add(-1)
+}
+
+func (c *CredentialCache) key(source, user, pass string) string {
+	mac := hmac.New(sha256.New, c.salt)
+	for _, s := range []string{source, user, pass} {
+		// length prefixes keep ("a", "bc") and ("ab", "c") apart
+		binary.Write(mac, binary.BigEndian, uint32(len(s)))
+		mac.Write([]byte(s))
+	}
+
+	return string(mac.Sum(nil))
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type verifier struct {
+	calls int
+	ok    bool
+	err   error
+}
+
+func (v *verifier) verify(user, pass string) (bool, error) {
+	v.calls++
+	return v.ok, v.err
+}
+
+func TestCacheHit(t *testing.T) {
+	c := newTestCache(t, time.Minute, 10)
+	v := &verifier{ok: true}
+
+	for i := 0; i < 3; i++ {
+		ok, err := c.Authenticate("admin", "admin", v.verify)
+		if !ok || err != nil {
+			t.Fatalf("expected Authenticate() to succeed, got: %v, %v", ok, err)
+		}
+	}
+
+	if v.calls != 1 {
+		t.Errorf("expected credentials to be verified once, got: %d", v.calls)
+	}
+}
+
+func TestCacheDifferentPassword(t *testing.T) {
+	c := newTestCache(t, time.Minute, 10)
+
+	c.Authenticate("admin", "admin", (&verifier{ok: true}).verify)
+
+	v := &verifier{ok: false}
+	if ok, _ := c.Authenticate("admin", "wrong", v.verify); ok {
+		t.Error("expected a different password to not hit the cache")
+	}
+	if v.calls != 1 {
+		t.Errorf("expected a different password to be verified, got %d calls", v.calls)
+	}
+}
+
+func TestCacheFailuresNotCached(t *testing.T) {
+	c := newTestCache(t, time.Minute, 10)
+
+	for _, v := range []*verifier{{ok: false}, {err: errors.New("LDAP is down")}} {
+		c.Authenticate("admin", "admin", v.verify)
+		c.Authenticate("admin", "admin", v.verify)
+
+		if v.calls != 2 {
+			t.Errorf("expected failed verifications to not be cached, got %d calls", v.calls)
+		}
+	}
+
+	if c.Len() != 0 {
+		t.Errorf("expected cache to be empty, got %d entries", c.Len())
+	}
+}
+
+func TestCacheWrapSeparatesSources(t *testing.T) {
+	c := newTestCache(t, time.Minute, 10)
+
+	ldap := &verifier{ok: true}
+	local := &verifier{ok: false}
+
+	c.Wrap("ldap", ldap.verify)("admin", "admin")
+
+	if ok, _ := c.Wrap("local", local.verify)("admin", "admin"); ok {
+		t.Error("expected credentials cached for one source to not be accepted by another")
+	}
+
+	c.Wrap("ldap", ldap.verify)("admin", "admin")
+	if ldap.calls != 1 {
+		t.Errorf("expected wrapped credentials to be cached, got %d calls", ldap.calls)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := newTestCache(t, time.Minute, 10)
+	v := &verifier{ok: true}
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	c.Authenticate("admin", "admin", v.verify)
+
+	now = now.Add(2 * time.Minute)
+	c.Authenticate("admin", "admin", v.verify)
+
+	if v.calls != 2 {
+		t.Errorf("expected expired credentials to be verified again, got %d calls", v.calls)
+	}
+}
+
+func TestCacheSizeBound(t *testing.T) {
+	c := newTestCache(t, time.Minute, 2)
+	v := &verifier{ok: true}
+
+	for _, user := range []string{"a", "b", "c"} {
+		c.Authenticate(user, "pass", v.verify)
+	}
+
+	if c.Len() != 2 {
+		t.Errorf("expected cache to hold 2 entries, got %d", c.Len())
+	}
+
+	// "a" was the least recently used one
+	c.Authenticate("a", "pass", v.verify)
+	if v.calls != 4 {
+		t.Errorf("expected evicted credentials to be verified again, got %d calls", v.calls)
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	c := newTestCache(t, time.Minute, 10)
+	v := &verifier{ok: true}
+
+	c.Authenticate("admin", "admin", v.verify)
+	c.Authenticate("other", "other", v.verify)
+
+	c.Invalidate("admin")
+
+	if c.Len() != 1 {
+		t.Errorf("expected only the other user to remain cached, got %d entries", c.Len())
+	}
+
+	v.ok = false
+	if ok, _ := c.Authenticate("admin", "admin", v.verify); ok {
+		t.Error("expected invalidated credentials to be verified again")
+	}
+}
+
+func TestCacheInvalidateDuringVerify(t *testing.T) {
+	c := newTestCache(t, time.Minute, 10)
+
+	c.Authenticate("admin", "admin", func(user, pass string) (bool, error) {
+		c.Invalidate(user)
+		return true, nil
+	})
+
+	if c.Len() != 0 {
+		t.Error("expected credentials invalidated during verification to not be cached")
+	}
+}
+
+func newTestCache(t *testing.T, ttl time.Duration, size int) *CredentialCache {
+	c, err := NewCredentialCache(ttl, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+)
+
+// ClientCert authenticates requests made with a TLS client certificate that
+// was verified against the configured CA. The user name is taken from the
+// certificate field named by field: cn (the default), email or dns.
+// Organizational units of the subject become the identity's groups.
+type ClientCert struct {
+	field string
+}
+
+func NewClientCert(field string) (*ClientCert, error) {
+	switch field {
+	case "":
+		field = "cn"
+	case "cn", "email", "dns":
+	default:
+		return nil, fmt.Errorf("unknown client certificate field %q", field)
+	}
+
+	return &ClientCert{field}, nil
+}
+
+func (c *ClientCert) Name() string {
+	return "cert"
+}
+
+func (c *ClientCert) Authenticate(r *http.Request) (*Identity, error) {
+	// VerifiedChains is only set when the certificate was checked against
+	// the client CAs, PeerCertificates may be anything
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+
+	name := c.userName(cert)
+	if name == "" {
+		return nil, ErrBadCredentials
+	}
+
+	return &Identity{
+		Name:   name,
+		Source: c.Name(),
+		Groups: cert.Subject.OrganizationalUnit,
+	}, nil
+}
+
+func (c *ClientCert) userName(cert *x509.Certificate) string {
+	switch c.field {
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+
+	return ""
+}
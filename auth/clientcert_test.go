@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func TestClientCert(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "builder-01",
+			OrganizationalUnit: []string{"build-farm"},
+		},
+		DNSNames:       []string{"builder-01.example.com"},
+		EmailAddresses: []string{"builds@example.com"},
+	}
+
+	for field, expected := range map[string]string{
+		"":      "builder-01",
+		"cn":    "builder-01",
+		"dns":   "builder-01.example.com",
+		"email": "builds@example.com",
+	} {
+		c, err := NewClientCert(field)
+		if err != nil {
+			t.Fatalf("expected NewClientCert() to succeed, got: %s", err)
+		}
+
+		r := newRequest()
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+		id, err := c.Authenticate(r)
+		if err != nil {
+			t.Fatalf("expected Authenticate() to succeed, got: %s", err)
+		}
+
+		if id.Name != expected {
+			t.Errorf("expected field %q to map to %s, got: %s", field, expected, id.Name)
+		}
+
+		if len(id.Groups) != 1 || id.Groups[0] != "build-farm" {
+			t.Errorf("expected organizational units to be mapped to groups, got: %v", id.Groups)
+		}
+	}
+
+	if _, err := NewClientCert("serial"); err == nil {
+		t.Error("expected an unknown field to be rejected")
+	}
+}
+
+func TestClientCertUnverified(t *testing.T) {
+	c, _ := NewClientCert("cn")
+
+	r := newRequest()
+	if _, err := c.Authenticate(r); err != ErrNoCredentials {
+		t.Errorf("expected a plain HTTP request to be skipped, got: %v", err)
+	}
+
+	// presented, but not verified
+	r.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "admin"}}},
+	}
+	if _, err := c.Authenticate(r); err != ErrNoCredentials {
+		t.Errorf("expected an unverified certificate to be skipped, got: %v", err)
+	}
+
+	c, _ = NewClientCert("email")
+	r.TLS.VerifiedChains = [][]*x509.Certificate{r.TLS.PeerCertificates}
+	if _, err := c.Authenticate(r); err != ErrBadCredentials {
+		t.Errorf("expected a certificate without the user field to be rejected, got: %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"container/list"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTracked bounds the number of users and addresses remembered. Beyond it
+// the entries that failed longest ago are dropped.
+const maxTracked = 100000
+
+var (
+	lockoutBlocked = expvar.NewInt("lockout_blocked")
+	lockoutLocked  = expvar.NewInt("lockout_locked")
+	lockoutUnlocks = expvar.NewInt("lockout_unlocks")
+)
+
+// LockedOutError is returned for requests from users or addresses that have
+// failed to authenticate too many times recently.
+type LockedOutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedOutError) Error() string {
+	return fmt.Sprintf("Too many failed attempts, retry in %s", e.RetryAfter)
+}
+
+// IsLockedOut returns true if err is a *LockedOutError.
+func IsLockedOut(err error) bool {
+	_, ok := err.(*LockedOutError)
+	return ok
+}
+
+// Lockout counts failed authentication attempts per user and client address,
+// per client address and per user at all addresses. Once a count reaches its
+// threshold, further attempts are refused for backoff, doubling with every
+// failure up to maxBackoff. Failures are forgotten after a quiet window.
+// Guesses spread over many addresses are caught by the count per user, its
+// threshold is higher so that anybody can't easily lock anybody else out.
+type Lockout struct {
+	threshold     int
+	userThreshold int
+	backoff       time.Duration
+	maxBackoff    time.Duration
+	window        time.Duration
+	max           int
+	now           func() time.Time
+
+	// the client address is taken from X-Forwarded-For behind these
+	trusted []*net.IPNet
+
+	mu      sync.Mutex
+	entries map[lockoutKey]*attempts
+	// order holds the *attempts, the one that failed longest ago first
+	order *list.List
+}
+
+// lockoutKey is a user at a client address, only the address if user is
+// empty, or only the user if addr is
+type lockoutKey struct {
+	user, addr string
+}
+
+type attempts struct {
+	key      lockoutKey
+	elem     *list.Element
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+// NewLockout returns a Lockout. userThreshold applies to the failures of a
+// user at all addresses, ten times threshold if it's not set.
+func NewLockout(threshold, userThreshold int, backoff, maxBackoff, window time.Duration) *Lockout {
+	if threshold < 1 {
+		threshold = 1
+	}
+	if userThreshold < 1 {
+		userThreshold = 10 * threshold
+	}
+
+	return &Lockout{
+		threshold:     threshold,
+		userThreshold: userThreshold,
+		backoff:       backoff,
+		maxBackoff:    maxBackoff,
+		window:        window,
+		max:           maxTracked,
+		now:           time.Now,
+		entries:       make(map[lockoutKey]*attempts),
+		order:         list.New(),
+	}
+}
+
+// TrustProxies sets the proxies whose X-Forwarded-For header is believed,
+// as a list of CIDRs or plain IP addresses.
+func (l *Lockout) TrustProxies(trusted []string) error {
+	networks, err := parseNetworks(trusted)
+	if err != nil {
+		return err
+	}
+
+	l.trusted = networks
+	return nil
+}
+
+// Check returns how long the user at the address, the address or the user
+// have to wait before trying again, zero if they don't.
+func (l *Lockout) Check(user, addr string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	var wait time.Duration
+	for _, key := range keys(user, addr) {
+		if a, ok := l.entries[key]; ok && a.until.After(now) {
+			if d := a.until.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+
+	return wait
+}
+
+// Fail records a failed attempt.
+func (l *Lockout) Fail(user, addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	for _, key := range keys(user, addr) {
+		a, ok := l.entries[key]
+		if !ok {
+			l.makeRoom()
+			a = &attempts{key: key}
+			a.elem = l.order.PushBack(a)
+			l.entries[key] = a
+		} else {
+			l.order.MoveToBack(a.elem)
+		}
+		if now.Sub(a.last) > l.window {
+			a.failures, a.until = 0, time.Time{}
+		}
+
+		a.failures++
+		a.last = now
+
+		threshold := l.threshold
+		if key.addr == "" {
+			threshold = l.userThreshold
+		}
+
+		if a.failures >= threshold {
+			d := l.backoff
+			for i := threshold; i < a.failures && d < l.maxBackoff; i++ {
+				d *= 2
+			}
+			if d > l.maxBackoff {
+				d = l.maxBackoff
+			}
+
+			a.until = now.Add(d)
+			lockoutLocked.Add(1)
+		}
+	}
+}
+
+// Succeed forgets the failed attempts of user at the address. Those of the
+// address are kept, a valid account must not help guessing the passwords of
+// others, and so are those of the user at all addresses, somebody else may
+// still be guessing.
+func (l *Lockout) Succeed(user, addr string) {
+	if user == "" {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.remove(lockoutKey{user, addr})
+}
+
+// Unlock lifts the lockout of a user, at all addresses, or of a client
+// address.
+func (l *Lockout) Unlock(userOrAddr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var found bool
+	for key := range l.entries {
+		if key.user == userOrAddr || key.user == "" && key.addr == userOrAddr {
+			l.remove(key)
+			found = true
+		}
+	}
+
+	if found {
+		lockoutUnlocks.Add(1)
+	}
+
+	return found
+}
+
+// makeRoom makes sure another entry can be added without going over max
+func (l *Lockout) makeRoom() {
+	for len(l.entries) >= l.max {
+		l.remove(l.order.Front().Value.(*attempts).key)
+	}
+}
+
+func (l *Lockout) remove(key lockoutKey) {
+	if a, ok := l.entries[key]; ok {
+		l.order.Remove(a.elem)
+		delete(l.entries, key)
+	}
+}
+
+func keys(user, addr string) []lockoutKey {
+	var k []lockoutKey
+	if user != "" {
+		k = append(k, lockoutKey{user, addr})
+	}
+	if addr != "" {
+		k = append(k, lockoutKey{"", addr})
+	}
+	if user != "" && addr != "" {
+		k = append(k, lockoutKey{user, ""})
+	}
+	return k
+}
+
+// Guard protects an authenticator checking passwords against guessing.
+// Only requests carrying HTTP Basic credentials are tracked.
+func (l *Lockout) Guard(a Authenticator) Authenticator {
+	return &guarded{a, l}
+}
+
+type guarded struct {
+	Authenticator
+	lockout *Lockout
+}
+
+func (g *guarded) Authenticate(r *http.Request) (*Identity, error) {
+	user, _, ok := r.BasicAuth()
+	if !ok {
+		return g.Authenticator.Authenticate(r)
+	}
+
+	addr := g.lockout.clientAddr(r)
+
+	if wait := g.lockout.Check(user, addr); wait > 0 {
+		lockoutBlocked.Add(1)
+		return nil, &LockedOutError{wait}
+	}
+
+	id, err := g.Authenticator.Authenticate(r)
+	switch {
+	case err == nil:
+		g.lockout.Succeed(user, addr)
+	case err == ErrBadCredentials:
+		g.lockout.Fail(user, addr)
+	}
+
+	return id, err
+}
+
+// clientAddr returns the address of the client. Requests from trusted
+// proxies are followed back through X-Forwarded-For, to the last address
+// that isn't a trusted proxy itself, anything before it may be forged.
+func (l *Lockout) clientAddr(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && inNetworks(l.trusted, addr); i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		addr = hop
+	}
+
+	return addr
+}
@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestLockout() (*Lockout, *time.Time) {
+	l := NewLockout(3, 10, time.Second, 10*time.Second, time.Minute)
+
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	return l, &now
+}
+
+func TestLockoutBackoff(t *testing.T) {
+	l, now := newTestLockout()
+
+	for i := 0; i < 2; i++ {
+		l.Fail("admin", "10.0.0.1")
+	}
+	if wait := l.Check("admin", "10.0.0.1"); wait != 0 {
+		t.Errorf("expected no lockout below the threshold, got: %s", wait)
+	}
+
+	for _, expected := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		l.Fail("admin", "10.0.0.1")
+
+		if wait := l.Check("admin", "10.0.0.1"); wait != expected*time.Second {
+			t.Errorf("expected the user to be locked out for %ds, got: %s", expected, wait)
+		}
+		if wait := l.Check("other", "10.0.0.1"); wait != expected*time.Second {
+			t.Errorf("expected the address to be locked out for %ds, got: %s", expected, wait)
+		}
+	}
+
+	// somebody else guessing doesn't lock the user out
+	if wait := l.Check("admin", "10.0.0.2"); wait != 0 {
+		t.Errorf("expected the user not to be locked out elsewhere, got: %s", wait)
+	}
+
+	*now = now.Add(11 * time.Second)
+	if wait := l.Check("admin", "10.0.0.1"); wait != 0 {
+		t.Errorf("expected the lockout to expire, got: %s", wait)
+	}
+}
+
+func TestLockoutWindow(t *testing.T) {
+	l, now := newTestLockout()
+
+	l.Fail("admin", "")
+	l.Fail("admin", "")
+
+	*now = now.Add(2 * time.Minute)
+	l.Fail("admin", "")
+
+	if wait := l.Check("admin", ""); wait != 0 {
+		t.Errorf("expected old failures to be forgotten, got: %s", wait)
+	}
+}
+
+func TestLockoutSucceedAndUnlock(t *testing.T) {
+	l, _ := newTestLockout()
+
+	for i := 0; i < 5; i++ {
+		l.Fail("admin", "10.0.0.1")
+		l.Fail("admin", "")
+	}
+
+	l.Succeed("admin", "10.0.0.1")
+	if wait := l.Check("", "10.0.0.1"); wait == 0 {
+		t.Error("expected a successful login to not reset the address")
+	}
+	if wait := l.Check("admin", ""); wait == 0 {
+		t.Error("expected a successful login to not reset the user elsewhere")
+	}
+
+	if !l.Unlock("10.0.0.1") {
+		t.Error("expected the address to be unlocked")
+	}
+	if wait := l.Check("", "10.0.0.1"); wait != 0 {
+		t.Errorf("expected the address to be unlocked, got: %s", wait)
+	}
+
+	if !l.Unlock("admin") {
+		t.Error("expected the user to be unlocked")
+	}
+	if wait := l.Check("admin", "10.0.0.1"); wait != 0 {
+		t.Errorf("expected the user to be unlocked, got: %s", wait)
+	}
+
+	if l.Unlock("nobody") {
+		t.Error("expected unlocking an unknown user to fail")
+	}
+}
+
+func TestLockoutUser(t *testing.T) {
+	l, _ := newTestLockout()
+
+	// below the threshold at every address, but not in total
+	for i := 0; i < 10; i++ {
+		addr := fmt.Sprintf("10.0.0.%d", i)
+		l.Fail("admin", addr)
+		l.Fail("admin", addr)
+	}
+
+	if wait := l.Check("admin", "10.0.1.1"); wait == 0 {
+		t.Error("expected the user to be locked out at all addresses")
+	}
+	if wait := l.Check("other", "10.0.1.1"); wait != 0 {
+		t.Errorf("expected other users not to be locked out, got: %s", wait)
+	}
+
+	l.Succeed("admin", "10.0.0.1")
+	if wait := l.Check("admin", "10.0.1.1"); wait == 0 {
+		t.Error("expected a successful login to not reset the user at all addresses")
+	}
+}
+
+func TestLockoutGuard(t *testing.T) {
+	l, _ := newTestLockout()
+
+	inner := &fixedAuthenticator{name: "test-guarded", err: ErrBadCredentials}
+	g := l.Guard(inner)
+
+	r := newRequest()
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.SetBasicAuth("admin", "wrong")
+
+	for i := 0; i < 3; i++ {
+		if _, err := g.Authenticate(r); err != ErrBadCredentials {
+			t.Fatalf("expected Authenticate() to fail with bad credentials, got: %v", err)
+		}
+	}
+
+	_, err := g.Authenticate(r)
+	if !IsLockedOut(err) {
+		t.Fatalf("expected the user to be locked out, got: %v", err)
+	}
+	if wait := err.(*LockedOutError).RetryAfter; wait != time.Second {
+		t.Errorf("expected to be told to retry in 1s, got: %s", wait)
+	}
+
+	// requests without a password aren't guesses
+	inner.err = ErrNoCredentials
+	if _, err := g.Authenticate(newRequest()); err != ErrNoCredentials {
+		t.Errorf("expected requests without basic credentials to pass through, got: %v", err)
+	}
+}
+
+func TestLockoutMaxTracked(t *testing.T) {
+	l, now := newTestLockout()
+	l.max = 4
+
+	for i := 0; i < 3; i++ {
+		l.Fail("admin", "10.0.0.1")
+	}
+
+	// nothing has expired yet, the oldest entries make room
+	for i := 0; i < 10; i++ {
+		*now = now.Add(time.Second)
+		l.Fail(fmt.Sprintf("user%d", i), fmt.Sprintf("10.0.1.%d", i))
+
+		if len(l.entries) > l.max {
+			t.Fatalf("expected at most %d entries, got %d", l.max, len(l.entries))
+		}
+	}
+
+	if wait := l.Check("admin", "10.0.0.1"); wait != 0 {
+		t.Errorf("expected the oldest entries to be dropped, got: %s", wait)
+	}
+}
+
+func TestLockoutForwarded(t *testing.T) {
+	l, _ := newTestLockout()
+	if err := l.TrustProxies([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatalf("expected TrustProxies() to succeed, got: %s", err)
+	}
+
+	for _, v := range []struct {
+		remote, forwarded, expected string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		// only trusted proxies may forward
+		{"192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		// the client may have set the header itself
+		{"10.0.0.1:1234", "203.0.113.1, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"10.0.0.1:1234", "garbage", "10.0.0.1"},
+	} {
+		r := newRequest()
+		r.RemoteAddr = v.remote
+		if v.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", v.forwarded)
+		}
+
+		if addr := l.clientAddr(r); addr != v.expected {
+			t.Errorf("expected %s to be the client behind %s and %q, got %s", v.expected, v.remote, v.forwarded, addr)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// maxPasswordLength is as much as bcrypt hashes, anything after it would
+// silently be ignored
+const maxPasswordLength = 72
+
+// PasswordPolicy is what passwords set through the admin API, the UI and the
+// command line must satisfy. The zero value only enforces the limits of the
+// password hashing.
+type PasswordPolicy struct {
+	MinLength int
+	// MinClasses is how many of lower case letters, upper case letters,
+	// digits and other characters a password must mix
+	MinClasses int
+}
+
+// Check returns an error describing why pass is not an acceptable password
+// for user.
+func (p PasswordPolicy) Check(user, pass string) error {
+	if pass == "" {
+		return errors.New("Password is required")
+	}
+
+	if len(pass) > maxPasswordLength {
+		return fmt.Errorf("Password must be at most %d bytes long", maxPasswordLength)
+	}
+
+	if len([]rune(pass)) < p.MinLength {
+		return fmt.Errorf("Password must be at least %d characters long", p.MinLength)
+	}
+
+	if passwordClasses(pass) < p.MinClasses {
+		return fmt.Errorf("Password must mix at least %d of lower case letters, upper case letters, digits and other characters", p.MinClasses)
+	}
+
+	if user != "" && strings.Contains(strings.ToLower(pass), strings.ToLower(user)) {
+		return errors.New("Password must not contain the user name")
+	}
+
+	return nil
+}
+
+func passwordClasses(pass string) int {
+	var lower, upper, digit, other int
+	for _, r := range pass {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+
+	return lower + upper + digit + other
+}
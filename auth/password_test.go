@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	p := PasswordPolicy{MinLength: 8, MinClasses: 3}
+
+	for _, pass := range []string{"Secret-pass", "correct Horse battery", "ÄÖÜäöü12"} {
+		if err := p.Check("janedoe", pass); err != nil {
+			t.Errorf("expected %q to be accepted, got: %s", pass, err)
+		}
+	}
+
+	for _, pass := range []string{"", "Sh0rt", "lowercase only", "UPPERlower", "x-JaneDoe-1", strings.Repeat("Aa1", 25)} {
+		if err := p.Check("janedoe", pass); err == nil {
+			t.Errorf("expected %q to be rejected", pass)
+		}
+	}
+
+	var lenient PasswordPolicy
+	if err := lenient.Check("janedoe", "x"); err != nil {
+		t.Errorf("expected the zero policy to accept any password, got: %s", err)
+	}
+	if err := lenient.Check("janedoe", ""); err == nil {
+		t.Error("expected the zero policy to reject empty passwords")
+	}
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ProxyHeader trusts the user name a reverse proxy puts into a request
+// header, but only if the request comes from one of the trusted networks.
+// Anybody else could set the header themselves.
+type ProxyHeader struct {
+	userHeader   string
+	groupsHeader string
+	trusted      []*net.IPNet
+}
+
+// NewProxyHeader creates an authenticator reading the user name from
+// userHeader and, if set, a comma separated list of groups from groupsHeader.
+// trusted is a list of CIDRs or plain IP addresses.
+func NewProxyHeader(userHeader, groupsHeader string, trusted []string) (*ProxyHeader, error) {
+	if userHeader == "" {
+		return nil, errors.New("proxy user header is not specified")
+	}
+
+	p := &ProxyHeader{
+		userHeader:   http.CanonicalHeaderKey(userHeader),
+		groupsHeader: http.CanonicalHeaderKey(groupsHeader),
+	}
+
+	var err error
+	if p.trusted, err = parseNetworks(trusted); err != nil {
+		return nil, err
+	}
+
+	if len(p.trusted) == 0 {
+		return nil, errors.New("no trusted proxies specified")
+	}
+
+	return p, nil
+}
+
+func (p *ProxyHeader) Name() string {
+	return "proxy"
+}
+
+func (p *ProxyHeader) Authenticate(r *http.Request) (*Identity, error) {
+	user := strings.TrimSpace(r.Header.Get(p.userHeader))
+	if user == "" {
+		return nil, ErrNoCredentials
+	}
+
+	if !p.isTrusted(r.RemoteAddr) {
+		log.Printf("Ignoring %s header from untrusted address %s", p.userHeader, r.RemoteAddr)
+		return nil, ErrBadCredentials
+	}
+
+	id := &Identity{Name: user, Source: p.Name()}
+
+	if p.groupsHeader != "" {
+		for _, group := range strings.Split(r.Header.Get(p.groupsHeader), ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				id.Groups = append(id.Groups, group)
+			}
+		}
+	}
+
+	return id, nil
+}
+
+func (p *ProxyHeader) isTrusted(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	return inNetworks(p.trusted, host)
+}
+
+// parseNetworks parses a list of CIDRs or plain IP addresses, the latter
+// are networks of a single address.
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, cidr := range list {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", cidr)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			cidr = fmt.Sprintf("%s/%d", ip, bits)
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", cidr)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// inNetworks returns true if the IP address addr is in one of networks
+func inNetworks(networks []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,51 @@
+package auth
+
+import "testing"
+
+func TestProxyHeader(t *testing.T) {
+	p, err := NewProxyHeader("x-remote-user", "X-Remote-Groups", []string{"10.0.0.0/24", "127.0.0.1", "::1"})
+	if err != nil {
+		t.Fatalf("expected NewProxyHeader() to succeed, got: %s", err)
+	}
+
+	r := newRequest()
+	r.RemoteAddr = "10.0.0.7:41234"
+	if _, err := p.Authenticate(r); err != ErrNoCredentials {
+		t.Errorf("expected a request without the header to be skipped, got: %v", err)
+	}
+
+	r.Header.Set("X-Remote-User", "admin")
+	r.Header.Set("X-Remote-Groups", "developers, admins")
+
+	for _, addr := range []string{"10.0.0.7:41234", "127.0.0.1:80", "[::1]:80"} {
+		r.RemoteAddr = addr
+
+		id, err := p.Authenticate(r)
+		if err != nil {
+			t.Fatalf("expected a request from %s to be trusted, got: %s", addr, err)
+		}
+
+		if id.Name != "admin" || len(id.Groups) != 2 || id.Groups[1] != "admins" {
+			t.Errorf("expected the headers to be mapped, got: %#v", id)
+		}
+	}
+
+	for _, addr := range []string{"10.0.1.7:41234", "192.168.0.1:80", "garbage"} {
+		r.RemoteAddr = addr
+		if _, err := p.Authenticate(r); err != ErrBadCredentials {
+			t.Errorf("expected a request from %s to be rejected, got: %v", addr, err)
+		}
+	}
+}
+
+func TestProxyHeaderConfig(t *testing.T) {
+	for _, trusted := range [][]string{nil, {"10.0.0.0/33"}, {"proxy.local"}} {
+		if _, err := NewProxyHeader("X-Remote-User", "", trusted); err == nil {
+			t.Errorf("expected trusted proxies %v to be rejected", trusted)
+		}
+	}
+
+	if _, err := NewProxyHeader("", "", []string{"127.0.0.1"}); err == nil {
+		t.Error("expected an empty header name to be rejected")
+	}
+}
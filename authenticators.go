@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ksurent/lfs-server-go/auth"
+	"github.com/ksurent/lfs-server-go/config"
+	"github.com/ksurent/lfs-server-go/extauth/htpasswd"
+	"github.com/ksurent/lfs-server-go/extauth/ldap"
+	"github.com/ksurent/lfs-server-go/extauth/oidc"
+	"github.com/ksurent/lfs-server-go/extauth/webhook"
+	"github.com/ksurent/lfs-server-go/meta"
+)
+
+// newAuthenticatorChain builds the authenticators listed in the
+// configuration. Unknown ones are skipped, which can only ever deny access.
+func (a *App) newAuthenticatorChain() *auth.Chain {
+	var authenticators []auth.Authenticator
+	for _, name := range a.config.AuthenticatorNames() {
+		authenticator, err := a.newAuthenticator(name)
+		if err != nil {
+			log.Println("Skipping authenticator:", err)
+			continue
+		}
+
+		authenticators = append(authenticators, authenticator)
+	}
+
+	return auth.NewChain(authenticators...)
+}
+
+func (a *App) newAuthorizer() auth.Authorizer {
+	switch a.config.Authorizer {
+	case "", "all":
+		return auth.AllowAll{}
+	case "namespace":
+		return auth.NamespaceAuthorizer{}
+	case "webhook":
+		w, err := webhook.New(a.config.Webhook)
+		if err != nil {
+			log.Println("Could not create the webhook authorizer, denying all requests:", err)
+			return denyAll{}
+		}
+		return w
+	default:
+		// denying everything is safer than guessing
+		log.Printf("Unknown authorizer %q, denying all requests", a.config.Authorizer)
+		return denyAll{}
+	}
+}
+
+type denyAll struct{}
+
+func (denyAll) Authorize(id *auth.Identity, namespace, repo string, op auth.Operation) (bool, error) {
+	return false, nil
+}
+
+func (a *App) newAuthenticator(name string) (auth.Authenticator, error) {
+	var verify auth.VerifyFunc
+
+	switch name {
+	case "metastore":
+		if a.metaStore == nil {
+			return nil, errors.New("metastore authenticator requires a meta store")
+		}
+		verify = a.metaStore.Authenticate
+	case "token":
+		if a.metaStore == nil {
+			return nil, errors.New("token authenticator requires a meta store")
+		}
+		// tokens are looked up by their hash, there's nothing slow to
+		// cache, and revoked ones have to stop working right away
+		return auth.NewBasic(name, a.verifyToken), nil
+	case "ldap":
+		verify = func(user, pass string) (bool, error) {
+			return ldap.AuthenticateLdap(a.config.Ldap, user, pass)
+		}
+	case "htpasswd":
+		f, err := a.loadHtpasswd()
+		if err != nil {
+			return nil, err
+		}
+
+		verify = f.Authenticate
+		if a.config.Htpasswd.Import && a.metaStore != nil {
+			verify = f.Import(a.metaStore)
+		}
+	case "cert":
+		if !a.config.VerifyClientCerts() {
+			return nil, errors.New("cert authenticator requires TLS and ClientCA")
+		}
+
+		c, err := auth.NewClientCert(a.config.ClientCertUser)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case "proxy":
+		p, err := auth.NewProxyHeader(
+			a.config.Proxy.UserHeader,
+			a.config.Proxy.GroupsHeader,
+			config.SplitList(a.config.Proxy.TrustedProxies),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	case "oidc":
+		// tokens are checked against the issuer's keys, nothing to cache
+		o, err := oidc.New(a.config.Oidc)
+		if err != nil {
+			return nil, err
+		}
+		return o, nil
+	default:
+		return nil, fmt.Errorf("unknown authenticator %q", name)
+	}
+
+	if a.authCache != nil {
+		verify = a.authCache.Wrap(name, verify)
+	}
+
+	return auth.NewBasic(name, verify), nil
+}
+
+// verifyToken checks that pass is an access token of user, who has to exist
+// and not be disabled
+func (a *App) verifyToken(user, pass string) (bool, error) {
+	token, err := a.metaStore.GetToken(meta.HashToken(pass))
+	switch {
+	case err == meta.ErrTokenNotFound:
+		return false, nil
+	case err != nil:
+		return false, err
+	case token.User != user:
+		return false, nil
+	}
+
+	u, err := a.metaStore.GetUser(user)
+	switch {
+	case err == meta.ErrUserNotFound:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	return !u.Disabled, nil
+}
+
+// loadHtpasswd loads the configured htpasswd file and starts watching it for
+// changes. Cached credentials of users whose entries changed are forgotten.
+func (a *App) loadHtpasswd() (*htpasswd.File, error) {
+	if a.config.Htpasswd.File == "" {
+		return nil, errors.New("htpasswd authenticator requires a file")
+	}
+
+	f, err := htpasswd.Load(a.config.Htpasswd.File)
+	if err != nil {
+		return nil, err
+	}
+
+	interval, err := time.ParseDuration(a.config.Htpasswd.ReloadInterval)
+	if err != nil || interval <= 0 {
+		log.Println("Failed to parse htpasswd reload interval, defaulting to 10 seconds")
+		interval = 10 * time.Second
+	}
+
+	f.Watch(interval, func(users []string) {
+		if a.authCache == nil {
+			return
+		}
+
+		for _, user := range users {
+			a.authCache.Invalidate(user)
+		}
+	})
+
+	return f, nil
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ksurent/lfs-server-go/auth"
+	"github.com/ksurent/lfs-server-go/meta"
+)
+
+const commandUsage = `Commands:
+  user list
+  user add <name> [password] [role]
+  user del <name>
+  user passwd <name> [password]
+  user role <name> <role>
+  user profile [-display-name text] [-email address] <name>
+  user disable <name>
+  user enable <name>
+  project list
+  project add -namespace name [-description text] [-owner name]
+              [-visibility private|public] [-max-object-size bytes] <name>
+  project show <name>
+  project move [-name new-name] [-namespace name] [-owner name] [-alias]
+               <name>
+  token list [user]
+  token create <user> [name]
+  token revoke <id>
+  object list
+  object show <oid>
+  usage show
+  usage recount
+
+Passwords that are not given are read from the standard input. The secret
+of a new token is only printed once.`
+
+var errUsage = errors.New("invalid command\n\n" + commandUsage)
+
+// command runs an administrative subcommand against the meta store,
+// printing tables or, if asJSON is set, JSON. New passwords must satisfy
+// policy.
+type command struct {
+	store  meta.GenericMetaStore
+	policy auth.PasswordPolicy
+	asJSON bool
+	in     *bufio.Reader
+	out    io.Writer
+}
+
+func runCommand(store meta.GenericMetaStore, policy auth.PasswordPolicy, args []string, asJSON bool, in io.Reader, out io.Writer) error {
+	c := &command{store, policy, asJSON, bufio.NewReader(in), out}
+
+	if len(args) < 2 {
+		return errUsage
+	}
+
+	switch args[0] + " " + args[1] {
+	case "user list":
+		return c.listUsers()
+	case "user add":
+		return c.addUser(args[2:])
+	case "user del":
+		return c.deleteUser(args[2:])
+	case "user passwd":
+		return c.setPassword(args[2:])
+	case "user role":
+		return c.setRole(args[2:])
+	case "user profile":
+		return c.setProfile(args[2:])
+	case "user disable":
+		return c.setDisabled(args[2:], true)
+	case "user enable":
+		return c.setDisabled(args[2:], false)
+	case "project list":
+		return c.listProjects()
+	case "project add":
+		return c.addProject(args[2:])
+	case "project show":
+		return c.showProject(args[2:])
+	case "project move":
+		return c.moveProject(args[2:])
+	case "token list":
+		return c.listTokens(args[2:])
+	case "token create":
+		return c.createToken(args[2:])
+	case "token revoke":
+		return c.revokeToken(args[2:])
+	case "object list":
+		return c.listObjects()
+	case "object show":
+		return c.showObject(args[2:])
+	case "usage show":
+		return c.showUsage()
+	case "usage recount":
+		return c.store.RecountUsage()
+	default:
+		return errUsage
+	}
+}
+
+func (c *command) listUsers() error {
+	users, err := c.store.Users()
+	if err != nil {
+		return err
+	}
+
+	list := make([]*adminUser, 0, len(users))
+	for _, user := range users {
+		list = append(list, newAdminUser(user))
+	}
+	sort.Sort(adminUsersByName(list))
+
+	return c.print(list, []string{"NAME", "ROLE", "DISPLAY NAME", "EMAIL", "DISABLED"}, func(row func(...interface{})) {
+		for _, user := range list {
+			row(user.Name, user.Role, user.DisplayName, user.Email, user.Disabled)
+		}
+	})
+}
+
+func (c *command) addUser(args []string) error {
+	if len(args) < 1 || len(args) > 3 {
+		return errUsage
+	}
+
+	role := meta.RoleUser
+	if len(args) == 3 {
+		role = args[2]
+	}
+	if !meta.ValidRole(role) {
+		return meta.ErrInvalidRole
+	}
+
+	if _, err := c.store.GetUser(args[0]); err == nil {
+		return fmt.Errorf("user %s already exists", args[0])
+	} else if err != meta.ErrUserNotFound {
+		return err
+	}
+
+	pass, err := c.password(args[0], args[1:])
+	if err != nil {
+		return err
+	}
+
+	if err := c.store.AddUser(args[0], pass); err != nil {
+		return err
+	}
+
+	return c.store.SetRole(args[0], role)
+}
+
+func (c *command) deleteUser(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	if _, err := c.store.GetUser(args[0]); err != nil {
+		return err
+	}
+
+	return c.store.DeleteUser(args[0])
+}
+
+func (c *command) setPassword(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+
+	if _, err := c.store.GetUser(args[0]); err != nil {
+		return err
+	}
+
+	pass, err := c.password(args[0], args[1:])
+	if err != nil {
+		return err
+	}
+
+	return c.store.UpdateUser(args[0], &meta.UserUpdate{Password: &pass})
+}
+
+func (c *command) setRole(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+
+	if !meta.ValidRole(args[1]) {
+		return meta.ErrInvalidRole
+	}
+
+	if _, err := c.store.GetUser(args[0]); err != nil {
+		return err
+	}
+
+	return c.store.SetRole(args[0], args[1])
+}
+
+func (c *command) setProfile(args []string) error {
+	var displayName, email string
+
+	flags := flag.NewFlagSet("user profile", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.StringVar(&displayName, "display-name", "", "")
+	flags.StringVar(&email, "email", "", "")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+
+	// only the flags that were given change
+	var update meta.UserUpdate
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "display-name":
+			update.DisplayName = &displayName
+		case "email":
+			update.Email = &email
+		}
+	})
+
+	return c.store.UpdateUser(flags.Arg(0), &update)
+}
+
+func (c *command) setDisabled(args []string, disabled bool) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	return c.store.UpdateUser(args[0], &meta.UserUpdate{Disabled: &disabled})
+}
+
+func (c *command) listProjects() error {
+	header := []string{"NAME", "NAMESPACE", "VISIBILITY", "OWNER", "OBJECTS"}
+
+	return c.printEach(header, func(emit func(interface{}, ...interface{}) error) error {
+		return c.store.ForEachProject("", func(project *meta.Project) error {
+			return emit(project, project.Name, project.Namespace, project.Visibility, project.Owner, len(project.Oids))
+		})
+	})
+}
+
+func (c *command) addProject(args []string) error {
+	var project meta.Project
+
+	flags := flag.NewFlagSet("project add", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.StringVar(&project.Namespace, "namespace", "", "")
+	flags.StringVar(&project.Description, "description", "", "")
+	flags.StringVar(&project.Owner, "owner", "", "")
+	flags.StringVar(&project.Visibility, "visibility", meta.VisibilityPrivate, "")
+	flags.Int64Var(&project.MaxObjectSize, "max-object-size", 0, "")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+
+	project.Name = flags.Arg(0)
+	if project.Namespace == "" {
+		return meta.ErrNoProjectNamespace
+	}
+
+	return c.store.AddProject(&project)
+}
+
+func (c *command) showProject(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	project, err := c.store.GetProject(args[0])
+	if err != nil {
+		return err
+	}
+
+	return c.print(project, []string{"FIELD", "VALUE"}, func(row func(...interface{})) {
+		row("name", project.Name)
+		row("namespace", project.Namespace)
+		row("description", project.Description)
+		row("owner", project.Owner)
+		row("created", project.CreatedAt.Format(time.RFC3339))
+		row("visibility", project.Visibility)
+		row("max object size", project.MaxObjectSize)
+		for _, oid := range project.Oids {
+			row("oid", oid)
+		}
+	})
+}
+
+func (c *command) moveProject(args []string) error {
+	var move meta.ProjectMove
+
+	flags := flag.NewFlagSet("project move", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.StringVar(&move.Name, "name", "", "")
+	flags.StringVar(&move.Namespace, "namespace", "", "")
+	flags.StringVar(&move.Owner, "owner", "", "")
+	flags.BoolVar(&move.Alias, "alias", false, "")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+
+	_, err := c.store.MoveProject(flags.Arg(0), &move)
+	return err
+}
+
+// newToken is an access token along with its secret, as printed when it is
+// created
+type newToken struct {
+	*meta.Token
+	Secret string `json:"secret"`
+}
+
+func (c *command) listTokens(args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+
+	var user string
+	if len(args) == 1 {
+		user = args[0]
+	}
+
+	tokens, err := c.store.Tokens(user)
+	if err != nil {
+		return err
+	}
+	sort.Sort(tokensByUser(tokens))
+
+	return c.print(tokens, []string{"ID", "USER", "NAME", "CREATED"}, func(row func(...interface{})) {
+		for _, t := range tokens {
+			row(t.ID, t.User, t.Name, t.CreatedAt.Format(time.RFC3339))
+		}
+	})
+}
+
+func (c *command) createToken(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+
+	if _, err := c.store.GetUser(args[0]); err != nil {
+		return err
+	}
+
+	var name string
+	if len(args) == 2 {
+		name = args[1]
+	}
+
+	token, secret, err := meta.NewToken(args[0], name)
+	if err != nil {
+		return err
+	}
+
+	if err := c.store.AddToken(token); err != nil {
+		return err
+	}
+
+	return c.print(&newToken{token, secret}, []string{"ID", "SECRET"}, func(row func(...interface{})) {
+		row(token.ID, secret)
+	})
+}
+
+func (c *command) revokeToken(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	return c.store.RevokeToken(args[0])
+}
+
+func (c *command) listObjects() error {
+	header := []string{"OID", "SIZE", "PENDING", "PROJECTS"}
+
+	return c.printEach(header, func(emit func(interface{}, ...interface{}) error) error {
+		return c.store.ForEachObject("", func(m *meta.Object) error {
+			object := newAdminObject(m)
+			return emit(object, object.Oid, object.Size, object.Pending, strings.Join(object.ProjectNames, ","))
+		})
+	})
+}
+
+func (c *command) showObject(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	rv := &meta.RequestVars{Oid: args[0]}
+
+	m, err := c.store.Get(rv)
+	if meta.IsObjectNotFound(err) {
+		m, err = c.store.GetPending(rv)
+	}
+	if err != nil {
+		return err
+	}
+
+	object := newAdminObject(m)
+
+	return c.print(object, []string{"OID", "SIZE", "PENDING", "PROJECTS"}, func(row func(...interface{})) {
+		row(object.Oid, object.Size, object.Pending, strings.Join(object.ProjectNames, ","))
+	})
+}
+
+// showUsage prints the storage used by each namespace and in total
+func (c *command) showUsage() error {
+	report, err := newUsageReport(c.store)
+	if err != nil {
+		return err
+	}
+
+	namespaces := make([]string, 0, len(report.Namespaces))
+	for namespace := range report.Namespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	header := []string{"NAMESPACE", "OBJECTS", "BYTES", "PENDING", "PENDING BYTES", "SHARED", "SHARED BYTES"}
+
+	return c.print(report, header, func(row func(...interface{})) {
+		usageRow := func(name string, u *meta.Usage) {
+			row(name, u.Objects, u.Bytes, u.PendingObjects, u.PendingBytes, u.SharedObjects, u.SharedBytes)
+		}
+
+		for _, namespace := range namespaces {
+			usageRow(namespace, report.Namespaces[namespace])
+		}
+		usageRow("(total)", report.Total)
+	})
+}
+
+// password returns the new password of user given on the command line or
+// reads it from the standard input, it must satisfy the password policy
+func (c *command) password(user string, args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], c.policy.Check(user, args[0])
+	}
+
+	line, err := c.in.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	pass := strings.TrimRight(line, "\r\n")
+	return pass, c.policy.Check(user, pass)
+}
+
+// print writes v as JSON, or as a table with the rows produced by rows
+func (c *command) print(v interface{}, header []string, rows func(row func(...interface{}))) error {
+	if c.asJSON {
+		enc := json.NewEncoder(c.out)
+		return enc.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+
+	rows(func(columns ...interface{}) {
+		for i, column := range columns {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, column)
+		}
+		fmt.Fprintln(tw)
+	})
+
+	return tw.Flush()
+}
+
+// printEach is like print for listings that can be too big to hold in
+// memory: each calls emit with every value and its table columns, they are
+// written out as they come. JSON output is still a single array.
+func (c *command) printEach(header []string, each func(emit func(interface{}, ...interface{}) error) error) error {
+	if c.asJSON {
+		sep := "["
+		err := each(func(v interface{}, _ ...interface{}) error {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+
+			if _, err := io.WriteString(c.out, sep); err != nil {
+				return err
+			}
+			sep = ","
+
+			_, err = c.out.Write(b)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		if sep == "[" {
+			_, err = io.WriteString(c.out, "[]\n")
+		} else {
+			_, err = io.WriteString(c.out, "]\n")
+		}
+		return err
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+
+	err := each(func(_ interface{}, columns ...interface{}) error {
+		for i, column := range columns {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, column)
+		}
+		_, err := fmt.Fprintln(tw)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ksurent/lfs-server-go/auth"
+	"github.com/ksurent/lfs-server-go/meta"
+)
+
+func TestCommandUsers(t *testing.T) {
+	defer testMetaStore.DeleteUser("cliuser")
+
+	var out bytes.Buffer
+
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"user", "add", "cliuser"}, false, strings.NewReader("first\n"), &out); err != nil {
+		t.Fatalf("expected user add to succeed, got: %s", err)
+	}
+
+	if ok, _ := testMetaStore.Authenticate("cliuser", "first"); !ok {
+		t.Error("expected the password to be read from the standard input")
+	}
+
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"user", "add", "cliuser", "again"}, false, nil, &out); err == nil {
+		t.Error("expected adding an existing user to fail")
+	}
+
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"user", "role", "cliuser", "admin"}, false, nil, &out); err != nil {
+		t.Fatalf("expected user role to succeed, got: %s", err)
+	}
+
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"user", "passwd", "cliuser", "second"}, false, nil, &out); err != nil {
+		t.Fatalf("expected user passwd to succeed, got: %s", err)
+	}
+
+	if ok, _ := testMetaStore.Authenticate("cliuser", "second"); !ok {
+		t.Error("expected the password to be changed")
+	}
+
+	if user, err := testMetaStore.GetUser("cliuser"); err != nil || !user.IsAdmin() {
+		t.Errorf("expected the role to survive a password change, got: %v, %v", user, err)
+	}
+
+	strict := auth.PasswordPolicy{MinLength: 8}
+	if err := runCommand(testMetaStore, strict, []string{"user", "passwd", "cliuser", "short"}, false, nil, &out); err == nil {
+		t.Error("expected a password violating the policy to be refused")
+	}
+
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"user", "profile", "-email", "cli@example.com", "cliuser"}, false, nil, &out); err != nil {
+		t.Fatalf("expected user profile to succeed, got: %s", err)
+	}
+
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"user", "disable", "cliuser"}, false, nil, &out); err != nil {
+		t.Fatalf("expected user disable to succeed, got: %s", err)
+	}
+
+	if ok, _ := testMetaStore.Authenticate("cliuser", "second"); ok {
+		t.Error("expected disabled users to fail authentication")
+	}
+
+	if user, err := testMetaStore.GetUser("cliuser"); err != nil || user.Email != "cli@example.com" || !user.Disabled {
+		t.Errorf("expected the profile to be updated, got: %v, %v", user, err)
+	}
+
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"user", "enable", "cliuser"}, false, nil, &out); err != nil {
+		t.Fatalf("expected user enable to succeed, got: %s", err)
+	}
+
+	out.Reset()
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"user", "list"}, true, nil, &out); err != nil {
+		t.Fatalf("expected user list to succeed, got: %s", err)
+	}
+
+	var users []*adminUser
+	if err := json.Unmarshal(out.Bytes(), &users); err != nil {
+		t.Fatalf("expected JSON output, got: %s", out.String())
+	}
+
+	found := false
+	for _, user := range users {
+		if user.Name == "cliuser" && user.Role == meta.RoleAdmin {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected cliuser to be listed, got: %s", out.String())
+	}
+
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"user", "del", "cliuser"}, false, nil, &out); err != nil {
+		t.Fatalf("expected user del to succeed, got: %s", err)
+	}
+
+	if _, err := testMetaStore.GetUser("cliuser"); err != meta.ErrUserNotFound {
+		t.Errorf("expected the user to be removed, got: %v", err)
+	}
+}
+
+func TestCommandTokens(t *testing.T) {
+	if err := testMetaStore.AddUser("clitoken", "secret"); err != nil {
+		t.Fatalf("expected adding a user to succeed, got: %s", err)
+	}
+	defer testMetaStore.DeleteUser("clitoken")
+
+	var out bytes.Buffer
+
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"token", "create", "nosuchuser"}, false, nil, &out); err != meta.ErrUserNotFound {
+		t.Errorf("expected creating a token of an unknown user to fail, got: %v", err)
+	}
+
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"token", "create", "clitoken", "laptop"}, true, nil, &out); err != nil {
+		t.Fatalf("expected token create to succeed, got: %s", err)
+	}
+
+	var created struct {
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Secret string `json:"secret"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &created); err != nil || created.ID == "" || created.Secret == "" {
+		t.Fatalf("expected the token and its secret as JSON, got: %s", out.String())
+	}
+
+	if token, err := testMetaStore.GetToken(meta.HashToken(created.Secret)); err != nil || token.ID != created.ID || token.User != "clitoken" || token.Name != "laptop" {
+		t.Errorf("expected the token to be stored, got: %v, %v", token, err)
+	}
+
+	out.Reset()
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"token", "list", "clitoken"}, false, nil, &out); err != nil {
+		t.Fatalf("expected token list to succeed, got: %s", err)
+	}
+
+	if !strings.Contains(out.String(), created.ID) || strings.Contains(out.String(), created.Secret) {
+		t.Errorf("expected the token to be listed without its secret, got: %s", out.String())
+	}
+
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"token", "revoke", created.ID}, false, nil, &out); err != nil {
+		t.Fatalf("expected token revoke to succeed, got: %s", err)
+	}
+
+	if _, err := testMetaStore.GetToken(meta.HashToken(created.Secret)); err != meta.ErrTokenNotFound {
+		t.Errorf("expected the token to be revoked, got: %v", err)
+	}
+
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"token", "revoke", created.ID}, false, nil, &out); err != meta.ErrTokenNotFound {
+		t.Errorf("expected revoking an unknown token to fail, got: %v", err)
+	}
+}
+
+func TestCommandObjects(t *testing.T) {
+	var out bytes.Buffer
+
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"object", "list"}, false, nil, &out); err != nil {
+		t.Fatalf("expected object list to succeed, got: %s", err)
+	}
+
+	if !strings.HasPrefix(out.String(), "OID") || !strings.Contains(out.String(), contentOid) {
+		t.Errorf("expected a table of objects, got: %s", out.String())
+	}
+
+	out.Reset()
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"object", "show", contentOid}, true, nil, &out); err != nil {
+		t.Fatalf("expected object show to succeed, got: %s", err)
+	}
+
+	var object adminObject
+	if err := json.Unmarshal(out.Bytes(), &object); err != nil || object.Size != contentSize {
+		t.Errorf("expected the object as JSON, got: %s", out.String())
+	}
+
+	out.Reset()
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"project", "show", testRepo}, false, nil, &out); err != nil {
+		t.Fatalf("expected project show to succeed, got: %s", err)
+	}
+
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"project", "add", "nonamespace"}, false, nil, &out); err != meta.ErrNoProjectNamespace {
+		t.Errorf("expected project add without a namespace to fail, got: %v", err)
+	}
+
+	out.Reset()
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"usage", "recount"}, false, nil, &out); err != nil {
+		t.Fatalf("expected usage recount to succeed, got: %s", err)
+	}
+	if err := runCommand(testMetaStore, auth.PasswordPolicy{}, []string{"usage", "show"}, false, nil, &out); err != nil {
+		t.Fatalf("expected usage show to succeed, got: %s", err)
+	}
+	if !strings.HasPrefix(out.String(), "NAMESPACE") || !strings.Contains(out.String(), "(total)") {
+		t.Errorf("expected a table of usage, got: %s", out.String())
+	}
+
+	for _, args := range [][]string{
+		{"object"},
+		{"object", "frobnicate"},
+		{"user", "del"},
+	} {
+		if err := runCommand(testMetaStore, auth.PasswordPolicy{}, args, false, nil, &out); err != errUsage {
+			t.Errorf("expected %v to be rejected, got: %v", args, err)
+		}
+	}
+}
@@ -10,12 +10,24 @@ import (
 )
 
 type CassandraConfig struct {
-	Hosts        string `json:"hosts"`
-	Keyspace     string `json:"keyspace"`
-	ProtoVersion int    `json:"ProtoVersion"`
-	Username     string `json:"username"`
-	Password     string `json:"password"`
-	Enabled      bool   `json:"enabled"`
+	Hosts               string `json:"hosts"`
+	Keyspace            string `json:"keyspace"`
+	ProtoVersion        int    `json:"ProtoVersion"`
+	Username            string `json:"username"`
+	Password            string `json:"password"`
+	Enabled             bool   `json:"enabled"`
+	TLS                 bool   `json:"tls"`
+	CACert              string `json:"cacert"`
+	ClientCert          string `json:"clientcert"`
+	ClientKey           string `json:"clientkey"`
+	VerifyHost          bool   `json:"verifyhost"`
+	ReplicationStrategy string `json:"replicationstrategy"`
+	ReplicationFactor   int    `json:"replicationfactor"`
+	DataCenters         string `json:"datacenters"`
+	Consistency         string `json:"consistency"`
+	Timeout             string `json:"timeout"`
+	ConnectTimeout      string `json:"connecttimeout"`
+	NumRetries          int    `json:"numretries"`
 }
 
 type AwsConfig struct {
@@ -35,6 +47,9 @@ type LdapConfig struct {
 	UserCn          string `json:"usercn"`
 	BindDn          string `json:"binddn"`
 	BindPass        string `json:"bindpass"`
+	SearchScope     string `json:"searchscope"`
+	StartTLS        bool   `json:"starttls"`
+	CACert          string `json:"cacert"`
 }
 
 type MySQLConfig struct {
@@ -45,6 +60,15 @@ type MySQLConfig struct {
 	Enabled  bool   `json:"enabled"`
 }
 
+type PostgresConfig struct {
+	Host     string `json:"host"`
+	Database string `json:"database"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	SSLMode  string `json:"sslmode"`
+	Enabled  bool   `json:"enabled"`
+}
+
 type GraphiteConfig struct {
 	Endpoint       string `json:"endpoint"`
 	Prefix         string `json:"prefix"`
@@ -54,28 +78,101 @@ type GraphiteConfig struct {
 	Timeout        string `json:"timeout"`
 }
 
+type AuthCacheConfig struct {
+	Enabled bool   `json:"enabled"`
+	TTL     string `json:"ttl"`
+	Size    int    `json:"size"`
+}
+
+type HtpasswdConfig struct {
+	File           string `json:"file"`
+	ReloadInterval string `json:"reloadinterval"`
+	Import         bool   `json:"import"`
+}
+
+type OidcConfig struct {
+	Issuer        string `json:"issuer"`
+	JwksURL       string `json:"jwksurl"`
+	Audience      string `json:"audience"`
+	UsernameClaim string `json:"usernameclaim"`
+	GroupsClaim   string `json:"groupsclaim"`
+	Leeway        string `json:"leeway"`
+}
+
+type ProxyConfig struct {
+	UserHeader     string `json:"userheader"`
+	GroupsHeader   string `json:"groupsheader"`
+	TrustedProxies string `json:"trustedproxies"`
+}
+
+type LockoutConfig struct {
+	Enabled       bool   `json:"enabled"`
+	Threshold     int    `json:"threshold"`
+	UserThreshold int    `json:"userthreshold"`
+	Backoff       string `json:"backoff"`
+	MaxBackoff    string `json:"maxbackoff"`
+	Window        string `json:"window"`
+}
+
+type WebhookConfig struct {
+	URL      string `json:"url"`
+	Token    string `json:"token"`
+	Timeout  string `json:"timeout"`
+	Retries  int    `json:"retries"`
+	CacheTTL string `json:"cachettl"`
+	FailOpen bool   `json:"failopen"`
+}
+
+type PasswordConfig struct {
+	MinLength  int `json:"minlength"`
+	MinClasses int `json:"minclasses"`
+}
+
+type AuditConfig struct {
+	File string `json:"file"`
+}
+
 // Configuration holds application configuration. Values will be pulled from
 // environment variables, prefixed by keyPrefix. Default values can be added
 // via tags.
 type Configuration struct {
-	Listen       string           `json:"listen"`
-	Host         string           `json:"host"`
-	UrlContext   string           `json:"url_context"`
-	ContentPath  string           `json:"content_path"`
-	Cert         string           `json:"cert"`
-	Key          string           `json:"key"`
-	Scheme       string           `json:"scheme"`
-	Public       bool             `json:"public"`
-	MetaDB       string           `json:"metadb"`
-	BackingStore string           `json:"backing_store"`
-	ContentStore string           `json:"content_store"`
-	LogFile      string           `json:"logfile"`
-	NumProcs     int              `json:"numprocs"`
-	Aws          *AwsConfig       `json:"aws"`
-	Cassandra    *CassandraConfig `json:"cassandra"`
-	Ldap         *LdapConfig      `json:"ldap"`
-	MySQL        *MySQLConfig     `json:"mysql"`
-	Graphite     *GraphiteConfig  `json:"graphite"`
+	Listen         string           `json:"listen"`
+	Host           string           `json:"host"`
+	UrlContext     string           `json:"url_context"`
+	ContentPath    string           `json:"content_path"`
+	Cert           string           `json:"cert"`
+	Key            string           `json:"key"`
+	ClientCA       string           `json:"client_ca"`
+	RequireClient  bool             `json:"require_client"`
+	ClientCertUser string           `json:"client_cert_user"`
+	Scheme         string           `json:"scheme"`
+	Public         bool             `json:"public"`
+	PublicRead     string           `json:"public_read"`
+	Authenticators string           `json:"authenticators"`
+	Authorizer     string           `json:"authorizer"`
+	Admins         string           `json:"admins"`
+	AdminUser      string           `json:"admin_user"`
+	AdminPass      string           `json:"admin_pass"`
+	MetaDB         string           `json:"metadb"`
+	BackingStore   string           `json:"backing_store"`
+	StrictProjects bool             `json:"strict_projects"`
+	ContentStore   string           `json:"content_store"`
+	LogFile        string           `json:"logfile"`
+	NumProcs       int              `json:"numprocs"`
+	Aws            *AwsConfig       `json:"aws"`
+	Cassandra      *CassandraConfig `json:"cassandra"`
+	Ldap           *LdapConfig      `json:"ldap"`
+	MySQL          *MySQLConfig     `json:"mysql"`
+	Postgres       *PostgresConfig  `json:"postgres"`
+	Graphite       *GraphiteConfig  `json:"graphite"`
+	AuthCache      *AuthCacheConfig `json:"auth_cache"`
+	Htpasswd       *HtpasswdConfig  `json:"htpasswd"`
+	Oidc           *OidcConfig      `json:"oidc"`
+	Proxy          *ProxyConfig     `json:"proxy"`
+	Lockout        *LockoutConfig   `json:"lockout"`
+	Webhook        *WebhookConfig   `json:"webhook"`
+	Password       *PasswordConfig  `json:"password"`
+	Audit          *AuditConfig     `json:"audit"`
 }
 
 func (c *Configuration) IsHTTPS() bool {
@@ -86,10 +183,49 @@ func (c *Configuration) UseTLS() bool {
 	return c.Cert != "" && c.Key != ""
 }
 
+// PublicReadPatterns returns the namespace/repo patterns of projects that can
+// be downloaded without authentication.
+func (c *Configuration) PublicReadPatterns() []string {
+	return SplitList(c.PublicRead)
+}
+
+// VerifyClientCerts returns true if TLS clients may authenticate with a
+// certificate.
+func (c *Configuration) VerifyClientCerts() bool {
+	return c.UseTLS() && c.ClientCA != ""
+}
+
 func (c *Configuration) IsPublic() bool {
 	return c.Public
 }
 
+// AuthenticatorNames returns the configured authenticator chain. Without
+// explicit configuration LDAP is used when enabled, the meta store otherwise.
+func (c *Configuration) AuthenticatorNames() []string {
+	if names := SplitList(c.Authenticators); len(names) > 0 {
+		return names
+	}
+
+	if c.Ldap != nil && c.Ldap.Enabled {
+		return []string{"ldap"}
+	}
+
+	return []string{"metastore"}
+}
+
+// SplitList splits a comma separated configuration value, ignoring empty
+// elements.
+func SplitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
 func (c *Configuration) DumpConfig() map[string]interface{} {
 	return structs.Map(c)
 }
@@ -133,9 +269,18 @@ func NewFromFile(configFile string) (*Configuration, error) {
 		NumProcs:     runtime.NumCPU(),
 		Ldap:         &LdapConfig{},
 		Aws:          &AwsConfig{},
-		Cassandra:    &CassandraConfig{},
+		Cassandra:    &CassandraConfig{ReplicationStrategy: "SimpleStrategy", ReplicationFactor: 1, Consistency: "quorum", VerifyHost: true},
 		MySQL:        &MySQLConfig{},
+		Postgres:     &PostgresConfig{SSLMode: "require"},
 		Graphite:     &GraphiteConfig{},
+		AuthCache:    &AuthCacheConfig{TTL: "5m", Size: 10000},
+		Htpasswd:     &HtpasswdConfig{ReloadInterval: "10s"},
+		Oidc:         &OidcConfig{UsernameClaim: "preferred_username", GroupsClaim: "groups", Leeway: "1m"},
+		Proxy:        &ProxyConfig{UserHeader: "X-Remote-User"},
+		Lockout:      &LockoutConfig{Threshold: 5, UserThreshold: 50, Backoff: "30s", MaxBackoff: "15m", Window: "15m"},
+		Webhook:      &WebhookConfig{Timeout: "2s", Retries: 1, CacheTTL: "1m"},
+		Password:     &PasswordConfig{MinLength: 8, MinClasses: 1},
+		Audit:        &AuditConfig{},
 	}
 
 	for _, v := range []struct {
@@ -147,7 +292,16 @@ func NewFromFile(configFile string) (*Configuration, error) {
 		{"Ldap", cfg.Ldap},
 		{"Cassandra", cfg.Cassandra},
 		{"MySQL", cfg.MySQL},
+		{"Postgres", cfg.Postgres},
 		{"Graphite", cfg.Graphite},
+		{"AuthCache", cfg.AuthCache},
+		{"Htpasswd", cfg.Htpasswd},
+		{"Oidc", cfg.Oidc},
+		{"Proxy", cfg.Proxy},
+		{"Lockout", cfg.Lockout},
+		{"Webhook", cfg.Webhook},
+		{"Password", cfg.Password},
+		{"Audit", cfg.Audit},
 	} {
 		if err := iniCfg.Section(v.section).MapTo(v.dest); err != nil {
 			return nil, err
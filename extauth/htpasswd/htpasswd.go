@@ -0,0 +1,323 @@
+// Package htpasswd authenticates users against an Apache htpasswd file.
+// bcrypt, SHA and APR1 (MD5) entries are supported, crypt(3) and plain text
+// ones are not.
+package htpasswd
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ksurent/lfs-server-go/meta"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// File is a parsed htpasswd file. It is safe for concurrent use.
+type File struct {
+	path string
+
+	mu      sync.RWMutex
+	entries map[string]string
+	modTime time.Time
+	size    int64
+
+	stop chan struct{}
+}
+
+// Load reads and parses the htpasswd file at path.
+func Load(path string) (*File, error) {
+	f := &File{path: path}
+	if _, err := f.Reload(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Authenticate checks pass against the hash stored for user.
+func (f *File) Authenticate(user, pass string) (bool, error) {
+	f.mu.RLock()
+	hash, ok := f.entries[user]
+	f.mu.RUnlock()
+
+	if !ok || pass == "" {
+		return false, nil
+	}
+
+	return verify(hash, pass), nil
+}
+
+// Users returns the names of all users in the file.
+func (f *File) Users() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	users := make([]string, 0, len(f.entries))
+	for user := range f.entries {
+		users = append(users, user)
+	}
+
+	return users
+}
+
+// Reload re-reads the file if it was modified since the last time it was
+// read and returns the users whose entries were added, changed or removed.
+// If the new contents can't be parsed the old entries are kept.
+func (f *File) Reload() ([]string, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.RLock()
+	unchanged := f.entries != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size
+	f.mu.RUnlock()
+
+	if unchanged {
+		return nil, nil
+	}
+
+	fh, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	entries, err := parse(fh)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", f.path, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var changed []string
+	for user, hash := range entries {
+		if old, ok := f.entries[user]; !ok || old != hash {
+			changed = append(changed, user)
+		}
+	}
+	for user := range f.entries {
+		if _, ok := entries[user]; !ok {
+			changed = append(changed, user)
+		}
+	}
+
+	f.entries = entries
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+
+	return changed, nil
+}
+
+// Watch checks the file for modifications every interval until Close is
+// called. onChange, if not nil, is called with the users whose entries
+// changed.
+func (f *File) Watch(interval time.Duration, onChange func(users []string)) {
+	f.mu.Lock()
+	if f.stop != nil {
+		f.mu.Unlock()
+		return
+	}
+	f.stop = make(chan struct{})
+	stop := f.stop
+	f.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				changed, err := f.Reload()
+				if err != nil {
+					log.Println("Failed to reload htpasswd file:", err)
+					continue
+				}
+
+				if len(changed) > 0 {
+					log.Printf("Reloaded %s, %d user(s) changed", f.path, len(changed))
+					if onChange != nil {
+						onChange(changed)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Close stops watching the file.
+func (f *File) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.stop != nil {
+		close(f.stop)
+		f.stop = nil
+	}
+}
+
+// Import returns a verify function that adds users accepted by f to store.
+// htpasswd only keeps password hashes, so a user can only be imported once
+// they log in with their plain text password. Users that already exist in
+// store are left as they are.
+func (f *File) Import(store meta.GenericMetaStore) func(user, pass string) (bool, error) {
+	return func(user, pass string) (bool, error) {
+		ok, err := f.Authenticate(user, pass)
+		if !ok || err != nil {
+			return ok, err
+		}
+
+		if err := store.AddUser(user, pass); err != nil {
+			// the user is still who they say they are
+			log.Printf("Failed to import user %q from htpasswd: %s", user, err)
+		}
+
+		return true, nil
+	}
+}
+
+func parse(r io.Reader) (map[string]string, error) {
+	entries := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("line %d: malformed entry", n)
+		}
+
+		if !supported(parts[1]) {
+			return nil, fmt.Errorf("line %d: unsupported password hash for user %q", n, parts[0])
+		}
+
+		entries[parts[0]] = parts[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func supported(hash string) bool {
+	return strings.HasPrefix(hash, "$2") ||
+		strings.HasPrefix(hash, "{SHA}") ||
+		strings.HasPrefix(hash, "$apr1$")
+}
+
+func verify(hash, pass string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		return secureCompare(hash[len("{SHA}"):], base64.StdEncoding.EncodeToString(sum[:]))
+	case strings.HasPrefix(hash, "$apr1$"):
+		parts := strings.SplitN(hash[len("$apr1$"):], "$", 2)
+		if len(parts) != 2 {
+			return false
+		}
+		return secureCompare(hash, apr1(pass, parts[0]))
+	default:
+		return false
+	}
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 is Apache's variant of the MD5 based crypt(3) algorithm.
+func apr1(pass, salt string) string {
+	const magic = "$apr1$"
+
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.New()
+	io.WriteString(alt, pass)
+	io.WriteString(alt, salt)
+	io.WriteString(alt, pass)
+	sum := alt.Sum(nil)
+
+	d := md5.New()
+	io.WriteString(d, pass)
+	io.WriteString(d, magic)
+	io.WriteString(d, salt)
+
+	for i := len(pass); i > 0; i -= 16 {
+		if i > 16 {
+			d.Write(sum)
+		} else {
+			d.Write(sum[:i])
+		}
+	}
+
+	for i := len(pass); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write([]byte{pass[0]})
+		}
+	}
+	sum = d.Sum(nil)
+
+	// deliberately slow
+	for i := 0; i < 1000; i++ {
+		d := md5.New()
+		if i&1 != 0 {
+			io.WriteString(d, pass)
+		} else {
+			d.Write(sum)
+		}
+		if i%3 != 0 {
+			io.WriteString(d, salt)
+		}
+		if i%7 != 0 {
+			io.WriteString(d, pass)
+		}
+		if i&1 != 0 {
+			d.Write(sum)
+		} else {
+			io.WriteString(d, pass)
+		}
+		sum = d.Sum(nil)
+	}
+
+	out := []byte(magic + salt + "$")
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(sum[i[0]])<<16|uint(sum[i[1]])<<8|uint(sum[i[2]]), 4)
+	}
+	encode(uint(sum[11]), 2)
+
+	return string(out)
+}
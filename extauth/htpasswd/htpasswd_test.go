@@ -0,0 +1,211 @@
+package htpasswd
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ksurent/lfs-server-go/meta"
+)
+
+// all passwords are "secret"
+const testFile = `# test users
+bcrypt:$2y$04$P41ov7Ivs4sP1jZ4M55SoO2z7AgBNlZgNt5pThxTR24T5evj.ppBm
+sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+apr1:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0
+`
+
+func TestAuthenticate(t *testing.T) {
+	f, teardown := setupFile(t, testFile)
+	defer teardown()
+
+	for _, user := range []string{"bcrypt", "sha", "apr1"} {
+		if ok, err := f.Authenticate(user, "secret"); !ok || err != nil {
+			t.Errorf("expected %s user to authenticate, got: %v, %v", user, ok, err)
+		}
+
+		if ok, _ := f.Authenticate(user, "wrong"); ok {
+			t.Errorf("expected %s user to fail with a wrong password", user)
+		}
+	}
+
+	if ok, _ := f.Authenticate("nobody", "secret"); ok {
+		t.Error("expected a nonexisting user to fail")
+	}
+}
+
+func TestLoadUnsupported(t *testing.T) {
+	for _, contents := range []string{
+		"plain:secret\n",
+		"crypt:rl.3StKT.4T8M\n",
+		"no colon\n",
+	} {
+		path := writeFile(t, contents)
+		defer os.Remove(path)
+
+		if _, err := Load(path); err == nil {
+			t.Errorf("expected Load() to reject %q", contents)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	f, teardown := setupFile(t, testFile)
+	defer teardown()
+
+	if changed, err := f.Reload(); len(changed) != 0 || err != nil {
+		t.Errorf("expected an unmodified file to not be reloaded, got: %v, %v", changed, err)
+	}
+
+	// sha is gone, apr1 got a new password and new was added
+	rewrite(t, f.path, `bcrypt:$2y$04$P41ov7Ivs4sP1jZ4M55SoO2z7AgBNlZgNt5pThxTR24T5evj.ppBm
+apr1:$apr1$saltsalt$wrongwrongwrongwrongwr
+new:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=
+`)
+
+	changed, err := f.Reload()
+	if err != nil {
+		t.Fatalf("expected Reload() to succeed, got: %s", err)
+	}
+
+	sort.Strings(changed)
+	if len(changed) != 3 || changed[0] != "apr1" || changed[1] != "new" || changed[2] != "sha" {
+		t.Errorf("expected apr1, new and sha to change, got: %v", changed)
+	}
+
+	if ok, _ := f.Authenticate("sha", "secret"); ok {
+		t.Error("expected a removed user to fail")
+	}
+	if ok, _ := f.Authenticate("new", "secret"); !ok {
+		t.Error("expected an added user to authenticate")
+	}
+}
+
+func TestReloadKeepsEntriesOnError(t *testing.T) {
+	f, teardown := setupFile(t, testFile)
+	defer teardown()
+
+	rewrite(t, f.path, "garbage\n")
+
+	if _, err := f.Reload(); err == nil {
+		t.Error("expected Reload() to fail")
+	}
+
+	if ok, _ := f.Authenticate("sha", "secret"); !ok {
+		t.Error("expected old entries to be kept after a failed reload")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	f, teardown := setupFile(t, testFile)
+	defer teardown()
+
+	changes := make(chan []string, 1)
+	f.Watch(10*time.Millisecond, func(users []string) {
+		changes <- users
+	})
+	defer f.Close()
+
+	rewrite(t, f.path, "sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n")
+
+	select {
+	case users := <-changes:
+		if len(users) != 2 {
+			t.Errorf("expected 2 users to change, got: %v", users)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the modified file to be reloaded")
+	}
+
+	if ok, _ := f.Authenticate("bcrypt", "secret"); ok {
+		t.Error("expected a removed user to fail after the reload")
+	}
+}
+
+type importStore struct {
+	meta.GenericMetaStore
+	users map[string]string
+}
+
+func (s *importStore) AddUser(user, pass string) error {
+	if _, ok := s.users[user]; !ok {
+		s.users[user] = pass
+	}
+	return nil
+}
+
+func TestImport(t *testing.T) {
+	f, teardown := setupFile(t, testFile)
+	defer teardown()
+
+	store := &importStore{users: make(map[string]string)}
+	verify := f.Import(store)
+
+	verify("sha", "wrong")
+	if len(store.users) != 0 {
+		t.Errorf("expected a rejected user to not be imported, got: %v", store.users)
+	}
+
+	if ok, err := verify("sha", "secret"); !ok || err != nil {
+		t.Errorf("expected sha user to authenticate, got: %v, %v", ok, err)
+	}
+	if store.users["sha"] != "secret" {
+		t.Errorf("expected sha user to be imported, got: %v", store.users)
+	}
+}
+
+func TestApr1(t *testing.T) {
+	expected := "$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0"
+	if got := apr1("secret", "saltsalt"); got != expected {
+		t.Errorf("expected apr1() to return %s, got: %s", expected, got)
+	}
+}
+
+func setupFile(t *testing.T, contents string) (*File, func()) {
+	path := writeFile(t, contents)
+
+	f, err := Load(path)
+	if err != nil {
+		os.Remove(path)
+		t.Fatalf("expected Load() to succeed, got: %s", err)
+	}
+
+	return f, func() {
+		f.Close()
+		os.Remove(path)
+	}
+}
+
+func writeFile(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+// rewrite replaces the contents of path making sure the modification time
+// changes even on file systems with a coarse resolution.
+func rewrite(t *testing.T, path, contents string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
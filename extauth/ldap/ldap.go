@@ -2,8 +2,11 @@ package ldap
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/url"
 	"strings"
 
@@ -14,48 +17,141 @@ import (
 
 var (
 	errLdapUserNotFound    = errors.New("Unable to find user in LDAP")
+	errLdapUserAmbiguous   = errors.New("More than one LDAP entry matches user")
 	errNoLdapSearchResults = errors.New("No results from LDAP")
 	errLdapSearchFailed    = errors.New("Failed searching LDAP")
+	errLdapBadCACert       = errors.New("No certificates found in LDAP CA bundle")
 )
 
 func AuthenticateLdap(cfg *config.LdapConfig, user, password string) (bool, error) {
-	conn, err := connect(cfg.Server)
+	// An empty password turns a simple bind into an unauthenticated one,
+	// which most servers happily accept
+	if user == "" || password == "" {
+		return false, nil
+	}
+
+	scope, err := searchScope(cfg.SearchScope)
 	if err != nil {
 		return false, err
 	}
-	defer conn.Close()
 
-	dn, err := findUserDn(conn, cfg.Base, cfg.UserObjectClass, cfg.UserCn, user)
+	conn, err := connect(cfg)
 	if err != nil {
 		return false, err
 	}
+	defer conn.Close()
+
+	if cfg.BindDn != "" {
+		if err := conn.Bind(cfg.BindDn, cfg.BindPass); err != nil {
+			return false, fmt.Errorf("LDAP service account bind: %s", err)
+		}
+	}
+
+	dn, err := findUserDn(conn, cfg.Base, scope, cfg.UserObjectClass, cfg.UserCn, user)
+	if err == errLdapUserNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
 
 	reqE := conn.Bind(dn, password)
 	return reqE == nil, nil
 }
 
-func connect(rawurl string) (*l.Conn, error) {
-	url, err := url.Parse(rawurl)
+func connect(cfg *config.LdapConfig) (*l.Conn, error) {
+	url, err := url.Parse(cfg.Server)
 	if err != nil {
 		return nil, err
 	}
 
-	if !strings.Contains(url.Host, ":") {
-		url.Host += ":389"
+	host := url.Host
+	if !strings.Contains(host, ":") {
+		if url.Scheme == "ldaps" {
+			host += ":636"
+		} else {
+			host += ":389"
+		}
 	}
 
-	if url.Scheme == "ldaps" {
-		return l.DialTLS("tcp", url.Host, &tls.Config{InsecureSkipVerify: true})
+	switch url.Scheme {
+	case "ldaps":
+		tlsCfg, err := newTLSConfig(cfg.CACert, host)
+		if err != nil {
+			return nil, err
+		}
+
+		return l.DialTLS("tcp", host, tlsCfg)
+	case "ldap":
+		conn, err := l.Dial("tcp", host)
+		if err != nil {
+			return nil, err
+		}
+
+		if cfg.StartTLS {
+			tlsCfg, err := newTLSConfig(cfg.CACert, host)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+
+			if err := conn.StartTLS(tlsCfg); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("LDAP StartTLS: %s", err)
+			}
+		}
+
+		return conn, nil
+	default:
+		return nil, fmt.Errorf("Unsupported LDAP URL scheme %q", url.Scheme)
 	}
+}
 
-	return l.Dial("tcp", url.Host)
+// newTLSConfig verifies the server against the CA bundle in caFile, or
+// against the system roots if caFile is empty.
+func newTLSConfig(caFile, host string) (*tls.Config, error) {
+	serverName, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCfg := &tls.Config{ServerName: serverName}
+
+	if caFile == "" {
+		return tlsCfg, nil
+	}
+
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errLdapBadCACert
+	}
+	tlsCfg.RootCAs = pool
+
+	return tlsCfg, nil
+}
+
+func searchScope(scope string) (int, error) {
+	switch strings.ToLower(scope) {
+	case "base":
+		return l.ScopeBaseObject, nil
+	case "", "one":
+		return l.ScopeSingleLevel, nil
+	case "sub":
+		return l.ScopeWholeSubtree, nil
+	default:
+		return 0, fmt.Errorf("Unknown LDAP search scope %q", scope)
+	}
 }
 
-func findUserDn(conn *l.Conn, base, userClass, userCn, user string) (string, error) {
+func findUserDn(conn *l.Conn, base string, scope int, userClass, userCn, user string) (string, error) {
 	req := &l.SearchRequest{
 		BaseDN:     base,
-		Filter:     fmt.Sprintf("(&(objectclass=%s)(%s=%s))", userClass, userCn, user),
-		Scope:      1,
+		Filter:     fmt.Sprintf("(&(objectclass=%s)(%s=%s))", userClass, userCn, escapeFilter(user)),
+		Scope:      scope,
 		Attributes: []string{"dn"},
 	}
 
@@ -64,9 +160,29 @@ func findUserDn(conn *l.Conn, base, userClass, userCn, user string) (string, err
 		return "", err
 	}
 
-	if len(res.Entries) > 0 {
+	switch len(res.Entries) {
+	case 0:
+		return "", errLdapUserNotFound
+	case 1:
 		return res.Entries[0].DN, nil
+	default:
+		return "", errLdapUserAmbiguous
+	}
+}
+
+// escapeFilter escapes a value for use in a search filter as described in
+// RFC 4515, section 3.
+func escapeFilter(value string) string {
+	var buf []byte
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '\\', c == '*', c == '(', c == ')', c == 0, c > 0x7f:
+			buf = append(buf, fmt.Sprintf(`\%02x`, c)...)
+		default:
+			buf = append(buf, c)
+		}
 	}
 
-	return "", errLdapUserNotFound
+	return string(buf)
 }
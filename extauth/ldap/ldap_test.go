@@ -1,31 +1,36 @@
 package ldap
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
-	"time"
 
 	"github.com/ksurent/lfs-server-go/config"
 	"github.com/ksurent/lfs-server-go/extauth/ldap/testldap"
 )
 
 var (
-	testUser   = "admin"
-	testPass   = "admin"
-	testServer = "127.0.0.1:1389"
+	testUser = "admin"
+	testPass = "admin"
 )
 
-var cfg = &config.LdapConfig{
-	Enabled:         true,
-	Server:          "ldap://" + testServer,
-	Base:            "o=company",
-	UserObjectClass: "posixaccount",
-	UserCn:          "uid",
+func newConfig(server string) *config.LdapConfig {
+	return &config.LdapConfig{
+		Enabled:         true,
+		Server:          server,
+		Base:            "o=company",
+		UserObjectClass: "posixaccount",
+		UserCn:          "uid",
+		SearchScope:     "sub",
+	}
 }
 
 func TestAuthenticateLdap(t *testing.T) {
-	teardown := setupLdapServer()
+	_, addr, _, teardown := setupLdapServer(t, false)
 	defer teardown()
 
+	cfg := newConfig("ldap://" + addr)
+
 	ok, err := AuthenticateLdap(cfg, testUser, testPass)
 	if !ok {
 		if err != nil {
@@ -34,20 +39,173 @@ func TestAuthenticateLdap(t *testing.T) {
 			t.Error("expected authentication to succeed for test user")
 		}
 	}
+
+	if ok, _ := AuthenticateLdap(cfg, testUser, "wrong"); ok {
+		t.Error("expected authentication to fail for a wrong password")
+	}
+
+	if ok, _ := AuthenticateLdap(cfg, testUser, ""); ok {
+		t.Error("expected authentication to fail for an empty password")
+	}
+
+	ok, err = AuthenticateLdap(cfg, "azog", "defiler")
+	if ok || err != nil {
+		t.Errorf("expected authentication to fail without an error for a nonexisting user, got: %v, %v", ok, err)
+	}
+}
+
+func TestAuthenticateLdapFilterInjection(t *testing.T) {
+	s, addr, _, teardown := setupLdapServer(t, false)
+	defer teardown()
+
+	cfg := newConfig("ldap://" + addr)
+
+	// without escaping this matches every user, and ned is the first one
+	if ok, _ := AuthenticateLdap(cfg, "*", "ned"); ok {
+		t.Error("expected authentication to fail for a wildcard user name")
+	}
+
+	expected := `(&(objectclass=posixaccount)(uid=\2a))`
+	if f := s.LastFilter(); f != expected {
+		t.Errorf("expected search filter to be %s, got: %s", expected, f)
+	}
+
+	if ok, _ := AuthenticateLdap(cfg, "admin)(uid=*", testPass); ok {
+		t.Error("expected authentication to fail for an injected filter")
+	}
+}
+
+func TestAuthenticateLdapSearchScope(t *testing.T) {
+	_, addr, _, teardown := setupLdapServer(t, false)
+	defer teardown()
+
+	cfg := newConfig("ldap://" + addr)
+
+	// users live in o=testers,o=company
+	cfg.SearchScope = "one"
+	if ok, _ := AuthenticateLdap(cfg, testUser, testPass); ok {
+		t.Error("expected single level search to not find the test user")
+	}
+
+	cfg.Base = "o=testers,o=company"
+	if ok, err := AuthenticateLdap(cfg, testUser, testPass); !ok {
+		t.Errorf("expected single level search to find the test user, got: %v", err)
+	}
+
+	cfg.SearchScope = "bogus"
+	if _, err := AuthenticateLdap(cfg, testUser, testPass); err == nil {
+		t.Error("expected an unknown search scope to be rejected")
+	}
+}
+
+func TestAuthenticateLdapServiceAccount(t *testing.T) {
+	s, addr, _, teardown := setupLdapServer(t, false)
+	defer teardown()
+
+	s.RequireBind = true
+
+	cfg := newConfig("ldap://" + addr)
+
+	if ok, _ := AuthenticateLdap(cfg, testUser, testPass); ok {
+		t.Error("expected anonymous search to fail")
+	}
+
+	cfg.BindDn = testldap.ServiceDn
+	cfg.BindPass = "wrong"
+	if _, err := AuthenticateLdap(cfg, testUser, testPass); err == nil {
+		t.Error("expected service account bind to fail with a wrong password")
+	}
+
+	cfg.BindPass = testldap.ServicePass
+	if ok, err := AuthenticateLdap(cfg, testUser, testPass); !ok {
+		t.Errorf("expected authentication to succeed with a service account, got: %v", err)
+	}
+}
+
+func TestAuthenticateLdapStartTLS(t *testing.T) {
+	_, addr, caFile, teardown := setupLdapServer(t, false)
+	defer teardown()
+
+	cfg := newConfig("ldap://" + addr)
+	cfg.StartTLS = true
+
+	// the test certificate is not signed by any of the system roots
+	if _, err := AuthenticateLdap(cfg, testUser, testPass); err == nil {
+		t.Error("expected StartTLS to fail without the CA bundle")
+	}
+
+	cfg.CACert = caFile
+	if ok, err := AuthenticateLdap(cfg, testUser, testPass); !ok {
+		t.Errorf("expected authentication over StartTLS to succeed, got: %v", err)
+	}
+}
+
+func TestAuthenticateLdaps(t *testing.T) {
+	_, addr, caFile, teardown := setupLdapServer(t, true)
+	defer teardown()
+
+	cfg := newConfig("ldaps://" + addr)
+
+	if _, err := AuthenticateLdap(cfg, testUser, testPass); err == nil {
+		t.Error("expected ldaps to fail without the CA bundle")
+	}
+
+	cfg.CACert = caFile
+	if ok, err := AuthenticateLdap(cfg, testUser, testPass); !ok {
+		t.Errorf("expected authentication over ldaps to succeed, got: %v", err)
+	}
+}
+
+func TestEscapeFilter(t *testing.T) {
+	for in, out := range map[string]string{
+		"admin":           "admin",
+		"*":               `\2a`,
+		"a(b)c":           `a\28b\29c`,
+		`back\slash`:      `back\5cslash`,
+		"nul\x00":         `nul\00`,
+		"j\xc3\xbcrgen":   `j\c3\bcrgen`,
+		"admin)(uid=*":    `admin\29\28uid=\2a`,
+		"plain.user-name": "plain.user-name",
+	} {
+		if got := escapeFilter(in); got != out {
+			t.Errorf("expected escapeFilter(%q) to be %s, got: %s", in, out, got)
+		}
+	}
 }
 
-func setupLdapServer() func() {
+func setupLdapServer(t *testing.T, useTLS bool) (*testldap.Server, string, string, func()) {
 	s := testldap.NewServer()
 
-	teardown := func() {
-		s = nil
+	tlsCfg, caPem, err := testldap.SelfSignedTLS()
+	if err != nil {
+		t.Fatal(err)
 	}
+	s.TLSConfig = tlsCfg
 
-	// TODO figure out a way to get a random free port
-	go s.ListenAndServe(testServer)
+	f, err := ioutil.TempFile("", "testldap-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(caPem); err != nil {
+		t.Fatal(err)
+	}
+
+	var addr string
+	if useTLS {
+		addr, err = s.ListenTLS("127.0.0.1:0")
+	} else {
+		addr, err = s.Listen("127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	// this is stupid
-	time.Sleep(2 * time.Second)
+	teardown := func() {
+		s.Close()
+		os.Remove(f.Name())
+	}
 
-	return teardown
+	return s, addr, f.Name(), teardown
 }
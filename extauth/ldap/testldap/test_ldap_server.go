@@ -1,96 +1,340 @@
-// Just returns success when username = user and password = password
-// Otherwise, the response is a failure
-// used for testing
+// In-memory LDAP directory used for testing.
+// Users bind with their DN and the password stored in their userPassword
+// attribute; search filters and scopes are enforced by the server.
 package testldap
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
 	"log"
+	"math/big"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
+	ber "github.com/nmcclain/asn1-ber"
 	"github.com/nmcclain/ldap"
 )
 
-func NewServer() *ldap.Server {
-	s := ldap.NewServer()
-	s.BindFunc("", ldapHandler{})
-	s.SearchFunc("", searchSimple{})
+const (
+	// ServiceDn and ServicePass are the credentials of the service account
+	// present in the test directory.
+	ServiceDn   = "cn=lfs-search,ou=services,o=company"
+	ServicePass = "search"
+
+	startTLSOid = "1.3.6.1.4.1.1466.20037"
+
+	applicationExtendedRequest  = 23
+	applicationExtendedResponse = 24
+)
+
+var errClosed = errors.New("test LDAP server is closed")
+
+// Server wraps ldap.Server with support for StartTLS and bind-before-search.
+type Server struct {
+	// TLSConfig enables StartTLS on plain listeners and is required by
+	// ListenTLS.
+	TLSConfig *tls.Config
+	// RequireBind makes the server reject anonymous searches.
+	RequireBind bool
+
+	srv *ldap.Server
+	ln  net.Listener
+
+	mu         sync.Mutex
+	lastFilter string
+}
+
+func NewServer() *Server {
+	s := &Server{srv: ldap.NewServer()}
+	s.srv.EnforceLDAP = true
+	s.srv.BindFunc("", s)
+	s.srv.SearchFunc("", s)
 
 	return s
 }
 
-type ldapHandler struct {
+// Listen starts serving plain LDAP (with optional StartTLS) on addr in the
+// background and returns the address it is bound to.
+func (s *Server) Listen(addr string) (string, error) {
+	return s.listen(addr, false)
 }
 
-type searchSimple struct {
+// ListenTLS is the same as Listen but serves LDAP over TLS (ldaps).
+func (s *Server) ListenTLS(addr string) (string, error) {
+	if s.TLSConfig == nil {
+		return "", errors.New("TLSConfig is required for ldaps")
+	}
+
+	return s.listen(addr, true)
 }
 
-func (h ldapHandler) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
-	log.Printf("BindDN: %s, bindSimplePw: %s\n", bindDN, bindSimplePw)
-	s := searchSimple{}
-	req := ldap.SearchRequest{BaseDN: "o=testers,o=company", Filter: "(cn=admin*)"}
-	result, err := s.Search(bindDN, req, conn)
+func (s *Server) listen(addr string, useTLS bool) (string, error) {
+	ln, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Println("Unable to find user", bindDN)
-		return ldap.LDAPResultInvalidCredentials, err
-	}
-	found := false
-	for i := 0; i < len(result.Entries); i++ {
-		if strings.Contains(result.Entries[i].DN, bindDN) {
-			log.Println("Found DN", result.Entries[i].DN)
-			found = true
+		return "", err
+	}
+
+	if useTLS {
+		ln = tls.NewListener(ln, s.TLSConfig)
+	} else if s.TLSConfig != nil {
+		stls := &startTLSListener{
+			Listener: ln,
+			config:   s.TLSConfig,
+			conns:    make(chan net.Conn),
+			done:     make(chan struct{}),
 		}
+		go stls.acceptLoop()
+		ln = stls
+	}
+
+	s.ln = ln
+	go s.srv.Serve(ln)
+
+	return ln.Addr().String(), nil
+}
+
+func (s *Server) Close() error {
+	if s.ln == nil {
+		return nil
 	}
-	if found == false {
-		log.Println("Unable to find result for DN", bindDN)
+
+	return s.ln.Close()
+}
+
+// LastFilter returns the filter of the most recent search request.
+func (s *Server) LastFilter() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastFilter
+}
+
+func (s *Server) Bind(bindDN, bindSimplePw string, conn net.Conn) (ldap.LDAPResultCode, error) {
+	if bindSimplePw == "" {
 		return ldap.LDAPResultInvalidCredentials, nil
 	}
-	if bindSimplePw == "admin" {
-		log.Printf("Authorized: BindDN: %s, bindSimplePw: %s\n", bindDN, bindSimplePw)
-		return ldap.LDAPResultSuccess, nil
+
+	for _, e := range entries {
+		if !strings.EqualFold(e.DN, bindDN) {
+			continue
+		}
+
+		for _, attr := range e.Attributes {
+			if attr.Name == "userPassword" && len(attr.Values) > 0 && attr.Values[0] == bindSimplePw {
+				return ldap.LDAPResultSuccess, nil
+			}
+		}
 	}
-	log.Printf("Unauthorized: BindDN: %s, bindSimplePw: %s\n", bindDN, bindSimplePw)
+
+	log.Printf("Unauthorized: BindDN: %s\n", bindDN)
 	return ldap.LDAPResultInvalidCredentials, nil
 }
 
-func (s searchSimple) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
-	log.Println("Searching")
-	entries := []*ldap.Entry{
-		&ldap.Entry{"cn=ned,o=testers,o=company", []*ldap.EntryAttribute{
-			&ldap.EntryAttribute{"cn", []string{"ned"}},
-			&ldap.EntryAttribute{"o", []string{"ate"}},
-			&ldap.EntryAttribute{"uidNumber", []string{"5000"}},
-			&ldap.EntryAttribute{"accountstatus", []string{"active"}},
-			&ldap.EntryAttribute{"uid", []string{"ned"}},
-			&ldap.EntryAttribute{"description", []string{"ned via sa"}},
-			&ldap.EntryAttribute{"objectclass", []string{"posixaccount"}},
-		}},
-		&ldap.Entry{"cn=admin,o=testers,o=company", []*ldap.EntryAttribute{
-			&ldap.EntryAttribute{"cn", []string{"admin"}},
-			&ldap.EntryAttribute{"o", []string{"ate"}},
-			&ldap.EntryAttribute{"uidNumber", []string{"5001"}},
-			&ldap.EntryAttribute{"accountstatus", []string{"active"}},
-			&ldap.EntryAttribute{"uid", []string{"admin"}},
-			&ldap.EntryAttribute{"description", []string{"admin via sa"}},
-			&ldap.EntryAttribute{"objectclass", []string{"posixaccount", "user"}},
-		}},
-		&ldap.Entry{"cn=trent,o=testers,o=company", []*ldap.EntryAttribute{
-			&ldap.EntryAttribute{"cn", []string{"trent"}},
-			&ldap.EntryAttribute{"o", []string{"ate"}},
-			&ldap.EntryAttribute{"uidNumber", []string{"5005"}},
-			&ldap.EntryAttribute{"accountstatus", []string{"active"}},
-			&ldap.EntryAttribute{"uid", []string{"trent"}},
-			&ldap.EntryAttribute{"description", []string{"trent via sa"}},
-			&ldap.EntryAttribute{"objectclass", []string{"posixaccount"}},
-		}},
-		&ldap.Entry{"cn=randy,o=testers,o=company", []*ldap.EntryAttribute{
-			&ldap.EntryAttribute{"cn", []string{"randy"}},
-			&ldap.EntryAttribute{"o", []string{"ate"}},
-			&ldap.EntryAttribute{"uidNumber", []string{"5555"}},
-			&ldap.EntryAttribute{"accountstatus", []string{"active"}},
-			&ldap.EntryAttribute{"uid", []string{"randy"}},
-			&ldap.EntryAttribute{"objectclass", []string{"posixaccount"}},
-		}},
-	}
-	return ldap.ServerSearchResult{entries, []string{}, []ldap.Control{}, ldap.LDAPResultSuccess}, nil
+func (s *Server) Search(boundDN string, searchReq ldap.SearchRequest, conn net.Conn) (ldap.ServerSearchResult, error) {
+	s.mu.Lock()
+	s.lastFilter = searchReq.Filter
+	s.mu.Unlock()
+
+	if s.RequireBind && boundDN == "" {
+		return ldap.ServerSearchResult{ResultCode: ldap.LDAPResultInsufficientAccessRights}, errors.New("anonymous search is not allowed")
+	}
+
+	return ldap.ServerSearchResult{
+		Entries:    entries,
+		Referrals:  []string{},
+		Controls:   []ldap.Control{},
+		ResultCode: ldap.LDAPResultSuccess,
+	}, nil
+}
+
+// startTLSListener answers StartTLS extended requests itself, since
+// ldap.Server does not support them, and hands the upgraded (or untouched)
+// connections over to ldap.Server.
+type startTLSListener struct {
+	net.Listener
+	config *tls.Config
+	conns  chan net.Conn
+	done   chan struct{}
+}
+
+func (ln *startTLSListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.done:
+		return nil, errClosed
+	}
+}
+
+func (ln *startTLSListener) Close() error {
+	close(ln.done)
+	return ln.Listener.Close()
+}
+
+func (ln *startTLSListener) handOver(conn net.Conn) {
+	select {
+	case ln.conns <- conn:
+	case <-ln.done:
+		conn.Close()
+	}
+}
+
+func (ln *startTLSListener) acceptLoop() {
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go ln.negotiate(conn)
+	}
+}
+
+func (ln *startTLSListener) negotiate(conn net.Conn) {
+	packet, err := ber.ReadPacket(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if !isStartTLS(packet) {
+		// replay the first message to the LDAP server
+		ln.handOver(&replayConn{conn, io.MultiReader(bytes.NewReader(packet.Bytes()), conn)})
+		return
+	}
+
+	response := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	response.AppendChild(packet.Children[0])
+
+	extended := ber.Encode(ber.ClassApplication, ber.TypeConstructed, applicationExtendedResponse, nil, "Extended Response")
+	extended.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, 0, "resultCode"))
+	extended.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	extended.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	response.AppendChild(extended)
+
+	if _, err := conn.Write(response.Bytes()); err != nil {
+		conn.Close()
+		return
+	}
+
+	tlsConn := tls.Server(conn, ln.config)
+	if err := tlsConn.Handshake(); err != nil {
+		log.Println("StartTLS handshake failed:", err)
+		tlsConn.Close()
+		return
+	}
+
+	ln.handOver(tlsConn)
+}
+
+func isStartTLS(packet *ber.Packet) bool {
+	if len(packet.Children) < 2 {
+		return false
+	}
+
+	op := packet.Children[1]
+	if op.ClassType != ber.ClassApplication || op.Tag != applicationExtendedRequest || len(op.Children) < 1 {
+		return false
+	}
+
+	name := op.Children[0]
+	return name.Data != nil && name.Data.String() == startTLSOid
+}
+
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+var entries = []*ldap.Entry{
+	&ldap.Entry{DN: "cn=ned,o=testers,o=company", Attributes: []*ldap.EntryAttribute{
+		&ldap.EntryAttribute{Name: "cn", Values: []string{"ned"}},
+		&ldap.EntryAttribute{Name: "o", Values: []string{"ate"}},
+		&ldap.EntryAttribute{Name: "uidNumber", Values: []string{"5000"}},
+		&ldap.EntryAttribute{Name: "accountstatus", Values: []string{"active"}},
+		&ldap.EntryAttribute{Name: "uid", Values: []string{"ned"}},
+		&ldap.EntryAttribute{Name: "description", Values: []string{"ned via sa"}},
+		&ldap.EntryAttribute{Name: "objectclass", Values: []string{"posixaccount"}},
+		&ldap.EntryAttribute{Name: "userPassword", Values: []string{"ned"}},
+	}},
+	&ldap.Entry{DN: "cn=admin,o=testers,o=company", Attributes: []*ldap.EntryAttribute{
+		&ldap.EntryAttribute{Name: "cn", Values: []string{"admin"}},
+		&ldap.EntryAttribute{Name: "o", Values: []string{"ate"}},
+		&ldap.EntryAttribute{Name: "uidNumber", Values: []string{"5001"}},
+		&ldap.EntryAttribute{Name: "accountstatus", Values: []string{"active"}},
+		&ldap.EntryAttribute{Name: "uid", Values: []string{"admin"}},
+		&ldap.EntryAttribute{Name: "description", Values: []string{"admin via sa"}},
+		&ldap.EntryAttribute{Name: "objectclass", Values: []string{"posixaccount", "user"}},
+		&ldap.EntryAttribute{Name: "userPassword", Values: []string{"admin"}},
+	}},
+	&ldap.Entry{DN: "cn=trent,o=testers,o=company", Attributes: []*ldap.EntryAttribute{
+		&ldap.EntryAttribute{Name: "cn", Values: []string{"trent"}},
+		&ldap.EntryAttribute{Name: "o", Values: []string{"ate"}},
+		&ldap.EntryAttribute{Name: "uidNumber", Values: []string{"5005"}},
+		&ldap.EntryAttribute{Name: "accountstatus", Values: []string{"active"}},
+		&ldap.EntryAttribute{Name: "uid", Values: []string{"trent"}},
+		&ldap.EntryAttribute{Name: "description", Values: []string{"trent via sa"}},
+		&ldap.EntryAttribute{Name: "objectclass", Values: []string{"posixaccount"}},
+		&ldap.EntryAttribute{Name: "userPassword", Values: []string{"trent"}},
+	}},
+	&ldap.Entry{DN: "cn=randy,o=testers,o=company", Attributes: []*ldap.EntryAttribute{
+		&ldap.EntryAttribute{Name: "cn", Values: []string{"randy"}},
+		&ldap.EntryAttribute{Name: "o", Values: []string{"ate"}},
+		&ldap.EntryAttribute{Name: "uidNumber", Values: []string{"5555"}},
+		&ldap.EntryAttribute{Name: "uid", Values: []string{"randy"}},
+		&ldap.EntryAttribute{Name: "objectclass", Values: []string{"posixaccount"}},
+		&ldap.EntryAttribute{Name: "userPassword", Values: []string{"randy"}},
+	}},
+	&ldap.Entry{DN: ServiceDn, Attributes: []*ldap.EntryAttribute{
+		&ldap.EntryAttribute{Name: "cn", Values: []string{"lfs-search"}},
+		&ldap.EntryAttribute{Name: "objectclass", Values: []string{"applicationProcess"}},
+		&ldap.EntryAttribute{Name: "userPassword", Values: []string{ServicePass}},
+	}},
+}
+
+// SelfSignedTLS generates a throwaway certificate for 127.0.0.1 and returns
+// a server configuration using it along with the PEM encoded certificate,
+// which clients can use as their CA bundle.
+func SelfSignedTLS() (*tls.Config, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "testldap"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+
+	return cfg, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
 }
@@ -0,0 +1,314 @@
+// Package oidc authenticates requests carrying OpenID Connect (or plain
+// OAuth2 JWT) bearer tokens. Tokens are verified against the keys published
+// by the issuer.
+package oidc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ksurent/lfs-server-go/auth"
+	"github.com/ksurent/lfs-server-go/config"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// minRefresh limits how often the key set is fetched because of tokens
+// signed with unknown keys, so that garbage tokens can't hammer the issuer.
+const minRefresh = time.Minute
+
+var (
+	errNoIssuer   = errors.New("OIDC issuer is not specified")
+	errNoAudience = errors.New("OIDC audience is not specified")
+	errNoKeys     = errors.New("OIDC key set is not available")
+
+	// only asymmetric algorithms, anybody can get hold of the key set
+	allowedAlgorithms = map[string]bool{
+		string(jose.RS256): true,
+		string(jose.RS384): true,
+		string(jose.RS512): true,
+		string(jose.PS256): true,
+		string(jose.PS384): true,
+		string(jose.PS512): true,
+		string(jose.ES256): true,
+		string(jose.ES384): true,
+		string(jose.ES512): true,
+	}
+)
+
+// Authenticator verifies bearer tokens issued by the configured issuer.
+type Authenticator struct {
+	cfg    *config.OidcConfig
+	leeway time.Duration
+	client *http.Client
+	now    func() time.Time
+
+	mu      sync.Mutex
+	jwksURL string
+	keys    *jose.JSONWebKeySet
+	// fetched is when the key set was last requested, successfully or not
+	fetched time.Time
+	// fetching is closed when the key set being fetched has arrived
+	fetching chan struct{}
+}
+
+func New(cfg *config.OidcConfig) (*Authenticator, error) {
+	if cfg.Issuer == "" {
+		return nil, errNoIssuer
+	}
+	if cfg.Audience == "" {
+		return nil, errNoAudience
+	}
+
+	leeway := time.Minute
+	if cfg.Leeway != "" {
+		d, err := time.ParseDuration(cfg.Leeway)
+		if err != nil {
+			return nil, fmt.Errorf("Leeway: %s", err)
+		}
+		leeway = d
+	}
+
+	return &Authenticator{
+		cfg:     cfg,
+		leeway:  leeway,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		now:     time.Now,
+		jwksURL: cfg.JwksURL,
+	}, nil
+}
+
+func (a *Authenticator) Name() string {
+	return "oidc"
+}
+
+// Authenticate returns auth.ErrNoCredentials for requests without a bearer
+// token and auth.ErrBadCredentials for tokens that don't pass verification.
+func (a *Authenticator) Authenticate(r *http.Request) (*auth.Identity, error) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return nil, auth.ErrNoCredentials
+	}
+
+	return a.Verify(strings.TrimSpace(header[7:]))
+}
+
+// Verify checks the signature, issuer, audience and expiry of token and maps
+// its claims to an identity.
+func (a *Authenticator) Verify(token string) (*auth.Identity, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, a.reject(err)
+	}
+
+	if len(tok.Headers) != 1 {
+		return nil, a.reject(errors.New("expected exactly one signature"))
+	}
+
+	header := tok.Headers[0]
+	if !allowedAlgorithms[header.Algorithm] {
+		return nil, a.reject(fmt.Errorf("algorithm %q is not allowed", header.Algorithm))
+	}
+
+	keys, err := a.keysFor(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		std    jwt.Claims
+		claims map[string]interface{}
+		valid  bool
+	)
+	for _, key := range keys {
+		if err := tok.Claims(key.Key, &std, &claims); err == nil {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, a.reject(errors.New("signature verification failed"))
+	}
+
+	if std.Expiry == nil {
+		return nil, a.reject(errors.New("token does not expire"))
+	}
+
+	err = std.ValidateWithLeeway(jwt.Expected{
+		Issuer:   a.cfg.Issuer,
+		Audience: jwt.Audience{a.cfg.Audience},
+		Time:     a.now(),
+	}, a.leeway)
+	if err != nil {
+		return nil, a.reject(err)
+	}
+
+	name, _ := claims[a.usernameClaim()].(string)
+	if name == "" {
+		return nil, a.reject(fmt.Errorf("claim %q is missing", a.usernameClaim()))
+	}
+
+	return &auth.Identity{
+		Name:   name,
+		Source: a.Name(),
+		Groups: stringList(claims[a.groupsClaim()]),
+	}, nil
+}
+
+func (a *Authenticator) reject(err error) error {
+	log.Println("Rejected bearer token:", err)
+	return auth.ErrBadCredentials
+}
+
+func (a *Authenticator) usernameClaim() string {
+	if a.cfg.UsernameClaim == "" {
+		return "preferred_username"
+	}
+	return a.cfg.UsernameClaim
+}
+
+func (a *Authenticator) groupsClaim() string {
+	if a.cfg.GroupsClaim == "" {
+		return "groups"
+	}
+	return a.cfg.GroupsClaim
+}
+
+// keysFor returns the keys that may have signed a token with the given key
+// id, fetching the key set if the id is unknown. The lock isn't held while
+// fetching, so that a slow issuer only holds up the requests that wait for
+// the new key set.
+func (a *Authenticator) keysFor(kid string) ([]jose.JSONWebKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for a.fetching != nil {
+		if a.keys != nil {
+			if keys := a.lookup(kid); len(keys) > 0 {
+				return keys, nil
+			}
+		}
+
+		// somebody else is fetching the key set, it may have the key
+		done := a.fetching
+		a.mu.Unlock()
+		<-done
+		a.mu.Lock()
+	}
+
+	if a.keys != nil {
+		if keys := a.lookup(kid); len(keys) > 0 {
+			return keys, nil
+		}
+	}
+
+	if !a.fetched.IsZero() && a.now().Sub(a.fetched) < minRefresh {
+		if a.keys == nil {
+			return nil, errNoKeys
+		}
+		return nil, a.reject(fmt.Errorf("unknown key %q", kid))
+	}
+
+	a.fetched = a.now()
+	done := make(chan struct{})
+	a.fetching = done
+	jwksURL := a.jwksURL
+
+	a.mu.Unlock()
+	keys, jwksURL, err := a.fetchKeys(jwksURL)
+	a.mu.Lock()
+
+	a.fetching = nil
+	close(done)
+
+	if err != nil {
+		return nil, err
+	}
+	a.jwksURL = jwksURL
+	a.keys = keys
+
+	if keys := a.lookup(kid); len(keys) > 0 {
+		return keys, nil
+	}
+
+	return nil, a.reject(fmt.Errorf("unknown key %q", kid))
+}
+
+func (a *Authenticator) lookup(kid string) []jose.JSONWebKey {
+	if kid == "" {
+		return a.keys.Keys
+	}
+	return a.keys.Key(kid)
+}
+
+// fetchKeys fetches the key set from jwksURL, or from the URL the issuer's
+// discovery document names if it's empty, and returns it with its URL
+func (a *Authenticator) fetchKeys(jwksURL string) (*jose.JSONWebKeySet, string, error) {
+	if jwksURL == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JwksURI string `json:"jwks_uri"`
+		}
+
+		url := strings.TrimSuffix(a.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+		if err := a.getJSON(url, &discovery); err != nil {
+			return nil, "", err
+		}
+
+		if discovery.Issuer != a.cfg.Issuer {
+			return nil, "", fmt.Errorf("OIDC discovery returned issuer %q, expected %q", discovery.Issuer, a.cfg.Issuer)
+		}
+		if discovery.JwksURI == "" {
+			return nil, "", errors.New("OIDC discovery did not return jwks_uri")
+		}
+
+		jwksURL = discovery.JwksURI
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := a.getJSON(jwksURL, &keys); err != nil {
+		return nil, "", err
+	}
+
+	return &keys, jwksURL, nil
+}
+
+func (a *Authenticator) getJSON(url string, v interface{}) error {
+	res, err := a.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// stringList accepts both a list of strings and a single string, identity
+// providers don't agree on how to represent single element lists.
+func stringList(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var list []string
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,333 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ksurent/lfs-server-go/auth"
+	"github.com/ksurent/lfs-server-go/config"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const testAudience = "lfs-server-go"
+
+type testIssuer struct {
+	*httptest.Server
+	keys      jose.JSONWebKeySet
+	jwksCalls int
+	// if set, the key set is only served once slow is closed
+	slow chan struct{}
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	iss := &testIssuer{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   iss.URL,
+			"jwks_uri": iss.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		iss.jwksCalls++
+		if iss.slow != nil {
+			<-iss.slow
+		}
+		json.NewEncoder(w).Encode(iss.keys)
+	})
+
+	iss.Server = httptest.NewServer(mux)
+
+	return iss
+}
+
+// addKey generates a signing key and publishes its public half
+func (iss *testIssuer) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iss.keys.Keys = append(iss.keys.Keys, jose.JSONWebKey{
+		Key:       &key.PublicKey,
+		KeyID:     kid,
+		Algorithm: string(jose.RS256),
+		Use:       "sig",
+	})
+
+	return key
+}
+
+func sign(t *testing.T, alg jose.SignatureAlgorithm, key interface{}, kid string, claims ...interface{}) string {
+	opts := (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", kid)
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builder := jwt.Signed(signer)
+	for _, c := range claims {
+		builder = builder.Claims(c)
+	}
+
+	token, err := builder.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func (iss *testIssuer) claims() jwt.Claims {
+	return jwt.Claims{
+		Issuer:   iss.URL,
+		Audience: jwt.Audience{testAudience},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		IssuedAt: jwt.NewNumericDate(time.Now()),
+	}
+}
+
+func newAuthenticator(t *testing.T, iss *testIssuer) *Authenticator {
+	a, err := New(&config.OidcConfig{Issuer: iss.URL, Audience: testAudience})
+	if err != nil {
+		t.Fatalf("expected New() to succeed, got: %s", err)
+	}
+
+	return a
+}
+
+func bearer(token string) *http.Request {
+	r, _ := http.NewRequest("GET", "http://localhost/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestAuthenticate(t *testing.T) {
+	iss := newTestIssuer(t)
+	defer iss.Close()
+
+	key := iss.addKey(t, "test")
+	a := newAuthenticator(t, iss)
+
+	token := sign(t, jose.RS256, key, "test", iss.claims(), map[string]interface{}{
+		"preferred_username": "admin",
+		"groups":             []string{"developers", "admins"},
+	})
+
+	id, err := a.Authenticate(bearer(token))
+	if err != nil {
+		t.Fatalf("expected Authenticate() to succeed, got: %s", err)
+	}
+
+	if id.Name != "admin" || id.Source != "oidc" {
+		t.Errorf("expected admin to be authenticated by oidc, got: %#v", id)
+	}
+
+	if len(id.Groups) != 2 || id.Groups[0] != "developers" || id.Groups[1] != "admins" {
+		t.Errorf("expected groups to be mapped, got: %v", id.Groups)
+	}
+
+	// the key set is cached
+	a.Authenticate(bearer(token))
+	if iss.jwksCalls != 1 {
+		t.Errorf("expected the key set to be fetched once, got %d fetches", iss.jwksCalls)
+	}
+}
+
+func TestAuthenticateNoToken(t *testing.T) {
+	iss := newTestIssuer(t)
+	defer iss.Close()
+
+	a := newAuthenticator(t, iss)
+
+	r, _ := http.NewRequest("GET", "http://localhost/", nil)
+	if _, err := a.Authenticate(r); err != auth.ErrNoCredentials {
+		t.Errorf("expected a request without a token to be skipped, got: %v", err)
+	}
+
+	r.SetBasicAuth("admin", "admin")
+	if _, err := a.Authenticate(r); err != auth.ErrNoCredentials {
+		t.Errorf("expected a request with basic credentials to be skipped, got: %v", err)
+	}
+}
+
+func TestAuthenticateInvalid(t *testing.T) {
+	iss := newTestIssuer(t)
+	defer iss.Close()
+
+	key := iss.addKey(t, "test")
+	a := newAuthenticator(t, iss)
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := map[string]interface{}{"preferred_username": "admin"}
+
+	expired := iss.claims()
+	expired.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+
+	noExpiry := iss.claims()
+	noExpiry.Expiry = nil
+
+	wrongAudience := iss.claims()
+	wrongAudience.Audience = jwt.Audience{"someone-else"}
+
+	wrongIssuer := iss.claims()
+	wrongIssuer.Issuer = "https://evil.example.com"
+
+	for name, token := range map[string]string{
+		"garbage":        "not.a.token",
+		"expired":        sign(t, jose.RS256, key, "test", expired, user),
+		"no expiry":      sign(t, jose.RS256, key, "test", noExpiry, user),
+		"wrong audience": sign(t, jose.RS256, key, "test", wrongAudience, user),
+		"wrong issuer":   sign(t, jose.RS256, key, "test", wrongIssuer, user),
+		"wrong key":      sign(t, jose.RS256, other, "test", iss.claims(), user),
+		"unknown key":    sign(t, jose.ES256, ecKey, "other", iss.claims(), user),
+		"no username":    sign(t, jose.RS256, key, "test", iss.claims()),
+		"symmetric":      sign(t, jose.HS256, []byte("secret"), "test", iss.claims(), user),
+	} {
+		if _, err := a.Authenticate(bearer(token)); err != auth.ErrBadCredentials {
+			t.Errorf("expected %s token to be rejected, got: %v", name, err)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	iss := newTestIssuer(t)
+	defer iss.Close()
+
+	iss.addKey(t, "old")
+	a := newAuthenticator(t, iss)
+
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	if _, err := a.keysFor("old"); err != nil {
+		t.Fatalf("expected the old key to be found, got: %s", err)
+	}
+
+	key := iss.addKey(t, "new")
+	token := sign(t, jose.RS256, key, "new", iss.claims(), map[string]interface{}{"preferred_username": "admin"})
+
+	// too soon to ask the issuer again
+	if _, err := a.Authenticate(bearer(token)); err != auth.ErrBadCredentials {
+		t.Errorf("expected the new key to be unknown yet, got: %v", err)
+	}
+
+	now = now.Add(2 * minRefresh)
+	if _, err := a.Authenticate(bearer(token)); err != nil {
+		t.Errorf("expected the key set to be refreshed, got: %v", err)
+	}
+
+	if iss.jwksCalls != 2 {
+		t.Errorf("expected the key set to be fetched twice, got %d fetches", iss.jwksCalls)
+	}
+}
+
+func TestSlowKeyFetch(t *testing.T) {
+	iss := newTestIssuer(t)
+	defer iss.Close()
+
+	iss.addKey(t, "old")
+	a := newAuthenticator(t, iss)
+
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	if _, err := a.keysFor("old"); err != nil {
+		t.Fatalf("expected the old key to be found, got: %s", err)
+	}
+
+	now = now.Add(2 * minRefresh)
+	iss.slow = make(chan struct{})
+
+	fetched := make(chan error)
+	go func() {
+		_, err := a.keysFor("new")
+		fetched <- err
+	}()
+
+	// known keys are found while the issuer takes its time
+	for {
+		a.mu.Lock()
+		fetching := a.fetching != nil
+		a.mu.Unlock()
+		if fetching {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	found := make(chan error)
+	go func() {
+		_, err := a.keysFor("old")
+		found <- err
+	}()
+
+	select {
+	case err := <-found:
+		if err != nil {
+			t.Errorf("expected the old key to be found, got: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the old key to be found while the key set is fetched")
+	}
+
+	close(iss.slow)
+	if err := <-fetched; err != auth.ErrBadCredentials {
+		t.Errorf("expected the new key to be unknown, got: %v", err)
+	}
+
+	if iss.jwksCalls != 2 {
+		t.Errorf("expected the key set to be fetched twice, got %d fetches", iss.jwksCalls)
+	}
+}
+
+func TestCustomClaims(t *testing.T) {
+	iss := newTestIssuer(t)
+	defer iss.Close()
+
+	key := iss.addKey(t, "test")
+
+	a, err := New(&config.OidcConfig{
+		Issuer:        iss.URL,
+		Audience:      testAudience,
+		UsernameClaim: "email",
+		GroupsClaim:   "roles",
+	})
+	if err != nil {
+		t.Fatalf("expected New() to succeed, got: %s", err)
+	}
+
+	token := sign(t, jose.RS256, key, "test", iss.claims(), map[string]interface{}{
+		"email": "admin@example.com",
+		"roles": "developers",
+	})
+
+	id, err := a.Authenticate(bearer(token))
+	if err != nil {
+		t.Fatalf("expected Authenticate() to succeed, got: %s", err)
+	}
+
+	if id.Name != "admin@example.com" || len(id.Groups) != 1 || id.Groups[0] != "developers" {
+		t.Errorf("expected custom claims to be mapped, got: %#v", id)
+	}
+}
@@ -0,0 +1,201 @@
+// Package webhook delegates authorization decisions to an external HTTP
+// service, typically the git hosting platform owning the repositories.
+//
+// For every decision the service receives a POST request with a JSON body
+//
+//	{"user": "...", "groups": [...], "namespace": "...", "repo": "...", "operation": "read|write"}
+//
+// and answers with 200 and {"allow": true|false}. 403 is taken as a denial,
+// anything else as a failure.
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ksurent/lfs-server-go/auth"
+	"github.com/ksurent/lfs-server-go/config"
+)
+
+// maxCached bounds the number of remembered decisions
+const maxCached = 10000
+
+var errNoURL = errors.New("webhook URL is not specified")
+
+type request struct {
+	User      string   `json:"user"`
+	Groups    []string `json:"groups,omitempty"`
+	Namespace string   `json:"namespace"`
+	Repo      string   `json:"repo"`
+	Operation string   `json:"operation"`
+}
+
+type response struct {
+	Allow bool `json:"allow"`
+}
+
+type decision struct {
+	allow   bool
+	expires time.Time
+}
+
+// Authorizer asks the configured endpoint and caches its decisions.
+type Authorizer struct {
+	url      string
+	token    string
+	retries  int
+	ttl      time.Duration
+	failOpen bool
+	client   *http.Client
+	now      func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]decision
+}
+
+func New(cfg *config.WebhookConfig) (*Authorizer, error) {
+	if cfg.URL == "" {
+		return nil, errNoURL
+	}
+
+	timeout, err := parseDuration(cfg.Timeout, 2*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("Timeout: %s", err)
+	}
+
+	ttl, err := parseDuration(cfg.CacheTTL, time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("CacheTTL: %s", err)
+	}
+
+	return &Authorizer{
+		url:      cfg.URL,
+		token:    cfg.Token,
+		retries:  cfg.Retries,
+		ttl:      ttl,
+		failOpen: cfg.FailOpen,
+		client:   &http.Client{Timeout: timeout},
+		now:      time.Now,
+		cache:    make(map[string]decision),
+	}, nil
+}
+
+// Authorize returns the endpoint's decision. If the endpoint can't be
+// reached the request is allowed when failing open, otherwise the error is
+// returned.
+func (a *Authorizer) Authorize(id *auth.Identity, namespace, repo string, op auth.Operation) (bool, error) {
+	if id == nil {
+		return false, nil
+	}
+
+	req := &request{
+		User:      id.Name,
+		Groups:    id.Groups,
+		Namespace: namespace,
+		Repo:      repo,
+		Operation: op.String(),
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+
+	// the request body identifies the decision unambiguously
+	key := string(body)
+
+	a.mu.Lock()
+	d, ok := a.cache[key]
+	a.mu.Unlock()
+
+	if ok && a.now().Before(d.expires) {
+		return d.allow, nil
+	}
+
+	allow, err := a.ask(body)
+	if err != nil {
+		if a.failOpen {
+			log.Println("Authorization webhook failed, allowing:", err)
+			return true, nil
+		}
+		return false, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.cache) >= maxCached {
+		a.expire()
+	}
+	a.cache[key] = decision{allow, a.now().Add(a.ttl)}
+
+	return allow, nil
+}
+
+func (a *Authorizer) ask(body []byte) (bool, error) {
+	for attempt := 0; ; attempt++ {
+		allow, err := a.post(body)
+		if err == nil || attempt >= a.retries {
+			return allow, err
+		}
+
+		time.Sleep(time.Duration(attempt+1) * 100 * time.Millisecond)
+	}
+}
+
+func (a *Authorizer) post(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", a.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		var r response
+		if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+			return false, fmt.Errorf("authorization webhook: %s", err)
+		}
+		return r.Allow, nil
+	case http.StatusForbidden:
+		return false, nil
+	default:
+		return false, fmt.Errorf("authorization webhook: %s", res.Status)
+	}
+}
+
+// expire drops stale decisions, or all of them if none are stale
+func (a *Authorizer) expire() {
+	now := a.now()
+	for key, d := range a.cache {
+		if now.After(d.expires) {
+			delete(a.cache, key)
+		}
+	}
+
+	if len(a.cache) >= maxCached {
+		a.cache = make(map[string]decision)
+	}
+}
+
+func parseDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,184 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ksurent/lfs-server-go/auth"
+	"github.com/ksurent/lfs-server-go/config"
+)
+
+var testIdentity = &auth.Identity{Name: "admin", Groups: []string{"developers"}}
+
+// testEndpoint allows writes to the developers namespace and reads anywhere
+type testEndpoint struct {
+	*httptest.Server
+	calls    int32
+	failures int32
+	last     request
+}
+
+func newTestEndpoint(t *testing.T) *testEndpoint {
+	e := &testEndpoint{}
+
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&e.calls, 1)
+
+		if atomic.LoadInt32(&e.failures) > 0 {
+			atomic.AddInt32(&e.failures, -1)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&e.last); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if e.last.Namespace == "forbidden" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		allow := e.last.Operation == "read" || e.last.Namespace == "developers"
+		json.NewEncoder(w).Encode(&response{Allow: allow})
+	}))
+
+	return e
+}
+
+func newTestAuthorizer(t *testing.T, url string, failOpen bool) *Authorizer {
+	a, err := New(&config.WebhookConfig{
+		URL:      url,
+		Token:    "secret",
+		Timeout:  "1s",
+		Retries:  1,
+		CacheTTL: "1m",
+		FailOpen: failOpen,
+	})
+	if err != nil {
+		t.Fatalf("expected New() to succeed, got: %s", err)
+	}
+
+	return a
+}
+
+func TestAuthorize(t *testing.T) {
+	e := newTestEndpoint(t)
+	defer e.Close()
+
+	a := newTestAuthorizer(t, e.URL, false)
+
+	for _, v := range []struct {
+		namespace string
+		op        auth.Operation
+		expected  bool
+	}{
+		{"developers", auth.Write, true},
+		{"others", auth.Read, true},
+		{"others", auth.Write, false},
+		{"forbidden", auth.Read, false},
+	} {
+		ok, err := a.Authorize(testIdentity, v.namespace, "repo", v.op)
+		if err != nil {
+			t.Fatalf("expected Authorize() to succeed, got: %s", err)
+		}
+
+		if ok != v.expected {
+			t.Errorf("expected %s on %s to be allowed: %v, got: %v", v.op, v.namespace, v.expected, ok)
+		}
+	}
+
+	if e.last.User != "admin" || len(e.last.Groups) != 1 || e.last.Repo != "repo" {
+		t.Errorf("expected the identity and repo to be sent, got: %#v", e.last)
+	}
+
+	if ok, _ := a.Authorize(nil, "developers", "repo", auth.Read); ok {
+		t.Error("expected anonymous requests to be denied")
+	}
+}
+
+func TestAuthorizeCache(t *testing.T) {
+	e := newTestEndpoint(t)
+	defer e.Close()
+
+	a := newTestAuthorizer(t, e.URL, false)
+
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	a.Authorize(testIdentity, "developers", "repo", auth.Write)
+	a.Authorize(testIdentity, "developers", "repo", auth.Write)
+	a.Authorize(testIdentity, "others", "repo", auth.Write)
+	a.Authorize(testIdentity, "others", "repo", auth.Write)
+
+	if calls := atomic.LoadInt32(&e.calls); calls != 2 {
+		t.Errorf("expected decisions to be cached, got %d calls", calls)
+	}
+
+	now = now.Add(2 * time.Minute)
+	a.Authorize(testIdentity, "developers", "repo", auth.Write)
+
+	if calls := atomic.LoadInt32(&e.calls); calls != 3 {
+		t.Errorf("expected expired decisions to be asked for again, got %d calls", calls)
+	}
+}
+
+func TestAuthorizeRetry(t *testing.T) {
+	e := newTestEndpoint(t)
+	defer e.Close()
+
+	a := newTestAuthorizer(t, e.URL, false)
+
+	e.failures = 1
+	if ok, err := a.Authorize(testIdentity, "developers", "repo", auth.Write); !ok || err != nil {
+		t.Errorf("expected a single failure to be retried, got: %v, %v", ok, err)
+	}
+
+	e.failures = 2
+	if _, err := a.Authorize(testIdentity, "others", "repo", auth.Read); err == nil {
+		t.Error("expected Authorize() to fail closed after running out of retries")
+	}
+
+	// failures are not cached
+	if ok, err := a.Authorize(testIdentity, "others", "repo", auth.Read); !ok || err != nil {
+		t.Errorf("expected the endpoint to be asked again, got: %v, %v", ok, err)
+	}
+}
+
+func TestAuthorizeFailOpen(t *testing.T) {
+	e := newTestEndpoint(t)
+	e.Close()
+
+	a := newTestAuthorizer(t, e.URL, true)
+
+	if ok, err := a.Authorize(testIdentity, "others", "repo", auth.Write); !ok || err != nil {
+		t.Errorf("expected Authorize() to fail open, got: %v, %v", ok, err)
+	}
+}
+
+func TestAuthorizeTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		json.NewEncoder(w).Encode(&response{Allow: true})
+	}))
+	defer slow.Close()
+
+	a, err := New(&config.WebhookConfig{URL: slow.URL, Timeout: "50ms"})
+	if err != nil {
+		t.Fatalf("expected New() to succeed, got: %s", err)
+	}
+
+	if _, err := a.Authorize(testIdentity, "developers", "repo", auth.Read); err == nil {
+		t.Error("expected a slow endpoint to time out")
+	}
+}
@@ -2,15 +2,31 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/ksurent/lfs-server-go/audit"
 	"github.com/ksurent/lfs-server-go/config"
 	"github.com/ksurent/lfs-server-go/content"
 	"github.com/ksurent/lfs-server-go/content/fs"
@@ -258,8 +274,6 @@ func TestPostUnauthed(t *testing.T) {
 }
 
 func TestPut(t *testing.T) {
-	// XXX this test is currently broken
-
 	req, err := http.NewRequest("PUT", lfsServer.URL+"/namespace/repo/objects/"+contentOid, nil)
 	if err != nil {
 		t.Fatalf("request error: %s", err)
@@ -328,6 +342,1654 @@ func TestMediaTypesParsed(t *testing.T) {
 	}
 }
 
+func TestAuthCacheDeletedUser(t *testing.T) {
+	cachedCfg := *cfg
+	cachedCfg.AuthCache = &config.AuthCacheConfig{Enabled: true, TTL: "1h", Size: 10}
+
+	app := NewApp(&cachedCfg, testContentStore, testMetaStore)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	if err := app.metaStore.AddUser("cached", "cached"); err != nil {
+		t.Fatalf("expected AddUser() to succeed, got: %s", err)
+	}
+
+	get := func() int {
+		req, err := http.NewRequest("GET", server.URL+"/namespace/repo/objects/"+contentOid, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth("cached", "cached")
+		req.Header.Set("Accept", contentMediaType)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	if status := get(); status != 200 {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+
+	if err := app.metaStore.DeleteUser("cached"); err != nil {
+		t.Fatalf("expected DeleteUser() to succeed, got: %s", err)
+	}
+
+	if status := get(); status != 401 {
+		t.Fatalf("expected status 401 for a deleted user, got %d", status)
+	}
+}
+
+func TestAuthenticatorChainFallback(t *testing.T) {
+	chainCfg := *cfg
+	chainCfg.Authenticators = "ldap, metastore"
+	// nothing listens there
+	chainCfg.Ldap = &config.LdapConfig{Enabled: true, Server: "ldap://127.0.0.1:1"}
+
+	server := httptest.NewServer(NewApp(&chainCfg, testContentStore, testMetaStore))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/namespace/repo/objects/"+contentOid, nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	req.SetBasicAuth(testUser, testPass)
+	req.Header.Set("Accept", contentMediaType)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Fatalf("expected the meta store to authenticate when LDAP is down, got status %d", res.StatusCode)
+	}
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	tokenCfg := *cfg
+	tokenCfg.Authenticators = "token"
+
+	server := httptest.NewServer(NewApp(&tokenCfg, testContentStore, testMetaStore))
+	defer server.Close()
+
+	if err := testMetaStore.AddUser("tokenuser", "password"); err != nil {
+		t.Fatalf("expected AddUser() to succeed, got: %s", err)
+	}
+	defer testMetaStore.DeleteUser("tokenuser")
+
+	token, secret, err := meta.NewToken("tokenuser", "ci")
+	if err != nil {
+		t.Fatalf("expected NewToken() to succeed, got: %s", err)
+	}
+	if err := testMetaStore.AddToken(token); err != nil {
+		t.Fatalf("expected AddToken() to succeed, got: %s", err)
+	}
+
+	objectPath := "/namespace/repo/objects/" + contentOid
+	get := func(path, user, pass string) int {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(user, pass)
+		req.Header.Set("Accept", contentMediaType)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	if status := get(objectPath, "tokenuser", secret); status != 200 {
+		t.Errorf("expected status 200 with a token, got %d", status)
+	}
+
+	if status := get(objectPath, "tokenuser", "password"); status != 401 {
+		t.Errorf("expected status 401 with a password, got %d", status)
+	}
+
+	if status := get(objectPath, testUser, secret); status != 401 {
+		t.Errorf("expected status 401 with the token of another user, got %d", status)
+	}
+
+	if status := get("/admin/usage", "tokenuser", secret); status != 403 {
+		t.Errorf("expected status 403 for the admin API without the admin role, got %d", status)
+	}
+
+	if err := testMetaStore.SetRole("tokenuser", meta.RoleAdmin); err != nil {
+		t.Fatalf("expected SetRole() to succeed, got: %s", err)
+	}
+
+	// the token vouches for the meta store user, so its role counts
+	if status := get("/admin/usage", "tokenuser", secret); status != 200 {
+		t.Errorf("expected status 200 for the admin API with the admin role, got %d", status)
+	}
+
+	if status := get("/user", "tokenuser", secret); status != 200 {
+		t.Errorf("expected status 200 for the account with a token, got %d", status)
+	}
+
+	disabled := true
+	if err := testMetaStore.UpdateUser("tokenuser", &meta.UserUpdate{Disabled: &disabled}); err != nil {
+		t.Fatalf("expected UpdateUser() to succeed, got: %s", err)
+	}
+
+	if status := get(objectPath, "tokenuser", secret); status != 401 {
+		t.Errorf("expected status 401 for a disabled user, got %d", status)
+	}
+
+	disabled = false
+	if err := testMetaStore.UpdateUser("tokenuser", &meta.UserUpdate{Disabled: &disabled}); err != nil {
+		t.Fatalf("expected UpdateUser() to succeed, got: %s", err)
+	}
+
+	if err := testMetaStore.RevokeToken(token.ID); err != nil {
+		t.Fatalf("expected RevokeToken() to succeed, got: %s", err)
+	}
+
+	if status := get(objectPath, "tokenuser", secret); status != 401 {
+		t.Errorf("expected status 401 with a revoked token, got %d", status)
+	}
+}
+
+func TestNamespaceAuthorizer(t *testing.T) {
+	authzCfg := *cfg
+	authzCfg.Authorizer = "namespace"
+
+	server := httptest.NewServer(NewApp(&authzCfg, testContentStore, testMetaStore))
+	defer server.Close()
+
+	linkTestObject(t, testUser, "adminrepo")
+
+	for _, v := range []struct {
+		namespace, repo string
+		expected        int
+	}{
+		{"namespace", testRepo, 403},
+		{testUser, "adminrepo", 200},
+	} {
+		req, err := http.NewRequest("GET", server.URL+"/"+v.namespace+"/"+v.repo+"/objects/"+contentOid, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Accept", contentMediaType)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != v.expected {
+			t.Errorf("expected status %d for namespace %q, got %d", v.expected, v.namespace, res.StatusCode)
+		}
+	}
+}
+
+func TestProjectNamespace(t *testing.T) {
+	authzCfg := *cfg
+	authzCfg.Authorizer = "namespace"
+
+	server := httptest.NewServer(NewApp(&authzCfg, testContentStore, testMetaStore))
+	defer server.Close()
+
+	if err := testMetaStore.AddProject(&meta.Project{Name: "secret", Namespace: "otherteam"}); err != nil && err != meta.ErrProjectExists {
+		t.Fatalf("expected AddProject() to succeed, got: %s", err)
+	}
+
+	// stored before namespaces were
+	if err := testMetaStore.AddProject(&meta.Project{Name: "legacy"}); err != nil && err != meta.ErrProjectExists {
+		t.Fatalf("expected AddProject() to succeed, got: %s", err)
+	}
+	linkTestObject(t, "", "legacy")
+
+	oid := strings.Repeat("5", 64)
+	upload := `{"operation":"upload","objects":[{"oid":"` + oid + `","size":1234}]}`
+
+	for _, v := range []struct {
+		method, path, accept, body string
+		expected                   int
+	}{
+		// a namespace the user may access doesn't open other projects
+		{"POST", "/" + testUser + "/secret/objects/batch", metaMediaType, upload, 404},
+		{"GET", "/" + testUser + "/secret/objects/" + contentOid, contentMediaType, "", 404},
+		{"POST", "/otherteam/secret/objects/batch", metaMediaType, upload, 403},
+		// projects without a namespace can't be reached from any
+		{"GET", "/" + testUser + "/legacy/objects/" + contentOid, contentMediaType, "", 404},
+		{"POST", "/" + testUser + "/legacy/objects/batch", metaMediaType, upload, 404},
+	} {
+		req, err := http.NewRequest(v.method, server.URL+v.path, bytes.NewBufferString(v.body))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Accept", v.accept)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != v.expected {
+			t.Errorf("expected status %d for %s %s, got %d", v.expected, v.method, v.path, res.StatusCode)
+		}
+	}
+
+	if _, err := testMetaStore.GetPending(&meta.RequestVars{Oid: oid}); !meta.IsObjectNotFound(err) {
+		t.Errorf("expected no object to be created, got: %v", err)
+	}
+}
+
+func TestWebhookAuthorizer(t *testing.T) {
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Namespace string `json:"namespace"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		switch req.Namespace {
+		case "allowed":
+			fmt.Fprint(w, `{"allow": true}`)
+		case "broken":
+			w.WriteHeader(500)
+		default:
+			fmt.Fprint(w, `{"allow": false}`)
+		}
+	}))
+	defer hook.Close()
+
+	authzCfg := *cfg
+	authzCfg.Authorizer = "webhook"
+	authzCfg.Webhook = &config.WebhookConfig{URL: hook.URL, Timeout: "1s", CacheTTL: "1m"}
+
+	server := httptest.NewServer(NewApp(&authzCfg, testContentStore, testMetaStore))
+	defer server.Close()
+
+	for _, v := range []struct {
+		namespace string
+		expected  int
+	}{
+		{"allowed", 200},
+		{"denied", 403},
+		{"broken", 500},
+	} {
+		linkTestObject(t, v.namespace, v.namespace+"repo")
+
+		req, err := http.NewRequest("GET", server.URL+"/"+v.namespace+"/"+v.namespace+"repo/objects/"+contentOid, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(testUser, testPass)
+		req.Header.Set("Accept", contentMediaType)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != v.expected {
+			t.Errorf("expected status %d for namespace %q, got %d", v.expected, v.namespace, res.StatusCode)
+		}
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lfs-server-go-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := newTestCert(t, nil, nil, "test-ca", dir, "ca")
+	newTestCert(t, ca, caKey, "127.0.0.1", dir, "server")
+	client, clientKey := newTestCert(t, ca, caKey, testUser, dir, "client")
+
+	tlsCfg := *cfg
+	tlsCfg.Cert = dir + "/server.crt"
+	tlsCfg.Key = dir + "/server.key"
+	tlsCfg.ClientCA = dir + "/ca.crt"
+	tlsCfg.Authenticators = "cert, metastore"
+
+	app := NewApp(&tlsCfg, testContentStore, testMetaStore)
+
+	server := httptest.NewUnstartedServer(app)
+	server.TLS, err = app.newTLSConfig()
+	if err != nil {
+		t.Fatalf("expected newTLSConfig() to succeed, got: %s", err)
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	get := func(certs []tls.Certificate) int {
+		c := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		}}
+
+		req, err := http.NewRequest("GET", server.URL+"/namespace/repo/objects/"+contentOid, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.Header.Set("Accept", contentMediaType)
+
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	if status := get(nil); status != 401 {
+		t.Errorf("expected status 401 without a client certificate, got %d", status)
+	}
+
+	pair := tls.Certificate{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}
+	if status := get([]tls.Certificate{pair}); status != 200 {
+		t.Errorf("expected status 200 with a client certificate, got %d", status)
+	}
+}
+
+// newTestCert creates a certificate signed by parent, or a self signed CA if
+// parent is nil, and writes it to dir/name.crt and dir/name.key.
+func newTestCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, cn, dir, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	} else if ip := net.ParseIP(cn); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for file, block := range map[string]*pem.Block{
+		name + ".crt": {Type: "CERTIFICATE", Bytes: der},
+		name + ".key": {Type: "EC PRIVATE KEY", Bytes: keyDer},
+	} {
+		if err := ioutil.WriteFile(dir+"/"+file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+func TestPublicRead(t *testing.T) {
+	publicCfg := *cfg
+	publicCfg.PublicRead = "opensource/*"
+
+	server := httptest.NewServer(NewApp(&publicCfg, testContentStore, testMetaStore))
+	defer server.Close()
+
+	linkTestObject(t, "opensource", "openrepo")
+
+	batch := func(operation string) string {
+		return `{"operation":"` + operation + `","objects":[{"oid":"` + contentOid + `","size":` + fmt.Sprint(contentSize) + `}]}`
+	}
+
+	for _, v := range []struct {
+		method, path, accept, body string
+		expected                   int
+	}{
+		{"GET", "/opensource/openrepo/objects/" + contentOid, contentMediaType, "", 200},
+		{"GET", "/opensource/openrepo/objects/" + contentOid, metaMediaType, "", 200},
+		{"POST", "/opensource/openrepo/objects/batch", metaMediaType, batch("download"), 200},
+		{"POST", "/opensource/openrepo/objects/batch", metaMediaType, batch("upload"), 401},
+		{"POST", "/opensource/openrepo/objects", metaMediaType, batch("upload"), 401},
+		{"PUT", "/opensource/openrepo/objects/" + contentOid, contentMediaType, contentStr, 401},
+		{"POST", "/opensource/openrepo/verify", contentMediaType, "", 401},
+		{"GET", "/namespace/repo/objects/" + contentOid, contentMediaType, "", 401},
+		{"POST", "/namespace/repo/objects/batch", metaMediaType, batch("download"), 401},
+		// the pattern doesn't open projects of other namespaces
+		{"GET", "/opensource/repo/objects/" + contentOid, contentMediaType, "", 404},
+		// anonymous users aren't told where private projects are
+		{"GET", "/elsewhere/repo/objects/" + contentOid, contentMediaType, "", 401},
+		{"POST", "/elsewhere/repo/objects/batch", metaMediaType, batch("upload"), 401},
+	} {
+		req, err := http.NewRequest(v.method, server.URL+v.path, bytes.NewBufferString(v.body))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.Header.Set("Accept", v.accept)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != v.expected {
+			t.Errorf("expected status %d for anonymous %s %s, got %d", v.expected, v.method, v.path, res.StatusCode)
+		}
+	}
+}
+
+func TestProjectSettings(t *testing.T) {
+	strictCfg := *cfg
+	strictCfg.StrictProjects = true
+
+	server := httptest.NewServer(NewApp(&strictCfg, testContentStore, testMetaStore))
+	defer server.Close()
+
+	for _, project := range []*meta.Project{
+		{Name: "publicrepo", Namespace: "namespace", Visibility: meta.VisibilityPublic},
+		{Name: "limitedrepo", Namespace: "namespace", MaxObjectSize: 10},
+	} {
+		if err := testMetaStore.AddProject(project); err != nil && err != meta.ErrProjectExists {
+			t.Fatalf("expected AddProject() to succeed, got: %s", err)
+		}
+	}
+
+	do := func(method, path, accept, body string, authed bool) (int, []byte) {
+		req, err := http.NewRequest(method, server.URL+path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.Header.Set("Accept", accept)
+		if authed {
+			req.SetBasicAuth(testUser, testPass)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		defer res.Body.Close()
+
+		by, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, by
+	}
+
+	upload := `{"operation":"upload","objects":[{"oid":"` + nonexistingOid + `","size":1234}]}`
+	post := `{"oid":"` + nonexistingOid + `","size":1234}`
+
+	for _, v := range []struct {
+		method, path, accept, body string
+		authed                     bool
+		expected                   int
+	}{
+		{"GET", "/namespace/publicrepo/objects/" + contentOid, contentMediaType, "", false, 404},
+		{"GET", "/namespace/publicrepo/objects/" + contentOid, metaMediaType, "", false, 404},
+		{"GET", "/namespace/limitedrepo/objects/" + contentOid, contentMediaType, "", false, 401},
+		{"POST", "/namespace/typo/objects/batch", metaMediaType, upload, true, 404},
+		{"POST", "/namespace/typo/objects", metaMediaType, post, true, 404},
+		{"POST", "/namespace/limitedrepo/objects", metaMediaType, post, true, 422},
+	} {
+		status, body := do(v.method, v.path, v.accept, v.body, v.authed)
+		if status != v.expected {
+			t.Errorf("expected status %d for %s %s, got %d: %s", v.expected, v.method, v.path, status, body)
+		}
+	}
+
+	status, body := do("POST", "/namespace/limitedrepo/objects/batch", metaMediaType, upload, true)
+	if status != 200 {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+
+	var res struct {
+		Objects []*Representation `json:"objects"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		t.Fatalf("expected a batch response, got: %s", body)
+	}
+
+	if len(res.Objects) != 1 || res.Objects[0].Error == nil || res.Objects[0].Error.Code != 422 {
+		t.Errorf("expected the object to be refused, got: %s", body)
+	}
+
+	if _, err := testMetaStore.GetProject("typo"); err != meta.ErrProjectNotFound {
+		t.Errorf("expected no project to be created, got: %v", err)
+	}
+
+	// a public project doesn't serve the objects of other projects
+	download := `{"operation":"download","objects":[{"oid":"` + contentOid + `","size":` + fmt.Sprint(contentSize) + `}]}`
+	status, body = do("POST", "/namespace/publicrepo/objects/batch", metaMediaType, download, false)
+	if status != 200 {
+		t.Fatalf("expected status 200, got %d: %s", status, body)
+	}
+
+	res.Objects = nil
+	if err := json.Unmarshal(body, &res); err != nil {
+		t.Fatalf("expected a batch response, got: %s", body)
+	}
+	if len(res.Objects) != 0 {
+		t.Errorf("expected the object of another project to be left out, got: %s", body)
+	}
+}
+
+func TestMount(t *testing.T) {
+	authzCfg := *cfg
+	authzCfg.Authorizer = "namespace"
+
+	// an object only in a project of another namespace, which the
+	// namespace authorizer doesn't let the user read
+	mountStr := "content to mount"
+	sum := sha256.Sum256([]byte(mountStr))
+	mountOid := hex.EncodeToString(sum[:])
+
+	rv := &meta.RequestVars{Oid: mountOid, Size: int64(len(mountStr)), Namespace: "theirs", Repo: "upstream"}
+	if _, err := testMetaStore.Put(rv); err != nil {
+		t.Fatalf("expected Put() to succeed, got: %s", err)
+	}
+	if _, err := testMetaStore.Commit(rv); err != nil {
+		t.Fatalf("expected Commit() to succeed, got: %s", err)
+	}
+	if err := testContentStore.Put(&meta.Object{Oid: mountOid, Size: rv.Size}, strings.NewReader(mountStr)); err != nil {
+		t.Fatalf("expected the content to be stored, got: %s", err)
+	}
+
+	for _, v := range []struct {
+		server *httptest.Server
+		path   string
+	}{
+		{lfsServer, "/namespace/forked"},
+		{httptest.NewServer(NewApp(&authzCfg, testContentStore, testMetaStore)), "/" + testUser + "/proved"},
+	} {
+		do := func(method, path, accept, body string) (int, []byte) {
+			req, err := http.NewRequest(method, v.server.URL+path, bytes.NewBufferString(body))
+			if err != nil {
+				t.Fatalf("request error: %s", err)
+			}
+			req.SetBasicAuth(testUser, testPass)
+			req.Header.Set("Accept", accept)
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("response error: %s", err)
+			}
+			defer res.Body.Close()
+
+			by, _ := ioutil.ReadAll(res.Body)
+			return res.StatusCode, by
+		}
+
+		upload := `{"operation":"upload","objects":[{"oid":"` + mountOid + `","size":` + fmt.Sprint(len(mountStr)) + `}]}`
+		status, body := do("POST", v.path+"/objects/batch", metaMediaType, upload)
+		if status != 200 {
+			t.Fatalf("expected status 200 for %s, got %d: %s", v.path, status, body)
+		}
+
+		var res struct {
+			Objects []*Representation `json:"objects"`
+		}
+		if err := json.Unmarshal(body, &res); err != nil || len(res.Objects) != 1 {
+			t.Fatalf("expected a batch response, got: %s", body)
+		}
+
+		mounted := v.server == lfsServer
+		if _, upload := res.Objects[0].Links["upload"]; upload == mounted {
+			t.Errorf("expected an upload link for %s only if the object can't be mounted, got: %s", v.path, body)
+		}
+
+		if !mounted {
+			if status, body := do("PUT", v.path+"/objects/"+mountOid, contentMediaType, "other content"); status != 422 {
+				t.Errorf("expected other content to be refused, got %d: %s", status, body)
+			}
+			if status, body := do("PUT", v.path+"/objects/"+mountOid, contentMediaType, mountStr); status != 200 {
+				t.Errorf("expected the content to be accepted, got %d: %s", status, body)
+			}
+			v.server.Close()
+		}
+
+		m, err := testMetaStore.Get(&meta.RequestVars{Oid: mountOid})
+		if err != nil {
+			t.Fatalf("expected Get() to succeed, got: %s", err)
+		}
+
+		project := strings.Split(v.path, "/")[2]
+		found := false
+		for _, name := range m.ProjectNames {
+			found = found || name == project
+		}
+		if !found {
+			t.Errorf("expected the object to be linked to %s, got: %v", project, m.ProjectNames)
+		}
+	}
+}
+
+func TestProxyAuth(t *testing.T) {
+	proxyCfg := *cfg
+	proxyCfg.Authenticators = "proxy"
+	proxyCfg.Authorizer = "namespace"
+	proxyCfg.Proxy = &config.ProxyConfig{UserHeader: "X-Forwarded-User", TrustedProxies: "127.0.0.1"}
+
+	server := httptest.NewServer(NewApp(&proxyCfg, testContentStore, testMetaStore))
+	defer server.Close()
+
+	for _, v := range []struct {
+		user     string
+		expected int
+	}{
+		{"", 401},
+		{"somebody", 403},
+		{"namespace", 200},
+	} {
+		req, err := http.NewRequest("GET", server.URL+"/namespace/repo/objects/"+contentOid, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.Header.Set("Accept", contentMediaType)
+		if v.user != "" {
+			req.Header.Set("X-Forwarded-User", v.user)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != v.expected {
+			t.Errorf("expected status %d for user %q, got %d", v.expected, v.user, res.StatusCode)
+		}
+	}
+}
+
+func TestLockout(t *testing.T) {
+	lockoutCfg := *cfg
+	lockoutCfg.Admins = testUser
+	lockoutCfg.Lockout = &config.LockoutConfig{Enabled: true, Threshold: 2, Backoff: "1m", MaxBackoff: "1h", Window: "1h"}
+
+	app := NewApp(&lockoutCfg, testContentStore, testMetaStore)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	if err := testMetaStore.AddUser("victim", "victim"); err != nil {
+		t.Fatalf("expected AddUser() to succeed, got: %s", err)
+	}
+	defer testMetaStore.DeleteUser("victim")
+
+	do := func(method, path, user, pass string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(user, pass)
+		req.Header.Set("Accept", contentMediaType)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+
+		return res
+	}
+
+	get := func(pass string) *http.Response {
+		return do("GET", "/namespace/repo/objects/"+contentOid, "victim", pass)
+	}
+
+	for i := 0; i < 2; i++ {
+		if res := get("wrong"); res.StatusCode != 401 {
+			t.Fatalf("expected status 401 for a wrong password, got %d", res.StatusCode)
+		}
+	}
+
+	res := get("victim")
+	if res.StatusCode != 429 {
+		t.Fatalf("expected status 429 for a locked out user, got %d", res.StatusCode)
+	}
+	if retry := res.Header.Get("Retry-After"); retry != "60" {
+		t.Errorf("expected Retry-After to be 60, got %q", retry)
+	}
+
+	// the admin shares the address with the victim
+	app.lockout.Unlock("127.0.0.1")
+
+	if res := do("DELETE", "/admin/lockouts/victim", "victim", "victim"); res.StatusCode != 429 {
+		t.Errorf("expected the locked out user to not unlock themselves, got %d", res.StatusCode)
+	}
+	if res := do("DELETE", "/admin/lockouts/victim", testUser, testPass); res.StatusCode != 204 {
+		t.Fatalf("expected status 204 for an admin unlock, got %d", res.StatusCode)
+	}
+
+	if res := get("victim"); res.StatusCode != 200 {
+		t.Errorf("expected status 200 after the unlock, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminBootstrap(t *testing.T) {
+	adminCfg := *cfg
+	adminCfg.AdminUser = "boss"
+	adminCfg.AdminPass = "boss"
+
+	server := httptest.NewServer(NewApp(&adminCfg, testContentStore, testMetaStore))
+	defer server.Close()
+	defer testMetaStore.DeleteUser("boss")
+
+	user, err := testMetaStore.GetUser("boss")
+	if err != nil {
+		t.Fatalf("expected the admin user to be created, got: %s", err)
+	}
+	if !user.IsAdmin() {
+		t.Errorf("expected the admin user to have the admin role, got: %s", user.Role)
+	}
+
+	for _, v := range []struct {
+		user, pass string
+		expected   int
+	}{
+		{testUser, testPass, 403},
+		{"boss", "boss", 404},
+	} {
+		req, err := http.NewRequest("DELETE", server.URL+"/admin/lockouts/nobody", nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(v.user, v.pass)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != v.expected {
+			t.Errorf("expected status %d for %s, got %d", v.expected, v.user, res.StatusCode)
+		}
+	}
+}
+
+func TestAdminSource(t *testing.T) {
+	adminCfg := *cfg
+	adminCfg.AdminUser = "boss"
+	adminCfg.AdminPass = "boss"
+	adminCfg.Authenticators = "proxy"
+	adminCfg.Proxy = &config.ProxyConfig{UserHeader: "X-Forwarded-User", TrustedProxies: "127.0.0.1"}
+	defer testMetaStore.DeleteUser("boss")
+
+	for _, v := range []struct {
+		admins   string
+		expected int
+	}{
+		// the proxy may name any user, the meta store role doesn't count
+		{"", 403},
+		{"boss", 200},
+	} {
+		adminCfg.Admins = v.admins
+
+		server := httptest.NewServer(NewApp(&adminCfg, testContentStore, testMetaStore))
+
+		req, err := http.NewRequest("GET", server.URL+"/admin/usage", nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.Header.Set("X-Forwarded-User", "boss")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+		server.Close()
+
+		if res.StatusCode != v.expected {
+			t.Errorf("expected status %d with admins %q, got %d", v.expected, v.admins, res.StatusCode)
+		}
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	adminCfg := *cfg
+	adminCfg.AdminUser = "boss"
+	adminCfg.AdminPass = "boss"
+
+	server := httptest.NewServer(NewApp(&adminCfg, testContentStore, testMetaStore))
+	defer server.Close()
+	defer testMetaStore.DeleteUser("boss")
+	defer testMetaStore.DeleteUser("newbie")
+
+	do := func(method, path, body string) (int, []byte) {
+		req, err := http.NewRequest(method, server.URL+path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth("boss", "boss")
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		defer res.Body.Close()
+
+		by, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+
+		return res.StatusCode, by
+	}
+
+	for _, v := range []struct {
+		method, path, body string
+		expected           int
+	}{
+		{"POST", "/admin/users", `{"name": "newbie", "password": "secret"}`, 201},
+		{"POST", "/admin/users", `{"name": "newbie", "password": "secret"}`, 409},
+		{"POST", "/admin/users", `{"name": "nopass"}`, 400},
+		{"POST", "/admin/users", `{"name": "x", "password": "x", "role": "root"}`, 400},
+		{"GET", "/admin/users/newbie", "", 200},
+		{"PUT", "/admin/users/newbie/role", `{"role": "admin"}`, 200},
+		{"PUT", "/admin/users/nobody/role", `{"role": "admin"}`, 404},
+		{"GET", "/admin/users", "", 200},
+		{"DELETE", "/admin/users/newbie", "", 204},
+		{"DELETE", "/admin/users/newbie", "", 404},
+		{"GET", "/admin/projects", "", 200},
+		{"GET", "/admin/projects/" + testRepo, "", 200},
+		{"GET", "/admin/projects/nonexisting", "", 404},
+		{"POST", "/admin/projects", `{"name": "nonamespace"}`, 400},
+		{"POST", "/admin/projects", `{"name": "disposable", "namespace": "team"}`, 201},
+		{"PUT", "/admin/projects/disposable", `{"visibility": "secret"}`, 400},
+		{"PUT", "/admin/projects/disposable", `{"max_object_size": -1}`, 400},
+		{"PUT", "/admin/projects/nonexisting", `{"description": "x"}`, 404},
+		{"DELETE", "/admin/projects/" + testRepo, "", 409},
+		{"DELETE", "/admin/projects/nonexisting", "", 404},
+		{"GET", "/admin/objects", "", 200},
+		{"GET", "/admin/objects/" + contentOid, "", 200},
+		{"GET", "/admin/objects/unknown", "", 404},
+	} {
+		status, body := do(v.method, v.path, v.body)
+		if status != v.expected {
+			t.Errorf("expected status %d for %s %s, got %d: %s", v.expected, v.method, v.path, status, body)
+		}
+	}
+
+	status, body := do("GET", "/admin/objects/"+contentOid, "")
+	if status != 200 {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+
+	var object struct {
+		Oid     string `json:"oid"`
+		Size    int64  `json:"size"`
+		Pending bool   `json:"pending"`
+	}
+	if err := json.Unmarshal(body, &object); err != nil {
+		t.Fatalf("expected a JSON object, got: %s", body)
+	}
+	if object.Oid != contentOid || object.Size != contentSize || object.Pending {
+		t.Errorf("unexpected object: %#v", object)
+	}
+
+	status, body = do("PUT", "/admin/projects/disposable", `{"visibility": "public", "max_object_size": 10}`)
+	var project meta.Project
+	if err := json.Unmarshal(body, &project); status != 200 || err != nil {
+		t.Fatalf("expected the updated project, got %d: %s", status, body)
+	}
+	if !project.IsPublic() || project.MaxObjectSize != 10 || project.Description != "" {
+		t.Errorf("expected only the given settings to change, got: %+v", project)
+	}
+
+	if status, body := do("DELETE", "/admin/projects/disposable", ""); status != 204 {
+		t.Errorf("expected the empty project to be deleted, got %d: %s", status, body)
+	}
+	if _, err := testMetaStore.GetProject("disposable"); err != meta.ErrProjectNotFound {
+		t.Errorf("expected the project to be gone, got: %v", err)
+	}
+
+	status, body = do("POST", "/admin/users", "{")
+	var e struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &e); status != 400 || err != nil || e.Message == "" {
+		t.Errorf("expected a JSON error message, got %d: %s", status, body)
+	}
+
+	// what another site can make a logged in admin's browser send
+	for _, v := range []struct {
+		contentType, origin string
+		expected            int
+	}{
+		{"text/plain", "", 415},
+		{"application/x-www-form-urlencoded", server.URL, 415},
+		{"application/json", "http://evil.example.com", 403},
+	} {
+		req, err := http.NewRequest("POST", server.URL+"/admin/users", strings.NewReader(`{"name": "forged", "password": "secret", "role": "admin"}`))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth("boss", "boss")
+		req.Header.Set("Content-Type", v.contentType)
+		if v.origin != "" {
+			req.Header.Set("Origin", v.origin)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != v.expected {
+			t.Errorf("expected status %d for %s from %q, got %d", v.expected, v.contentType, v.origin, res.StatusCode)
+		}
+	}
+
+	if _, err := testMetaStore.GetUser("forged"); err != meta.ErrUserNotFound {
+		t.Errorf("expected no user to be created, got: %v", err)
+	}
+}
+
+func TestMoveProject(t *testing.T) {
+	adminCfg := *cfg
+	adminCfg.AdminUser = "boss"
+	adminCfg.AdminPass = "boss"
+
+	server := httptest.NewServer(NewApp(&adminCfg, testContentStore, testMetaStore))
+	defer server.Close()
+	defer testMetaStore.DeleteUser("boss")
+
+	do := func(method, path, body, accept string) (int, []byte) {
+		req, err := http.NewRequest(method, server.URL+path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth("boss", "boss")
+		req.Header.Set("Accept", accept)
+		req.Header.Set("Content-Type", accept)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		defer res.Body.Close()
+
+		by, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+
+		return res.StatusCode, by
+	}
+
+	for _, v := range []struct {
+		method, path, body string
+		expected           int
+	}{
+		{"POST", "/admin/projects", `{"name": "movable", "namespace": "team"}`, 201},
+		{"POST", "/admin/projects/nonexisting/move", `{"name": "x"}`, 404},
+		{"POST", "/admin/projects/movable/move", `{"name": "` + testRepo + `"}`, 409},
+		{"POST", "/admin/projects/movable/move", `{"name": "a/b"}`, 400},
+		{"POST", "/admin/projects/movable/move", `{"name": "moved", "namespace": "newteam", "alias": true}`, 200},
+		{"GET", "/admin/projects/movable", "", 404},
+		{"GET", "/admin/projects/moved", "", 200},
+		{"POST", "/admin/projects", `{"name": "movable", "namespace": "team"}`, 409},
+	} {
+		status, body := do(v.method, v.path, v.body, "application/json")
+		if status != v.expected {
+			t.Errorf("expected status %d for %s %s, got %d: %s", v.expected, v.method, v.path, status, body)
+		}
+	}
+
+	// the project has to hold the object to serve it
+	upload := `{"operation":"upload","objects":[{"oid":"` + contentOid + `","size":` + fmt.Sprint(contentSize) + `}]}`
+	if status, body := do("POST", "/newteam/moved/objects/batch", upload, metaMediaType); status != 200 {
+		t.Fatalf("expected the object to be linked, got %d: %s", status, body)
+	}
+
+	status, body := do("GET", "/team/movable/objects/"+contentOid, "", metaMediaType)
+	if status != 200 {
+		t.Fatalf("expected the old path to keep working, got %d: %s", status, body)
+	}
+
+	var rep Representation
+	if err := json.Unmarshal(body, &rep); err != nil {
+		t.Fatalf("expected a representation, got: %s", body)
+	}
+	if href := rep.Links["download"].Href; !strings.Contains(href, "/newteam/moved/objects/") {
+		t.Errorf("expected links to the new location, got: %s", href)
+	}
+}
+
+func TestProjectPermissions(t *testing.T) {
+	adminCfg := *cfg
+	adminCfg.Authorizer = "namespace"
+	adminCfg.AdminUser = "boss"
+	adminCfg.AdminPass = "boss"
+
+	server := httptest.NewServer(NewApp(&adminCfg, testContentStore, testMetaStore))
+	defer server.Close()
+	defer testMetaStore.DeleteUser("boss")
+
+	do := func(user, pass, method, path, body, accept string) (int, []byte) {
+		req, err := http.NewRequest(method, server.URL+path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(user, pass)
+		req.Header.Set("Accept", accept)
+		req.Header.Set("Content-Type", accept)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		defer res.Body.Close()
+
+		by, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+
+		return res.StatusCode, by
+	}
+
+	if status, body := do("boss", "boss", "POST", "/admin/projects", `{"name": "granted", "namespace": "team"}`, "application/json"); status != 201 {
+		t.Fatalf("expected the project to be created, got %d: %s", status, body)
+	}
+	linkTestObject(t, "team", "granted")
+
+	oid := strings.Repeat("6", 64)
+	upload := `{"operation":"upload","objects":[{"oid":"` + oid + `","size":1234}]}`
+	permission := "/admin/projects/granted/permissions/" + testUser
+
+	for _, v := range []struct {
+		user, method, path, body, accept string
+		expected                         int
+	}{
+		// the namespace authorizer keeps the user out of the team
+		{testUser, "GET", "/team/granted/objects/" + contentOid, "", contentMediaType, 403},
+		{"boss", "PUT", permission, `{"access": "owner"}`, "application/json", 400},
+		{"boss", "PUT", "/admin/projects/nonexisting/permissions/" + testUser, `{"access": "read"}`, "application/json", 404},
+		{"boss", "PUT", permission, `{"access": "read"}`, "application/json", 200},
+		{testUser, "GET", "/team/granted/objects/" + contentOid, "", contentMediaType, 200},
+		{testUser, "POST", "/team/granted/objects/batch", upload, metaMediaType, 403},
+		{"boss", "PUT", permission, `{"access": "write"}`, "application/json", 200},
+		{testUser, "POST", "/team/granted/objects/batch", upload, metaMediaType, 200},
+		// a permission doesn't open the other projects of the namespace
+		{testUser, "GET", "/team/" + testRepo + "/objects/" + contentOid, "", contentMediaType, 404},
+		{"boss", "DELETE", permission, "", "application/json", 204},
+		{"boss", "DELETE", permission, "", "application/json", 404},
+		{testUser, "GET", "/team/granted/objects/" + contentOid, "", contentMediaType, 403},
+		{"boss", "GET", "/admin/projects/nonexisting/permissions", "", "application/json", 404},
+	} {
+		pass := testPass
+		if v.user == "boss" {
+			pass = "boss"
+		}
+
+		status, body := do(v.user, pass, v.method, v.path, v.body, v.accept)
+		if status != v.expected {
+			t.Errorf("expected status %d for %s %s, got %d: %s", v.expected, v.method, v.path, status, body)
+		}
+	}
+
+	if status, body := do("boss", "boss", "PUT", "/admin/projects/granted/permissions/carol", `{"access": "read"}`, "application/json"); status != 200 {
+		t.Fatalf("expected the permission to be set, got %d: %s", status, body)
+	}
+
+	status, body := do("boss", "boss", "GET", "/admin/projects/granted/permissions", "", "application/json")
+	var permissions []*meta.Permission
+	if err := json.Unmarshal(body, &permissions); status != 200 || err != nil {
+		t.Fatalf("expected a list of permissions, got %d: %s", status, body)
+	}
+	if len(permissions) != 1 || permissions[0].User != "carol" || permissions[0].Access != meta.AccessRead {
+		t.Errorf("expected read access for carol, got: %s", body)
+	}
+}
+
+func TestAccount(t *testing.T) {
+	accountCfg := *cfg
+	accountCfg.AdminUser = "boss"
+	accountCfg.AdminPass = "boss"
+	accountCfg.Password = &config.PasswordConfig{MinLength: 8, MinClasses: 2}
+
+	server := httptest.NewServer(NewApp(&accountCfg, testContentStore, testMetaStore))
+	defer server.Close()
+	defer testMetaStore.DeleteUser("boss")
+	defer testMetaStore.DeleteUser("member")
+
+	if err := testMetaStore.AddUser("member", "first-pass"); err != nil {
+		t.Fatalf("expected AddUser() to succeed, got: %s", err)
+	}
+
+	do := func(method, path, user, pass, body string) (int, []byte) {
+		req, err := http.NewRequest(method, server.URL+path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(user, pass)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		defer res.Body.Close()
+
+		by, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+
+		return res.StatusCode, by
+	}
+
+	for _, v := range []struct {
+		method, path, user, pass, body string
+		expected                       int
+	}{
+		{"GET", "/user", "member", "wrong", "", 401},
+		{"PUT", "/user", "member", "first-pass", `{"display_name": "Member"}`, 200},
+		{"PUT", "/user/password", "member", "first-pass", `{"current_password": "wrong", "password": "second-pass"}`, 403},
+		{"PUT", "/user/password", "member", "first-pass", `{"current_password": "first-pass", "password": "short"}`, 400},
+		{"PUT", "/user/password", "member", "first-pass", `{"current_password": "first-pass", "password": "second-pass"}`, 204},
+		{"GET", "/user", "member", "first-pass", "", 401},
+		{"GET", "/admin/users", "member", "second-pass", "", 403},
+		{"PUT", "/admin/users/member", "boss", "boss", `{"password": "weakpassword"}`, 400},
+		{"PUT", "/admin/users/nobody", "boss", "boss", `{"password": "third-pass"}`, 404},
+		{"PUT", "/admin/users/member", "boss", "boss", `{"password": "third-pass", "email": "member@example.com"}`, 200},
+		{"GET", "/user", "member", "second-pass", "", 401},
+		{"PUT", "/admin/users/member", "boss", "boss", `{"disabled": true}`, 200},
+		{"GET", "/user", "member", "third-pass", "", 401},
+		{"PUT", "/admin/users/member", "boss", "boss", `{"disabled": false}`, 200},
+		{"GET", "/user", "boss", "boss", "", 200},
+	} {
+		status, body := do(v.method, v.path, v.user, v.pass, v.body)
+		if status != v.expected {
+			t.Errorf("expected status %d for %s %s as %s, got %d: %s", v.expected, v.method, v.path, v.user, status, body)
+		}
+	}
+
+	status, body := do("GET", "/user", "member", "third-pass", "")
+	if status != 200 {
+		t.Fatalf("expected status 200, got %d: %s", status, body)
+	}
+
+	var user struct {
+		DisplayName string `json:"display_name"`
+		Email       string `json:"email"`
+		Disabled    bool   `json:"disabled"`
+	}
+	if err := json.Unmarshal(body, &user); err != nil {
+		t.Fatalf("expected a JSON object, got: %s", body)
+	}
+	if user.DisplayName != "Member" || user.Email != "member@example.com" || user.Disabled {
+		t.Errorf("unexpected profile: %#v", user)
+	}
+}
+
+func TestAccountSource(t *testing.T) {
+	accountCfg := *cfg
+	accountCfg.Authenticators = "proxy"
+	accountCfg.Proxy = &config.ProxyConfig{UserHeader: "X-Forwarded-User", TrustedProxies: "127.0.0.1"}
+
+	server := httptest.NewServer(NewApp(&accountCfg, testContentStore, testMetaStore))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/user", nil)
+	if err != nil {
+		t.Fatalf("request error: %s", err)
+	}
+	// the proxy may name any user, including one in the meta store
+	req.Header.Set("X-Forwarded-User", testUser)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != 404 {
+		t.Errorf("expected status 404 for a user the meta store didn't vouch for, got %d", res.StatusCode)
+	}
+}
+
+func TestAdminPagination(t *testing.T) {
+	adminCfg := *cfg
+	adminCfg.AdminUser = "boss"
+	adminCfg.AdminPass = "boss"
+
+	server := httptest.NewServer(NewApp(&adminCfg, testContentStore, testMetaStore))
+	defer server.Close()
+	defer testMetaStore.DeleteUser("boss")
+
+	get := func(path string) *http.Response {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth("boss", "boss")
+		req.Header.Set("Accept", "application/json")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+
+		return res
+	}
+
+	var expected []string
+	testMetaStore.ForEachObject("", func(m *meta.Object) error {
+		expected = append(expected, m.Oid)
+		return nil
+	})
+	if len(expected) < 2 {
+		t.Fatalf("expected the meta store to have several objects, got %d", len(expected))
+	}
+
+	var seen []string
+	next := regexp.MustCompile(`^<([^>]+)>; rel="next"$`)
+
+	for path := "/admin/objects?limit=1"; path != ""; {
+		res := get(path)
+
+		var page []struct {
+			Oid string `json:"oid"`
+		}
+		err := json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if res.StatusCode != 200 || err != nil {
+			t.Fatalf("expected a page of objects for %s, got %d: %v", path, res.StatusCode, err)
+		}
+
+		for _, object := range page {
+			seen = append(seen, object.Oid)
+		}
+
+		path = ""
+		if match := next.FindStringSubmatch(res.Header.Get("Link")); match != nil {
+			if len(page) != 1 {
+				t.Fatalf("expected a full page before the next link, got %d objects", len(page))
+			}
+			path = match[1]
+		}
+
+		if len(seen) > len(expected) {
+			t.Fatalf("expected pagination to end after %d objects", len(expected))
+		}
+	}
+
+	if strings.Join(seen, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected the pages to hold %v, got: %v", expected, seen)
+	}
+
+	for _, path := range []string{"/admin/objects?limit=0", "/admin/projects?limit=x"} {
+		res := get(path)
+		res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Errorf("expected status 400 for %s, got %d", path, res.StatusCode)
+		}
+	}
+}
+
+func TestAdminUsage(t *testing.T) {
+	adminCfg := *cfg
+	adminCfg.AdminUser = "boss"
+	adminCfg.AdminPass = "boss"
+
+	server := httptest.NewServer(NewApp(&adminCfg, testContentStore, testMetaStore))
+	defer server.Close()
+	defer testMetaStore.DeleteUser("boss")
+
+	get := func(path string, v interface{}) int {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth("boss", "boss")
+		req.Header.Set("Accept", "application/json")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode == 200 {
+			if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+				t.Fatalf("expected JSON from %s, got: %s", path, err)
+			}
+		}
+
+		return res.StatusCode
+	}
+
+	total, err := testMetaStore.GetUsage(meta.TotalUsage)
+	if err != nil {
+		t.Fatalf("expected GetUsage() to succeed, got: %s", err)
+	}
+	if total.Objects < 1 || total.Bytes < contentSize {
+		t.Fatalf("expected the seeded object to be counted, got: %+v", *total)
+	}
+
+	var report usageReport
+	if status := get("/admin/usage", &report); status != 200 {
+		t.Fatalf("expected the usage report, got %d", status)
+	}
+	if report.Total == nil || *report.Total != *total {
+		t.Errorf("expected the total usage %+v, got: %+v", *total, report.Total)
+	}
+
+	// the expvar only has the total, the namespaces are left to the report
+	var published meta.Usage
+	if err := json.Unmarshal([]byte(storageUsage.String()), &published); err != nil || published != *total {
+		t.Errorf("expected the total usage %+v to be published, got: %s", *total, storageUsage.String())
+	}
+
+	var sum meta.Usage
+	for _, usage := range report.Namespaces {
+		sum.Add(usage)
+	}
+	if sum.Bytes-report.DeduplicatedBytes != total.Bytes {
+		t.Errorf("expected the namespaces to add up to the total, got %+v for %+v", sum, *total)
+	}
+
+	var project projectUsage
+	if status := get("/admin/usage/projects/"+testRepo, &project); status != 200 {
+		t.Fatalf("expected the usage of %s, got %d", testRepo, status)
+	}
+	if project.Name != testRepo || project.Objects < 1 || project.Bytes < contentSize {
+		t.Errorf("expected %s to have the seeded object, got: %+v", testRepo, project)
+	}
+
+	var list []projectUsage
+	if status := get("/admin/usage/projects?namespace=nonexistent", &list); status != 200 || len(list) != 0 {
+		t.Errorf("expected no projects in an unknown namespace, got %d: %v", status, list)
+	}
+
+	if status := get("/admin/usage/projects/nonexistent", &project); status != 404 {
+		t.Errorf("expected 404 for an unknown project, got %d", status)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lfs-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	auditCfg := *cfg
+	auditCfg.AdminUser = "boss"
+	auditCfg.AdminPass = "boss"
+	auditCfg.Audit = &config.AuditConfig{File: dir + "/audit.log"}
+
+	server := httptest.NewServer(NewApp(&auditCfg, testContentStore, testMetaStore))
+	defer server.Close()
+	defer testMetaStore.DeleteUser("boss")
+	defer testMetaStore.DeleteUser("audited")
+
+	do := func(method, path, user, pass, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth(user, pass)
+		req.Header.Set("Accept", contentMediaType)
+		if body != "" {
+			req.Header.Set("Accept", "application/json")
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		return res
+	}
+
+	if res := do("GET", "/namespace/"+testRepo+"/objects/"+contentOid, testUser, testPass, ""); res.StatusCode != 200 {
+		t.Fatalf("expected the download to succeed, got %d", res.StatusCode)
+	}
+	if res := do("GET", "/namespace/"+testRepo+"/objects/"+contentOid, testUser, "wrong", ""); res.StatusCode != 401 {
+		t.Fatalf("expected bad credentials to be refused, got %d", res.StatusCode)
+	}
+	if res := do("POST", "/admin/users", "boss", "boss", `{"name": "audited", "password": "s3cretpass"}`); res.StatusCode != 201 {
+		t.Fatalf("expected the user to be created, got %d", res.StatusCode)
+	}
+
+	search := func(query string) []*audit.Event {
+		req, err := http.NewRequest("GET", server.URL+"/admin/audit?"+query, nil)
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth("boss", "boss")
+		req.Header.Set("Accept", "application/json")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		defer res.Body.Close()
+
+		var events []*audit.Event
+		if err := json.NewDecoder(res.Body).Decode(&events); res.StatusCode != 200 || err != nil {
+			t.Fatalf("expected audit events for %s, got %d: %v", query, res.StatusCode, err)
+		}
+
+		return events
+	}
+
+	events := search("oid=" + contentOid)
+	if len(events) != 2 {
+		t.Fatalf("expected the download and the failed attempt, got: %v", events)
+	}
+
+	download, failure := events[0], events[1]
+	if download.Action != audit.Download || download.User != testUser || download.Project != testRepo ||
+		download.Bytes != contentSize || download.Status != 200 || download.RemoteAddr == "" {
+		t.Errorf("expected the download to be recorded, got: %+v", download)
+	}
+	if failure.Action != audit.AuthFailure || failure.User != testUser || failure.Status != 401 {
+		t.Errorf("expected the failed attempt to be recorded, got: %+v", failure)
+	}
+
+	events = search("user=boss&action=admin")
+	if len(events) != 1 || events[0].Request != "POST /admin/users" || events[0].Status != 201 {
+		t.Errorf("expected the admin change to be recorded, got: %v", events)
+	}
+
+	if events := search("user=boss&since=2000-01-01T00:00:00Z&limit=1"); len(events) != 1 || events[0].Action != audit.Admin {
+		t.Errorf("expected the last event of the admin, got: %v", events)
+	}
+}
+
+func TestAdminUI(t *testing.T) {
+	adminCfg := *cfg
+	adminCfg.AdminUser = "boss"
+	adminCfg.AdminPass = "boss"
+
+	server := httptest.NewServer(NewApp(&adminCfg, testContentStore, testMetaStore))
+	defer server.Close()
+	defer testMetaStore.DeleteUser("boss")
+	defer testMetaStore.DeleteUser("uiuser")
+
+	if err := testMetaStore.AddProject(&meta.Project{Name: "uiproject", Namespace: "uinamespace"}); err != nil {
+		t.Fatalf("expected AddProject() to succeed, got: %s", err)
+	}
+	defer testMetaStore.DeleteProject("uiproject")
+
+	// don't follow the redirects after form posts
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	do := func(method, path string, form url.Values, origin string) (*http.Response, string) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		req.SetBasicAuth("boss", "boss")
+		req.Header.Set("Accept", "text/html")
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+		defer res.Body.Close()
+
+		by, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("response error: %s", err)
+		}
+
+		return res, string(by)
+	}
+
+	for _, v := range []struct {
+		path, expected string
+	}{
+		{"/admin/ui/", "total_requests"},
+		{"/admin/ui/projects", testRepo},
+		{"/admin/ui/projects/" + testRepo, contentOid},
+		{"/admin/ui/objects", contentOid},
+		{"/admin/ui/users", testUser},
+		{"/admin/ui/namespaces", `href="/admin/ui/projects?namespace=uinamespace"`},
+		{"/admin/ui/projects?namespace=uinamespace", `href="/admin/ui/projects/uiproject"`},
+		{"/admin/ui/projects?namespace=uinamespace&limit=1", `href="/admin/ui/projects?after=uiproject&amp;limit=1&amp;namespace=uinamespace"`},
+		{"/admin/ui/projects/" + testRepo + "?limit=1", `href="/admin/ui/projects/` + testRepo + `?after=`},
+		{"/admin/ui/objects?limit=1", "Next page"},
+	} {
+		res, body := do("GET", v.path, nil, "")
+		if res.StatusCode != 200 {
+			t.Errorf("expected status 200 for %s, got %d", v.path, res.StatusCode)
+		}
+		if !strings.Contains(body, v.expected) {
+			t.Errorf("expected %s to show %q", v.path, v.expected)
+		}
+	}
+
+	form := url.Values{"name": {"uiuser"}, "password": {"secret"}, "role": {"user"}}
+
+	if res, _ := do("POST", "/admin/ui/users", form, "http://evil.example.com"); res.StatusCode != 403 {
+		t.Errorf("expected cross-site posts to be refused, got %d", res.StatusCode)
+	}
+
+	if _, err := testMetaStore.GetUser("uiuser"); err != meta.ErrUserNotFound {
+		t.Fatalf("expected the user not to be created, got: %v", err)
+	}
+
+	if res, _ := do("POST", "/admin/ui/users", form, server.URL); res.StatusCode != 303 {
+		t.Errorf("expected status 303, got %d", res.StatusCode)
+	}
+
+	if _, err := testMetaStore.GetUser("uiuser"); err != nil {
+		t.Fatalf("expected the user to be created, got: %s", err)
+	}
+
+	res, _ := do("POST", "/admin/ui/users", form, server.URL)
+	if loc := res.Header.Get("Location"); !strings.Contains(loc, "error=") {
+		t.Errorf("expected an error for a duplicate user, got redirected to %q", loc)
+	}
+
+	if _, body := do("GET", "/admin/ui/projects?namespace=uinamespace", nil, ""); strings.Contains(body, `href="/admin/ui/projects/`+testRepo+`"`) {
+		t.Error("expected only the projects of the namespace to be listed")
+	}
+
+	tokenForm := url.Values{"user": {"uiuser"}, "name": {"laptop"}}
+
+	if res, _ := do("POST", "/admin/ui/tokens", tokenForm, "http://evil.example.com"); res.StatusCode != 403 {
+		t.Errorf("expected cross-site posts to be refused, got %d", res.StatusCode)
+	}
+
+	res, body := do("POST", "/admin/ui/tokens", tokenForm, server.URL)
+	if res.StatusCode != 200 {
+		t.Errorf("expected status 200, got %d", res.StatusCode)
+	}
+
+	tokens, err := testMetaStore.Tokens("uiuser")
+	if err != nil || len(tokens) != 1 || tokens[0].Name != "laptop" {
+		t.Fatalf("expected the token to be created, got %v and: %v", tokens, err)
+	}
+
+	if !strings.Contains(body, tokens[0].ID) || !strings.Contains(body, "secret is") {
+		t.Errorf("expected the secret of the new token to be shown, got: %s", body)
+	}
+
+	if _, body := do("GET", "/admin/ui/tokens", nil, ""); !strings.Contains(body, tokens[0].ID) || strings.Contains(body, "secret is") {
+		t.Errorf("expected the token to be listed without its secret, got: %s", body)
+	}
+
+	res, _ = do("POST", "/admin/ui/tokens", url.Values{"user": {"nosuchuser"}}, server.URL)
+	if loc := res.Header.Get("Location"); !strings.Contains(loc, "error=") {
+		t.Errorf("expected an error for an unknown user, got redirected to %q", loc)
+	}
+
+	if res, _ := do("POST", "/admin/ui/tokens/"+tokens[0].ID+"/revoke", nil, server.URL); res.StatusCode != 303 {
+		t.Errorf("expected status 303, got %d", res.StatusCode)
+	}
+
+	if tokens, err := testMetaStore.Tokens("uiuser"); err != nil || len(tokens) != 0 {
+		t.Errorf("expected the token to be revoked, got %v and: %v", tokens, err)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/admin/ui/", nil)
+	req.Header.Set("Accept", "text/html")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("response error: %s", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != 401 || res.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("expected browsers to be asked for credentials, got %d", res.StatusCode)
+	}
+}
+
+// linkTestObject adds the test object to a project of namespace, creating
+// the project if needed
+func linkTestObject(t *testing.T, namespace, repo string) {
+	rv := &meta.RequestVars{Oid: contentOid, Namespace: namespace, Repo: repo}
+	if _, err := testMetaStore.Link(rv); err != nil {
+		t.Fatalf("expected Link() to succeed, got: %s", err)
+	}
+}
+
 func TestMain(m *testing.M) {
 	os.Remove(cfg.MetaDB)
 	os.RemoveAll(cfg.ContentPath)
@@ -377,9 +2039,10 @@ func seedMetaStore() error {
 	}
 
 	rv := &meta.RequestVars{
-		Oid:  contentOid,
-		Size: contentSize,
-		Repo: testRepo,
+		Oid:       contentOid,
+		Size:      contentSize,
+		Namespace: "namespace",
+		Repo:      testRepo,
 	}
 
 	if _, err := testMetaStore.Put(rv); err != nil {
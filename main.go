@@ -5,6 +5,7 @@ import (
 	"expvar"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"runtime"
@@ -19,6 +20,8 @@ import (
 	"github.com/ksurent/lfs-server-go/meta/boltdb"
 	"github.com/ksurent/lfs-server-go/meta/cassandra"
 	"github.com/ksurent/lfs-server-go/meta/mysql"
+	"github.com/ksurent/lfs-server-go/meta/postgres"
+	"github.com/ksurent/lfs-server-go/meta/sqlite"
 
 	"github.com/facebookgo/pidfile"
 	"github.com/peterbourgon/g2g"
@@ -37,13 +40,22 @@ var (
 	metaResponse     = expvar.NewMap("meta")
 	downloadResponse = expvar.NewMap("download")
 	uploadResponse   = expvar.NewMap("upload")
+	adminResponse    = expvar.NewMap("admin")
+	accountResponse  = expvar.NewMap("account")
 
 	metaPending   = expvar.NewInt("pending_objects")
+	metaMounted   = expvar.NewInt("mounted_objects")
 	totalRequests = expvar.NewInt("total_requests")
 
 	expvarVersion = expvar.NewString("BuildVersion")
+
+	storageUsage = &usageVar{}
 )
 
+func init() {
+	expvar.Publish("storage_usage", storageUsage)
+}
+
 var graphite *g2g.Graphite
 
 func findMetaStore(cfg *config.Configuration) (meta.GenericMetaStore, error) {
@@ -56,6 +68,10 @@ func findMetaStore(cfg *config.Configuration) (meta.GenericMetaStore, error) {
 		return cassandra.NewCassandraMetaStore(cfg.Cassandra)
 	case "mysql":
 		return mysql.NewMySQLMetaStore(cfg.MySQL)
+	case "postgres":
+		return postgres.NewPostgresMetaStore(cfg.Postgres)
+	case "sqlite":
+		return sqlite.NewSQLiteMetaStore(cfg.MetaDB)
 	default:
 		return nil, errors.New("meta store not configured")
 	}
@@ -77,6 +93,13 @@ func findContentStore(cfg *config.Configuration) (content.GenericContentStore, e
 func main() {
 	showVersion := flag.Bool("version", false, "Print version and exit.")
 	configFile := flag.String("config", "", "Path to configuration.")
+	asJSON := flag.Bool("json", false, "Print the output of commands as JSON.")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [command]\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n%s\n", commandUsage)
+	}
 
 	flag.Parse()
 
@@ -94,6 +117,24 @@ func main() {
 		log.Fatal("Failed to parse "+*configFile+":", err)
 	}
 
+	if flag.NArg() > 0 {
+		log.SetOutput(ioutil.Discard)
+
+		metaStore, err := findMetaStore(cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Could not open the meta store:", err)
+			os.Exit(1)
+		}
+
+		err = runCommand(metaStore, newPasswordPolicy(cfg), flag.Args(), *asJSON, os.Stdin, os.Stdout)
+		metaStore.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	runtime.GOMAXPROCS(cfg.NumProcs)
 
 	if cfg.IsHTTPS() {
@@ -110,6 +151,9 @@ func main() {
 		log.Fatal("Could not open the content store:", err)
 	}
 
+	// authenticators register their metrics when the app is created
+	app := NewApp(cfg, contentStore, metaStore)
+
 	if cfg.Graphite.Enabled {
 		interval, err := time.ParseDuration(cfg.Graphite.Interval)
 		if err != nil {
@@ -157,7 +201,7 @@ func main() {
 		log.Fatal(err)
 	}
 
-	err = NewApp(cfg, contentStore, metaStore).Serve()
+	err = app.Serve()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -171,6 +215,8 @@ func setupGraphiteMetrics(prefix string, graphite *g2g.Graphite) {
 		{downloadResponse, "download"},
 		{uploadResponse, "upload"},
 		{metaResponse, "meta"},
+		{adminResponse, "admin"},
+		{accountResponse, "account"},
 	} {
 		var mapPrefix string
 		if prefix == "" {
@@ -179,19 +225,38 @@ func setupGraphiteMetrics(prefix string, graphite *g2g.Graphite) {
 			mapPrefix = prefix + "." + v.name
 		}
 
-		for _, code := range []string{"200", "202", "401", "403", "404", "500"} {
+		for _, code := range []string{"200", "201", "202", "204", "303", "400", "401", "403", "404", "409", "422", "429", "500"} {
 			v.m.Set(code, new(expvar.Int))
 			graphite.Register(mapPrefix+".http_"+code, v.m.Get(code))
 		}
 	}
 
+	usagePrefix := "storage"
+	if prefix != "" {
+		usagePrefix = prefix + "." + usagePrefix
+	}
+
+	for _, v := range []struct {
+		name  string
+		field func(*meta.Usage) int64
+	}{
+		{"objects", func(u *meta.Usage) int64 { return u.Objects }},
+		{"bytes", func(u *meta.Usage) int64 { return u.Bytes }},
+		{"pending_objects", func(u *meta.Usage) int64 { return u.PendingObjects }},
+		{"pending_bytes", func(u *meta.Usage) int64 { return u.PendingBytes }},
+		{"shared_objects", func(u *meta.Usage) int64 { return u.SharedObjects }},
+		{"shared_bytes", func(u *meta.Usage) int64 { return u.SharedBytes }},
+	} {
+		graphite.Register(usagePrefix+"."+v.name, storageUsage.total(v.field))
+	}
+
 	expvar.Do(func(kv expvar.KeyValue) {
 		if kv.Key == "memstats" || kv.Key == "cmdline" {
 			// skip built-in vars
 			return
 		}
 
-		if kv.Key == "download" || kv.Key == "upload" || kv.Key == "meta" {
+		if kv.Key == "download" || kv.Key == "upload" || kv.Key == "meta" || kv.Key == "admin" || kv.Key == "storage_usage" {
 			return
 		}
 
@@ -202,6 +267,13 @@ func setupGraphiteMetrics(prefix string, graphite *g2g.Graphite) {
 			path = prefix + "." + kv.Key
 		}
 
+		if m, ok := kv.Value.(*expvar.Map); ok {
+			m.Do(func(sub expvar.KeyValue) {
+				graphite.Register(path+"."+sub.Key, sub.Value)
+			})
+			return
+		}
+
 		graphite.Register(path, kv.Value)
 	})
 }
@@ -1,7 +1,11 @@
 package meta
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -29,3 +33,32 @@ func CheckPass(hashedPassword, password []byte) (bool, error) {
 	// no error means success
 	return (err == nil), nil
 }
+
+// NewToken creates an access token of user and returns it along with its
+// secret, which is shown once and never stored
+func NewToken(user, name string) (*Token, string, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 20)
+	for _, b := range [][]byte{id, secret} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, "", err
+		}
+	}
+
+	token := &Token{
+		ID:        hex.EncodeToString(id),
+		User:      user,
+		Name:      name,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		Hash:      HashToken(hex.EncodeToString(secret)),
+	}
+
+	return token, hex.EncodeToString(secret), nil
+}
+
+// HashToken returns the hash a token secret is stored and looked up by.
+// Secrets are random, unlike passwords they don't need a slow hash.
+func HashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/gob"
 	"errors"
+	"sort"
 	"time"
 
 	"github.com/ksurent/lfs-server-go/meta"
@@ -17,15 +18,22 @@ type MetaStore struct {
 	db *bolt.DB
 }
 
-var (
-	errNoBucket    = errors.New("Bucket not found")
-	errUnsupported = errors.New("This feature is not supported by this backend")
-)
+var errNoBucket = errors.New("Bucket not found")
+
+// pageSize is the number of records read per transaction when iterating,
+// tests lower it to cross page boundaries
+var pageSize = 1000
 
 var (
-	usersBucket    = []byte("users")
-	objectsBucket  = []byte("objects")
-	projectsBucket = []byte("projects")
+	usersBucket       = []byte("users")
+	rolesBucket       = []byte("roles")
+	profilesBucket    = []byte("profiles")
+	usageBucket       = []byte("usage")
+	objectsBucket     = []byte("objects")
+	projectsBucket    = []byte("projects")
+	aliasesBucket     = []byte("aliases")
+	tokensBucket      = []byte("tokens")
+	permissionsBucket = []byte("permissions")
 )
 
 // NewMetaStore creates a new MetaStore using the boltdb database at dbFile.
@@ -40,6 +48,18 @@ func NewMetaStore(dbFile string) (*MetaStore, error) {
 			return err
 		}
 
+		if _, err := tx.CreateBucketIfNotExists(rolesBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(profilesBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(usageBucket); err != nil {
+			return err
+		}
+
 		if _, err := tx.CreateBucketIfNotExists(objectsBucket); err != nil {
 			return err
 		}
@@ -48,6 +68,18 @@ func NewMetaStore(dbFile string) (*MetaStore, error) {
 			return err
 		}
 
+		if _, err := tx.CreateBucketIfNotExists(aliasesBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(tokensBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(permissionsBucket); err != nil {
+			return err
+		}
+
 		return nil
 	})
 
@@ -64,207 +96,1062 @@ func (s *MetaStore) Get(rv *meta.RequestVars) (*meta.Object, error) {
 		return nil, meta.ErrObjectNotFound
 	}
 
-	return m, nil
+	return m, nil
+}
+
+// Same as Get() but for uncommitted objects
+func (s *MetaStore) GetPending(rv *meta.RequestVars) (*meta.Object, error) {
+	m, err := s.doGet(rv)
+	if err != nil {
+		return nil, err
+	} else if m.Existing {
+		return nil, meta.ErrObjectNotFound
+	}
+
+	return m, nil
+}
+
+func (s *MetaStore) doGet(rv *meta.RequestVars) (*meta.Object, error) {
+	var m *meta.Object
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		m, err = getObject(tx, rv.Oid)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// getObject returns the object, pending or committed, with the given oid
+func getObject(tx *bolt.Tx, oid string) (*meta.Object, error) {
+	bucket := tx.Bucket(objectsBucket)
+	if bucket == nil {
+		return nil, errNoBucket
+	}
+
+	value := bucket.Get([]byte(oid))
+	if len(value) == 0 {
+		return nil, meta.ErrObjectNotFound
+	}
+
+	var m meta.Object
+	dec := gob.NewDecoder(bytes.NewBuffer(value))
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+func (s *MetaStore) findProject(projectName string) (*meta.Project, error) {
+	var project *meta.Project
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(projectsBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		val := bucket.Get([]byte(projectName))
+		if len(val) < 1 {
+			return meta.ErrProjectNotFound
+		}
+		dec := gob.NewDecoder(bytes.NewBuffer(val))
+		return dec.Decode(&project)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if project.Name != "" {
+		return project, nil
+	}
+	return nil, meta.ErrProjectNotFound
+}
+
+// createProject creates the project an object is uploaded to, unless it's
+// already there
+func createProject(tx *bolt.Tx, rv *meta.RequestVars) error {
+	if rv.Repo == "" {
+		return nil
+	}
+
+	err := addProject(tx, &meta.Project{Name: rv.Repo, Oids: []string{rv.Oid}, Namespace: rv.Namespace, Owner: rv.User})
+	if err == meta.ErrProjectExists {
+		return nil
+	}
+
+	return err
+}
+
+// AddProject creates a project. It fails if the project already exists.
+func (s *MetaStore) AddProject(project *meta.Project) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return addProject(tx, project)
+	})
+}
+
+func addProject(tx *bolt.Tx, project *meta.Project) error {
+	if err := project.Normalize(); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(project); err != nil {
+		return err
+	}
+
+	bucket := tx.Bucket(projectsBucket)
+	if bucket == nil {
+		// should never get here unless the db is jacked
+		return errNoBucket
+	}
+
+	if val := bucket.Get([]byte(project.Name)); len(val) > 0 {
+		return meta.ErrProjectExists
+	}
+
+	return bucket.Put([]byte(project.Name), buf.Bytes())
+}
+
+// GetProject returns a single project
+func (s *MetaStore) GetProject(name string) (*meta.Project, error) {
+	return s.findProject(name)
+}
+
+// MoveProject renames, moves or transfers a project in a single
+// transaction. The objects of the project are found by going through all
+// of them.
+func (s *MetaStore) MoveProject(name string, move *meta.ProjectMove) (*meta.Project, error) {
+	var project meta.Project
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		projects := tx.Bucket(projectsBucket)
+		objects := tx.Bucket(objectsBucket)
+		usage := tx.Bucket(usageBucket)
+		aliases := tx.Bucket(aliasesBucket)
+		permissions := tx.Bucket(permissionsBucket)
+		if projects == nil || objects == nil || usage == nil || aliases == nil || permissions == nil {
+			return errNoBucket
+		}
+
+		val := projects.Get([]byte(name))
+		if len(val) == 0 {
+			return meta.ErrProjectNotFound
+		}
+		if err := gob.NewDecoder(bytes.NewBuffer(val)).Decode(&project); err != nil {
+			return err
+		}
+
+		renames := move.Renames(&project)
+		if renames && len(projects.Get([]byte(move.Name))) > 0 {
+			return meta.ErrProjectExists
+		}
+
+		// the name may still lead to another project, it's taken as well
+		if target := aliases.Get([]byte(move.Name)); renames && target != nil && string(target) != name {
+			return meta.ErrProjectExists
+		}
+
+		move.Apply(&project)
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&project); err != nil {
+			return err
+		}
+		if err := projects.Put([]byte(project.Name), buf.Bytes()); err != nil {
+			return err
+		}
+
+		if !renames {
+			return nil
+		}
+
+		if err := projects.Delete([]byte(name)); err != nil {
+			return err
+		}
+
+		if err := renameObjects(objects, name, project.Name); err != nil {
+			return err
+		}
+
+		if u := usage.Get([]byte(name)); u != nil {
+			if err := usage.Put([]byte(project.Name), u); err != nil {
+				return err
+			}
+			if err := usage.Delete([]byte(name)); err != nil {
+				return err
+			}
+		}
+
+		if p := permissions.Get([]byte(name)); p != nil {
+			if err := permissions.Put([]byte(project.Name), p); err != nil {
+				return err
+			}
+			if err := permissions.Delete([]byte(name)); err != nil {
+				return err
+			}
+		}
+
+		return moveAliases(aliases, name, project.Name, move.Alias)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &project, nil
+}
+
+// renameObjects replaces from by to in the project names of all objects
+func renameObjects(objects *bolt.Bucket, from, to string) error {
+	renamed := make(map[string][]byte)
+
+	err := objects.ForEach(func(k, v []byte) error {
+		var m meta.Object
+		if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&m); err != nil {
+			return err
+		}
+
+		found := false
+		for i, name := range m.ProjectNames {
+			if name == from {
+				m.ProjectNames[i] = to
+				found = true
+			}
+		}
+		if !found {
+			return nil
+		}
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&m); err != nil {
+			return err
+		}
+		renamed[string(k)] = buf.Bytes()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// buckets can't be changed while iterating over them
+	for oid, v := range renamed {
+		if err := objects.Put([]byte(oid), v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// moveAliases points the aliases of a renamed project at its new name. The
+// new name, if it was an old name of the project, stops being an alias, the
+// old one becomes one if alias is set.
+func moveAliases(aliases *bolt.Bucket, from, to string, alias bool) error {
+	var retarget [][]byte
+	err := aliases.ForEach(func(k, v []byte) error {
+		if string(v) == from {
+			retarget = append(retarget, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range retarget {
+		if err := aliases.Put(k, []byte(to)); err != nil {
+			return err
+		}
+	}
+
+	if err := aliases.Delete([]byte(to)); err != nil {
+		return err
+	}
+
+	if alias {
+		return aliases.Put([]byte(from), []byte(to))
+	}
+
+	return nil
+}
+
+// UpdateProject changes the settings of a project
+func (s *MetaStore) UpdateProject(name string, update *meta.ProjectUpdate) (*meta.Project, error) {
+	var project meta.Project
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		projects := tx.Bucket(projectsBucket)
+		if projects == nil {
+			return errNoBucket
+		}
+
+		val := projects.Get([]byte(name))
+		if len(val) == 0 {
+			return meta.ErrProjectNotFound
+		}
+		if err := gob.NewDecoder(bytes.NewBuffer(val)).Decode(&project); err != nil {
+			return err
+		}
+
+		if err := update.Apply(&project); err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&project); err != nil {
+			return err
+		}
+
+		return projects.Put([]byte(name), buf.Bytes())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &project, nil
+}
+
+// DeleteProject removes a project that no object belongs to. The objects
+// are found by going through all of them.
+func (s *MetaStore) DeleteProject(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		projects := tx.Bucket(projectsBucket)
+		objects := tx.Bucket(objectsBucket)
+		usage := tx.Bucket(usageBucket)
+		aliases := tx.Bucket(aliasesBucket)
+		permissions := tx.Bucket(permissionsBucket)
+		if projects == nil || objects == nil || usage == nil || aliases == nil || permissions == nil {
+			return errNoBucket
+		}
+
+		if len(projects.Get([]byte(name))) == 0 {
+			return meta.ErrProjectNotFound
+		}
+
+		err := objects.ForEach(func(k, v []byte) error {
+			var m meta.Object
+			if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&m); err != nil {
+				return err
+			}
+
+			for _, project := range m.ProjectNames {
+				if project == name {
+					return meta.ErrProjectNotEmpty
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		var leading [][]byte
+		err = aliases.ForEach(func(k, v []byte) error {
+			if string(v) == name {
+				leading = append(leading, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range leading {
+			if err := aliases.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		if err := usage.Delete([]byte(name)); err != nil {
+			return err
+		}
+
+		if err := permissions.Delete([]byte(name)); err != nil {
+			return err
+		}
+
+		return projects.Delete([]byte(name))
+	})
+}
+
+// ProjectAlias returns the project an old name of a renamed project leads to
+func (s *MetaStore) ProjectAlias(name string) (string, error) {
+	var target string
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(aliasesBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		val := bucket.Get([]byte(name))
+		if val == nil {
+			return meta.ErrProjectNotFound
+		}
+
+		target = string(val)
+		return nil
+	})
+
+	return target, err
+}
+
+// Put() creates uncommitted objects from meta.RequestVars and stores them in the
+// meta store. The object is looked up and stored in the same transaction, so
+// concurrent uploads of the same object only count once.
+func (s *MetaStore) Put(rv *meta.RequestVars) (*meta.Object, error) {
+	var m *meta.Object
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// Don't care here if it's pending or committed
+		existing, err := getObject(tx, rv.Oid)
+		if err != meta.ErrObjectNotFound {
+			m = existing
+			return err
+		}
+
+		if err := createProject(tx, rv); err != nil {
+			return err
+		}
+
+		m = &meta.Object{
+			Oid:          rv.Oid,
+			Size:         rv.Size,
+			ProjectNames: []string{rv.Repo},
+			Existing:     false,
+		}
+
+		return putObject(tx, m, meta.PutUsage(m))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Commit() finds uncommitted objects in the meta store using data in
+// meta.RequestVars and commits them, in the same transaction
+func (s *MetaStore) Commit(rv *meta.RequestVars) (*meta.Object, error) {
+	var m *meta.Object
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		m, err = getObject(tx, rv.Oid)
+		if err != nil {
+			return err
+		}
+		if m.Existing {
+			return meta.ErrObjectNotFound
+		}
+
+		m.Existing = true
+
+		return putObject(tx, m, meta.CommitUsage(m))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Link adds a committed object to the project of rv, the object is read and
+// written in the same transaction
+func (s *MetaStore) Link(rv *meta.RequestVars) (*meta.Object, error) {
+	var m *meta.Object
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		m, err = getObject(tx, rv.Oid)
+		if err != nil {
+			return err
+		}
+		if !m.Existing {
+			return meta.ErrObjectNotFound
+		}
+
+		if err := createProject(tx, rv); err != nil {
+			return err
+		}
+
+		for _, name := range m.ProjectNames {
+			if name == rv.Repo {
+				return nil
+			}
+		}
+
+		delta := meta.LinkUsage(m, rv.Repo)
+		m.ProjectNames = append(m.ProjectNames, rv.Repo)
+
+		return putObject(tx, m, delta)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// putObject stores m and changes the usage by delta
+func putObject(tx *bolt.Tx, m *meta.Object, delta meta.UsageDelta) error {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(m); err != nil {
+		return err
+	}
+
+	bucket := tx.Bucket(objectsBucket)
+	if bucket == nil {
+		return errNoBucket
+	}
+
+	if err := bucket.Put([]byte(m.Oid), buf.Bytes()); err != nil {
+		return err
+	}
+
+	return addUsage(tx, delta)
+}
+
+// addUsage adds delta to the usage counters
+func addUsage(tx *bolt.Tx, delta meta.UsageDelta) error {
+	bucket := tx.Bucket(usageBucket)
+	if bucket == nil {
+		return errNoBucket
+	}
+
+	for name, d := range delta {
+		u, err := decodeUsage(bucket.Get([]byte(name)))
+		if err != nil {
+			return err
+		}
+		u.Add(d)
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(u); err != nil {
+			return err
+		}
+
+		if err := bucket.Put([]byte(name), buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func decodeUsage(v []byte) (*meta.Usage, error) {
+	u := &meta.Usage{}
+	if v == nil {
+		return u, nil
+	}
+
+	err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(u)
+	return u, err
+}
+
+// GetUsage returns the storage used by a project or, for meta.TotalUsage, in
+// total
+func (s *MetaStore) GetUsage(projectName string) (*meta.Usage, error) {
+	var u *meta.Usage
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usageBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		var err error
+		u, err = decodeUsage(bucket.Get([]byte(projectName)))
+		return err
+	})
+
+	return u, err
+}
+
+// RecountUsage counts the usage of all objects in a single transaction.
+func (s *MetaStore) RecountUsage() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		objects := tx.Bucket(objectsBucket)
+		if objects == nil {
+			return errNoBucket
+		}
+
+		if err := tx.DeleteBucket(usageBucket); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		if _, err := tx.CreateBucket(usageBucket); err != nil {
+			return err
+		}
+
+		return objects.ForEach(func(k, v []byte) error {
+			var m meta.Object
+			if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&m); err != nil {
+				return err
+			}
+
+			return addUsage(tx, meta.ObjectUsage(&m))
+		})
+	})
+}
+
+// ForEachUsage iterates over the usage of the projects in name order.
+func (s *MetaStore) ForEachUsage(fn func(string, *meta.Usage) error) error {
+	return s.forEach(usageBucket, "", func(k, v []byte) error {
+		if string(k) == meta.TotalUsage {
+			return nil
+		}
+
+		u, err := decodeUsage(v)
+		if err != nil {
+			return err
+		}
+
+		return fn(string(k), u)
+	})
+}
+
+// Close closes the underlying boltdb.
+func (s *MetaStore) Close() {
+	s.db.Close()
+}
+
+// AddUser adds user credentials to the meta store.
+func (s *MetaStore) AddUser(user, pass string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+		encryptedPass, err := meta.EncryptPass([]byte(pass))
+		if err != nil {
+			return err
+		}
+		if val := bucket.Get([]byte(user)); len(val) > 0 {
+			return nil // Already there
+		}
+		return bucket.Put([]byte(user), []byte(encryptedPass))
+	})
+	return err
+}
+
+// DeleteUser removes user credentials from the meta store.
+func (s *MetaStore) DeleteUser(user string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		if err := bucket.Delete([]byte(user)); err != nil {
+			return err
+		}
+
+		if roles := tx.Bucket(rolesBucket); roles != nil {
+			if err := roles.Delete([]byte(user)); err != nil {
+				return err
+			}
+		}
+
+		if profiles := tx.Bucket(profilesBucket); profiles != nil {
+			if err := profiles.Delete([]byte(user)); err != nil {
+				return err
+			}
+		}
+
+		if err := deleteTokens(tx, func(t *meta.Token) bool { return t.User == user }); err != nil {
+			return err
+		}
+
+		return deleteUserPermissions(tx, user)
+	})
+
+	return err
 }
 
-// Same as Get() but for uncommitted objects
-func (s *MetaStore) GetPending(rv *meta.RequestVars) (*meta.Object, error) {
-	m, err := s.doGet(rv)
-	if err != nil {
-		return nil, err
-	} else if m.Existing {
-		return nil, meta.ErrObjectNotFound
+// AddToken stores an access token, keyed by its hash
+func (s *MetaStore) AddToken(token *meta.Token) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(token); err != nil {
+		return err
 	}
 
-	return m, nil
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tokensBucket)
+		if bucket == nil {
+			return errNoBucket
+		}
+
+		return bucket.Put([]byte(token.Hash), buf.Bytes())
+	})
 }
 
-func (s *MetaStore) doGet(rv *meta.RequestVars) (*meta.Object, error) {
-	var m meta.Object
+// GetToken returns the access token with the given hash
+func (s *MetaStore) GetToken(hash string) (*meta.Token, error) {
+	var token meta.Token
+
 	err := s.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(objectsBucket)
+		bucket := tx.Bucket(tokensBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		value := bucket.Get([]byte(rv.Oid))
-		if len(value) == 0 {
-			return meta.ErrObjectNotFound
+		val := bucket.Get([]byte(hash))
+		if len(val) == 0 {
+			return meta.ErrTokenNotFound
 		}
 
-		dec := gob.NewDecoder(bytes.NewBuffer(value))
-		return dec.Decode(&m)
+		return gob.NewDecoder(bytes.NewBuffer(val)).Decode(&token)
 	})
-
 	if err != nil {
 		return nil, err
 	}
 
-	return &m, nil
+	return &token, nil
 }
 
-func (s *MetaStore) findProject(projectName string) (*meta.Project, error) {
-	var project *meta.Project
+// Tokens returns the access tokens of user, or all of them
+func (s *MetaStore) Tokens(user string) ([]*meta.Token, error) {
+	var tokens []*meta.Token
+
 	err := s.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(projectsBucket)
+		bucket := tx.Bucket(tokensBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
-		val := bucket.Get([]byte(projectName))
-		if len(val) < 1 {
-			return meta.ErrProjectNotFound
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var t meta.Token
+			if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&t); err != nil {
+				return err
+			}
+			if user == "" || t.User == user {
+				tokens = append(tokens, &t)
+			}
+			return nil
+		})
+	})
+
+	return tokens, err
+}
+
+// RevokeToken removes an access token. Tokens are keyed by their hash, the
+// id is found by going through all of them.
+func (s *MetaStore) RevokeToken(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var found bool
+		err := deleteTokens(tx, func(t *meta.Token) bool {
+			found = found || t.ID == id
+			return t.ID == id
+		})
+		if err != nil {
+			return err
 		}
-		dec := gob.NewDecoder(bytes.NewBuffer(val))
-		return dec.Decode(&project)
+
+		if !found {
+			return meta.ErrTokenNotFound
+		}
+		return nil
+	})
+}
+
+// deleteTokens removes the access tokens matched by match
+func deleteTokens(tx *bolt.Tx, match func(*meta.Token) bool) error {
+	bucket := tx.Bucket(tokensBucket)
+	if bucket == nil {
+		return errNoBucket
+	}
+
+	var matched [][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		var t meta.Token
+		if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&t); err != nil {
+			return err
+		}
+		if match(&t) {
+			matched = append(matched, append([]byte(nil), k...))
+		}
+		return nil
 	})
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if project.Name != "" {
-		return project, nil
+
+	// buckets can't be changed while iterating over them
+	for _, k := range matched {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
 	}
-	return nil, meta.ErrProjectNotFound
+
+	return nil
 }
 
-// Currently the OIDS are nil
-func (s *MetaStore) createProject(rv *meta.RequestVars) error {
-	if _, err := s.findProject(rv.Repo); err == nil {
-		// already there
-		return nil
+// SetPermission gives a user access to a project. The permissions of a
+// project are stored together, keyed by its name.
+func (s *MetaStore) SetPermission(name string, permission *meta.Permission) error {
+	if !meta.ValidAccess(permission.Access) {
+		return meta.ErrInvalidAccess
 	}
 
-	if rv.Repo == "" {
-		return nil
-	}
-	err := s.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(projectsBucket)
-		if bucket == nil {
-			// should never get here unless the db is jacked
+	return s.db.Update(func(tx *bolt.Tx) error {
+		projects := tx.Bucket(projectsBucket)
+		if projects == nil {
 			return errNoBucket
 		}
-		var buf bytes.Buffer
-		enc := gob.NewEncoder(&buf)
-		m := meta.Project{Name: rv.Repo, Oids: []string{rv.Oid}}
-		err := enc.Encode(m)
-		// Just a bunch o keys
-		err = bucket.Put([]byte(rv.Repo), buf.Bytes())
+
+		if len(projects.Get([]byte(name))) == 0 {
+			return meta.ErrProjectNotFound
+		}
+
+		permissions, err := getPermissions(tx, name)
 		if err != nil {
 			return err
 		}
 
-		return nil
+		found := false
+		for _, p := range permissions {
+			if p.User == permission.User {
+				p.Access = permission.Access
+				found = true
+			}
+		}
+		if !found {
+			permissions = append(permissions, &meta.Permission{User: permission.User, Access: permission.Access})
+		}
+
+		return putPermissions(tx, name, permissions)
 	})
-	return err
 }
 
-// Put() creates uncommitted objects from meta.RequestVars and stores them in the
-// meta store
-func (s *MetaStore) Put(rv *meta.RequestVars) (*meta.Object, error) {
-	// Don't care here if it's pending or committed
-	if m, err := s.doGet(rv); err == nil {
-		return m, nil
-	}
-
-	if rv.Repo != "" {
-		err := s.createProject(rv)
+// DeletePermission takes the access to a project away from a user
+func (s *MetaStore) DeletePermission(name, user string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		permissions, err := getPermissions(tx, name)
 		if err != nil {
-			return nil, err
+			return err
 		}
-	}
 
-	m := &meta.Object{
-		Oid:          rv.Oid,
-		Size:         rv.Size,
-		ProjectNames: []string{rv.Repo},
-		Existing:     false,
+		for i, p := range permissions {
+			if p.User == user {
+				return putPermissions(tx, name, append(permissions[:i], permissions[i+1:]...))
+			}
+		}
+
+		return meta.ErrPermissionNotFound
+	})
+}
+
+// Permissions returns the permissions of a project
+func (s *MetaStore) Permissions(name string) ([]*meta.Permission, error) {
+	var permissions []*meta.Permission
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		permissions, err = getPermissions(tx, name)
+		return err
+	})
+
+	return permissions, err
+}
+
+func getPermissions(tx *bolt.Tx, name string) ([]*meta.Permission, error) {
+	bucket := tx.Bucket(permissionsBucket)
+	if bucket == nil {
+		return nil, errNoBucket
 	}
 
-	err := s.doPut(m)
-	if err != nil {
-		return nil, err
+	var permissions []*meta.Permission
+
+	val := bucket.Get([]byte(name))
+	if len(val) == 0 {
+		return permissions, nil
 	}
 
-	return m, nil
+	err := gob.NewDecoder(bytes.NewBuffer(val)).Decode(&permissions)
+	return permissions, err
 }
 
-// Commit() finds uncommitted objects in the meta store using data in
-// meta.RequestVars and commits them
-func (s *MetaStore) Commit(rv *meta.RequestVars) (*meta.Object, error) {
-	m, err := s.GetPending(rv)
-	if err != nil {
-		return nil, err
+// putPermissions stores the permissions of a project ordered by user
+func putPermissions(tx *bolt.Tx, name string, permissions []*meta.Permission) error {
+	bucket := tx.Bucket(permissionsBucket)
+	if bucket == nil {
+		return errNoBucket
 	}
 
-	m.Existing = true
+	if len(permissions) == 0 {
+		return bucket.Delete([]byte(name))
+	}
 
-	err = s.doPut(m)
-	if err != nil {
-		return nil, err
+	sort.Sort(permissionsByUser(permissions))
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(permissions); err != nil {
+		return err
 	}
 
-	return m, nil
+	return bucket.Put([]byte(name), buf.Bytes())
 }
 
-func (s *MetaStore) doPut(m *meta.Object) error {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(m)
+// deleteUserPermissions removes the permissions of user from all projects
+func deleteUserPermissions(tx *bolt.Tx, user string) error {
+	bucket := tx.Bucket(permissionsBucket)
+	if bucket == nil {
+		return errNoBucket
+	}
+
+	changed := make(map[string][]*meta.Permission)
+	err := bucket.ForEach(func(k, v []byte) error {
+		var permissions []*meta.Permission
+		if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&permissions); err != nil {
+			return err
+		}
+
+		for i, p := range permissions {
+			if p.User == user {
+				changed[string(k)] = append(permissions[:i], permissions[i+1:]...)
+				break
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	return s.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(objectsBucket)
+	// buckets can't be changed while iterating over them
+	for name, permissions := range changed {
+		if err := putPermissions(tx, name, permissions); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetUser returns a meta.User without the password.
+func (s *MetaStore) GetUser(user string) (*meta.User, error) {
+	var mu *meta.User
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		err = bucket.Put([]byte(m.Oid), buf.Bytes())
-		if err != nil {
-			return err
+		if bucket.Get([]byte(user)) == nil {
+			return meta.ErrUserNotFound
 		}
 
-		return nil
+		mu = &meta.User{Name: user, Role: userRole(tx, user)}
+		return userProfile(tx, mu)
 	})
-}
 
-// Close closes the underlying boltdb.
-func (s *MetaStore) Close() {
-	s.db.Close()
+	return mu, err
 }
 
-// AddUser adds user credentials to the meta store.
-func (s *MetaStore) AddUser(user, pass string) error {
-	err := s.db.Update(func(tx *bolt.Tx) error {
+// SetRole changes the role of an existing user.
+func (s *MetaStore) SetRole(user, role string) error {
+	if !meta.ValidRole(role) {
+		return meta.ErrInvalidRole
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(usersBucket)
-		if bucket == nil {
+		roles := tx.Bucket(rolesBucket)
+		if bucket == nil || roles == nil {
 			return errNoBucket
 		}
-		encryptedPass, err := meta.EncryptPass([]byte(pass))
-		if err != nil {
-			return err
-		}
-		if val := bucket.Get([]byte(user)); len(val) > 0 {
-			return nil // Already there
+
+		if bucket.Get([]byte(user)) == nil {
+			return meta.ErrUserNotFound
 		}
-		return bucket.Put([]byte(user), []byte(encryptedPass))
+
+		return roles.Put([]byte(user), []byte(role))
 	})
-	return err
 }
 
-// DeleteUser removes user credentials from the meta store.
-func (s *MetaStore) DeleteUser(user string) error {
-	err := s.db.Update(func(tx *bolt.Tx) error {
+// UpdateUser changes the password and profile of an existing user.
+func (s *MetaStore) UpdateUser(user string, update *meta.UserUpdate) error {
+	var encryptedPass string
+	if update.Password != nil {
+		var err error
+		if encryptedPass, err = meta.EncryptPass([]byte(*update.Password)); err != nil {
+			return err
+		}
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(usersBucket)
-		if bucket == nil {
+		profiles := tx.Bucket(profilesBucket)
+		if bucket == nil || profiles == nil {
 			return errNoBucket
 		}
 
-		err := bucket.Delete([]byte(user))
-		return err
+		if bucket.Get([]byte(user)) == nil {
+			return meta.ErrUserNotFound
+		}
+
+		if update.Password != nil {
+			if err := bucket.Put([]byte(user), []byte(encryptedPass)); err != nil {
+				return err
+			}
+		}
+
+		mu := &meta.User{Name: user}
+		if err := userProfile(tx, mu); err != nil {
+			return err
+		}
+		update.Apply(mu)
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&profile{mu.DisplayName, mu.Email, mu.Disabled}); err != nil {
+			return err
+		}
+
+		return profiles.Put([]byte(user), buf.Bytes())
 	})
+}
 
-	return err
+// profile is what is stored about a user besides the password and the role
+type profile struct {
+	DisplayName string
+	Email       string
+	Disabled    bool
+}
+
+// userProfile fills in the profile of mu, users that were never updated
+// have an empty one
+func userProfile(tx *bolt.Tx, mu *meta.User) error {
+	profiles := tx.Bucket(profilesBucket)
+	if profiles == nil {
+		return nil
+	}
+
+	v := profiles.Get([]byte(mu.Name))
+	if v == nil {
+		return nil
+	}
+
+	var p profile
+	if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&p); err != nil {
+		return err
+	}
+
+	mu.DisplayName, mu.Email, mu.Disabled = p.DisplayName, p.Email, p.Disabled
+	return nil
+}
+
+// userRole returns the role of user, users created before roles were
+// introduced are regular users
+func userRole(tx *bolt.Tx, user string) string {
+	if roles := tx.Bucket(rolesBucket); roles != nil {
+		if role := roles.Get([]byte(user)); len(role) > 0 {
+			return string(role)
+		}
+	}
+
+	return meta.RoleUser
 }
 
 // Users returns all meta.Users in the meta store
@@ -277,11 +1164,11 @@ func (s *MetaStore) Users() ([]*meta.User, error) {
 			return errNoBucket
 		}
 
-		bucket.ForEach(func(k, v []byte) error {
-			users = append(users, &meta.User{Name: string(k)})
-			return nil
+		return bucket.ForEach(func(k, v []byte) error {
+			mu := &meta.User{Name: string(k), Role: userRole(tx, string(k))}
+			users = append(users, mu)
+			return userProfile(tx, mu)
 		})
-		return nil
 	})
 
 	return users, err
@@ -312,19 +1199,101 @@ func (s *MetaStore) Objects() ([]*meta.Object, error) {
 	return objects, err
 }
 
+// ForEachObject iterates over the objects in OID order. Objects are read a
+// page at a time so that fn runs outside of database transactions.
+func (s *MetaStore) ForEachObject(after string, fn func(*meta.Object) error) error {
+	return s.forEach(objectsBucket, after, func(_, v []byte) error {
+		var m meta.Object
+		if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&m); err != nil {
+			return err
+		}
+		return fn(&m)
+	})
+}
+
+// ForEachProject iterates over the projects in name order.
+func (s *MetaStore) ForEachProject(after string, fn func(*meta.Project) error) error {
+	return s.forEach(projectsBucket, after, func(_, v []byte) error {
+		var p meta.Project
+		if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&p); err != nil {
+			return err
+		}
+		return fn(&p)
+	})
+}
+
+func (s *MetaStore) forEach(name []byte, after string, fn func(k, v []byte) error) error {
+	last := []byte(after)
+
+	for {
+		var keys, page [][]byte
+
+		err := s.db.View(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(name)
+			if bucket == nil {
+				return errNoBucket
+			}
+
+			c := bucket.Cursor()
+
+			k, v := c.First()
+			if len(last) > 0 {
+				k, v = c.Seek(last)
+				if bytes.Equal(k, last) {
+					k, v = c.Next()
+				}
+			}
+
+			for ; k != nil && len(page) < pageSize; k, v = c.Next() {
+				// keys and values are only valid during the transaction
+				keys = append(keys, append([]byte(nil), k...))
+				page = append(page, append([]byte(nil), v...))
+				last = append(last[:0], k...)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i, v := range page {
+			if err := fn(keys[i], v); err != nil {
+				return err
+			}
+		}
+
+		if len(page) < pageSize {
+			return nil
+		}
+	}
+}
+
 // Authenticate uses the authorization string to determine whether
 // or not to proceed. This server assumes an HTTP Basic auth format.
+// Disabled users fail to authenticate.
 func (s *MetaStore) Authenticate(user, pass string) (bool, error) {
 	var encryptedPass []byte
-	s.db.View(func(tx *bolt.Tx) error {
+	err := s.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(usersBucket)
 		if bucket == nil {
 			return errNoBucket
 		}
 
-		encryptedPass = bucket.Get([]byte(user))
+		mu := &meta.User{Name: user}
+		if err := userProfile(tx, mu); err != nil {
+			return err
+		}
+
+		if !mu.Disabled {
+			// the value is only valid during the transaction
+			encryptedPass = append([]byte(nil), bucket.Get([]byte(user))...)
+		}
 		return nil
 	})
+	if err != nil {
+		return false, err
+	}
 
 	return meta.CheckPass(encryptedPass, []byte(pass))
 }
@@ -352,7 +1321,8 @@ func (s *MetaStore) Projects() ([]*meta.Project, error) {
 	return projects, err
 }
 
-// TODO
-func (s *MetaStore) AddProject(name string) error {
-	return errUnsupported
-}
+type permissionsByUser []*meta.Permission
+
+func (s permissionsByUser) Len() int           { return len(s) }
+func (s permissionsByUser) Less(i, j int) bool { return s[i].User < s[j].User }
+func (s permissionsByUser) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -3,6 +3,7 @@ package cassandra
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/ksurent/lfs-server-go/config"
 	"github.com/ksurent/lfs-server-go/meta"
@@ -18,6 +19,9 @@ type CassandraMetaStore struct {
 
 var errUnsupported = errors.New("This feature is not supported by this backend")
 
+// pageSize is the number of rows fetched at a time when iterating
+const pageSize = 1000
+
 func NewCassandraMetaStore(cfg *config.CassandraConfig) (*CassandraMetaStore, error) {
 	sess, err := NewCassandraSession(cfg)
 	if err != nil {
@@ -34,14 +38,81 @@ func (self *CassandraMetaStore) Close() {
 	self.client.Close()
 }
 
-func (self *CassandraMetaStore) createProject(project string, pending bool) error {
-	counter := make(map[string]interface{}, 1)
-	self.client.Query("select count(*) as count from projects where name = ?", project).MapScan(counter)
-	if val, ok := counter["count"].(int64); ok && val > 0 {
+// createProject creates a project unless it's already there. Committed
+// projects take over projects only known from pending uploads, creating an
+// existing committed project fails with meta.ErrProjectExists.
+func (self *CassandraMetaStore) createProject(p *meta.Project, pending bool) error {
+	if err := p.Normalize(); err != nil {
+		return err
+	}
+
+	var existingPending bool
+	err := self.client.Query("select pending from projects where name = ?", p.Name).Scan(&existingPending)
+	switch {
+	case err == gocql.ErrNotFound:
+		err = self.client.Query("insert into projects (name, pending) values(?, ?)", p.Name, pending).Exec()
+	case err != nil:
+		return err
+	case pending:
 		// already there
 		return nil
+	case !existingPending:
+		return meta.ErrProjectExists
+	default:
+		err = self.client.Query("update projects set pending = ? where name = ?", false, p.Name).Exec()
+	}
+	if err != nil {
+		return err
+	}
+
+	// settings live in their own table so that existing projects tables
+	// don't have to be altered
+	return self.client.Query(`
+		insert into
+			project_settings (name, namespace, description, owner, created_at, visibility, max_object_size)
+		values
+			(?, ?, ?, ?, ?, ?, ?)
+	`, p.Name, p.Namespace, p.Description, p.Owner, p.CreatedAt, p.Visibility, p.MaxObjectSize).Exec()
+}
+
+// findSettings fills in the settings of projects, those created by older
+// versions get the defaults
+func (self *CassandraMetaStore) findSettings(projects ...*meta.Project) error {
+	byName := make(map[string]*meta.Project, len(projects))
+	for _, p := range projects {
+		p.Visibility = meta.VisibilityPrivate
+		byName[p.Name] = p
+	}
+
+	// pages of projects are looked up by name, everything else by reading
+	// the whole table
+	q := "select name, namespace, description, owner, created_at, visibility, max_object_size from project_settings"
+	args := []interface{}{}
+	if len(projects) <= pageSize {
+		q += " where name in (?" + strings.Repeat(", ?", len(projects)-1) + ")"
+		for _, p := range projects {
+			args = append(args, p.Name)
+		}
+	}
+
+	var (
+		name string
+		s    meta.Project
+	)
+
+	itr := self.client.Query(q, args...).Iter()
+	for itr.Scan(&name, &s.Namespace, &s.Description, &s.Owner, &s.CreatedAt, &s.Visibility, &s.MaxObjectSize) {
+		if p, ok := byName[name]; ok {
+			p.Namespace = s.Namespace
+			p.Description = s.Description
+			p.Owner = s.Owner
+			p.CreatedAt = s.CreatedAt
+			p.Visibility = s.Visibility
+			p.MaxObjectSize = s.MaxObjectSize
+		}
 	}
-	return self.client.Query("insert into projects (name, pending) values(?, ?)", project, pending).Exec()
+
+	return itr.Close()
 }
 
 func (self *CassandraMetaStore) addOidToProject(oid string, project string) error {
@@ -50,7 +121,9 @@ func (self *CassandraMetaStore) addOidToProject(oid string, project string) erro
 	return self.client.Query(q).Exec()
 }
 
-func (self *CassandraMetaStore) createPendingOid(m *meta.Object) error {
+// createPendingOid creates a pending object, new projects are owned by the
+// uploader
+func (self *CassandraMetaStore) createPendingOid(m *meta.Object, namespace, owner string) error {
 	err := self.client.Query(`
 		insert into
 			oids (oid, size, pending)
@@ -62,7 +135,7 @@ func (self *CassandraMetaStore) createPendingOid(m *meta.Object) error {
 	}
 
 	for _, name := range m.ProjectNames {
-		err := self.createProject(name, true)
+		err := self.createProject(&meta.Project{Name: name, Namespace: namespace, Owner: owner}, true)
 		if err != nil {
 			return err
 		}
@@ -73,6 +146,33 @@ func (self *CassandraMetaStore) createPendingOid(m *meta.Object) error {
 		}
 	}
 
+	return self.addUsage(meta.PutUsage(m))
+}
+
+/*
+Adds delta to the usage counters. Counters can't be updated in a batch with
+the rest, a failure leaves the usage off by this object
+*/
+func (self *CassandraMetaStore) addUsage(delta meta.UsageDelta) error {
+	for name, d := range delta {
+		err := self.client.Query(`
+			update
+				project_usage
+			set
+				objects = objects + ?,
+				bytes = bytes + ?,
+				pending_objects = pending_objects + ?,
+				pending_bytes = pending_bytes + ?,
+				shared_objects = shared_objects + ?,
+				shared_bytes = shared_bytes + ?
+			where
+				name = ?
+		`, d.Objects, d.Bytes, d.PendingObjects, d.PendingBytes, d.SharedObjects, d.SharedBytes, name).Exec()
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -117,7 +217,7 @@ func (self *CassandraMetaStore) commitPendingOid(m *meta.Object) error {
 		return err
 	}
 
-	return nil
+	return self.addUsage(meta.CommitUsage(m))
 }
 
 func (self *CassandraMetaStore) findProject(projectName string) (*meta.Project, error) {
@@ -135,6 +235,10 @@ func (self *CassandraMetaStore) findProject(projectName string) (*meta.Project,
 		return nil, meta.ErrProjectNotFound
 	}
 
+	if err := self.findSettings(&ct); err != nil {
+		return nil, err
+	}
+
 	return &ct, nil
 }
 
@@ -220,12 +324,142 @@ func (self *CassandraMetaStore) findAllProjects() ([]*meta.Project, error) {
 		return nil, err
 	}
 
-	if len(project_list) == 0 {
-		return nil, meta.ErrProjectNotFound
+	if len(project_list) > 0 {
+		if err := self.findSettings(project_list...); err != nil {
+			return nil, err
+		}
 	}
+
 	return project_list, nil
 }
 
+// forEachPage runs q a page at a time, resuming with the paging state of the
+// previous page. scan reads a row into the page, visit is called for the
+// rows of a page once it has been read.
+func (self *CassandraMetaStore) forEachPage(q *gocql.Query, scan func(*gocql.Iter) bool, visit func() error) error {
+	var state []byte
+
+	for {
+		itr := q.PageSize(pageSize).PageState(state).Iter()
+		state = itr.PageState()
+
+		for n := itr.NumRows(); n > 0 && scan(itr); n-- {
+		}
+
+		if err := itr.Close(); err != nil {
+			return err
+		}
+
+		if err := visit(); err != nil {
+			return err
+		}
+
+		if len(state) == 0 {
+			return nil
+		}
+	}
+}
+
+/*
+Object iterator in token order, pages are read with the paging state
+*/
+func (self *CassandraMetaStore) forEachOid(after string, fn func(*meta.Object) error) error {
+	q := self.client.Query("select oid, size, pending from oids")
+	if after != "" {
+		q = self.client.Query("select oid, size, pending from oids where token(oid) > token(?)", after)
+	}
+
+	var page []*meta.Object
+
+	scan := func(itr *gocql.Iter) bool {
+		var (
+			m       meta.Object
+			pending bool
+		)
+		if !itr.Scan(&m.Oid, &m.Size, &pending) {
+			return false
+		}
+		m.Existing = !pending
+
+		page = append(page, &m)
+		return true
+	}
+
+	visit := func() error {
+		defer func() { page = page[:0] }()
+
+		for _, m := range page {
+			itr := self.client.Query("select name from projects where oids contains ?", m.Oid).Iter()
+
+			var project string
+			for itr.Scan(&project) {
+				m.ProjectNames = append(m.ProjectNames, project)
+			}
+
+			if err := itr.Close(); err != nil {
+				return err
+			}
+
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return self.forEachPage(q, scan, visit)
+}
+
+/*
+Committed project iterator in token order
+*/
+func (self *CassandraMetaStore) forEachProject(after string, fn func(*meta.Project) error) error {
+	q := self.client.Query("select name, oids, pending from projects")
+	if after != "" {
+		q = self.client.Query("select name, oids, pending from projects where token(name) > token(?)", after)
+	}
+
+	var page []*meta.Project
+
+	scan := func(itr *gocql.Iter) bool {
+		var (
+			p       meta.Project
+			pending bool
+		)
+		if !itr.Scan(&p.Name, &p.Oids, &pending) {
+			return false
+		}
+
+		if !pending {
+			page = append(page, &p)
+		}
+		return true
+	}
+
+	visit := func() error {
+		defer func() { page = page[:0] }()
+
+		if len(page) == 0 {
+			return nil
+		}
+
+		if err := self.findSettings(page...); err != nil {
+			return err
+		}
+
+		for _, p := range page {
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return self.forEachPage(q, scan, visit)
+}
+
 // Put() creates uncommitted objects from meta.RequestVars and stores them in the
 // meta store
 func (self *CassandraMetaStore) Put(v *meta.RequestVars) (*meta.Object, error) {
@@ -245,7 +479,7 @@ func (self *CassandraMetaStore) Put(v *meta.RequestVars) (*meta.Object, error) {
 		Existing:     false,
 	}
 
-	err := self.doPut(m)
+	err := self.createPendingOid(m, v.Namespace, v.User)
 	if err != nil {
 		return nil, err
 	}
@@ -263,7 +497,7 @@ func (self *CassandraMetaStore) Commit(v *meta.RequestVars) (*meta.Object, error
 
 	m.Existing = true
 
-	err = self.doPut(m)
+	err = self.commitPendingOid(m)
 	if err != nil {
 		return nil, err
 	}
@@ -271,16 +505,38 @@ func (self *CassandraMetaStore) Commit(v *meta.RequestVars) (*meta.Object, error
 	return m, nil
 }
 
-func (self *CassandraMetaStore) doPut(m *meta.Object) error {
-	if !m.Existing {
-		if err := self.createPendingOid(m); err != nil {
-			return err
+// Link() adds a committed object to the project in meta.RequestVars. There are
+// no transactions, objects linked to the same project concurrently may be
+// counted twice in its usage
+func (self *CassandraMetaStore) Link(v *meta.RequestVars) (*meta.Object, error) {
+	m, err := self.findOid(v.Oid, false)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range m.ProjectNames {
+		if name == v.Repo {
+			return m, nil
 		}
+	}
 
-		return nil
+	err = self.createProject(&meta.Project{Name: v.Repo, Namespace: v.Namespace, Owner: v.User}, false)
+	if err != nil && err != meta.ErrProjectExists {
+		return nil, err
+	}
+
+	if err := self.addOidToProject(m.Oid, v.Repo); err != nil {
+		return nil, err
 	}
 
-	return self.commitPendingOid(m)
+	delta := meta.LinkUsage(m, v.Repo)
+	m.ProjectNames = append(m.ProjectNames, v.Repo)
+
+	if err := self.addUsage(delta); err != nil {
+		return nil, err
+	}
+
+	return m, nil
 }
 
 // Get() retrieves meta information for a committed object given information in
@@ -337,18 +593,304 @@ Removes a user from the system
 Usage: DeleteUser("testuser")
 */
 func (self *CassandraMetaStore) DeleteUser(user string) error {
-	return self.client.Query("delete from users where username = ?", user).Exec()
+	err := self.client.Query("delete from users where username = ?", user).Exec()
+	if err != nil {
+		return err
+	}
+
+	err = self.client.Query("delete from user_roles where username = ?", user).Exec()
+	if err != nil {
+		return err
+	}
+
+	err = self.client.Query("delete from user_profiles where username = ?", user).Exec()
+	if err != nil {
+		return err
+	}
+
+	tokens, err := self.Tokens(user)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tokens {
+		if err := self.client.Query("delete from tokens where hash = ?", t.Hash).Exec(); err != nil {
+			return err
+		}
+	}
+
+	// permissions are found by user through the index
+	itr := self.client.Query("select project from permissions where username = ?", user).Iter()
+	var project string
+	for itr.Scan(&project) {
+		if err := self.client.Query("delete from permissions where project = ? and username = ?", project, user).Exec(); err != nil {
+			itr.Close()
+			return err
+		}
+	}
+
+	return itr.Close()
+}
+
+/*
+Stores an access token
+*/
+func (self *CassandraMetaStore) AddToken(token *meta.Token) error {
+	return self.client.Query(`
+		insert into
+			tokens (hash, id, username, name, created_at)
+		values
+			(?, ?, ?, ?, ?)
+	`, token.Hash, token.ID, token.User, token.Name, token.CreatedAt).Exec()
+}
+
+/*
+Returns the access token with the hash of a secret
+*/
+func (self *CassandraMetaStore) GetToken(hash string) (*meta.Token, error) {
+	t := &meta.Token{Hash: hash}
+	err := self.client.Query(
+		"select id, username, name, created_at from tokens where hash = ?", hash,
+	).Scan(&t.ID, &t.User, &t.Name, &t.CreatedAt)
+	if err == gocql.ErrNotFound {
+		return nil, meta.ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+/*
+Returns the access tokens of a user, or all of them
+*/
+func (self *CassandraMetaStore) Tokens(user string) ([]*meta.Token, error) {
+	q := self.client.Query("select hash, id, username, name, created_at from tokens")
+	if user != "" {
+		q = self.client.Query("select hash, id, username, name, created_at from tokens where username = ?", user)
+	}
+
+	var (
+		tokens []*meta.Token
+		t      meta.Token
+	)
+
+	itr := q.Iter()
+	for itr.Scan(&t.Hash, &t.ID, &t.User, &t.Name, &t.CreatedAt) {
+		token := t
+		tokens = append(tokens, &token)
+	}
+
+	return tokens, itr.Close()
+}
+
+/*
+Removes an access token, it's found by its id through the index
+*/
+func (self *CassandraMetaStore) RevokeToken(id string) error {
+	var hash string
+	err := self.client.Query("select hash from tokens where id = ?", id).Scan(&hash)
+	if err == gocql.ErrNotFound {
+		return meta.ErrTokenNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return self.client.Query("delete from tokens where hash = ?", hash).Exec()
+}
+
+/*
+Gives a user access to a project, replacing the access they had
+*/
+func (self *CassandraMetaStore) SetPermission(name string, permission *meta.Permission) error {
+	if !meta.ValidAccess(permission.Access) {
+		return meta.ErrInvalidAccess
+	}
+
+	if _, err := self.findProject(name); err != nil {
+		return err
+	}
+
+	return self.client.Query(`
+		insert into
+			permissions (project, username, access)
+		values
+			(?, ?, ?)
+	`, name, permission.User, permission.Access).Exec()
+}
+
+/*
+Takes the access to a project away from a user
+*/
+func (self *CassandraMetaStore) DeletePermission(name, user string) error {
+	var access string
+	err := self.client.Query("select access from permissions where project = ? and username = ?", name, user).Scan(&access)
+	if err == gocql.ErrNotFound {
+		return meta.ErrPermissionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return self.client.Query("delete from permissions where project = ? and username = ?", name, user).Exec()
+}
+
+/*
+Returns the permissions of a project, they are clustered by user
+*/
+func (self *CassandraMetaStore) Permissions(name string) ([]*meta.Permission, error) {
+	var (
+		permissions []*meta.Permission
+		p           meta.Permission
+	)
+
+	itr := self.client.Query("select username, access from permissions where project = ?", name).Iter()
+	for itr.Scan(&p.User, &p.Access) {
+		permission := p
+		permissions = append(permissions, &permission)
+	}
+
+	return permissions, itr.Close()
+}
+
+/*
+Returns a user without the password
+*/
+func (self *CassandraMetaStore) GetUser(user string) (*meta.User, error) {
+	mu, err := self.findUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	role, err := self.findRole(user)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &meta.User{Name: mu.Name, Role: role}
+	if err := self.findProfile(u); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+/*
+Changes the password and profile of an existing user
+*/
+func (self *CassandraMetaStore) UpdateUser(user string, update *meta.UserUpdate) error {
+	mu, err := self.GetUser(user)
+	if err != nil {
+		return err
+	}
+	update.Apply(mu)
+
+	if update.Password != nil {
+		encryptedPass, err := meta.EncryptPass([]byte(*update.Password))
+		if err != nil {
+			return err
+		}
+
+		err = self.client.Query("update users set password = ? where username = ?", encryptedPass, user).Exec()
+		if err != nil {
+			return err
+		}
+	}
+
+	return self.client.Query(
+		"insert into user_profiles (username, display_name, email, disabled) values(?, ?, ?, ?)",
+		user, mu.DisplayName, mu.Email, mu.Disabled,
+	).Exec()
+}
+
+/*
+Users that were never updated have an empty profile
+*/
+func (self *CassandraMetaStore) findProfile(mu *meta.User) error {
+	err := self.client.Query(
+		"select display_name, email, disabled from user_profiles where username = ?", mu.Name,
+	).Scan(&mu.DisplayName, &mu.Email, &mu.Disabled)
+	if err == gocql.ErrNotFound {
+		return nil
+	}
+
+	return err
+}
+
+/*
+Changes the role of an existing user
+Usage: SetRole("testuser", meta.RoleAdmin)
+*/
+func (self *CassandraMetaStore) SetRole(user, role string) error {
+	if !meta.ValidRole(role) {
+		return meta.ErrInvalidRole
+	}
+
+	if _, err := self.findUser(user); err != nil {
+		return err
+	}
+
+	return self.client.Query("insert into user_roles (username, role) values(?, ?)", user, role).Exec()
+}
+
+/*
+Users without a stored role are regular users
+*/
+func (self *CassandraMetaStore) findRole(user string) (string, error) {
+	var role string
+	err := self.client.Query("select role from user_roles where username = ?", user).Scan(&role)
+	if err == gocql.ErrNotFound || (err == nil && role == "") {
+		return meta.RoleUser, nil
+	}
+
+	return role, err
 }
 
 /*
 returns all users
 */
 func (self *CassandraMetaStore) Users() ([]*meta.User, error) {
-	var mu meta.User
+	roles := make(map[string]string)
+	var name, role string
+	iter := self.client.Query("select username, role from user_roles").Iter()
+	for iter.Scan(&name, &role) {
+		roles[name] = role
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	profiles := make(map[string]*meta.User)
+	iter = self.client.Query("select username, display_name, email, disabled from user_profiles").Iter()
+	for {
+		var p meta.User
+		if !iter.Scan(&p.Name, &p.DisplayName, &p.Email, &p.Disabled) {
+			break
+		}
+		profiles[p.Name] = &p
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
 	users := make([]*meta.User, 0)
 	q := self.client.Query("select username from users")
 	b := cqlr.BindQuery(q)
-	for b.Scan(&mu) {
+	for {
+		var mu meta.User
+		if !b.Scan(&mu) {
+			break
+		}
+
+		mu.Role = roles[mu.Name]
+		if mu.Role == "" {
+			mu.Role = meta.RoleUser
+		}
+		if p, ok := profiles[mu.Name]; ok {
+			mu.DisplayName, mu.Email, mu.Disabled = p.DisplayName, p.Email, p.Disabled
+		}
 		users = append(users, &mu)
 	}
 
@@ -373,11 +915,302 @@ func (self *CassandraMetaStore) Projects() ([]*meta.Project, error) {
 	return self.findAllProjects()
 }
 
+/*
+Iterates over all oids, committed or pending
+*/
+func (self *CassandraMetaStore) ForEachObject(after string, fn func(*meta.Object) error) error {
+	return self.forEachOid(after, fn)
+}
+
+/*
+Iterates over all committed projects
+*/
+func (self *CassandraMetaStore) ForEachProject(after string, fn func(*meta.Project) error) error {
+	return self.forEachProject(after, fn)
+}
+
+/*
+Returns the storage used by a project or in total, zero if nothing was
+stored
+*/
+func (self *CassandraMetaStore) GetUsage(projectName string) (*meta.Usage, error) {
+	var u meta.Usage
+	err := self.client.Query(
+		"select objects, bytes, pending_objects, pending_bytes, shared_objects, shared_bytes from project_usage where name = ?", projectName,
+	).Scan(&u.Objects, &u.Bytes, &u.PendingObjects, &u.PendingBytes, &u.SharedObjects, &u.SharedBytes)
+	if err != nil && err != gocql.ErrNotFound {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+/*
+Iterates over the usage of all projects in token order
+*/
+func (self *CassandraMetaStore) ForEachUsage(fn func(string, *meta.Usage) error) error {
+	q := self.client.Query("select name, objects, bytes, pending_objects, pending_bytes, shared_objects, shared_bytes from project_usage")
+
+	var (
+		names  []string
+		usages []*meta.Usage
+	)
+
+	scan := func(itr *gocql.Iter) bool {
+		var (
+			name string
+			u    meta.Usage
+		)
+		if !itr.Scan(&name, &u.Objects, &u.Bytes, &u.PendingObjects, &u.PendingBytes, &u.SharedObjects, &u.SharedBytes) {
+			return false
+		}
+
+		// renamed projects leave zero counters behind, they can't be deleted
+		if name != meta.TotalUsage && u != (meta.Usage{}) {
+			names = append(names, name)
+			usages = append(usages, &u)
+		}
+		return true
+	}
+
+	visit := func() error {
+		defer func() { names, usages = names[:0], usages[:0] }()
+
+		for i, name := range names {
+			if err := fn(name, usages[i]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return self.forEachPage(q, scan, visit)
+}
+
+/*
+Counts the usage of all objects. Counters can only be incremented, they are
+moved by the difference to the count
+*/
+func (self *CassandraMetaStore) RecountUsage() error {
+	delta := meta.UsageDelta{}
+	add := func(name string, u *meta.Usage) {
+		if delta[name] == nil {
+			delta[name] = &meta.Usage{}
+		}
+		delta[name].Add(u)
+	}
+
+	err := self.forEachOid("", func(m *meta.Object) error {
+		for name, u := range meta.ObjectUsage(m) {
+			add(name, u)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	current := map[string]*meta.Usage{}
+	err = self.ForEachUsage(func(name string, u *meta.Usage) error {
+		current[name] = u
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if current[meta.TotalUsage], err = self.GetUsage(meta.TotalUsage); err != nil {
+		return err
+	}
+
+	for name, u := range current {
+		add(name, u.Neg())
+	}
+
+	return self.addUsage(delta)
+}
+
 /*
 AddProject (create a new project using POST)
+Fails if the project already exists
+*/
+func (self *CassandraMetaStore) AddProject(project *meta.Project) error {
+	return self.createProject(project, false)
+}
+
+/*
+Returns a single project
+*/
+func (self *CassandraMetaStore) GetProject(name string) (*meta.Project, error) {
+	return self.findProject(name)
+}
+
+/*
+Renames, moves or transfers a project in a logged batch, the project names of
+objects are looked up in the projects table and change along. The usage is
+moved after the batch, counters can't be part of it.
+*/
+func (self *CassandraMetaStore) MoveProject(name string, move *meta.ProjectMove) (*meta.Project, error) {
+	p, err := self.findProject(name)
+	if err != nil {
+		return nil, err
+	}
+
+	renames := move.Renames(p)
+	if renames {
+		switch _, err := self.findProject(move.Name); err {
+		case nil:
+			return nil, meta.ErrProjectExists
+		case meta.ErrProjectNotFound:
+		default:
+			return nil, err
+		}
+
+		// the name may still lead to another project, it's taken as well
+		switch target, err := self.ProjectAlias(move.Name); {
+		case err == nil && target != name:
+			return nil, meta.ErrProjectExists
+		case err != nil && err != meta.ErrProjectNotFound:
+			return nil, err
+		}
+	}
+
+	var pending bool
+	if err := self.client.Query("select pending from projects where name = ?", name).Scan(&pending); err != nil {
+		return nil, err
+	}
+
+	move.Apply(p)
+
+	batch := self.client.NewBatch(gocql.LoggedBatch)
+	batch.Query(`
+		insert into
+			project_settings (name, namespace, description, owner, created_at, visibility, max_object_size)
+		values
+			(?, ?, ?, ?, ?, ?, ?)
+	`, p.Name, p.Namespace, p.Description, p.Owner, p.CreatedAt, p.Visibility, p.MaxObjectSize)
+
+	if renames {
+		batch.Query("insert into projects (name, oids, pending) values (?, ?, ?)", p.Name, p.Oids, pending)
+		batch.Query("delete from projects where name = ?", name)
+		batch.Query("delete from project_settings where name = ?", name)
+
+		itr := self.client.Query("select name from project_aliases where target = ?", name).Iter()
+		var alias string
+		for itr.Scan(&alias) {
+			batch.Query("update project_aliases set target = ? where name = ?", p.Name, alias)
+		}
+		if err := itr.Close(); err != nil {
+			return nil, err
+		}
+
+		permissions, err := self.Permissions(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, permission := range permissions {
+			batch.Query("insert into permissions (project, username, access) values (?, ?, ?)", p.Name, permission.User, permission.Access)
+		}
+		batch.Query("delete from permissions where project = ?", name)
+
+		batch.Query("delete from project_aliases where name = ?", p.Name)
+		if move.Alias {
+			batch.Query("insert into project_aliases (name, target) values (?, ?)", name, p.Name)
+		}
+	}
+
+	if err := self.client.ExecuteBatch(batch); err != nil {
+		return nil, err
+	}
+
+	if renames {
+		u, err := self.GetUsage(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := self.addUsage(meta.UsageDelta{p.Name: u, name: u.Neg()}); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+/*
+Changes the settings of a project
 */
-func (self *CassandraMetaStore) AddProject(name string) error {
-	return self.createProject(name, false)
+func (self *CassandraMetaStore) UpdateProject(name string, update *meta.ProjectUpdate) (*meta.Project, error) {
+	p, err := self.findProject(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := update.Apply(p); err != nil {
+		return nil, err
+	}
+
+	err = self.client.Query(`
+		update
+			project_settings
+		set
+			description = ?,
+			visibility = ?,
+			max_object_size = ?
+		where
+			name = ?
+	`, p.Description, p.Visibility, p.MaxObjectSize, name).Exec()
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+/*
+Removes a project that no object belongs to in a logged batch. The projects
+table lists pending objects as well. Usage counters can't be deleted, they
+are left at zero.
+*/
+func (self *CassandraMetaStore) DeleteProject(name string) error {
+	p, err := self.findProject(name)
+	if err != nil {
+		return err
+	}
+
+	if len(p.Oids) > 0 {
+		return meta.ErrProjectNotEmpty
+	}
+
+	batch := self.client.NewBatch(gocql.LoggedBatch)
+	batch.Query("delete from projects where name = ?", name)
+	batch.Query("delete from project_settings where name = ?", name)
+	batch.Query("delete from permissions where project = ?", name)
+
+	itr := self.client.Query("select name from project_aliases where target = ?", name).Iter()
+	var alias string
+	for itr.Scan(&alias) {
+		batch.Query("delete from project_aliases where name = ?", alias)
+	}
+	if err := itr.Close(); err != nil {
+		return err
+	}
+
+	return self.client.ExecuteBatch(batch)
+}
+
+/*
+Returns the project an old name of a renamed project leads to
+*/
+func (self *CassandraMetaStore) ProjectAlias(name string) (string, error) {
+	var target string
+	err := self.client.Query("select target from project_aliases where name = ?", name).Scan(&target)
+	if err == gocql.ErrNotFound {
+		return "", meta.ErrProjectNotFound
+	}
+
+	return target, err
 }
 
 /*
@@ -390,5 +1223,13 @@ func (self *CassandraMetaStore) Authenticate(user, pass string) (bool, error) {
 		return false, err
 	}
 
+	if err := self.findProfile(mu); err != nil {
+		return false, err
+	}
+
+	if mu.Disabled {
+		return false, nil
+	}
+
 	return meta.CheckPass([]byte(mu.Password), []byte(pass))
 }
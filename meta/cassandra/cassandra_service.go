@@ -1,30 +1,45 @@
 package cassandra
 
 import (
+	"errors"
 	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ksurent/lfs-server-go/config"
 
 	"github.com/gocql/gocql"
 )
 
+var (
+	errNoHosts       = errors.New("Cassandra hosts are not specified")
+	errNoDataCenters = errors.New("NetworkTopologyStrategy requires DataCenters")
+	validIdentifier  = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
 type CassandraService struct {
 	Client *gocql.Session
 }
 
-// TODO: Add auth for cassandra
 func NewCassandraSession(cfg *config.CassandraConfig) (*CassandraService, error) {
-	cluster := gocql.NewCluster(cfg.Hosts)
-	cluster.ProtoVersion = cfg.ProtoVersion
+	cluster, err := newCluster(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("config: %s", err)
+	}
+
+	replication, err := replicationOptions(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("config: %s", err)
+	}
 
 	q := fmt.Sprintf(`
 		create keyspace if not exists
 			%s
-		with replication = {
-			'class': 'SimpleStrategy',
-			'replication_factor': 1
-		};
-	`, cfg.Keyspace)
+		with replication = %s;
+	`, cfg.Keyspace, replication)
 
 	session, err := cluster.CreateSession()
 	if err != nil {
@@ -38,7 +53,6 @@ func NewCassandraSession(cfg *config.CassandraConfig) (*CassandraService, error)
 	session.Close()
 
 	cluster.Keyspace = cfg.Keyspace
-	cluster.Consistency = gocql.Quorum
 
 	session, err = cluster.CreateSession()
 	if err != nil {
@@ -53,6 +67,139 @@ func NewCassandraSession(cfg *config.CassandraConfig) (*CassandraService, error)
 	return &CassandraService{Client: session}, nil
 }
 
+func newCluster(cfg *config.CassandraConfig) (*gocql.ClusterConfig, error) {
+	hosts := config.SplitList(cfg.Hosts)
+	if len(hosts) == 0 {
+		return nil, errNoHosts
+	}
+
+	cluster := gocql.NewCluster(hosts...)
+	cluster.ProtoVersion = cfg.ProtoVersion
+
+	consistency, err := parseConsistency(cfg.Consistency)
+	if err != nil {
+		return nil, err
+	}
+	cluster.Consistency = consistency
+
+	if cfg.Username != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: cfg.Username,
+			Password: cfg.Password,
+		}
+	}
+
+	if cfg.TLS {
+		cluster.SslOpts = &gocql.SslOptions{
+			CaPath:                 cfg.CACert,
+			CertPath:               cfg.ClientCert,
+			KeyPath:                cfg.ClientKey,
+			EnableHostVerification: cfg.VerifyHost,
+		}
+	}
+
+	if cfg.Timeout != "" {
+		timeout, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("Timeout: %s", err)
+		}
+		cluster.Timeout = timeout
+	}
+
+	if cfg.ConnectTimeout != "" {
+		timeout, err := time.ParseDuration(cfg.ConnectTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("ConnectTimeout: %s", err)
+		}
+		cluster.ConnectTimeout = timeout
+	}
+
+	if cfg.NumRetries > 0 {
+		cluster.RetryPolicy = &gocql.SimpleRetryPolicy{NumRetries: cfg.NumRetries}
+	}
+
+	return cluster, nil
+}
+
+func parseConsistency(c string) (gocql.Consistency, error) {
+	switch strings.ToLower(strings.Replace(c, "_", "", -1)) {
+	case "any":
+		return gocql.Any, nil
+	case "one":
+		return gocql.One, nil
+	case "two":
+		return gocql.Two, nil
+	case "three":
+		return gocql.Three, nil
+	case "", "quorum":
+		return gocql.Quorum, nil
+	case "all":
+		return gocql.All, nil
+	case "localquorum":
+		return gocql.LocalQuorum, nil
+	case "eachquorum":
+		return gocql.EachQuorum, nil
+	case "localone":
+		return gocql.LocalOne, nil
+	default:
+		return 0, fmt.Errorf("Unknown consistency level %q", c)
+	}
+}
+
+// replicationOptions builds the replication map used when creating the
+// keyspace. DataCenters is a comma separated list of name:factor pairs and
+// is only used by NetworkTopologyStrategy.
+func replicationOptions(cfg *config.CassandraConfig) (string, error) {
+	switch cfg.ReplicationStrategy {
+	case "", "SimpleStrategy":
+		factor := cfg.ReplicationFactor
+		if factor < 1 {
+			factor = 1
+		}
+
+		return fmt.Sprintf("{'class': 'SimpleStrategy', 'replication_factor': %d}", factor), nil
+	case "NetworkTopologyStrategy":
+		dcs := make(map[string]int)
+		for _, pair := range config.SplitList(cfg.DataCenters) {
+			parts := strings.SplitN(pair, ":", 2)
+			name := strings.TrimSpace(parts[0])
+			if !validIdentifier.MatchString(name) {
+				return "", fmt.Errorf("Invalid data center name %q", name)
+			}
+
+			factor := 1
+			if len(parts) == 2 {
+				n, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+				if err != nil || n < 1 {
+					return "", fmt.Errorf("Invalid replication factor for data center %q", name)
+				}
+				factor = n
+			}
+
+			dcs[name] = factor
+		}
+
+		if len(dcs) == 0 {
+			return "", errNoDataCenters
+		}
+
+		names := make([]string, 0, len(dcs))
+		for name := range dcs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		opts := "{'class': 'NetworkTopologyStrategy'"
+		for _, name := range names {
+			opts += fmt.Sprintf(", '%s': %d", name, dcs[name])
+		}
+
+		return opts + "}", nil
+	default:
+		return "", fmt.Errorf("Unsupported replication strategy %q", cfg.ReplicationStrategy)
+	}
+}
+
 func initializeCassandra(session *gocql.Session) error {
 	// projects table
 	q := fmt.Sprintf("create table if not exists projects (name text PRIMARY KEY, oids SET<text>, pending boolean);")
@@ -70,12 +217,100 @@ func initializeCassandra(session *gocql.Session) error {
 
 	// Oids table
 	q = fmt.Sprintf(`create table if not exists oids(oid text primary key, size bigint, pending boolean);`)
-	session.Query(q).Exec()
+	err = session.Query(q).Exec()
 	if err != nil {
 		return err
 	}
 
 	// user management
 	q = fmt.Sprintf("create table if not exists users(username text primary key, password text);")
-	return session.Query(q).Exec()
+	err = session.Query(q).Exec()
+	if err != nil {
+		return err
+	}
+
+	// roles live in their own table so that existing users tables don't
+	// have to be altered
+	q = fmt.Sprintf("create table if not exists user_roles(username text primary key, role text);")
+	err = session.Query(q).Exec()
+	if err != nil {
+		return err
+	}
+
+	q = fmt.Sprintf("create table if not exists user_profiles(username text primary key, display_name text, email text, disabled boolean);")
+	err = session.Query(q).Exec()
+	if err != nil {
+		return err
+	}
+
+	q = fmt.Sprintf(`create table if not exists project_settings(
+		name text primary key,
+		namespace text,
+		description text,
+		owner text,
+		created_at timestamp,
+		visibility text,
+		max_object_size bigint
+	);`)
+	err = session.Query(q).Exec()
+	if err != nil {
+		return err
+	}
+
+	// counters can't share a table with other columns
+	q = fmt.Sprintf(`create table if not exists project_usage(
+		name text primary key,
+		objects counter,
+		bytes counter,
+		pending_objects counter,
+		pending_bytes counter,
+		shared_objects counter,
+		shared_bytes counter
+	);`)
+	err = session.Query(q).Exec()
+	if err != nil {
+		return err
+	}
+
+	q = fmt.Sprintf("create table if not exists project_aliases(name text primary key, target text);")
+	err = session.Query(q).Exec()
+	if err != nil {
+		return err
+	}
+
+	q = fmt.Sprintf("create index if not exists on project_aliases(target);")
+	err = session.Query(q).Exec()
+	if err != nil {
+		return err
+	}
+
+	// tokens are looked up by the hash of their secret
+	q = fmt.Sprintf("create table if not exists tokens(hash text primary key, id text, username text, name text, created_at timestamp);")
+	err = session.Query(q).Exec()
+	if err != nil {
+		return err
+	}
+
+	for _, column := range []string{"id", "username"} {
+		q = fmt.Sprintf("create index if not exists on tokens(%s);", column)
+		err = session.Query(q).Exec()
+		if err != nil {
+			return err
+		}
+	}
+
+	// permissions are clustered by user within their project
+	q = fmt.Sprintf("create table if not exists permissions(project text, username text, access text, primary key (project, username));")
+	err = session.Query(q).Exec()
+	if err != nil {
+		return err
+	}
+
+	q = fmt.Sprintf("create index if not exists on permissions(username);")
+	err = session.Query(q).Exec()
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
@@ -0,0 +1,103 @@
+package cassandra
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ksurent/lfs-server-go/config"
+
+	"github.com/gocql/gocql"
+)
+
+func TestNewCluster(t *testing.T) {
+	cluster, err := newCluster(&config.CassandraConfig{
+		Hosts:          "cass1:9042, cass2:9042,,cass3",
+		Username:       "lfs",
+		Password:       "secret",
+		TLS:            true,
+		CACert:         "/etc/ssl/ca.pem",
+		VerifyHost:     true,
+		Consistency:    "local_quorum",
+		Timeout:        "2s",
+		ConnectTimeout: "5s",
+		NumRetries:     3,
+	})
+	if err != nil {
+		t.Fatalf("expected newCluster() to succeed, got: %s", err)
+	}
+
+	if hosts := []string{"cass1:9042", "cass2:9042", "cass3"}; !reflect.DeepEqual(cluster.Hosts, hosts) {
+		t.Errorf("expected hosts to be %v, got: %v", hosts, cluster.Hosts)
+	}
+
+	if cluster.Consistency != gocql.LocalQuorum {
+		t.Errorf("expected consistency to be LOCAL_QUORUM, got: %s", cluster.Consistency)
+	}
+
+	if a, ok := cluster.Authenticator.(gocql.PasswordAuthenticator); !ok || a.Username != "lfs" || a.Password != "secret" {
+		t.Errorf("expected password authentication, got: %#v", cluster.Authenticator)
+	}
+
+	if cluster.SslOpts == nil || cluster.SslOpts.CaPath != "/etc/ssl/ca.pem" || !cluster.SslOpts.EnableHostVerification {
+		t.Errorf("expected TLS to be configured, got: %#v", cluster.SslOpts)
+	}
+
+	if cluster.Timeout.String() != "2s" || cluster.ConnectTimeout.String() != "5s" {
+		t.Errorf("expected timeouts to be 2s and 5s, got: %s and %s", cluster.Timeout, cluster.ConnectTimeout)
+	}
+
+	if p, ok := cluster.RetryPolicy.(*gocql.SimpleRetryPolicy); !ok || p.NumRetries != 3 {
+		t.Errorf("expected 3 retries, got: %#v", cluster.RetryPolicy)
+	}
+}
+
+func TestNewClusterInvalid(t *testing.T) {
+	for _, cfg := range []*config.CassandraConfig{
+		{Hosts: " , "},
+		{Hosts: "localhost", Consistency: "most"},
+		{Hosts: "localhost", Timeout: "soon"},
+		{Hosts: "localhost", ConnectTimeout: "later"},
+	} {
+		if _, err := newCluster(cfg); err == nil {
+			t.Errorf("expected newCluster() to fail for %#v", cfg)
+		}
+	}
+}
+
+func TestReplicationOptions(t *testing.T) {
+	for _, v := range []struct {
+		cfg      *config.CassandraConfig
+		expected string
+	}{
+		{
+			&config.CassandraConfig{},
+			"{'class': 'SimpleStrategy', 'replication_factor': 1}",
+		},
+		{
+			&config.CassandraConfig{ReplicationStrategy: "SimpleStrategy", ReplicationFactor: 3},
+			"{'class': 'SimpleStrategy', 'replication_factor': 3}",
+		},
+		{
+			&config.CassandraConfig{ReplicationStrategy: "NetworkTopologyStrategy", DataCenters: "us-east:3, eu_west:2, ap"},
+			"{'class': 'NetworkTopologyStrategy', 'ap': 1, 'eu_west': 2, 'us-east': 3}",
+		},
+	} {
+		opts, err := replicationOptions(v.cfg)
+		if err != nil {
+			t.Errorf("expected replicationOptions() to succeed, got: %s", err)
+		} else if opts != v.expected {
+			t.Errorf("expected replication to be %s, got: %s", v.expected, opts)
+		}
+	}
+
+	for _, cfg := range []*config.CassandraConfig{
+		{ReplicationStrategy: "NetworkTopologyStrategy"},
+		{ReplicationStrategy: "NetworkTopologyStrategy", DataCenters: "dc1:x"},
+		{ReplicationStrategy: "NetworkTopologyStrategy", DataCenters: "dc1':1"},
+		{ReplicationStrategy: "OldNetworkTopologyStrategy"},
+	} {
+		if _, err := replicationOptions(cfg); err == nil {
+			t.Errorf("expected replicationOptions() to fail for %#v", cfg)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package meta
 
 import (
 	"errors"
+	"time"
 )
 
 type notFound struct {
@@ -18,9 +19,19 @@ func IsObjectNotFound(err error) bool {
 }
 
 var (
-	ErrObjectNotFound  = &notFound{"Object not found"}
-	ErrProjectNotFound = errors.New("Project not found")
-	ErrUserNotFound    = errors.New("Unable to find user")
+	ErrObjectNotFound       = &notFound{"Object not found"}
+	ErrProjectNotFound      = errors.New("Project not found")
+	ErrProjectExists        = errors.New("Project already exists")
+	ErrProjectNotEmpty      = errors.New("Project still has objects")
+	ErrNoProjectName        = errors.New("Project name is required")
+	ErrNoProjectNamespace   = errors.New("Project namespace is required")
+	ErrUserNotFound         = errors.New("Unable to find user")
+	ErrTokenNotFound        = errors.New("Token not found")
+	ErrPermissionNotFound   = errors.New("Permission not found")
+	ErrInvalidAccess        = errors.New("Invalid access")
+	ErrInvalidRole          = errors.New("Invalid role")
+	ErrInvalidVisibility    = errors.New("Invalid visibility")
+	ErrInvalidMaxObjectSize = errors.New("Invalid maximum object size")
 )
 
 // MetaObject is object metadata as seen by the object and metadata stores.
@@ -33,14 +44,328 @@ type Object struct {
 
 // MetaProject is project metadata
 type Project struct {
-	Name string   `json:"name" cql:"name"`
-	Oids []string `json:"oids" cql:"oids"`
+	Name        string    `json:"name" cql:"name"`
+	Oids        []string  `json:"oids" cql:"oids"`
+	Namespace   string    `json:"namespace"`
+	Description string    `json:"description"`
+	Owner       string    `json:"owner"`
+	CreatedAt   time.Time `json:"created_at"`
+	Visibility  string    `json:"visibility"`
+	// MaxObjectSize limits the size of uploaded objects, 0 is unlimited
+	MaxObjectSize int64 `json:"max_object_size"`
+}
+
+// Project visibilities. Anybody may download from public projects
+const (
+	VisibilityPrivate = "private"
+	VisibilityPublic  = "public"
+)
+
+// ValidVisibility returns true if visibility is one of the known
+// visibilities
+func ValidVisibility(visibility string) bool {
+	return visibility == VisibilityPrivate || visibility == VisibilityPublic
+}
+
+// Normalize validates a project about to be created and fills in the
+// defaults: private visibility and the current time, truncated to what all
+// backends can store.
+func (p *Project) Normalize() error {
+	if p.Name == "" {
+		return ErrNoProjectName
+	}
+
+	if p.Visibility == "" {
+		p.Visibility = VisibilityPrivate
+	}
+	if !ValidVisibility(p.Visibility) {
+		return ErrInvalidVisibility
+	}
+
+	if p.CreatedAt.IsZero() {
+		p.CreatedAt = time.Now()
+	}
+	p.CreatedAt = p.CreatedAt.UTC().Truncate(time.Second)
+
+	return nil
+}
+
+// IsPublic returns true if anybody may download from the project
+func (p *Project) IsPublic() bool {
+	return p.Visibility == VisibilityPublic
+}
+
+// ProjectMove lists the changes MoveProject makes to a project: a new name,
+// namespace or owner, empty fields are left as they are. With Alias the old
+// name keeps leading to the renamed project.
+type ProjectMove struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Owner     string `json:"owner"`
+	Alias     bool   `json:"alias"`
+}
+
+// Renames returns true if the move gives the project a new name
+func (m *ProjectMove) Renames(p *Project) bool {
+	return m.Name != "" && m.Name != p.Name
+}
+
+// Apply copies the changes to p
+func (m *ProjectMove) Apply(p *Project) {
+	if m.Name != "" {
+		p.Name = m.Name
+	}
+	if m.Namespace != "" {
+		p.Namespace = m.Namespace
+	}
+	if m.Owner != "" {
+		p.Owner = m.Owner
+	}
+}
+
+// ProjectUpdate lists the changes UpdateProject makes to the settings of a
+// project, nil fields are left as they are. The visibility is what decides
+// who may download beyond what the authorizer allows.
+type ProjectUpdate struct {
+	Description   *string `json:"description"`
+	Visibility    *string `json:"visibility"`
+	MaxObjectSize *int64  `json:"max_object_size"`
+}
+
+// Apply copies the changes to p, it fails if they aren't valid
+func (u *ProjectUpdate) Apply(p *Project) error {
+	if u.Visibility != nil && !ValidVisibility(*u.Visibility) {
+		return ErrInvalidVisibility
+	}
+	if u.MaxObjectSize != nil && *u.MaxObjectSize < 0 {
+		return ErrInvalidMaxObjectSize
+	}
+
+	if u.Description != nil {
+		p.Description = *u.Description
+	}
+	if u.Visibility != nil {
+		p.Visibility = *u.Visibility
+	}
+	if u.MaxObjectSize != nil {
+		p.MaxObjectSize = *u.MaxObjectSize
+	}
+
+	return nil
+}
+
+// Usage is the storage used by a project, or by all projects together.
+// Objects linked to several projects count in full towards each of them and
+// are counted again as shared, the storage saved by deduplication is the
+// sum of the projects' bytes minus the total.
+type Usage struct {
+	Objects        int64 `json:"objects"`
+	Bytes          int64 `json:"bytes"`
+	PendingObjects int64 `json:"pending_objects"`
+	PendingBytes   int64 `json:"pending_bytes"`
+	SharedObjects  int64 `json:"shared_objects"`
+	SharedBytes    int64 `json:"shared_bytes"`
+}
+
+// Add adds the counts of d to u
+func (u *Usage) Add(d *Usage) {
+	u.Objects += d.Objects
+	u.Bytes += d.Bytes
+	u.PendingObjects += d.PendingObjects
+	u.PendingBytes += d.PendingBytes
+	u.SharedObjects += d.SharedObjects
+	u.SharedBytes += d.SharedBytes
+}
+
+// Neg returns the counts of u negated, to take them away
+func (u *Usage) Neg() *Usage {
+	return &Usage{
+		Objects:        -u.Objects,
+		Bytes:          -u.Bytes,
+		PendingObjects: -u.PendingObjects,
+		PendingBytes:   -u.PendingBytes,
+		SharedObjects:  -u.SharedObjects,
+		SharedBytes:    -u.SharedBytes,
+	}
+}
+
+// UsageDelta is how storing or committing an object changes the usage of
+// the projects it belongs to, keyed by project name. The change of the
+// total is stored under TotalUsage.
+type UsageDelta map[string]*Usage
+
+// TotalUsage is the UsageDelta key of the total, it can't be a project name
+// because those are single path segments
+const TotalUsage = "/"
+
+func (d UsageDelta) add(name string, u Usage) {
+	if d[name] == nil {
+		d[name] = &Usage{}
+	}
+	d[name].Add(&u)
+}
+
+// PutUsage returns the usage change of a new pending object
+func PutUsage(m *Object) UsageDelta {
+	d := UsageDelta{}
+	pending := Usage{PendingObjects: 1, PendingBytes: m.Size}
+
+	d.add(TotalUsage, pending)
+	for _, name := range m.ProjectNames {
+		if name != "" {
+			d.add(name, pending)
+		}
+	}
+
+	return d
+}
+
+// CommitUsage returns the usage change of committing a pending object
+func CommitUsage(m *Object) UsageDelta {
+	d := UsageDelta{}
+	committed := Usage{Objects: 1, Bytes: m.Size, PendingObjects: -1, PendingBytes: -m.Size}
+
+	projects := projectNames(m, "")
+	if len(projects) > 1 {
+		committed.SharedObjects, committed.SharedBytes = 1, m.Size
+	}
+
+	d.add(TotalUsage, committed)
+	for _, name := range projects {
+		d.add(name, committed)
+	}
+
+	return d
+}
+
+// LinkUsage returns the usage change of adding project to the projects of
+// the committed object m. The object becomes shared with the projects it
+// already belongs to.
+func LinkUsage(m *Object, project string) UsageDelta {
+	d := UsageDelta{}
+	others := projectNames(m, project)
+
+	linked := Usage{Objects: 1, Bytes: m.Size}
+	if len(others) > 0 {
+		linked.SharedObjects, linked.SharedBytes = 1, m.Size
+	}
+	d.add(project, linked)
+
+	if len(others) == 1 {
+		shared := Usage{SharedObjects: 1, SharedBytes: m.Size}
+		d.add(TotalUsage, shared)
+		d.add(others[0], shared)
+	}
+
+	return d
+}
+
+// projectNames returns the project names of m but the empty one and except
+func projectNames(m *Object, except string) []string {
+	var names []string
+	for _, name := range m.ProjectNames {
+		if name != "" && name != except {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// ObjectUsage returns the usage of m as it is stored, used to count the
+// usage from scratch
+func ObjectUsage(m *Object) UsageDelta {
+	d := PutUsage(m)
+	if m.Existing {
+		for name, u := range CommitUsage(m) {
+			d.add(name, *u)
+		}
+	}
+
+	return d
+}
+
+// Roles a meta store user can have
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// ValidRole returns true if role is one of the known roles
+func ValidRole(role string) bool {
+	return role == RoleUser || role == RoleAdmin
 }
 
 // MetaUser encapsulates information about a meta store user
 type User struct {
-	Name     string `cql:"username"`
-	Password string ` cql:"password"`
+	Name        string `cql:"username"`
+	Password    string ` cql:"password"`
+	Role        string `cql:"role"`
+	DisplayName string `cql:"display_name"`
+	Email       string `cql:"email"`
+	// Disabled users are kept but can't authenticate
+	Disabled bool `cql:"disabled"`
+}
+
+// UserUpdate lists the changes UpdateUser makes to a user, nil fields are
+// left as they are. The password is given in clear text.
+type UserUpdate struct {
+	Password    *string `json:"password"`
+	DisplayName *string `json:"display_name"`
+	Email       *string `json:"email"`
+	Disabled    *bool   `json:"disabled"`
+}
+
+// Apply copies the profile changes, everything but the password, to user
+func (u *UserUpdate) Apply(user *User) {
+	if u.DisplayName != nil {
+		user.DisplayName = *u.DisplayName
+	}
+	if u.Email != nil {
+		user.Email = *u.Email
+	}
+	if u.Disabled != nil {
+		user.Disabled = *u.Disabled
+	}
+}
+
+// Permission gives a user access to a project on top of what the authorizer
+// allows. Users don't have to be meta store users.
+type Permission struct {
+	User   string `json:"user"`
+	Access string `json:"access"`
+}
+
+// Access a permission gives, write access includes read access
+const (
+	AccessRead  = "read"
+	AccessWrite = "write"
+)
+
+// ValidAccess returns true if access is one of the known accesses
+func ValidAccess(access string) bool {
+	return access == AccessRead || access == AccessWrite
+}
+
+// CanWrite returns true if the permission allows uploads
+func (p *Permission) CanWrite() bool {
+	return p.Access == AccessWrite
+}
+
+// Token is an access token of a meta store user, it stands in for the
+// password when authenticating with the token authenticator. Only the hash
+// of the secret is stored.
+type Token struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Hash      string    `json:"-"`
+}
+
+// IsAdmin returns true if the user has the admin role
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
 }
 
 // Wrapper for MetaStore so we can use different types
@@ -49,12 +374,76 @@ type GenericMetaStore interface {
 	Get(v *RequestVars) (*Object, error)
 	GetPending(v *RequestVars) (*Object, error)
 	Commit(v *RequestVars) (*Object, error)
+	// Link adds the committed object v.Oid to the project v.Repo, which is
+	// created like by Put, and returns the object. Linking an object to a
+	// project it belongs to changes nothing.
+	Link(v *RequestVars) (*Object, error)
 	Close()
 	DeleteUser(user string) error
 	AddUser(user, pass string) error
-	AddProject(projectName string) error
+	GetUser(user string) (*User, error)
+	SetRole(user, role string) error
+	// UpdateUser changes the password and profile of an existing user
+	UpdateUser(user string, update *UserUpdate) error
+	AddProject(project *Project) error
+	GetProject(projectName string) (*Project, error)
+	// MoveProject renames, moves or transfers a project, along with the
+	// project names of its objects, its usage and the aliases leading to
+	// it, and returns the moved project. Renaming to an existing project,
+	// or to an alias of another one, fails with ErrProjectExists.
+	MoveProject(projectName string, move *ProjectMove) (*Project, error)
+	// UpdateProject changes the settings of a project and returns the
+	// updated project.
+	UpdateProject(projectName string, update *ProjectUpdate) (*Project, error)
+	// DeleteProject removes a project along with its usage and the aliases
+	// leading to it. Projects that objects, committed or pending, belong
+	// to can't be deleted, that fails with ErrProjectNotEmpty.
+	DeleteProject(projectName string) error
+	// ProjectAlias returns the name of the project an alias leads to, or
+	// ErrProjectNotFound if name isn't an alias.
+	ProjectAlias(name string) (string, error)
 	Users() ([]*User, error)
+	// AddToken stores a new access token
+	AddToken(token *Token) error
+	// GetToken returns the access token with the hash of a secret, or
+	// ErrTokenNotFound.
+	GetToken(hash string) (*Token, error)
+	// Tokens returns the access tokens of a user, or of all users if user
+	// is empty.
+	Tokens(user string) ([]*Token, error)
+	// RevokeToken removes the access token with the given id, or fails
+	// with ErrTokenNotFound. Deleting a user revokes their tokens.
+	RevokeToken(id string) error
+	// SetPermission gives a user access to a project, replacing the access
+	// they had, or fails with ErrProjectNotFound or ErrInvalidAccess.
+	SetPermission(projectName string, permission *Permission) error
+	// DeletePermission takes the access to a project away from a user, or
+	// fails with ErrPermissionNotFound.
+	DeletePermission(projectName, user string) error
+	// Permissions returns the permissions of a project ordered by user,
+	// none for unknown projects. They follow the project when it's renamed
+	// and are removed along with it and along with their user.
+	Permissions(projectName string) ([]*Permission, error)
 	Objects() ([]*Object, error)
 	Projects() ([]*Project, error)
+	// ForEachObject calls fn for every object, committed or pending, in
+	// an order defined by the store. If after is not empty it starts with
+	// the object following the one with that OID. Iteration stops at the
+	// first error returned by fn, which is then returned.
+	ForEachObject(after string, fn func(*Object) error) error
+	// ForEachProject is like ForEachObject for projects, after is a
+	// project name.
+	ForEachProject(after string, fn func(*Project) error) error
+	// GetUsage returns the storage used by a project, TotalUsage returns
+	// the total. Projects that never stored anything have zero usage.
+	GetUsage(projectName string) (*Usage, error)
+	// ForEachUsage calls fn with the usage of every project that has
+	// stored something, in an order defined by the store. The total is
+	// not included.
+	ForEachUsage(fn func(projectName string, usage *Usage) error) error
+	// RecountUsage replaces the usage counters with a count of all
+	// objects, for data stored before usage was counted. Uploads running
+	// at the same time may be counted twice or not at all.
+	RecountUsage() error
 	Authenticate(string, string) (bool, error)
 }
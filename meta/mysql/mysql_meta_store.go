@@ -2,18 +2,20 @@ package mysql
 
 import (
 	"database/sql"
-	"errors"
+	"strings"
+	"time"
 
 	"github.com/ksurent/lfs-server-go/config"
 	"github.com/ksurent/lfs-server-go/meta"
 )
 
-var errUnsupported = errors.New("MySQL based authentication is not implemented, please use LDAP")
-
 type MySQLMetaStore struct {
 	client *sql.DB
 }
 
+// pageSize is the number of rows fetched at a time when iterating
+const pageSize = 1000
+
 func NewMySQLMetaStore(cfg *config.MySQLConfig) (*MySQLMetaStore, error) {
 	db, err := NewMySQLSession(cfg)
 	if err != nil {
@@ -111,49 +113,294 @@ func (s *MySQLMetaStore) mapOid(id int) ([]string, error) {
 	return oidList, nil
 }
 
+// projectColumns are the columns scanned by scanProject
+const projectColumns = "id, name, namespace, description, owner, created_at, visibility, max_object_size"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (s *MySQLMetaStore) scanProject(row scanner) (*meta.Project, error) {
+	id, p, err := scanProjectRow(row)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Oids, err = s.mapOid(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// scanProjectRow scans a project without its oids
+func scanProjectRow(row scanner) (int, *meta.Project, error) {
+	var (
+		id int
+		p  meta.Project
+	)
+
+	err := row.Scan(&id, &p.Name, &p.Namespace, &p.Description, &p.Owner, &p.CreatedAt, &p.Visibility, &p.MaxObjectSize)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return id, &p, nil
+}
+
 // Find all committed projects
 func (s *MySQLMetaStore) findAllProjects() ([]*meta.Project, error) {
-	rows, err := s.client.Query("select id, name from projects where pending = 0")
+	rows, err := s.client.Query("select " + projectColumns + " from projects where pending = 0")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var (
-		name        string
-		id          int
-		projectList []*meta.Project
-	)
+	var projectList []*meta.Project
 
 	for rows.Next() {
-		err := rows.Scan(&id, &name)
+		p, err := s.scanProject(rows)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				return nil, meta.ErrObjectNotFound
-			}
 			return nil, err
 		}
 
-		oids, err := s.mapOid(id)
+		projectList = append(projectList, p)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return projectList, nil
+}
+
+// Find a committed project by name
+func (s *MySQLMetaStore) findProject(name string) (*meta.Project, error) {
+	row := s.client.QueryRow("select "+projectColumns+" from projects where name = ? and pending = 0", name)
+
+	p, err := s.scanProject(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, meta.ErrProjectNotFound
+		}
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Iterate over all objects in oid order, a page at a time
+func (s *MySQLMetaStore) forEachOid(after string, fn func(*meta.Object) error) error {
+	for {
+		page, err := s.findOidPage(after)
 		if err != nil {
+			return err
+		}
+
+		for _, m := range page {
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+
+		if len(page) < pageSize {
+			return nil
+		}
+
+		after = page[len(page)-1].Oid
+	}
+}
+
+func (s *MySQLMetaStore) findOidPage(after string) ([]*meta.Object, error) {
+	rows, err := s.client.Query(`
+		select
+			oid, size, pending
+		from
+			oids
+		where
+			oid > ?
+		order by
+			oid
+		limit ?
+	`, after, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		page  []*meta.Object
+		byOid = make(map[string]*meta.Object)
+		args  []interface{}
+	)
+
+	for rows.Next() {
+		var (
+			m       meta.Object
+			pending bool
+		)
+		if err := rows.Scan(&m.Oid, &m.Size, &pending); err != nil {
 			return nil, err
 		}
+		m.Existing = !pending
 
-		projectList = append(projectList, &meta.Project{Name: name, Oids: oids})
+		page = append(page, &m)
+		byOid[m.Oid] = &m
+		args = append(args, m.Oid)
 	}
 
-	err = rows.Err()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page) == 0 {
+		return nil, nil
+	}
+
+	rows, err = s.client.Query(`
+		select
+			m.oid, p.name
+		from
+			oid_maps m
+		join
+			projects p
+		on
+			p.id = m.projectID
+		where
+			m.oid in (?`+strings.Repeat(", ?", len(args)-1)+`)
+	`, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return projectList, nil
+	for rows.Next() {
+		var oid, name string
+		if err := rows.Scan(&oid, &name); err != nil {
+			return nil, err
+		}
+
+		if m, ok := byOid[oid]; ok {
+			m.ProjectNames = append(m.ProjectNames, name)
+		}
+	}
+
+	return page, rows.Err()
 }
 
-// Create committed project (called from the management interface)
-func (s *MySQLMetaStore) createProject(name string) error {
-	_, err := s.client.Exec("insert into projects (name, pending) values (?, 0)", name)
-	return err
+// Iterate over all committed projects in name order, a page at a time
+func (s *MySQLMetaStore) forEachProject(after string, fn func(*meta.Project) error) error {
+	for {
+		ids, page, err := s.findProjectPage(after)
+		if err != nil {
+			return err
+		}
+
+		for i, p := range page {
+			p.Oids, err = s.mapOid(ids[i])
+			if err != nil {
+				return err
+			}
+
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+
+		if len(page) < pageSize {
+			return nil
+		}
+
+		after = page[len(page)-1].Name
+	}
+}
+
+func (s *MySQLMetaStore) findProjectPage(after string) ([]int, []*meta.Project, error) {
+	rows, err := s.client.Query(`
+		select
+			`+projectColumns+`
+		from
+			projects
+		where
+			pending = 0
+			and name > ?
+		order by
+			name
+		limit ?
+	`, after, pageSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var (
+		ids  []int
+		page []*meta.Project
+	)
+
+	for rows.Next() {
+		id, p, err := scanProjectRow(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		ids = append(ids, id)
+		page = append(page, p)
+	}
+
+	return ids, page, rows.Err()
+}
+
+// Create committed project (called from the management interface). A
+// project only known from pending uploads is taken over.
+func (s *MySQLMetaStore) createProject(p *meta.Project) error {
+	if err := p.Normalize(); err != nil {
+		return err
+	}
+
+	tx, err := s.client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var pending bool
+	err = tx.QueryRow("select pending from projects where name = ? for update", p.Name).Scan(&pending)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec(`
+			insert into
+				projects (name, pending, namespace, description, owner, created_at, visibility, max_object_size)
+			values
+				(?, 0, ?, ?, ?, ?, ?, ?)
+		`, p.Name, p.Namespace, p.Description, p.Owner, p.CreatedAt, p.Visibility, p.MaxObjectSize)
+	case err != nil:
+		return err
+	case !pending:
+		return meta.ErrProjectExists
+	default:
+		_, err = tx.Exec(`
+			update
+				projects
+			set
+				pending = 0,
+				namespace = ?,
+				description = ?,
+				owner = ?,
+				created_at = ?,
+				visibility = ?,
+				max_object_size = ?
+			where
+				name = ?
+		`, p.Namespace, p.Description, p.Owner, p.CreatedAt, p.Visibility, p.MaxObjectSize, p.Name)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // Transactionally change status from pending to committed
@@ -162,40 +409,97 @@ func (s *MySQLMetaStore) commitPendingObject(m *meta.Object) error {
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("update oids set pending = 0 where oid = ? and pending = 1", m.Oid)
+	if err != nil {
+		return err
+	}
 
-	tx.Exec("update oids set pending = 0 where oid = ?", m.Oid)
+	// somebody else committed it in the meantime, it's accounted for
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
 
 	for _, name := range m.ProjectNames {
 		tx.Exec("update projects set pending = 0 where name = ?", name)
 	}
 
+	if err := addUsage(tx, meta.CommitUsage(m)); err != nil {
+		return err
+	}
+
 	return tx.Commit()
 }
 
-// Transactionally create pending oid and related data
-func (s *MySQLMetaStore) createPendingObject(m *meta.Object) error {
+// addUsage adds delta to the usage counters
+func addUsage(tx *sql.Tx, delta meta.UsageDelta) error {
+	for name, d := range delta {
+		_, err := tx.Exec(`
+			insert into
+				project_usage (name, objects, bytes, pending_objects, pending_bytes, shared_objects, shared_bytes)
+			values
+				(?, ?, ?, ?, ?, ?, ?)
+			on duplicate key update
+				objects = objects + values(objects),
+				bytes = bytes + values(bytes),
+				pending_objects = pending_objects + values(pending_objects),
+				pending_bytes = pending_bytes + values(pending_bytes),
+				shared_objects = shared_objects + values(shared_objects),
+				shared_bytes = shared_bytes + values(shared_bytes)
+		`, name, d.Objects, d.Bytes, d.PendingObjects, d.PendingBytes, d.SharedObjects, d.SharedBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const usageColumns = "objects, bytes, pending_objects, pending_bytes, shared_objects, shared_bytes"
+
+func scanUsage(row scanner, u *meta.Usage) error {
+	return row.Scan(&u.Objects, &u.Bytes, &u.PendingObjects, &u.PendingBytes, &u.SharedObjects, &u.SharedBytes)
+}
+
+// Transactionally create pending oid and related data, new projects are
+// owned by the uploader
+func (s *MySQLMetaStore) createPendingObject(m *meta.Object, namespace, owner string) error {
 	tx, err := s.client.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("insert ignore into oids (oid, size, pending) values (?, ?, 1)", m.Oid, m.Size)
+	if err != nil {
+		return err
+	}
 
-	tx.Exec("insert into oids (oid, size, pending) values (?, ?, 1)", m.Oid, m.Size)
+	// somebody else stored it in the meantime, it's accounted for
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
 
 	for _, name := range m.ProjectNames {
 		res, err := tx.Exec(`
 			insert into
-				projects (name, pending)
+				projects (name, pending, namespace, owner, created_at, visibility)
 			values
-				(?, 1)
+				(?, 1, ?, ?, ?, ?)
 			on duplicate key update
 				id = last_insert_id(id)
-		`, name)
+		`, name, namespace, owner, time.Now().UTC().Truncate(time.Second), meta.VisibilityPrivate)
 		if err == nil {
 			id, _ := res.LastInsertId()
 			tx.Exec("insert into oid_maps (oid, projectID) values (?, ?)", m.Oid, id)
 		}
 	}
 
+	if err := addUsage(tx, meta.PutUsage(m)); err != nil {
+		return err
+	}
+
 	return tx.Commit()
 }
 
@@ -239,8 +543,7 @@ func (s *MySQLMetaStore) findOid(oid string, pending bool) (*meta.Object, error)
 			p.id = m.projectID
 		where
 			m.oid = ?
-			and p.pending = ?
-	`, oid, n)
+	`, oid)
 	if err != nil {
 		return nil, err
 	}
@@ -286,7 +589,7 @@ func (s *MySQLMetaStore) Put(v *meta.RequestVars) (*meta.Object, error) {
 		Existing:     false,
 	}
 
-	err := s.doPut(m)
+	err := s.createPendingObject(m, v.Namespace, v.User)
 	if err != nil {
 		return nil, err
 	}
@@ -294,34 +597,113 @@ func (s *MySQLMetaStore) Put(v *meta.RequestVars) (*meta.Object, error) {
 	return m, nil
 }
 
-// Commit() finds uncommitted objects in the meta store using data in
-// meta.RequestVars and commits them
-func (s *MySQLMetaStore) Commit(v *meta.RequestVars) (*meta.Object, error) {
-	m, err := s.GetPending(v)
+/*
+Link (add a committed object to a project)
+the object row is locked while its projects are read and the link added
+*/
+func (s *MySQLMetaStore) Link(v *meta.RequestVars) (*meta.Object, error) {
+	tx, err := s.client.Begin()
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
 
-	m.Existing = true
+	m := &meta.Object{Existing: true}
+	err = tx.QueryRow("select oid, size from oids where oid = ? and pending = 0 for update", v.Oid).Scan(&m.Oid, &m.Size)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, meta.ErrObjectNotFound
+		}
+		return nil, err
+	}
 
-	err = s.doPut(m)
+	rows, err := tx.Query(`
+		select
+			p.name
+		from
+			projects p
+		join
+			oid_maps m
+		on
+			p.id = m.projectID
+		where
+			m.oid = ?
+	`, v.Oid)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		m.ProjectNames = append(m.ProjectNames, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, name := range m.ProjectNames {
+		if name == v.Repo {
+			return m, nil
+		}
+	}
+
+	// the object is committed, so is the project it's linked to
+	res, err := tx.Exec(`
+		insert into
+			projects (name, pending, namespace, owner, created_at, visibility)
+		values
+			(?, 0, ?, ?, ?, ?)
+		on duplicate key update
+			id = last_insert_id(id),
+			pending = 0
+	`, v.Repo, v.Namespace, v.User, time.Now().UTC().Truncate(time.Second), meta.VisibilityPrivate)
 	if err != nil {
 		return nil, err
 	}
 
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("insert into oid_maps (oid, projectID) values (?, ?)", m.Oid, id); err != nil {
+		return nil, err
+	}
+
+	delta := meta.LinkUsage(m, v.Repo)
+	m.ProjectNames = append(m.ProjectNames, v.Repo)
+
+	if err := addUsage(tx, delta); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
 	return m, nil
 }
 
-func (s *MySQLMetaStore) doPut(m *meta.Object) error {
-	if !m.Existing {
-		if err := s.createPendingObject(m); err != nil {
-			return err
-		}
+// Commit() finds uncommitted objects in the meta store using data in
+// meta.RequestVars and commits them
+func (s *MySQLMetaStore) Commit(v *meta.RequestVars) (*meta.Object, error) {
+	m, err := s.GetPending(v)
+	if err != nil {
+		return nil, err
+	}
 
-		return nil
+	m.Existing = true
+
+	err = s.commitPendingObject(m)
+	if err != nil {
+		return nil, err
 	}
 
-	return s.commitPendingObject(m)
+	return m, nil
 }
 
 func (s *MySQLMetaStore) Get(v *meta.RequestVars) (*meta.Object, error) {
@@ -336,35 +718,527 @@ func (s *MySQLMetaStore) GetPending(v *meta.RequestVars) (*meta.Object, error) {
 
 /*
 AddUser (Add a new user)
-Not implemented in mysql_meta_store
+Existing users are left untouched
 */
 func (s *MySQLMetaStore) AddUser(user, pass string) error {
-	return errUnsupported
+	encryptedPass, err := meta.EncryptPass([]byte(pass))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.Exec(`
+		insert into
+			users (username, password)
+		values
+			(?, ?)
+		on duplicate key update
+			username = username
+	`, user, encryptedPass)
+	return err
 }
 
 /*
 AddProject (Add a new project)
+Fails if the project already exists
 */
-func (s *MySQLMetaStore) AddProject(name string) error {
-	return s.createProject(name)
+func (s *MySQLMetaStore) AddProject(project *meta.Project) error {
+	return s.createProject(project)
 }
 
 /*
-DeleteUser (Delete a user)
-Not implemented
+GetProject (get a single project)
 */
-func (s *MySQLMetaStore) DeleteUser(user string) error {
-	return errUnsupported
+func (s *MySQLMetaStore) GetProject(name string) (*meta.Project, error) {
+	return s.findProject(name)
 }
 
 /*
-Users (get list of users)
-Not implemented
+MoveProject (rename, move or transfer a project)
+objects refer to projects by id, only the project and the tables keyed by
+its name change
 */
-func (s *MySQLMetaStore) Users() ([]*meta.User, error) {
-	return nil, errUnsupported
-}
-
+func (s *MySQLMetaStore) MoveProject(name string, move *meta.ProjectMove) (*meta.Project, error) {
+	tx, err := s.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRow("select "+projectColumns+" from projects where name = ? and pending = 0 for update", name)
+	id, p, err := scanProjectRow(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, meta.ErrProjectNotFound
+		}
+		return nil, err
+	}
+
+	renames := move.Renames(p)
+	if renames {
+		var n int
+		if err := tx.QueryRow("select count(*) from projects where name = ? for update", move.Name).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return nil, meta.ErrProjectExists
+		}
+
+		// the name may still lead to another project, it's taken as well
+		err := tx.QueryRow("select count(*) from project_aliases where name = ? and target <> ? for update", move.Name, name).Scan(&n)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return nil, meta.ErrProjectExists
+		}
+	}
+
+	move.Apply(p)
+
+	_, err = tx.Exec("update projects set name = ?, namespace = ?, owner = ? where id = ?", p.Name, p.Namespace, p.Owner, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if renames {
+		for _, q := range []struct {
+			query string
+			args  []interface{}
+		}{
+			{"update project_usage set name = ? where name = ?", []interface{}{p.Name, name}},
+			{"update project_aliases set target = ? where target = ?", []interface{}{p.Name, name}},
+			{"update permissions set project = ? where project = ?", []interface{}{p.Name, name}},
+			{"delete from project_aliases where name = ?", []interface{}{p.Name}},
+		} {
+			if _, err := tx.Exec(q.query, q.args...); err != nil {
+				return nil, err
+			}
+		}
+
+		if move.Alias {
+			_, err := tx.Exec("insert into project_aliases (name, target) values (?, ?)", name, p.Name)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if p.Oids, err = s.mapOid(id); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+/*
+UpdateProject (change the settings of a project)
+*/
+func (s *MySQLMetaStore) UpdateProject(name string, update *meta.ProjectUpdate) (*meta.Project, error) {
+	tx, err := s.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRow("select "+projectColumns+" from projects where name = ? and pending = 0 for update", name)
+	id, p, err := scanProjectRow(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, meta.ErrProjectNotFound
+		}
+		return nil, err
+	}
+
+	if err := update.Apply(p); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(
+		"update projects set description = ?, visibility = ?, max_object_size = ? where id = ?",
+		p.Description, p.Visibility, p.MaxObjectSize, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if p.Oids, err = s.mapOid(id); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+/*
+DeleteProject (remove a project no object belongs to)
+pending objects are mapped to their projects as well
+*/
+func (s *MySQLMetaStore) DeleteProject(name string) error {
+	tx, err := s.client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow("select id from projects where name = ? and pending = 0 for update", name).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return meta.ErrProjectNotFound
+		}
+		return err
+	}
+
+	var n int
+	if err := tx.QueryRow("select count(*) from oid_maps where projectID = ?", id).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return meta.ErrProjectNotEmpty
+	}
+
+	for _, q := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{"delete from project_aliases where target = ?", []interface{}{name}},
+		{"delete from project_usage where name = ?", []interface{}{name}},
+		{"delete from permissions where project = ?", []interface{}{name}},
+		{"delete from projects where id = ?", []interface{}{id}},
+	} {
+		if _, err := tx.Exec(q.query, q.args...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+/*
+ProjectAlias (the project an old name of a renamed project leads to)
+*/
+func (s *MySQLMetaStore) ProjectAlias(name string) (string, error) {
+	var target string
+	err := s.client.QueryRow("select target from project_aliases where name = ?", name).Scan(&target)
+	if err == sql.ErrNoRows {
+		return "", meta.ErrProjectNotFound
+	}
+
+	return target, err
+}
+
+/*
+DeleteUser (Delete a user)
+their tokens and permissions go along
+*/
+func (s *MySQLMetaStore) DeleteUser(user string) error {
+	tx, err := s.client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("delete from users where username = ?", user); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("delete from tokens where username = ?", user); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("delete from permissions where username = ?", user); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+/*
+AddToken (store an access token)
+*/
+func (s *MySQLMetaStore) AddToken(token *meta.Token) error {
+	_, err := s.client.Exec(
+		"insert into tokens (hash, id, username, name, created_at) values (?, ?, ?, ?, ?)",
+		token.Hash, token.ID, token.User, token.Name, token.CreatedAt,
+	)
+	return err
+}
+
+/*
+GetToken (get the access token with a hash)
+*/
+func (s *MySQLMetaStore) GetToken(hash string) (*meta.Token, error) {
+	t := &meta.Token{Hash: hash}
+	err := s.client.QueryRow(
+		"select id, username, name, created_at from tokens where hash = ?", hash,
+	).Scan(&t.ID, &t.User, &t.Name, &t.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, meta.ErrTokenNotFound
+		}
+		return nil, err
+	}
+
+	return t, nil
+}
+
+/*
+Tokens (get the access tokens of a user, or all of them)
+*/
+func (s *MySQLMetaStore) Tokens(user string) ([]*meta.Token, error) {
+	rows, err := s.client.Query(`
+		select
+			hash, id, username, name, created_at
+		from
+			tokens
+		where
+			? = '' or username = ?
+		order by
+			username, created_at
+	`, user, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*meta.Token
+	for rows.Next() {
+		var t meta.Token
+		if err := rows.Scan(&t.Hash, &t.ID, &t.User, &t.Name, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &t)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+/*
+RevokeToken (remove an access token)
+*/
+func (s *MySQLMetaStore) RevokeToken(id string) error {
+	res, err := s.client.Exec("delete from tokens where id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return meta.ErrTokenNotFound
+	}
+
+	return nil
+}
+
+/*
+SetPermission (give a user access to a project)
+*/
+func (s *MySQLMetaStore) SetPermission(name string, permission *meta.Permission) error {
+	if !meta.ValidAccess(permission.Access) {
+		return meta.ErrInvalidAccess
+	}
+
+	tx, err := s.client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow("select id from projects where name = ? and pending = 0 for update", name).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return meta.ErrProjectNotFound
+		}
+		return err
+	}
+
+	_, err = tx.Exec(`
+		insert into
+			permissions (project, username, access)
+		values
+			(?, ?, ?)
+		on duplicate key update
+			access = values(access)
+	`, name, permission.User, permission.Access)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+/*
+DeletePermission (take the access to a project away from a user)
+*/
+func (s *MySQLMetaStore) DeletePermission(name, user string) error {
+	res, err := s.client.Exec("delete from permissions where project = ? and username = ?", name, user)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return meta.ErrPermissionNotFound
+	}
+
+	return nil
+}
+
+/*
+Permissions (get the permissions of a project)
+*/
+func (s *MySQLMetaStore) Permissions(name string) ([]*meta.Permission, error) {
+	rows, err := s.client.Query(`
+		select
+			username, access
+		from
+			permissions
+		where
+			project = ?
+		order by
+			username
+	`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions []*meta.Permission
+	for rows.Next() {
+		var p meta.Permission
+		if err := rows.Scan(&p.User, &p.Access); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, &p)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+/*
+GetUser (get a single user)
+return meta user object without password
+*/
+func (s *MySQLMetaStore) GetUser(user string) (*meta.User, error) {
+	mu := &meta.User{Name: user}
+	err := s.client.QueryRow(`
+		select
+			role, display_name, email, disabled
+		from
+			users
+		where
+			username = ?
+	`, user).Scan(&mu.Role, &mu.DisplayName, &mu.Email, &mu.Disabled)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, meta.ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	return mu, nil
+}
+
+/*
+SetRole (change the role of an existing user)
+*/
+func (s *MySQLMetaStore) SetRole(user, role string) error {
+	if !meta.ValidRole(role) {
+		return meta.ErrInvalidRole
+	}
+
+	if _, err := s.GetUser(user); err != nil {
+		return err
+	}
+
+	_, err := s.client.Exec("update users set role = ? where username = ?", role, user)
+	return err
+}
+
+/*
+UpdateUser (change the password and profile of an existing user)
+*/
+func (s *MySQLMetaStore) UpdateUser(user string, update *meta.UserUpdate) error {
+	mu, err := s.GetUser(user)
+	if err != nil {
+		return err
+	}
+	update.Apply(mu)
+
+	q := "update users set display_name = ?, email = ?, disabled = ?"
+	args := []interface{}{mu.DisplayName, mu.Email, mu.Disabled}
+
+	if update.Password != nil {
+		encryptedPass, err := meta.EncryptPass([]byte(*update.Password))
+		if err != nil {
+			return err
+		}
+
+		q += ", password = ?"
+		args = append(args, encryptedPass)
+	}
+
+	_, err = s.client.Exec(q+" where username = ?", append(args, user)...)
+	return err
+}
+
+/*
+Users (get list of users)
+return meta user objects without passwords
+*/
+func (s *MySQLMetaStore) Users() ([]*meta.User, error) {
+	rows, err := s.client.Query(`
+		select
+			username, role, display_name, email, disabled
+		from
+			users
+		order by
+			username
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*meta.User
+	for rows.Next() {
+		var mu meta.User
+		if err := rows.Scan(&mu.Name, &mu.Role, &mu.DisplayName, &mu.Email, &mu.Disabled); err != nil {
+			return nil, err
+		}
+		users = append(users, &mu)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
 /*
 Objects (get all oids)
 return meta object
@@ -381,6 +1255,149 @@ func (s *MySQLMetaStore) Projects() ([]*meta.Project, error) {
 	return s.findAllProjects()
 }
 
+/*
+ForEachObject (iterate over all oids, committed or pending)
+in oid order
+*/
+func (s *MySQLMetaStore) ForEachObject(after string, fn func(*meta.Object) error) error {
+	return s.forEachOid(after, fn)
+}
+
+/*
+ForEachProject (iterate over all projects)
+in name order
+*/
+func (s *MySQLMetaStore) ForEachProject(after string, fn func(*meta.Project) error) error {
+	return s.forEachProject(after, fn)
+}
+
+/*
+GetUsage (storage used by a project or in total)
+projects that never stored anything have zero usage
+*/
+func (s *MySQLMetaStore) GetUsage(projectName string) (*meta.Usage, error) {
+	var u meta.Usage
+	err := scanUsage(s.client.QueryRow("select "+usageColumns+" from project_usage where name = ?", projectName), &u)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+/*
+ForEachUsage (iterate over the usage of all projects)
+in name order
+*/
+func (s *MySQLMetaStore) ForEachUsage(fn func(string, *meta.Usage) error) error {
+	after := ""
+
+	for {
+		names, usages, err := s.findUsagePage(after)
+		if err != nil {
+			return err
+		}
+
+		for i, name := range names {
+			if err := fn(name, usages[i]); err != nil {
+				return err
+			}
+		}
+
+		if len(names) < pageSize {
+			return nil
+		}
+		after = names[len(names)-1]
+	}
+}
+
+/*
+RecountUsage (count the usage of all objects)
+the counters are replaced in a single transaction
+*/
+func (s *MySQLMetaStore) RecountUsage() error {
+	total := meta.UsageDelta{}
+	err := s.forEachOid("", func(m *meta.Object) error {
+		for name, u := range meta.ObjectUsage(m) {
+			if total[name] == nil {
+				total[name] = &meta.Usage{}
+			}
+			total[name].Add(u)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("delete from project_usage"); err != nil {
+		return err
+	}
+
+	if err := addUsage(tx, total); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *MySQLMetaStore) findUsagePage(after string) ([]string, []*meta.Usage, error) {
+	rows, err := s.client.Query(`
+		select
+			name, `+usageColumns+`
+		from
+			project_usage
+		where
+			name > ?
+			and name != ?
+		order by
+			name
+		limit ?
+	`, after, meta.TotalUsage, pageSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var (
+		names  []string
+		usages []*meta.Usage
+	)
+	for rows.Next() {
+		var (
+			name string
+			u    meta.Usage
+		)
+		if err := rows.Scan(&name, &u.Objects, &u.Bytes, &u.PendingObjects, &u.PendingBytes, &u.SharedObjects, &u.SharedBytes); err != nil {
+			return nil, nil, err
+		}
+
+		names = append(names, name)
+		usages = append(usages, &u)
+	}
+
+	return names, usages, rows.Err()
+}
+
+/*
+Authenticate (check user credentials)
+Unknown and disabled users fail authentication without an error
+*/
 func (s *MySQLMetaStore) Authenticate(user, pass string) (bool, error) {
-	return false, errUnsupported
+	var encryptedPass string
+	err := s.client.QueryRow("select password from users where username = ? and disabled = 0", user).Scan(&encryptedPass)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return meta.CheckPass([]byte(encryptedPass), []byte(pass))
 }
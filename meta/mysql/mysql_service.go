@@ -17,7 +17,7 @@ func NewMySQLSession(cfg *config.MySQLConfig) (*sql.DB, error) {
 		return nil, fmt.Errorf("config: %s", err)
 	}
 
-	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s",
+	dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true",
 		cfg.Username,
 		cfg.Password,
 		cfg.Host,
@@ -51,7 +51,13 @@ func createTables(db *sql.DB) error {
 			projects(
 				id int not null auto_increment primary key,
 				name varchar(255) not null unique,
-				pending tinyint(1) unsigned not null default 1
+				pending tinyint(1) unsigned not null default 1,
+				namespace varchar(255) not null default '',
+				description varchar(1024) not null default '',
+				owner varchar(255) not null default '',
+				created_at datetime not null default current_timestamp,
+				visibility varchar(16) not null default 'private',
+				max_object_size bigint not null default 0
 			)
 		engine=innodb
 	`)
@@ -78,7 +84,122 @@ func createTables(db *sql.DB) error {
 		engine=innodb
 	`)
 
-	return tx.Commit()
+	tx.Exec(`
+		create table if not exists
+			project_usage(
+				name varchar(255) not null primary key,
+				objects bigint not null default 0,
+				bytes bigint not null default 0,
+				pending_objects bigint not null default 0,
+				pending_bytes bigint not null default 0,
+				shared_objects bigint not null default 0,
+				shared_bytes bigint not null default 0
+			)
+		engine=innodb
+	`)
+
+	tx.Exec(`
+		create table if not exists
+			project_aliases(
+				name varchar(255) not null primary key,
+				target varchar(255) not null,
+
+				index (target)
+			)
+		engine=innodb
+	`)
+
+	tx.Exec(`
+		create table if not exists
+			users(
+				username varchar(255) not null primary key,
+				password varchar(255) not null,
+				role varchar(32) not null default 'user',
+				display_name varchar(255) not null default '',
+				email varchar(255) not null default '',
+				disabled tinyint(1) unsigned not null default 0
+			)
+		engine=innodb
+	`)
+
+	tx.Exec(`
+		create table if not exists
+			tokens(
+				hash char(64) not null primary key,
+				id varchar(32) not null unique,
+				username varchar(255) not null,
+				name varchar(255) not null default '',
+				created_at datetime not null,
+
+				index (username)
+			)
+		engine=innodb
+	`)
+
+	tx.Exec(`
+		create table if not exists
+			permissions(
+				project varchar(255) not null,
+				username varchar(255) not null,
+				access varchar(16) not null,
+
+				primary key (project, username),
+				index (username)
+			)
+		engine=innodb
+	`)
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return addColumns(db)
+}
+
+// addedColumns are columns that tables created by older versions lack
+var addedColumns = []struct {
+	table, column, definition string
+}{
+	{"users", "role", "varchar(32) not null default 'user'"},
+	{"users", "display_name", "varchar(255) not null default ''"},
+	{"users", "email", "varchar(255) not null default ''"},
+	{"users", "disabled", "tinyint(1) unsigned not null default 0"},
+	{"projects", "namespace", "varchar(255) not null default ''"},
+	{"projects", "description", "varchar(1024) not null default ''"},
+	{"projects", "owner", "varchar(255) not null default ''"},
+	{"projects", "created_at", "datetime not null default current_timestamp"},
+	{"projects", "visibility", "varchar(16) not null default 'private'"},
+	{"projects", "max_object_size", "bigint not null default 0"},
+}
+
+func addColumns(db *sql.DB) error {
+	for _, c := range addedColumns {
+		var n int
+		err := db.QueryRow(`
+			select
+				count(*)
+			from
+				information_schema.columns
+			where
+				table_schema = database()
+				and table_name = ?
+				and column_name = ?
+		`, c.table, c.column).Scan(&n)
+		if err != nil {
+			return err
+		}
+
+		if n > 0 {
+			continue
+		}
+
+		_, err = db.Exec(fmt.Sprintf("alter table %s add column %s %s", c.table, c.column, c.definition))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func validateConfig(cfg *config.MySQLConfig) error {
@@ -0,0 +1,16 @@
+package postgres
+
+import (
+	"github.com/ksurent/lfs-server-go/config"
+	"github.com/ksurent/lfs-server-go/meta/sqlstore"
+)
+
+// NewPostgresMetaStore connects to the database, brings its schema up to
+// date and returns a meta store on it
+func NewPostgresMetaStore(cfg *config.PostgresConfig) (*sqlstore.MetaStore, error) {
+	db, err := NewPostgresSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return sqlstore.NewMetaStore(db, sqlstore.Postgres), nil
+}
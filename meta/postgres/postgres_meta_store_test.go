@@ -0,0 +1,66 @@
+package postgres
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/ksurent/lfs-server-go/config"
+	"github.com/ksurent/lfs-server-go/meta/sqlstore"
+	"github.com/ksurent/lfs-server-go/meta/sqlstore/sqlstoretest"
+)
+
+func TestMetaStore(t *testing.T) {
+	sqlstoretest.Run(t, setupMeta)
+}
+
+func TestMigrate(t *testing.T) {
+	db, teardown, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	// a second server starting up finds the schema up to date
+	if err := migrate(db); err != nil {
+		t.Fatalf("expected migrate() to succeed again, got: %s", err)
+	}
+
+	var n, version int
+	err = db.QueryRow("select count(*), max(version) from schema_migrations").Scan(&n, &version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(migrations) || version != len(migrations) {
+		t.Errorf("expected %d migrations to be recorded once, got %d up to version %d", len(migrations), n, version)
+	}
+}
+
+func setupDB() (*sql.DB, func(), error) {
+	db, err := NewPostgresSession(&config.PostgresConfig{
+		Enabled:  true,
+		Host:     "127.0.0.1:5432",
+		Username: "lfs_server",
+		Password: "pass123",
+		Database: "lfs_server_go_test",
+		SSLMode:  "disable",
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	teardown := func() {
+		db.Exec("TRUNCATE TABLE oid_maps, oids, projects, users, project_usage, project_aliases, tokens, permissions RESTART IDENTITY")
+		db.Close()
+	}
+
+	return db, teardown, nil
+}
+
+func setupMeta() (*sqlstore.MetaStore, func(), error) {
+	db, teardown, err := setupDB()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return sqlstore.NewMetaStore(db, sqlstore.Postgres), teardown, nil
+}
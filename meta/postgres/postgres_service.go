@@ -0,0 +1,206 @@
+package postgres
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/ksurent/lfs-server-go/config"
+
+	_ "github.com/lib/pq"
+)
+
+func NewPostgresSession(cfg *config.PostgresConfig) (*sql.DB, error) {
+	err := validateConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("config: %s", err)
+	}
+
+	dsn := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(cfg.Username, cfg.Password),
+		Host:   cfg.Host,
+		Path:   cfg.Database,
+	}
+	if cfg.SSLMode != "" {
+		dsn.RawQuery = url.Values{"sslmode": {cfg.SSLMode}}.Encode()
+	}
+
+	db, err := sql.Open("postgres", dsn.String())
+	if err != nil {
+		return nil, fmt.Errorf("open: %s", err)
+	}
+
+	err = db.Ping()
+	if err != nil {
+		return nil, fmt.Errorf("ping: %s", err)
+	}
+
+	if err := migrate(db); err != nil {
+		return nil, fmt.Errorf("migrating the schema: %s", err)
+	}
+
+	return db, nil
+}
+
+// migrations create and change the schema, in order. Each one runs once, in
+// a transaction of its own, and its number is recorded in
+// schema_migrations. Only ever append to the list.
+//
+// Names are compared byte by byte, like in the other stores, so that
+// iteration doesn't depend on the collation of the database.
+var migrations = []string{
+	`
+	create table projects(
+		id serial primary key,
+		name varchar(255) collate "C" not null unique,
+		pending boolean not null default true,
+		namespace varchar(255) not null default '',
+		description varchar(1024) not null default '',
+		owner varchar(255) not null default '',
+		created_at timestamp with time zone not null default now(),
+		visibility varchar(16) not null default 'private',
+		max_object_size bigint not null default 0
+	);
+
+	create table oids(
+		oid char(64) collate "C" primary key,
+		size bigint not null,
+		pending boolean not null default true
+	);
+
+	create table oid_maps(
+		oid char(64) not null references oids (oid),
+		project_id integer not null references projects (id),
+
+		primary key (project_id, oid)
+	);
+
+	create index oid_maps_oid on oid_maps (oid);
+
+	create table project_usage(
+		name varchar(255) collate "C" primary key,
+		objects bigint not null default 0,
+		bytes bigint not null default 0,
+		pending_objects bigint not null default 0,
+		pending_bytes bigint not null default 0,
+		shared_objects bigint not null default 0,
+		shared_bytes bigint not null default 0
+	);
+
+	create table project_aliases(
+		name varchar(255) primary key,
+		target varchar(255) not null
+	);
+
+	create index project_aliases_target on project_aliases (target);
+
+	create table users(
+		username varchar(255) collate "C" primary key,
+		password varchar(255) not null,
+		role varchar(32) not null default 'user',
+		display_name varchar(255) not null default '',
+		email varchar(255) not null default '',
+		disabled boolean not null default false
+	);
+	`,
+	`
+	create table tokens(
+		hash char(64) primary key,
+		id varchar(32) not null unique,
+		username varchar(255) collate "C" not null,
+		name varchar(255) not null default '',
+		created_at timestamp with time zone not null
+	);
+
+	create index tokens_username on tokens (username);
+	`,
+	`
+	alter table project_aliases
+		alter column name type varchar(255) collate "C",
+		alter column target type varchar(255) collate "C";
+	`,
+	`
+	create table permissions(
+		project varchar(255) collate "C" not null,
+		username varchar(255) collate "C" not null,
+		access varchar(16) not null,
+
+		primary key (project, username)
+	);
+
+	create index permissions_username on permissions (username);
+	`,
+}
+
+// migrate applies the migrations the database hasn't seen yet. Servers
+// starting at the same time wait for each other on the lock.
+func migrate(db *sql.DB) error {
+	_, err := db.Exec(`
+		create table if not exists
+			schema_migrations(
+				version integer primary key,
+				applied_at timestamp with time zone not null default now()
+			)
+	`)
+	if err != nil {
+		return err
+	}
+
+	for {
+		done, err := migrateOnce(db)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// migrateOnce applies the next migration, it returns true if there was none
+func migrateOnce(db *sql.DB) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("lock table schema_migrations in exclusive mode"); err != nil {
+		return false, err
+	}
+
+	var version int
+	if err := tx.QueryRow("select coalesce(max(version), 0) from schema_migrations").Scan(&version); err != nil {
+		return false, err
+	}
+
+	if version >= len(migrations) {
+		return true, tx.Commit()
+	}
+
+	if _, err := tx.Exec(migrations[version]); err != nil {
+		return false, fmt.Errorf("migration %d: %s", version+1, err)
+	}
+
+	if _, err := tx.Exec("insert into schema_migrations (version) values ($1)", version+1); err != nil {
+		return false, err
+	}
+
+	return false, tx.Commit()
+}
+
+func validateConfig(cfg *config.PostgresConfig) error {
+	if len(strings.TrimSpace(cfg.Host)) == 0 {
+		return errors.New("Postgres host is not specified")
+	}
+
+	if len(strings.TrimSpace(cfg.Database)) == 0 {
+		return errors.New("Postgres database is not specified")
+	}
+
+	if len(strings.TrimSpace(cfg.Username)) == 0 {
+		return errors.New("Postgres username is not specified")
+	}
+
+	return nil
+}
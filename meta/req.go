@@ -17,7 +17,8 @@ type RequestVars struct {
 }
 
 type BatchVars struct {
-	Objects []*RequestVars `json:"objects"`
+	Operation string         `json:"operation"`
+	Objects   []*RequestVars `json:"objects"`
 }
 
 func (v *RequestVars) ObjectLink(scheme, host string) string {
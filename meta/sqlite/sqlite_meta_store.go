@@ -0,0 +1,15 @@
+package sqlite
+
+import (
+	"github.com/ksurent/lfs-server-go/meta/sqlstore"
+)
+
+// NewSQLiteMetaStore opens the database file, brings its schema up to date
+// and returns a meta store on it
+func NewSQLiteMetaStore(dbFile string) (*sqlstore.MetaStore, error) {
+	db, err := NewSQLiteSession(dbFile)
+	if err != nil {
+		return nil, err
+	}
+	return sqlstore.NewMetaStore(db, sqlstore.SQLite), nil
+}
@@ -0,0 +1,74 @@
+package sqlite
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ksurent/lfs-server-go/meta/sqlstore"
+	"github.com/ksurent/lfs-server-go/meta/sqlstore/sqlstoretest"
+)
+
+func TestMetaStore(t *testing.T) {
+	sqlstoretest.Run(t, setupMeta)
+}
+
+func TestMigrate(t *testing.T) {
+	db, teardown, err := setupDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	// opening the database again finds the schema up to date
+	if err := migrate(db); err != nil {
+		t.Fatalf("expected migrate() to succeed again, got: %s", err)
+	}
+
+	var version int
+	if err := db.QueryRow("pragma user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Errorf("expected the schema to be at version %d, got: %d", len(migrations), version)
+	}
+
+	var mode string
+	if err := db.QueryRow("pragma journal_mode").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "wal" {
+		t.Errorf("expected the database to be in WAL mode, got: %s", mode)
+	}
+}
+
+func setupDB() (*sql.DB, func(), error) {
+	dir, err := ioutil.TempDir("", "sqlite")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db, err := NewSQLiteSession(filepath.Join(dir, "meta.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+
+	teardown := func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+
+	return db, teardown, nil
+}
+
+func setupMeta() (*sqlstore.MetaStore, func(), error) {
+	db, teardown, err := setupDB()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return sqlstore.NewMetaStore(db, sqlstore.SQLite), teardown, nil
+}
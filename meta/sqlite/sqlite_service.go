@@ -0,0 +1,147 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// NewSQLiteSession opens the database file, creating it if needed. Readers
+// don't block the writer in WAL mode, and writers take the lock when their
+// transaction begins and wait up to busy_timeout for each other.
+func NewSQLiteSession(dbFile string) (*sql.DB, error) {
+	dsn := "file:" + dbFile + "?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=on&_txlock=immediate"
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open: %s", err)
+	}
+
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping: %s", err)
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating the schema: %s", err)
+	}
+
+	return db, nil
+}
+
+// migrations create and change the schema, in order. The number of those
+// applied is kept in the user_version of the database. Only ever append to
+// the list.
+var migrations = []string{
+	`
+	create table projects(
+		id integer primary key,
+		name text not null unique,
+		pending boolean not null default 1,
+		namespace text not null default '',
+		description text not null default '',
+		owner text not null default '',
+		created_at timestamp not null,
+		visibility text not null default 'private',
+		max_object_size integer not null default 0
+	);
+
+	create table oids(
+		oid text primary key,
+		size integer not null,
+		pending boolean not null default 1
+	);
+
+	create table oid_maps(
+		oid text not null references oids (oid),
+		project_id integer not null references projects (id),
+
+		primary key (project_id, oid)
+	);
+
+	create index oid_maps_oid on oid_maps (oid);
+
+	create table project_usage(
+		name text primary key,
+		objects integer not null default 0,
+		bytes integer not null default 0,
+		pending_objects integer not null default 0,
+		pending_bytes integer not null default 0,
+		shared_objects integer not null default 0,
+		shared_bytes integer not null default 0
+	);
+
+	create table project_aliases(
+		name text primary key,
+		target text not null
+	);
+
+	create index project_aliases_target on project_aliases (target);
+
+	create table users(
+		username text primary key,
+		password text not null,
+		role text not null default 'user',
+		display_name text not null default '',
+		email text not null default '',
+		disabled boolean not null default 0
+	);
+	`,
+	`
+	create table tokens(
+		hash text primary key,
+		id text not null unique,
+		username text not null,
+		name text not null default '',
+		created_at timestamp not null
+	);
+
+	create index tokens_username on tokens (username);
+	`,
+	`
+	create table permissions(
+		project text not null,
+		username text not null,
+		access text not null,
+
+		primary key (project, username)
+	);
+
+	create index permissions_username on permissions (username);
+	`,
+}
+
+// migrate applies the migrations the database hasn't seen yet, all in one
+// transaction
+func migrate(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow("pragma user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	if version >= len(migrations) {
+		return nil
+	}
+
+	for ; version < len(migrations); version++ {
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			return fmt.Errorf("migration %d: %s", version+1, err)
+		}
+	}
+
+	// pragmas don't take parameters
+	if _, err := tx.Exec(fmt.Sprintf("pragma user_version = %d", version)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,50 @@
+package sqlstore
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// Dialect is what the store does differently for each database. Queries are
+// written with ? placeholders and the true and false literals, which all of
+// them understand.
+type Dialect struct {
+	// Numbered placeholders are $1, $2... instead of ?
+	Numbered bool
+	// ForUpdate is appended to the selects of rows a transaction goes on to
+	// change, for databases that lock rows
+	ForUpdate string
+}
+
+var (
+	Postgres = &Dialect{Numbered: true, ForUpdate: " for update"}
+	// SQLite transactions take the write lock when they begin, see
+	// _txlock in the DSN
+	SQLite = &Dialect{}
+)
+
+// rebind rewrites the placeholders of query for the dialect. Queries have no
+// question marks other than placeholders.
+func (d *Dialect) rebind(query string) string {
+	if !d.Numbered {
+		return query
+	}
+
+	var buf bytes.Buffer
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			buf.WriteRune(r)
+			continue
+		}
+
+		n++
+		buf.WriteString("$" + strconv.Itoa(n))
+	}
+
+	return buf.String()
+}
+
+func (s *MetaStore) rebind(query string) string {
+	return s.dialect.rebind(query)
+}
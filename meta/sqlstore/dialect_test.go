@@ -0,0 +1,16 @@
+package sqlstore
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	query := "select id from projects where name = ? and owner in (?, ?) and description = ''"
+
+	if q := SQLite.rebind(query); q != query {
+		t.Errorf("expected SQLite queries to be left alone, got: %s", q)
+	}
+
+	expected := "select id from projects where name = $1 and owner in ($2, $3) and description = ''"
+	if q := Postgres.rebind(query); q != expected {
+		t.Errorf("expected %q, got: %s", expected, q)
+	}
+}
@@ -0,0 +1,1349 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/ksurent/lfs-server-go/meta"
+)
+
+// MetaStore keeps the meta data in a database/sql database, the dialect
+// covers the differences between databases
+type MetaStore struct {
+	client  *sql.DB
+	dialect *Dialect
+}
+
+// pageSize is the number of rows fetched at a time when iterating
+const pageSize = 1000
+
+// NewMetaStore returns a meta store on db, whose schema is up to date
+func NewMetaStore(db *sql.DB, dialect *Dialect) *MetaStore {
+	return &MetaStore{client: db, dialect: dialect}
+}
+
+/*
+Close (method close database connection)
+*/
+func (s *MetaStore) Close() {
+	s.client.Close()
+}
+
+// Find all committed meta objects (called from the management interface)
+func (s *MetaStore) findAllOids() ([]*meta.Object, error) {
+	rows, err := s.client.Query(s.rebind("select oid, size from oids where not pending"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var oidList []*meta.Object
+	for rows.Next() {
+		m := &meta.Object{Existing: true}
+		if err := rows.Scan(&m.Oid, &m.Size); err != nil {
+			return nil, err
+		}
+		oidList = append(oidList, m)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return oidList, nil
+}
+
+// Find committed oids for a project id
+func (s *MetaStore) mapOid(id int) ([]string, error) {
+	rows, err := s.client.Query(s.rebind(`
+		select
+			m.oid
+		from
+			oid_maps m
+		join
+			oids o
+		on
+			o.oid = m.oid
+		join
+			projects p
+		on
+			p.id = m.project_id
+		where
+			m.project_id = ?
+			and not o.pending
+			and not p.pending
+		order by
+			m.oid
+	`), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var oidList []string
+	for rows.Next() {
+		var oid string
+		if err := rows.Scan(&oid); err != nil {
+			return nil, err
+		}
+		oidList = append(oidList, oid)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return oidList, nil
+}
+
+// projectColumns are the columns scanned by scanProject
+const projectColumns = "id, name, namespace, description, owner, created_at, visibility, max_object_size"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (s *MetaStore) scanProject(row scanner) (*meta.Project, error) {
+	id, p, err := scanProjectRow(row)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Oids, err = s.mapOid(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// scanProjectRow scans a project without its oids
+func scanProjectRow(row scanner) (int, *meta.Project, error) {
+	var (
+		id int
+		p  meta.Project
+	)
+
+	err := row.Scan(&id, &p.Name, &p.Namespace, &p.Description, &p.Owner, &p.CreatedAt, &p.Visibility, &p.MaxObjectSize)
+	if err != nil {
+		return 0, nil, err
+	}
+	p.CreatedAt = p.CreatedAt.UTC()
+
+	return id, &p, nil
+}
+
+// Find all committed projects
+func (s *MetaStore) findAllProjects() ([]*meta.Project, error) {
+	var projectList []*meta.Project
+	err := s.forEachProject("", func(p *meta.Project) error {
+		projectList = append(projectList, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return projectList, nil
+}
+
+// Find a committed project by name
+func (s *MetaStore) findProject(name string) (*meta.Project, error) {
+	row := s.client.QueryRow(s.rebind("select "+projectColumns+" from projects where name = ? and not pending"), name)
+
+	p, err := s.scanProject(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, meta.ErrProjectNotFound
+		}
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Iterate over all objects in oid order, a page at a time
+func (s *MetaStore) forEachOid(after string, fn func(*meta.Object) error) error {
+	for {
+		page, err := s.findOidPage(after)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range page {
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+
+		if len(page) < pageSize {
+			return nil
+		}
+
+		after = page[len(page)-1].Oid
+	}
+}
+
+func (s *MetaStore) findOidPage(after string) ([]*meta.Object, error) {
+	rows, err := s.client.Query(s.rebind(`
+		select
+			oid, size, pending
+		from
+			oids
+		where
+			oid > ?
+		order by
+			oid
+		limit ?
+	`), after, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		page  []*meta.Object
+		byOid = make(map[string]*meta.Object)
+		args  []interface{}
+	)
+
+	for rows.Next() {
+		var (
+			m       meta.Object
+			pending bool
+		)
+		if err := rows.Scan(&m.Oid, &m.Size, &pending); err != nil {
+			return nil, err
+		}
+		m.Existing = !pending
+
+		page = append(page, &m)
+		byOid[m.Oid] = &m
+		args = append(args, m.Oid)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page) == 0 {
+		return nil, nil
+	}
+
+	rows, err = s.client.Query(s.rebind(`
+		select
+			m.oid, p.name
+		from
+			oid_maps m
+		join
+			projects p
+		on
+			p.id = m.project_id
+		where
+			m.oid in (?`+strings.Repeat(", ?", len(args)-1)+`)
+	`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var oid, name string
+		if err := rows.Scan(&oid, &name); err != nil {
+			return nil, err
+		}
+
+		if m, ok := byOid[oid]; ok {
+			m.ProjectNames = append(m.ProjectNames, name)
+		}
+	}
+
+	return page, rows.Err()
+}
+
+// Iterate over all committed projects in name order, a page at a time
+func (s *MetaStore) forEachProject(after string, fn func(*meta.Project) error) error {
+	for {
+		ids, page, err := s.findProjectPage(after)
+		if err != nil {
+			return err
+		}
+
+		for i, p := range page {
+			p.Oids, err = s.mapOid(ids[i])
+			if err != nil {
+				return err
+			}
+
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+
+		if len(page) < pageSize {
+			return nil
+		}
+
+		after = page[len(page)-1].Name
+	}
+}
+
+func (s *MetaStore) findProjectPage(after string) ([]int, []*meta.Project, error) {
+	rows, err := s.client.Query(s.rebind(`
+		select
+			`+projectColumns+`
+		from
+			projects
+		where
+			not pending
+			and name > ?
+		order by
+			name
+		limit ?
+	`), after, pageSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var (
+		ids  []int
+		page []*meta.Project
+	)
+
+	for rows.Next() {
+		id, p, err := scanProjectRow(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		ids = append(ids, id)
+		page = append(page, p)
+	}
+
+	return ids, page, rows.Err()
+}
+
+// Create committed project (called from the management interface). A
+// project only known from pending uploads is taken over.
+func (s *MetaStore) createProject(p *meta.Project) error {
+	if err := p.Normalize(); err != nil {
+		return err
+	}
+
+	res, err := s.client.Exec(s.rebind(`
+		insert into
+			projects (name, pending, namespace, description, owner, created_at, visibility, max_object_size)
+		values
+			(?, false, ?, ?, ?, ?, ?, ?)
+		on conflict (name) do update set
+			pending = false,
+			namespace = excluded.namespace,
+			description = excluded.description,
+			owner = excluded.owner,
+			created_at = excluded.created_at,
+			visibility = excluded.visibility,
+			max_object_size = excluded.max_object_size
+		where
+			projects.pending
+	`), p.Name, p.Namespace, p.Description, p.Owner, p.CreatedAt, p.Visibility, p.MaxObjectSize)
+	if err != nil {
+		return err
+	}
+
+	// the project exists and isn't pending
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return meta.ErrProjectExists
+	}
+
+	return nil
+}
+
+// upsertProject creates a project if needed and returns its id, a committed
+// project stays committed
+func (s *MetaStore) upsertProject(tx *sql.Tx, name, namespace, owner string, pending bool) (int, error) {
+	_, err := tx.Exec(s.rebind(`
+		insert into
+			projects (name, pending, namespace, owner, created_at, visibility)
+		values
+			(?, ?, ?, ?, ?, ?)
+		on conflict (name) do update set
+			pending = projects.pending and excluded.pending
+	`), name, pending, namespace, owner, time.Now().UTC().Truncate(time.Second), meta.VisibilityPrivate)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = tx.QueryRow(s.rebind("select id from projects where name = ?"), name).Scan(&id)
+	return id, err
+}
+
+// Transactionally change status from pending to committed
+func (s *MetaStore) commitPendingObject(m *meta.Object) error {
+	tx, err := s.client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(s.rebind("update oids set pending = false where oid = ? and pending"), m.Oid)
+	if err != nil {
+		return err
+	}
+
+	// somebody else committed it in the meantime, it's accounted for
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	for _, name := range m.ProjectNames {
+		if _, err := tx.Exec(s.rebind("update projects set pending = false where name = ?"), name); err != nil {
+			return err
+		}
+	}
+
+	if err := s.addUsage(tx, meta.CommitUsage(m)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// addUsage adds delta to the usage counters
+func (s *MetaStore) addUsage(tx *sql.Tx, delta meta.UsageDelta) error {
+	for name, d := range delta {
+		_, err := tx.Exec(s.rebind(`
+			insert into
+				project_usage (name, objects, bytes, pending_objects, pending_bytes, shared_objects, shared_bytes)
+			values
+				(?, ?, ?, ?, ?, ?, ?)
+			on conflict (name) do update set
+				objects = project_usage.objects + excluded.objects,
+				bytes = project_usage.bytes + excluded.bytes,
+				pending_objects = project_usage.pending_objects + excluded.pending_objects,
+				pending_bytes = project_usage.pending_bytes + excluded.pending_bytes,
+				shared_objects = project_usage.shared_objects + excluded.shared_objects,
+				shared_bytes = project_usage.shared_bytes + excluded.shared_bytes
+		`), name, d.Objects, d.Bytes, d.PendingObjects, d.PendingBytes, d.SharedObjects, d.SharedBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const usageColumns = "objects, bytes, pending_objects, pending_bytes, shared_objects, shared_bytes"
+
+func scanUsage(row scanner, u *meta.Usage) error {
+	return row.Scan(&u.Objects, &u.Bytes, &u.PendingObjects, &u.PendingBytes, &u.SharedObjects, &u.SharedBytes)
+}
+
+// Transactionally create pending oid and related data, new projects are
+// owned by the uploader
+func (s *MetaStore) createPendingObject(m *meta.Object, namespace, owner string) error {
+	tx, err := s.client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(s.rebind("insert into oids (oid, size, pending) values (?, ?, true) on conflict do nothing"), m.Oid, m.Size)
+	if err != nil {
+		return err
+	}
+
+	// somebody else stored it in the meantime, it's accounted for
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	for _, name := range m.ProjectNames {
+		if name == "" {
+			continue
+		}
+
+		id, err := s.upsertProject(tx, name, namespace, owner, true)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(s.rebind("insert into oid_maps (oid, project_id) values (?, ?)"), m.Oid, id); err != nil {
+			return err
+		}
+	}
+
+	if err := s.addUsage(tx, meta.PutUsage(m)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// findOid finds an object, lock is appended to the select of the object
+func (s *MetaStore) findOid(q queryer, oid string, pending bool, lock string) (*meta.Object, error) {
+	m := meta.Object{Existing: !pending}
+
+	err := q.QueryRow(s.rebind(`
+		select
+			oid, size
+		from
+			oids
+		where
+			oid = ?
+			and pending = ?
+	`+lock), oid, pending).Scan(&m.Oid, &m.Size)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, meta.ErrObjectNotFound
+		}
+		return nil, err
+	}
+
+	rows, err := q.Query(s.rebind(`
+		select
+			p.name
+		from
+			projects p
+		join
+			oid_maps m
+		on
+			p.id = m.project_id
+		where
+			m.oid = ?
+		order by
+			p.name
+	`), oid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+
+		m.ProjectNames = append(m.ProjectNames, name)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// queryer is what findOid needs of a database or a transaction
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Put() creates uncommitted objects from meta.RequestVars and stores them in the
+// meta store
+func (s *MetaStore) Put(v *meta.RequestVars) (*meta.Object, error) {
+	// Don't care here if it's pending or committed
+	if m, err := s.findOid(s.client, v.Oid, false, ""); err == nil {
+		return m, nil
+	}
+	if m, err := s.findOid(s.client, v.Oid, true, ""); err == nil {
+		return m, nil
+	}
+
+	m := &meta.Object{
+		Oid:          v.Oid,
+		Size:         v.Size,
+		ProjectNames: []string{v.Repo},
+		Existing:     false,
+	}
+
+	err := s.createPendingObject(m, v.Namespace, v.User)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+/*
+Link (add a committed object to a project)
+the object is locked while its projects are read and the link added, or the
+transaction holds the write lock from the start, so nobody else links the
+object in the meantime
+*/
+func (s *MetaStore) Link(v *meta.RequestVars) (*meta.Object, error) {
+	tx, err := s.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	m, err := s.findOid(tx, v.Oid, false, s.dialect.ForUpdate)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range m.ProjectNames {
+		if name == v.Repo {
+			return m, nil
+		}
+	}
+
+	// the object is committed, so is the project it's linked to
+	id, err := s.upsertProject(tx, v.Repo, v.Namespace, v.User, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(s.rebind("insert into oid_maps (oid, project_id) values (?, ?)"), m.Oid, id); err != nil {
+		return nil, err
+	}
+
+	delta := meta.LinkUsage(m, v.Repo)
+	m.ProjectNames = append(m.ProjectNames, v.Repo)
+
+	if err := s.addUsage(tx, delta); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Commit() finds uncommitted objects in the meta store using data in
+// meta.RequestVars and commits them
+func (s *MetaStore) Commit(v *meta.RequestVars) (*meta.Object, error) {
+	m, err := s.GetPending(v)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Existing = true
+
+	err = s.commitPendingObject(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (s *MetaStore) Get(v *meta.RequestVars) (*meta.Object, error) {
+	return s.findOid(s.client, v.Oid, false, "")
+}
+
+// Get() retrieves meta information for a committed object given information in
+// meta.RequestVars
+func (s *MetaStore) GetPending(v *meta.RequestVars) (*meta.Object, error) {
+	return s.findOid(s.client, v.Oid, true, "")
+}
+
+/*
+AddUser (Add a new user)
+Existing users are left untouched
+*/
+func (s *MetaStore) AddUser(user, pass string) error {
+	encryptedPass, err := meta.EncryptPass([]byte(pass))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.Exec(s.rebind(`
+		insert into
+			users (username, password)
+		values
+			(?, ?)
+		on conflict (username) do nothing
+	`), user, encryptedPass)
+	return err
+}
+
+/*
+AddProject (Add a new project)
+Fails if the project already exists
+*/
+func (s *MetaStore) AddProject(project *meta.Project) error {
+	return s.createProject(project)
+}
+
+/*
+GetProject (get a single project)
+*/
+func (s *MetaStore) GetProject(name string) (*meta.Project, error) {
+	return s.findProject(name)
+}
+
+/*
+MoveProject (rename, move or transfer a project)
+objects refer to projects by id, only the project and the tables keyed by
+its name change
+*/
+func (s *MetaStore) MoveProject(name string, move *meta.ProjectMove) (*meta.Project, error) {
+	tx, err := s.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRow(s.rebind("select "+projectColumns+" from projects where name = ? and not pending"+s.dialect.ForUpdate), name)
+	id, p, err := scanProjectRow(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, meta.ErrProjectNotFound
+		}
+		return nil, err
+	}
+
+	renames := move.Renames(p)
+	if renames {
+		var n int
+		if err := tx.QueryRow(s.rebind("select count(*) from projects where name = ?"), move.Name).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return nil, meta.ErrProjectExists
+		}
+
+		// the name may still lead to another project, it's taken as well
+		err := tx.QueryRow(s.rebind("select count(*) from project_aliases where name = ? and target <> ?"), move.Name, name).Scan(&n)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return nil, meta.ErrProjectExists
+		}
+	}
+
+	move.Apply(p)
+
+	_, err = tx.Exec(s.rebind("update projects set name = ?, namespace = ?, owner = ? where id = ?"), p.Name, p.Namespace, p.Owner, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if renames {
+		for _, q := range []struct {
+			query string
+			args  []interface{}
+		}{
+			{"update project_usage set name = ? where name = ?", []interface{}{p.Name, name}},
+			{"update project_aliases set target = ? where target = ?", []interface{}{p.Name, name}},
+			{"update permissions set project = ? where project = ?", []interface{}{p.Name, name}},
+			{"delete from project_aliases where name = ?", []interface{}{p.Name}},
+		} {
+			if _, err := tx.Exec(s.rebind(q.query), q.args...); err != nil {
+				return nil, err
+			}
+		}
+
+		if move.Alias {
+			_, err := tx.Exec(s.rebind("insert into project_aliases (name, target) values (?, ?)"), name, p.Name)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if p.Oids, err = s.mapOid(id); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+/*
+UpdateProject (change the settings of a project)
+*/
+func (s *MetaStore) UpdateProject(name string, update *meta.ProjectUpdate) (*meta.Project, error) {
+	tx, err := s.client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRow(s.rebind("select "+projectColumns+" from projects where name = ? and not pending"+s.dialect.ForUpdate), name)
+	id, p, err := scanProjectRow(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, meta.ErrProjectNotFound
+		}
+		return nil, err
+	}
+
+	if err := update.Apply(p); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(
+		s.rebind("update projects set description = ?, visibility = ?, max_object_size = ? where id = ?"),
+		p.Description, p.Visibility, p.MaxObjectSize, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if p.Oids, err = s.mapOid(id); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+/*
+DeleteProject (remove a project no object belongs to)
+pending objects are mapped to their projects as well
+*/
+func (s *MetaStore) DeleteProject(name string) error {
+	tx, err := s.client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow(s.rebind("select id from projects where name = ? and not pending"+s.dialect.ForUpdate), name).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return meta.ErrProjectNotFound
+		}
+		return err
+	}
+
+	var n int
+	if err := tx.QueryRow(s.rebind("select count(*) from oid_maps where project_id = ?"), id).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return meta.ErrProjectNotEmpty
+	}
+
+	for _, q := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{"delete from project_aliases where target = ?", []interface{}{name}},
+		{"delete from project_usage where name = ?", []interface{}{name}},
+		{"delete from permissions where project = ?", []interface{}{name}},
+		{"delete from projects where id = ?", []interface{}{id}},
+	} {
+		if _, err := tx.Exec(s.rebind(q.query), q.args...); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+/*
+ProjectAlias (the project an old name of a renamed project leads to)
+*/
+func (s *MetaStore) ProjectAlias(name string) (string, error) {
+	var target string
+	err := s.client.QueryRow(s.rebind("select target from project_aliases where name = ?"), name).Scan(&target)
+	if err == sql.ErrNoRows {
+		return "", meta.ErrProjectNotFound
+	}
+
+	return target, err
+}
+
+/*
+DeleteUser (Delete a user)
+their tokens and permissions go along
+*/
+func (s *MetaStore) DeleteUser(user string) error {
+	tx, err := s.client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(s.rebind("delete from users where username = ?"), user); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.rebind("delete from tokens where username = ?"), user); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.rebind("delete from permissions where username = ?"), user); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+/*
+AddToken (store an access token)
+*/
+func (s *MetaStore) AddToken(token *meta.Token) error {
+	_, err := s.client.Exec(
+		s.rebind("insert into tokens (hash, id, username, name, created_at) values (?, ?, ?, ?, ?)"),
+		token.Hash, token.ID, token.User, token.Name, token.CreatedAt,
+	)
+	return err
+}
+
+/*
+GetToken (get the access token with a hash)
+*/
+func (s *MetaStore) GetToken(hash string) (*meta.Token, error) {
+	t := &meta.Token{Hash: hash}
+	err := s.client.QueryRow(
+		s.rebind("select id, username, name, created_at from tokens where hash = ?"), hash,
+	).Scan(&t.ID, &t.User, &t.Name, &t.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, meta.ErrTokenNotFound
+		}
+		return nil, err
+	}
+
+	return t, nil
+}
+
+/*
+Tokens (get the access tokens of a user, or all of them)
+*/
+func (s *MetaStore) Tokens(user string) ([]*meta.Token, error) {
+	rows, err := s.client.Query(s.rebind(`
+		select
+			hash, id, username, name, created_at
+		from
+			tokens
+		where
+			? = '' or username = ?
+		order by
+			username, created_at
+	`), user, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*meta.Token
+	for rows.Next() {
+		var t meta.Token
+		if err := rows.Scan(&t.Hash, &t.ID, &t.User, &t.Name, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &t)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+/*
+RevokeToken (remove an access token)
+*/
+func (s *MetaStore) RevokeToken(id string) error {
+	res, err := s.client.Exec(s.rebind("delete from tokens where id = ?"), id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return meta.ErrTokenNotFound
+	}
+
+	return nil
+}
+
+/*
+SetPermission (give a user access to a project)
+*/
+func (s *MetaStore) SetPermission(name string, permission *meta.Permission) error {
+	if !meta.ValidAccess(permission.Access) {
+		return meta.ErrInvalidAccess
+	}
+
+	tx, err := s.client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow(s.rebind("select id from projects where name = ? and not pending"+s.dialect.ForUpdate), name).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return meta.ErrProjectNotFound
+		}
+		return err
+	}
+
+	_, err = tx.Exec(s.rebind(`
+		insert into
+			permissions (project, username, access)
+		values
+			(?, ?, ?)
+		on conflict (project, username) do update set
+			access = excluded.access
+	`), name, permission.User, permission.Access)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+/*
+DeletePermission (take the access to a project away from a user)
+*/
+func (s *MetaStore) DeletePermission(name, user string) error {
+	res, err := s.client.Exec(s.rebind("delete from permissions where project = ? and username = ?"), name, user)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return meta.ErrPermissionNotFound
+	}
+
+	return nil
+}
+
+/*
+Permissions (get the permissions of a project)
+*/
+func (s *MetaStore) Permissions(name string) ([]*meta.Permission, error) {
+	rows, err := s.client.Query(s.rebind(`
+		select
+			username, access
+		from
+			permissions
+		where
+			project = ?
+		order by
+			username
+	`), name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var permissions []*meta.Permission
+	for rows.Next() {
+		var p meta.Permission
+		if err := rows.Scan(&p.User, &p.Access); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, &p)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+/*
+GetUser (get a single user)
+return meta user object without password
+*/
+func (s *MetaStore) GetUser(user string) (*meta.User, error) {
+	mu := &meta.User{Name: user}
+	err := s.client.QueryRow(s.rebind(`
+		select
+			role, display_name, email, disabled
+		from
+			users
+		where
+			username = ?
+	`), user).Scan(&mu.Role, &mu.DisplayName, &mu.Email, &mu.Disabled)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, meta.ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	return mu, nil
+}
+
+/*
+SetRole (change the role of an existing user)
+*/
+func (s *MetaStore) SetRole(user, role string) error {
+	if !meta.ValidRole(role) {
+		return meta.ErrInvalidRole
+	}
+
+	res, err := s.client.Exec(s.rebind("update users set role = ? where username = ?"), role, user)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return meta.ErrUserNotFound
+	}
+
+	return nil
+}
+
+/*
+UpdateUser (change the password and profile of an existing user)
+*/
+func (s *MetaStore) UpdateUser(user string, update *meta.UserUpdate) error {
+	mu, err := s.GetUser(user)
+	if err != nil {
+		return err
+	}
+	update.Apply(mu)
+
+	// the password is kept when none is given
+	var encryptedPass sql.NullString
+	if update.Password != nil {
+		encryptedPass.String, err = meta.EncryptPass([]byte(*update.Password))
+		if err != nil {
+			return err
+		}
+		encryptedPass.Valid = true
+	}
+
+	_, err = s.client.Exec(s.rebind(`
+		update
+			users
+		set
+			display_name = ?,
+			email = ?,
+			disabled = ?,
+			password = coalesce(?, password)
+		where
+			username = ?
+	`), mu.DisplayName, mu.Email, mu.Disabled, encryptedPass, user)
+	return err
+}
+
+/*
+Users (get list of users)
+return meta user objects without passwords
+*/
+func (s *MetaStore) Users() ([]*meta.User, error) {
+	rows, err := s.client.Query(s.rebind(`
+		select
+			username, role, display_name, email, disabled
+		from
+			users
+		order by
+			username
+	`))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*meta.User
+	for rows.Next() {
+		var mu meta.User
+		if err := rows.Scan(&mu.Name, &mu.Role, &mu.DisplayName, &mu.Email, &mu.Disabled); err != nil {
+			return nil, err
+		}
+		users = append(users, &mu)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+/*
+Objects (get all oids)
+return meta object
+*/
+func (s *MetaStore) Objects() ([]*meta.Object, error) {
+	return s.findAllOids()
+}
+
+/*
+Projects (get all projects)
+return meta project object
+*/
+func (s *MetaStore) Projects() ([]*meta.Project, error) {
+	return s.findAllProjects()
+}
+
+/*
+ForEachObject (iterate over all oids, committed or pending)
+in oid order
+*/
+func (s *MetaStore) ForEachObject(after string, fn func(*meta.Object) error) error {
+	return s.forEachOid(after, fn)
+}
+
+/*
+ForEachProject (iterate over all projects)
+in name order
+*/
+func (s *MetaStore) ForEachProject(after string, fn func(*meta.Project) error) error {
+	return s.forEachProject(after, fn)
+}
+
+/*
+GetUsage (storage used by a project or in total)
+projects that never stored anything have zero usage
+*/
+func (s *MetaStore) GetUsage(projectName string) (*meta.Usage, error) {
+	var u meta.Usage
+	err := scanUsage(s.client.QueryRow(s.rebind("select "+usageColumns+" from project_usage where name = ?"), projectName), &u)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+/*
+ForEachUsage (iterate over the usage of all projects)
+in name order
+*/
+func (s *MetaStore) ForEachUsage(fn func(string, *meta.Usage) error) error {
+	after := ""
+
+	for {
+		names, usages, err := s.findUsagePage(after)
+		if err != nil {
+			return err
+		}
+
+		for i, name := range names {
+			if err := fn(name, usages[i]); err != nil {
+				return err
+			}
+		}
+
+		if len(names) < pageSize {
+			return nil
+		}
+		after = names[len(names)-1]
+	}
+}
+
+/*
+RecountUsage (count the usage of all objects)
+the counters are replaced in a single transaction
+*/
+func (s *MetaStore) RecountUsage() error {
+	total := meta.UsageDelta{}
+	err := s.forEachOid("", func(m *meta.Object) error {
+		for name, u := range meta.ObjectUsage(m) {
+			if total[name] == nil {
+				total[name] = &meta.Usage{}
+			}
+			total[name].Add(u)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(s.rebind("delete from project_usage")); err != nil {
+		return err
+	}
+
+	if err := s.addUsage(tx, total); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *MetaStore) findUsagePage(after string) ([]string, []*meta.Usage, error) {
+	rows, err := s.client.Query(s.rebind(`
+		select
+			name, `+usageColumns+`
+		from
+			project_usage
+		where
+			name > ?
+			and name != ?
+		order by
+			name
+		limit ?
+	`), after, meta.TotalUsage, pageSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var (
+		names  []string
+		usages []*meta.Usage
+	)
+	for rows.Next() {
+		var (
+			name string
+			u    meta.Usage
+		)
+		if err := rows.Scan(&name, &u.Objects, &u.Bytes, &u.PendingObjects, &u.PendingBytes, &u.SharedObjects, &u.SharedBytes); err != nil {
+			return nil, nil, err
+		}
+
+		names = append(names, name)
+		usages = append(usages, &u)
+	}
+
+	return names, usages, rows.Err()
+}
+
+/*
+Authenticate (check user credentials)
+Unknown and disabled users fail authentication without an error
+*/
+func (s *MetaStore) Authenticate(user, pass string) (bool, error) {
+	var encryptedPass string
+	err := s.client.QueryRow(s.rebind("select password from users where username = ? and not disabled"), user).Scan(&encryptedPass)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return meta.CheckPass([]byte(encryptedPass), []byte(pass))
+}
@@ -0,0 +1,817 @@
+// Package sqlstoretest has the tests of the database/sql meta store, each
+// database runs them against a store of its own.
+package sqlstoretest
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ksurent/lfs-server-go/meta"
+	"github.com/ksurent/lfs-server-go/meta/sqlstore"
+)
+
+var (
+	testUser    = "admin"
+	testPass    = "admin"
+	contentSize = int64(len("this is my content"))
+	contentOid  = "f97e1b2936a56511b3b6efc99011758e4700d60fb1674d31445d1ee40b663f24"
+	contentRepo = "repo"
+)
+
+// Setup returns an empty meta store and a function that tears it down
+type Setup func() (*sqlstore.MetaStore, func(), error)
+
+// Run runs every test against a store of its own
+func Run(t *testing.T, setup Setup) {
+	for _, test := range []struct {
+		name string
+		fn   func(*testing.T, *sqlstore.MetaStore)
+	}{
+		{"PutGet", testPutGet},
+		{"PutDuplicate", testPutDuplicate},
+		{"Projects", testProjects},
+		{"UpdateDeleteProject", testUpdateDeleteProject},
+		{"ForEach", testForEach},
+		{"Usage", testUsage},
+		{"MoveProject", testMoveProject},
+		{"Link", testLink},
+		{"Authentication", testAuthentication},
+		{"Roles", testRoles},
+		{"UpdateUser", testUpdateUser},
+		{"Tokens", testTokens},
+		{"Permissions", testPermissions},
+	} {
+		store, teardown, err := setup()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, store)
+		})
+		teardown()
+	}
+}
+
+func testPutGet(t *testing.T, testMetaStore *sqlstore.MetaStore) {
+
+	rv := &meta.RequestVars{
+		Oid:  contentOid,
+		Size: contentSize,
+		Repo: contentRepo,
+	}
+
+	if _, err := testMetaStore.Put(rv); err != nil {
+		t.Errorf("expected Put() to succeed, got: %s", err)
+	}
+
+	if _, err := testMetaStore.Get(rv); !meta.IsObjectNotFound(err) {
+		t.Errorf("expected Get() to return 'not found', got: %s", err)
+	}
+
+	m, err := testMetaStore.GetPending(rv)
+	if err != nil {
+		t.Errorf("expected GetPending() to succeed, got: %s", err)
+	} else {
+		if m.Oid != contentOid {
+			t.Errorf("expected pending object id to be %s, got: %s", contentOid, m.Oid)
+		}
+		if m.Size != contentSize {
+			t.Errorf("expected pending object size to be %d, got: %d", contentSize, m.Size)
+		}
+		if m.Existing {
+			t.Error("expected meta object to be in the pending state")
+		}
+		if len(m.ProjectNames) != 1 || m.ProjectNames[0] != contentRepo {
+			t.Errorf("expected pending object to belong to project %q, got: %v", contentRepo, m.ProjectNames)
+		}
+	}
+
+	if _, err := testMetaStore.Commit(rv); err != nil {
+		t.Errorf("expected Commit() to succeed, got: %s", err)
+	}
+
+	if _, err = testMetaStore.GetPending(rv); !meta.IsObjectNotFound(err) {
+		t.Errorf("expected GetPending() to return 'not found', got: %s", err)
+	}
+
+	m, err = testMetaStore.Get(rv)
+	if err != nil {
+		t.Errorf("expected Get() to succeed, got: %s", err)
+	} else {
+		if m.Oid != contentOid {
+			t.Errorf("expected committed object id to be %s, got: %s", contentOid, m.Oid)
+		}
+		if m.Size != contentSize {
+			t.Errorf("expected committed object size to be %d, got: %d", contentSize, m.Size)
+		}
+		if !m.Existing {
+			t.Error("expected meta object to be in the committed state")
+		}
+		if len(m.ProjectNames) != 1 || m.ProjectNames[0] != contentRepo {
+			t.Errorf("expected committed object to belong to project %q, got: %v", contentRepo, m.ProjectNames)
+		}
+	}
+}
+
+func testPutDuplicate(t *testing.T, testMetaStore *sqlstore.MetaStore) {
+
+	rv := &meta.RequestVars{
+		Oid:  contentOid,
+		Size: contentSize,
+		Repo: contentRepo,
+	}
+
+	_, err := testMetaStore.Put(rv)
+	if err != nil {
+		t.Errorf("expected Put() to succeed, got: %s", err)
+	}
+
+	_, err = testMetaStore.Put(rv)
+	if err != nil {
+		t.Errorf("expected duplicate pending Put() to succeed, got: %s", err)
+	}
+
+	if _, err = testMetaStore.Commit(rv); err != nil {
+		t.Errorf("expected Commit() to succeed, got: %s", err)
+	}
+
+	_, err = testMetaStore.Put(rv)
+	if err != nil {
+		t.Errorf("expected duplicate committed Put() to succeed, got: %s", err)
+	}
+}
+
+func testProjects(t *testing.T, testMetaStore *sqlstore.MetaStore) {
+
+	project := &meta.Project{
+		Name:          contentRepo,
+		Description:   "test project",
+		Owner:         testUser,
+		Visibility:    meta.VisibilityPublic,
+		MaxObjectSize: 1024,
+	}
+
+	if err := testMetaStore.AddProject(project); err != nil {
+		t.Errorf("expected AddProject() to succeed, got: %s", err)
+	}
+
+	if err := testMetaStore.AddProject(&meta.Project{Name: contentRepo}); err != meta.ErrProjectExists {
+		t.Errorf("expected AddProject() to fail for an existing project, got: %v", err)
+	}
+
+	if err := testMetaStore.AddProject(&meta.Project{Name: "other", Visibility: "secret"}); err != meta.ErrInvalidVisibility {
+		t.Errorf("expected AddProject() to fail for an invalid visibility, got: %v", err)
+	}
+
+	projects, err := testMetaStore.Projects()
+	if err != nil {
+		t.Errorf("expected Projects() to succeed, got: %s", err)
+	} else if len(projects) != 1 || projects[0].Name != contentRepo {
+		t.Errorf("expected Projects() to return %s, got: %v", contentRepo, projects)
+	}
+
+	p, err := testMetaStore.GetProject(contentRepo)
+	if err != nil {
+		t.Fatalf("expected GetProject() to succeed, got: %s", err)
+	}
+
+	if p.Description != project.Description || p.Owner != project.Owner || !p.IsPublic() || p.MaxObjectSize != project.MaxObjectSize {
+		t.Errorf("expected GetProject() to return %#v, got: %#v", project, p)
+	}
+
+	if !p.CreatedAt.Equal(project.CreatedAt) {
+		t.Errorf("expected the project to be created at %s, got: %s", project.CreatedAt, p.CreatedAt)
+	}
+
+	if _, err := testMetaStore.GetProject("nonexisting"); err != meta.ErrProjectNotFound {
+		t.Errorf("expected GetProject() to fail for a nonexisting project, got: %v", err)
+	}
+}
+
+func testUpdateDeleteProject(t *testing.T, testMetaStore *sqlstore.MetaStore) {
+
+	project := &meta.Project{Name: contentRepo, Description: "test project"}
+	if err := testMetaStore.AddProject(project); err != nil {
+		t.Fatalf("expected AddProject() to succeed, got: %s", err)
+	}
+
+	rv := &meta.RequestVars{Oid: contentOid, Size: contentSize, Repo: contentRepo}
+	if _, err := testMetaStore.Put(rv); err != nil {
+		t.Fatalf("expected Put() to succeed, got: %s", err)
+	}
+	if _, err := testMetaStore.Commit(rv); err != nil {
+		t.Fatalf("expected Commit() to succeed, got: %s", err)
+	}
+
+	public, size := meta.VisibilityPublic, int64(10)
+	p, err := testMetaStore.UpdateProject(contentRepo, &meta.ProjectUpdate{Visibility: &public, MaxObjectSize: &size})
+	if err != nil {
+		t.Fatalf("expected UpdateProject() to succeed, got: %s", err)
+	}
+	if !p.IsPublic() || p.MaxObjectSize != size || p.Description != project.Description {
+		t.Errorf("expected only the given settings to change, got: %+v", p)
+	}
+	if p, err := testMetaStore.GetProject(contentRepo); err != nil || !p.IsPublic() || p.MaxObjectSize != size {
+		t.Errorf("expected the settings to be stored, got %+v and: %v", p, err)
+	}
+
+	secret := "secret"
+	if _, err := testMetaStore.UpdateProject(contentRepo, &meta.ProjectUpdate{Visibility: &secret}); err != meta.ErrInvalidVisibility {
+		t.Errorf("expected UpdateProject() to fail for an invalid visibility, got: %v", err)
+	}
+	if _, err := testMetaStore.UpdateProject("nonexisting", &meta.ProjectUpdate{}); err != meta.ErrProjectNotFound {
+		t.Errorf("expected UpdateProject() to fail for a nonexisting project, got: %v", err)
+	}
+
+	if err := testMetaStore.DeleteProject(contentRepo); err != meta.ErrProjectNotEmpty {
+		t.Errorf("expected DeleteProject() to fail for a project with objects, got: %v", err)
+	}
+
+	if err := testMetaStore.AddProject(&meta.Project{Name: "old"}); err != nil {
+		t.Fatalf("expected AddProject() to succeed, got: %s", err)
+	}
+	if _, err := testMetaStore.MoveProject("old", &meta.ProjectMove{Name: "empty", Alias: true}); err != nil {
+		t.Fatalf("expected MoveProject() to succeed, got: %s", err)
+	}
+
+	if err := testMetaStore.DeleteProject("empty"); err != nil {
+		t.Fatalf("expected DeleteProject() to succeed, got: %s", err)
+	}
+	if _, err := testMetaStore.GetProject("empty"); err != meta.ErrProjectNotFound {
+		t.Errorf("expected the project to be gone, got: %v", err)
+	}
+	if target, err := testMetaStore.ProjectAlias("old"); err != meta.ErrProjectNotFound {
+		t.Errorf("expected the aliases of the project to be gone, got %q and: %v", target, err)
+	}
+	if err := testMetaStore.DeleteProject("empty"); err != meta.ErrProjectNotFound {
+		t.Errorf("expected DeleteProject() to fail for a nonexisting project, got: %v", err)
+	}
+}
+
+func testForEach(t *testing.T, testMetaStore *sqlstore.MetaStore) {
+
+	oids := []string{contentOid, strings.Repeat("0", 64), strings.Repeat("1", 64)}
+	for _, oid := range oids {
+		if _, err := testMetaStore.Put(&meta.RequestVars{Oid: oid, Size: contentSize, Repo: contentRepo}); err != nil {
+			t.Fatalf("expected Put() to succeed, got: %s", err)
+		}
+	}
+	if _, err := testMetaStore.Commit(&meta.RequestVars{Oid: contentOid, Size: contentSize, Repo: contentRepo}); err != nil {
+		t.Fatalf("expected Commit() to succeed, got: %s", err)
+	}
+
+	var seen []string
+	err := testMetaStore.ForEachObject("", func(m *meta.Object) error {
+		seen = append(seen, m.Oid)
+		if m.Existing != (m.Oid == contentOid) {
+			t.Errorf("expected only %s to be committed, got %s with existing=%t", contentOid, m.Oid, m.Existing)
+		}
+		if len(m.ProjectNames) != 1 || m.ProjectNames[0] != contentRepo {
+			t.Errorf("expected %s to belong to project %q, got: %v", m.Oid, contentRepo, m.ProjectNames)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected ForEachObject() to succeed, got: %s", err)
+	}
+
+	sort.Strings(oids)
+	if strings.Join(seen, ",") != strings.Join(oids, ",") {
+		t.Fatalf("expected ForEachObject() to visit %v in order, got: %v", oids, seen)
+	}
+
+	var rest []string
+	err = testMetaStore.ForEachObject(seen[0], func(m *meta.Object) error {
+		rest = append(rest, m.Oid)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected ForEachObject() to succeed, got: %s", err)
+	}
+	if strings.Join(rest, ",") != strings.Join(seen[1:], ",") {
+		t.Errorf("expected ForEachObject() after %s to visit %v, got: %v", seen[0], seen[1:], rest)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = testMetaStore.ForEachObject("", func(m *meta.Object) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("expected ForEachObject() to stop after the first object, got %d and: %v", n, err)
+	}
+
+	var projects []string
+	err = testMetaStore.ForEachProject("", func(p *meta.Project) error {
+		projects = append(projects, p.Name)
+		// only committed objects are listed
+		if len(p.Oids) != 1 || p.Oids[0] != contentOid {
+			t.Errorf("expected project %s to have %s only, got: %v", p.Name, contentOid, p.Oids)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected ForEachProject() to succeed, got: %s", err)
+	}
+	if len(projects) != 1 || projects[0] != contentRepo {
+		t.Errorf("expected ForEachProject() to visit %s, got: %v", contentRepo, projects)
+	}
+}
+
+func testUsage(t *testing.T, testMetaStore *sqlstore.MetaStore) {
+
+	committed := &meta.RequestVars{Oid: contentOid, Size: contentSize, Namespace: "ns", Repo: contentRepo}
+	pending := &meta.RequestVars{Oid: strings.Repeat("0", 64), Size: 2 * contentSize, Namespace: "ns", Repo: contentRepo}
+
+	for _, rv := range []*meta.RequestVars{committed, pending, committed} {
+		if _, err := testMetaStore.Put(rv); err != nil {
+			t.Fatalf("expected Put() to succeed, got: %s", err)
+		}
+	}
+	if _, err := testMetaStore.Commit(committed); err != nil {
+		t.Fatalf("expected Commit() to succeed, got: %s", err)
+	}
+
+	expected := meta.Usage{Objects: 1, Bytes: contentSize, PendingObjects: 1, PendingBytes: 2 * contentSize}
+
+	check := func() {
+		for _, name := range []string{contentRepo, meta.TotalUsage} {
+			usage, err := testMetaStore.GetUsage(name)
+			if err != nil {
+				t.Fatalf("expected GetUsage() to succeed, got: %s", err)
+			}
+			if *usage != expected {
+				t.Errorf("expected the usage of %s to be %+v, got: %+v", name, expected, *usage)
+			}
+		}
+
+		var names []string
+		err := testMetaStore.ForEachUsage(func(name string, usage *meta.Usage) error {
+			names = append(names, name)
+			return nil
+		})
+		if err != nil || strings.Join(names, ",") != contentRepo {
+			t.Errorf("expected ForEachUsage() to visit %s only, got %v and: %v", contentRepo, names, err)
+		}
+	}
+
+	check()
+
+	if err := testMetaStore.RecountUsage(); err != nil {
+		t.Fatalf("expected RecountUsage() to succeed, got: %s", err)
+	}
+
+	check()
+
+	project, err := testMetaStore.GetProject(contentRepo)
+	if err != nil || project.Namespace != "ns" {
+		t.Errorf("expected the project to be in namespace ns, got %v and: %v", project, err)
+	}
+
+	// the project is committed by now
+	if _, err := testMetaStore.Commit(pending); err != nil {
+		t.Fatalf("expected Commit() to succeed, got: %s", err)
+	}
+
+	expected = meta.Usage{Objects: 2, Bytes: 3 * contentSize}
+
+	check()
+}
+
+func testMoveProject(t *testing.T, testMetaStore *sqlstore.MetaStore) {
+
+	for _, oid := range []string{contentOid, strings.Repeat("0", 64)} {
+		rv := &meta.RequestVars{Oid: oid, Size: contentSize, Namespace: "ns", Repo: contentRepo}
+		if _, err := testMetaStore.Put(rv); err != nil {
+			t.Fatalf("expected Put() to succeed, got: %s", err)
+		}
+		if _, err := testMetaStore.Commit(rv); err != nil {
+			t.Fatalf("expected Commit() to succeed, got: %s", err)
+		}
+	}
+
+	if err := testMetaStore.AddProject(&meta.Project{Name: "taken"}); err != nil {
+		t.Fatalf("expected AddProject() to succeed, got: %s", err)
+	}
+
+	if _, err := testMetaStore.MoveProject("nonexistent", &meta.ProjectMove{Name: "x"}); err != meta.ErrProjectNotFound {
+		t.Errorf("expected moving an unknown project to fail, got: %v", err)
+	}
+	if _, err := testMetaStore.MoveProject(contentRepo, &meta.ProjectMove{Name: "taken"}); err != meta.ErrProjectExists {
+		t.Errorf("expected renaming to an existing project to fail, got: %v", err)
+	}
+
+	p, err := testMetaStore.MoveProject(contentRepo, &meta.ProjectMove{Name: "renamed", Namespace: "other", Owner: "bob", Alias: true})
+	if err != nil {
+		t.Fatalf("expected MoveProject() to succeed, got: %s", err)
+	}
+	if p.Name != "renamed" || p.Namespace != "other" || p.Owner != "bob" {
+		t.Errorf("expected the moved project, got: %+v", p)
+	}
+
+	if _, err := testMetaStore.GetProject(contentRepo); err != meta.ErrProjectNotFound {
+		t.Errorf("expected the old name to be gone, got: %v", err)
+	}
+	if p, err := testMetaStore.GetProject("renamed"); err != nil || p.Namespace != "other" {
+		t.Errorf("expected the project under its new name, got %v and: %v", p, err)
+	}
+
+	err = testMetaStore.ForEachObject("", func(m *meta.Object) error {
+		if len(m.ProjectNames) != 1 || m.ProjectNames[0] != "renamed" {
+			t.Errorf("expected %s to belong to the renamed project, got: %v", m.Oid, m.ProjectNames)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected ForEachObject() to succeed, got: %s", err)
+	}
+
+	if u, err := testMetaStore.GetUsage("renamed"); err != nil || u.Objects != 2 {
+		t.Errorf("expected the usage to move along, got %v and: %v", u, err)
+	}
+	if u, err := testMetaStore.GetUsage(contentRepo); err != nil || *u != (meta.Usage{}) {
+		t.Errorf("expected no usage under the old name, got %v and: %v", u, err)
+	}
+
+	if _, err := testMetaStore.MoveProject("renamed", &meta.ProjectMove{Name: "again"}); err != nil {
+		t.Fatalf("expected MoveProject() to succeed, got: %s", err)
+	}
+
+	for alias, expected := range map[string]string{contentRepo: "again", "renamed": ""} {
+		target, err := testMetaStore.ProjectAlias(alias)
+		if expected == "" && err != meta.ErrProjectNotFound {
+			t.Errorf("expected %s not to be an alias, got %q and: %v", alias, target, err)
+		}
+		if expected != "" && (err != nil || target != expected) {
+			t.Errorf("expected %s to lead to %s, got %q and: %v", alias, expected, target, err)
+		}
+	}
+
+	if _, err := testMetaStore.MoveProject("taken", &meta.ProjectMove{Name: contentRepo}); err != meta.ErrProjectExists {
+		t.Errorf("expected renaming to an alias of another project to fail, got: %v", err)
+	}
+
+	if _, err := testMetaStore.MoveProject("again", &meta.ProjectMove{Name: contentRepo}); err != nil {
+		t.Fatalf("expected MoveProject() to succeed, got: %s", err)
+	}
+	if target, err := testMetaStore.ProjectAlias(contentRepo); err != meta.ErrProjectNotFound {
+		t.Errorf("expected a project name not to be an alias, got %q and: %v", target, err)
+	}
+}
+
+func testLink(t *testing.T, testMetaStore *sqlstore.MetaStore) {
+
+	rv := &meta.RequestVars{Oid: contentOid, Size: contentSize, Repo: contentRepo}
+	if _, err := testMetaStore.Put(rv); err != nil {
+		t.Fatalf("expected Put() to succeed, got: %s", err)
+	}
+	if _, err := testMetaStore.Commit(rv); err != nil {
+		t.Fatalf("expected Commit() to succeed, got: %s", err)
+	}
+
+	pending := &meta.RequestVars{Oid: strings.Repeat("0", 64), Size: contentSize, Repo: contentRepo}
+	if _, err := testMetaStore.Put(pending); err != nil {
+		t.Fatalf("expected Put() to succeed, got: %s", err)
+	}
+	if _, err := testMetaStore.Link(&meta.RequestVars{Oid: pending.Oid, Repo: "fork"}); !meta.IsObjectNotFound(err) {
+		t.Errorf("expected linking a pending object to fail, got: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		m, err := testMetaStore.Link(&meta.RequestVars{Oid: contentOid, Namespace: "ns", Repo: "fork"})
+		if err != nil {
+			t.Fatalf("expected Link() to succeed, got: %s", err)
+		}
+		if len(m.ProjectNames) != 2 {
+			t.Errorf("expected the object to belong to two projects, got: %v", m.ProjectNames)
+		}
+	}
+
+	if p, err := testMetaStore.GetProject("fork"); err != nil || p.Namespace != "ns" {
+		t.Errorf("expected the project to be created, got %v and: %v", p, err)
+	}
+
+	expected := map[string]meta.Usage{
+		contentRepo:     {Objects: 1, Bytes: contentSize, PendingObjects: 1, PendingBytes: contentSize, SharedObjects: 1, SharedBytes: contentSize},
+		"fork":          {Objects: 1, Bytes: contentSize, SharedObjects: 1, SharedBytes: contentSize},
+		meta.TotalUsage: {Objects: 1, Bytes: contentSize, PendingObjects: 1, PendingBytes: contentSize, SharedObjects: 1, SharedBytes: contentSize},
+	}
+
+	for _, recount := range []bool{false, true} {
+		if recount {
+			if err := testMetaStore.RecountUsage(); err != nil {
+				t.Fatalf("expected RecountUsage() to succeed, got: %s", err)
+			}
+		}
+
+		for name, u := range expected {
+			usage, err := testMetaStore.GetUsage(name)
+			if err != nil || *usage != u {
+				t.Errorf("expected the usage of %s to be %+v (recount: %t), got %+v and: %v", name, u, recount, usage, err)
+			}
+		}
+	}
+}
+
+func testAuthentication(t *testing.T, testMetaStore *sqlstore.MetaStore) {
+
+	if err := testMetaStore.AddUser(testUser, testPass); err != nil {
+		t.Errorf("expected AddUser() to succeed, got: %s", err)
+	}
+
+	if err := testMetaStore.AddUser(testUser, "other"); err != nil {
+		t.Errorf("expected duplicate AddUser() to succeed, got: %s", err)
+	}
+
+	users, err := testMetaStore.Users()
+	if err != nil {
+		t.Errorf("expected Users() to succeed, got: %s", err)
+	} else if len(users) != 1 || users[0].Name != testUser {
+		t.Errorf("expected Users() to return %s, got: %v", testUser, users)
+	}
+
+	ok, err := testMetaStore.Authenticate(testUser, testPass)
+	if !ok {
+		if err != nil {
+			t.Errorf("expected Authenticate() to succeed, got: %s", err)
+		} else {
+			t.Error("expected Authenticate() to succeed")
+		}
+	}
+
+	ok, _ = testMetaStore.Authenticate(testUser, "other")
+	if ok {
+		t.Errorf("expected duplicate AddUser() to not change the password")
+	}
+
+	if err := testMetaStore.DeleteUser(testUser); err != nil {
+		t.Errorf("expected DeleteUser() to succeed, got: %s", err)
+	}
+
+	users, err = testMetaStore.Users()
+	if err != nil {
+		t.Errorf("expected Users() to succeed, got: %s", err)
+	} else if len(users) != 0 {
+		t.Errorf("expected Users() to not return deleted user, got: %v", users)
+	}
+
+	ok, _ = testMetaStore.Authenticate(testUser, testPass)
+	if ok {
+		t.Errorf("expected Authenticate() to fail for a deleted user")
+	}
+
+	ok, err = testMetaStore.Authenticate("azog", "defiler")
+	if ok || err != nil {
+		t.Errorf("expected Authenticate() to fail without an error for nonexisting user, got: %v, %v", ok, err)
+	}
+}
+
+func testRoles(t *testing.T, testMetaStore *sqlstore.MetaStore) {
+
+	if err := testMetaStore.SetRole(testUser, meta.RoleAdmin); err != meta.ErrUserNotFound {
+		t.Errorf("expected SetRole() to fail for nonexisting user, got: %v", err)
+	}
+
+	if err := testMetaStore.AddUser(testUser, testPass); err != nil {
+		t.Errorf("expected AddUser() to succeed, got: %s", err)
+	}
+
+	user, err := testMetaStore.GetUser(testUser)
+	if err != nil {
+		t.Fatalf("expected GetUser() to succeed, got: %s", err)
+	}
+	if user.Role != meta.RoleUser {
+		t.Errorf("expected a new user to have the %s role, got: %s", meta.RoleUser, user.Role)
+	}
+
+	if err := testMetaStore.SetRole(testUser, "superuser"); err != meta.ErrInvalidRole {
+		t.Errorf("expected SetRole() to reject an unknown role, got: %v", err)
+	}
+
+	if err := testMetaStore.SetRole(testUser, meta.RoleAdmin); err != nil {
+		t.Errorf("expected SetRole() to succeed, got: %s", err)
+	}
+
+	user, err = testMetaStore.GetUser(testUser)
+	if err != nil {
+		t.Fatalf("expected GetUser() to succeed, got: %s", err)
+	}
+	if !user.IsAdmin() {
+		t.Errorf("expected user to be an admin, got role: %s", user.Role)
+	}
+
+	users, err := testMetaStore.Users()
+	if err != nil {
+		t.Errorf("expected Users() to succeed, got: %s", err)
+	} else if len(users) != 1 || !users[0].IsAdmin() {
+		t.Errorf("expected Users() to return the admin role, got: %v", users)
+	}
+
+	if err := testMetaStore.DeleteUser(testUser); err != nil {
+		t.Errorf("expected DeleteUser() to succeed, got: %s", err)
+	}
+
+	if _, err := testMetaStore.GetUser(testUser); err != meta.ErrUserNotFound {
+		t.Errorf("expected GetUser() to fail for a deleted user, got: %v", err)
+	}
+}
+
+func testUpdateUser(t *testing.T, testMetaStore *sqlstore.MetaStore) {
+
+	newPass := "changed"
+
+	update := &meta.UserUpdate{Password: &newPass}
+	if err := testMetaStore.UpdateUser(testUser, update); err != meta.ErrUserNotFound {
+		t.Errorf("expected UpdateUser() to fail for nonexisting user, got: %v", err)
+	}
+
+	if err := testMetaStore.AddUser(testUser, testPass); err != nil {
+		t.Errorf("expected AddUser() to succeed, got: %s", err)
+	}
+
+	if err := testMetaStore.UpdateUser(testUser, update); err != nil {
+		t.Errorf("expected UpdateUser() to succeed, got: %s", err)
+	}
+
+	if ok, _ := testMetaStore.Authenticate(testUser, testPass); ok {
+		t.Error("expected the old password to be rejected")
+	}
+	if ok, _ := testMetaStore.Authenticate(testUser, newPass); !ok {
+		t.Error("expected the new password to be accepted")
+	}
+
+	displayName, email, disabled := "Test User", "test@example.com", true
+	update = &meta.UserUpdate{DisplayName: &displayName, Email: &email, Disabled: &disabled}
+	if err := testMetaStore.UpdateUser(testUser, update); err != nil {
+		t.Errorf("expected UpdateUser() to succeed, got: %s", err)
+	}
+
+	if ok, _ := testMetaStore.Authenticate(testUser, newPass); ok {
+		t.Error("expected a disabled user to fail authentication")
+	}
+
+	user, err := testMetaStore.GetUser(testUser)
+	if err != nil {
+		t.Fatalf("expected GetUser() to succeed, got: %s", err)
+	}
+	if user.DisplayName != displayName || user.Email != email || !user.Disabled {
+		t.Errorf("expected the profile to be updated, got: %#v", user)
+	}
+
+	// fields that are left out don't change
+	disabled = false
+	if err := testMetaStore.UpdateUser(testUser, &meta.UserUpdate{Disabled: &disabled}); err != nil {
+		t.Errorf("expected UpdateUser() to succeed, got: %s", err)
+	}
+
+	users, err := testMetaStore.Users()
+	if err != nil {
+		t.Errorf("expected Users() to succeed, got: %s", err)
+	} else if len(users) != 1 || users[0].Email != email || users[0].Disabled {
+		t.Errorf("expected Users() to return the updated profile, got: %v", users)
+	}
+
+	if ok, _ := testMetaStore.Authenticate(testUser, newPass); !ok {
+		t.Error("expected an enabled user to authenticate")
+	}
+}
+
+func testTokens(t *testing.T, testMetaStore *sqlstore.MetaStore) {
+
+	if err := testMetaStore.AddUser(testUser, testPass); err != nil {
+		t.Fatalf("expected AddUser() to succeed, got: %s", err)
+	}
+
+	first, firstSecret, err := meta.NewToken(testUser, "first")
+	if err != nil {
+		t.Fatalf("expected NewToken() to succeed, got: %s", err)
+	}
+	second, secondSecret, err := meta.NewToken(testUser, "second")
+	if err != nil {
+		t.Fatalf("expected NewToken() to succeed, got: %s", err)
+	}
+
+	for _, token := range []*meta.Token{first, second} {
+		if err := testMetaStore.AddToken(token); err != nil {
+			t.Fatalf("expected AddToken() to succeed, got: %s", err)
+		}
+	}
+
+	token, err := testMetaStore.GetToken(meta.HashToken(firstSecret))
+	if err != nil || token.ID != first.ID || token.User != testUser || token.Name != "first" || !token.CreatedAt.Equal(first.CreatedAt) {
+		t.Errorf("expected GetToken() to return %+v, got %+v and: %v", first, token, err)
+	}
+
+	if _, err := testMetaStore.GetToken(meta.HashToken("wrong")); err != meta.ErrTokenNotFound {
+		t.Errorf("expected GetToken() to fail with ErrTokenNotFound, got: %v", err)
+	}
+
+	tokens, err := testMetaStore.Tokens(testUser)
+	if err != nil || len(tokens) != 2 {
+		t.Errorf("expected Tokens() to return 2 tokens, got %v and: %v", tokens, err)
+	}
+
+	if tokens, err := testMetaStore.Tokens("nobody"); err != nil || len(tokens) != 0 {
+		t.Errorf("expected Tokens() of an unknown user to be empty, got %v and: %v", tokens, err)
+	}
+
+	if err := testMetaStore.RevokeToken(first.ID); err != nil {
+		t.Errorf("expected RevokeToken() to succeed, got: %s", err)
+	}
+
+	if _, err := testMetaStore.GetToken(meta.HashToken(firstSecret)); err != meta.ErrTokenNotFound {
+		t.Errorf("expected a revoked token to be gone, got: %v", err)
+	}
+
+	if err := testMetaStore.RevokeToken(first.ID); err != meta.ErrTokenNotFound {
+		t.Errorf("expected RevokeToken() of an unknown token to fail with ErrTokenNotFound, got: %v", err)
+	}
+
+	if err := testMetaStore.DeleteUser(testUser); err != nil {
+		t.Errorf("expected DeleteUser() to succeed, got: %s", err)
+	}
+
+	if _, err := testMetaStore.GetToken(meta.HashToken(secondSecret)); err != meta.ErrTokenNotFound {
+		t.Errorf("expected deleting a user to revoke their tokens, got: %v", err)
+	}
+
+	if tokens, err := testMetaStore.Tokens(""); err != nil || len(tokens) != 0 {
+		t.Errorf("expected no tokens to be left, got %v and: %v", tokens, err)
+	}
+}
+
+func testPermissions(t *testing.T, testMetaStore *sqlstore.MetaStore) {
+	if err := testMetaStore.AddProject(&meta.Project{Name: contentRepo}); err != nil {
+		t.Fatalf("expected AddProject() to succeed, got: %s", err)
+	}
+
+	if err := testMetaStore.SetPermission("nonexisting", &meta.Permission{User: "bob", Access: meta.AccessRead}); err != meta.ErrProjectNotFound {
+		t.Errorf("expected SetPermission() to fail for a nonexisting project, got: %v", err)
+	}
+	if err := testMetaStore.SetPermission(contentRepo, &meta.Permission{User: "bob", Access: "owner"}); err != meta.ErrInvalidAccess {
+		t.Errorf("expected SetPermission() to fail for an invalid access, got: %v", err)
+	}
+
+	for _, p := range []*meta.Permission{
+		{User: "carol", Access: meta.AccessRead},
+		{User: "bob", Access: meta.AccessRead},
+		{User: "bob", Access: meta.AccessWrite},
+	} {
+		if err := testMetaStore.SetPermission(contentRepo, p); err != nil {
+			t.Fatalf("expected SetPermission() to succeed, got: %s", err)
+		}
+	}
+
+	permissions, err := testMetaStore.Permissions(contentRepo)
+	if err != nil || len(permissions) != 2 || permissions[0].User != "bob" || !permissions[0].CanWrite() || permissions[1].User != "carol" || permissions[1].CanWrite() {
+		t.Errorf("expected write access for bob and read access for carol, got %v and: %v", permissions, err)
+	}
+
+	if permissions, err := testMetaStore.Permissions("nonexisting"); err != nil || len(permissions) != 0 {
+		t.Errorf("expected no permissions for a nonexisting project, got %v and: %v", permissions, err)
+	}
+
+	if err := testMetaStore.DeletePermission(contentRepo, "carol"); err != nil {
+		t.Errorf("expected DeletePermission() to succeed, got: %s", err)
+	}
+	if err := testMetaStore.DeletePermission(contentRepo, "carol"); err != meta.ErrPermissionNotFound {
+		t.Errorf("expected DeletePermission() of an unknown permission to fail with ErrPermissionNotFound, got: %v", err)
+	}
+
+	if _, err := testMetaStore.MoveProject(contentRepo, &meta.ProjectMove{Name: "renamed"}); err != nil {
+		t.Fatalf("expected MoveProject() to succeed, got: %s", err)
+	}
+	if permissions, err := testMetaStore.Permissions("renamed"); err != nil || len(permissions) != 1 || permissions[0].User != "bob" {
+		t.Errorf("expected the permissions to follow the project, got %v and: %v", permissions, err)
+	}
+	if permissions, err := testMetaStore.Permissions(contentRepo); err != nil || len(permissions) != 0 {
+		t.Errorf("expected no permissions to be left under the old name, got %v and: %v", permissions, err)
+	}
+
+	if err := testMetaStore.AddUser("bob", testPass); err != nil {
+		t.Fatalf("expected AddUser() to succeed, got: %s", err)
+	}
+	if err := testMetaStore.DeleteUser("bob"); err != nil {
+		t.Fatalf("expected DeleteUser() to succeed, got: %s", err)
+	}
+	if permissions, err := testMetaStore.Permissions("renamed"); err != nil || len(permissions) != 0 {
+		t.Errorf("expected deleting a user to remove their permissions, got %v and: %v", permissions, err)
+	}
+
+	if err := testMetaStore.SetPermission("renamed", &meta.Permission{User: "carol", Access: meta.AccessRead}); err != nil {
+		t.Fatalf("expected SetPermission() to succeed, got: %s", err)
+	}
+	if err := testMetaStore.DeleteProject("renamed"); err != nil {
+		t.Fatalf("expected DeleteProject() to succeed, got: %s", err)
+	}
+	if err := testMetaStore.AddProject(&meta.Project{Name: "renamed"}); err != nil {
+		t.Fatalf("expected AddProject() to succeed, got: %s", err)
+	}
+	if permissions, err := testMetaStore.Permissions("renamed"); err != nil || len(permissions) != 0 {
+		t.Errorf("expected the permissions to be removed along with the project, got %v and: %v", permissions, err)
+	}
+}
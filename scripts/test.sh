@@ -18,7 +18,7 @@ fi
 # install godep dependencies
 godep restore
 # space delimiter
-prereqs=(Cassandra mysqld)
+prereqs=(Cassandra mysqld postgres)
 for p in ${prereqs[@]}; do
   lf="`echo [$(echo $p | cut -b1)]${p:1}`"
   if [[ "x`ps -ef |grep $lf`" == "x" ]];then
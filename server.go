@@ -2,19 +2,26 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"expvar"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/ksurent/lfs-server-go/audit"
+	"github.com/ksurent/lfs-server-go/auth"
 	"github.com/ksurent/lfs-server-go/config"
 	"github.com/ksurent/lfs-server-go/content"
-	"github.com/ksurent/lfs-server-go/extauth/ldap"
 	"github.com/ksurent/lfs-server-go/meta"
 
 	"github.com/facebookgo/grace/gracehttp"
@@ -26,7 +33,14 @@ import (
 type Representation struct {
 	Oid   string           `json:"oid"`
 	Size  int64            `json:"size"`
-	Links map[string]*link `json:"_links"`
+	Links map[string]*link `json:"_links,omitempty"`
+	Error *objectError     `json:"error,omitempty"`
+}
+
+// objectError tells batch clients why a single object can't be transferred
+type objectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
 }
 
 // link provides a structure used to build a hypermedia representation of an HTTP link.
@@ -37,10 +51,17 @@ type link struct {
 
 // App links a Router, ContentStore, and MetaStore to provide the LFS server.
 type App struct {
-	config       *config.Configuration
-	router       *mux.Router
-	contentStore content.GenericContentStore
-	metaStore    meta.GenericMetaStore
+	config         *config.Configuration
+	router         *mux.Router
+	contentStore   content.GenericContentStore
+	metaStore      meta.GenericMetaStore
+	authCache      *auth.CredentialCache
+	authenticator  auth.Authenticator
+	authorizer     auth.Authorizer
+	publicRead     []string
+	lockout        *auth.Lockout
+	passwordPolicy auth.PasswordPolicy
+	auditLog       *audit.Log
 }
 
 // NewApp creates a new App using the ContentStore and MetaStore provided
@@ -52,18 +73,120 @@ func NewApp(cfg *config.Configuration, c content.GenericContentStore, m meta.Gen
 		router:       mux.NewRouter(),
 	}
 
+	if cfg.AuthCache != nil && cfg.AuthCache.Enabled {
+		ttl, err := time.ParseDuration(cfg.AuthCache.TTL)
+		if err != nil {
+			log.Println("Failed to parse auth cache TTL (" + err.Error() + "), defaulting to 5 minutes")
+			ttl = 5 * time.Minute
+		}
+
+		if cache, err := auth.NewCredentialCache(ttl, cfg.AuthCache.Size); err == nil {
+			app.authCache = cache
+			if m != nil {
+				app.metaStore = &cacheInvalidatingMetaStore{m, cache}
+			}
+		} else {
+			log.Println("Could not create the auth cache:", err)
+		}
+	}
+
+	app.passwordPolicy = newPasswordPolicy(cfg)
+	app.auditLog = newAuditLog(cfg)
+
+	if m != nil {
+		storageUsage.set(m)
+	}
+
+	if app.metaStore != nil && cfg.AdminUser != "" {
+		if err := app.bootstrapAdmin(); err != nil {
+			log.Println("Could not create the admin user:", err)
+		}
+	}
+
+	app.authenticator = app.newAuthenticatorChain()
+
+	if cfg.Lockout != nil && cfg.Lockout.Enabled {
+		app.lockout = auth.NewLockout(
+			cfg.Lockout.Threshold,
+			cfg.Lockout.UserThreshold,
+			parseDuration("lockout Backoff", cfg.Lockout.Backoff, 30*time.Second),
+			parseDuration("lockout MaxBackoff", cfg.Lockout.MaxBackoff, 15*time.Minute),
+			parseDuration("lockout Window", cfg.Lockout.Window, 15*time.Minute),
+		)
+		if cfg.Proxy != nil {
+			// the same proxies that may name the user may name the client
+			if err := app.lockout.TrustProxies(config.SplitList(cfg.Proxy.TrustedProxies)); err != nil {
+				log.Println("Not trusting any proxies for the lockout:", err)
+			}
+		}
+		app.authenticator = app.lockout.Guard(app.authenticator)
+	}
+	app.authorizer = app.newAuthorizer()
+
+	for _, pattern := range cfg.PublicReadPatterns() {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Printf("Skipping public read pattern %q: %s", pattern, err)
+			continue
+		}
+		app.publicRead = append(app.publicRead, pattern)
+	}
+
 	app.router.HandleFunc("/debug/vars", app.DebugHandler).Methods("GET")
 
-	app.addEndpoint("/{namespace}/{repo}/objects/batch", app.BatchHandler, metaResponse).Methods("POST").MatcherFunc(MetaMatcher)
-	app.addEndpoint("/{namespace}/{repo}/objects", app.PostHandler, metaResponse).Methods("POST").MatcherFunc(MetaMatcher)
-	app.addEndpoint("/search/{oid}", app.GetSearchHandler, metaResponse).Methods("GET")
-	app.addEndpoint("/{namespace}/{repo}/verify", app.VerifyHandler, metaResponse).Methods("POST").MatcherFunc(ContentMatcher)
+	// the batch handler checks for write access itself, only uploads need it
+	app.addEndpoint("/{namespace}/{repo}/objects/batch", auth.Read, app.BatchHandler, metaResponse).Methods("POST").MatcherFunc(MetaMatcher)
+	app.addEndpoint("/{namespace}/{repo}/objects", auth.Write, app.PostHandler, metaResponse).Methods("POST").MatcherFunc(MetaMatcher)
+	app.addEndpoint("/search/{oid}", auth.Read, app.GetSearchHandler, metaResponse).Methods("GET")
+	app.addEndpoint("/{namespace}/{repo}/verify", auth.Write, app.VerifyHandler, metaResponse).Methods("POST").MatcherFunc(ContentMatcher)
+
+	app.addEndpoint("/admin/lockouts/{name}", auth.Admin, app.UnlockHandler, adminResponse).Methods("DELETE")
+	app.addEndpoint("/admin/users", auth.Admin, app.ListUsersHandler, adminResponse).Methods("GET")
+	app.addEndpoint("/admin/users", auth.Admin, app.CreateUserHandler, adminResponse).Methods("POST")
+	app.addEndpoint("/admin/users/{name}", auth.Admin, app.GetUserHandler, adminResponse).Methods("GET")
+	app.addEndpoint("/admin/users/{name}", auth.Admin, app.UpdateUserHandler, adminResponse).Methods("PUT")
+	app.addEndpoint("/admin/users/{name}", auth.Admin, app.DeleteUserHandler, adminResponse).Methods("DELETE")
+	app.addEndpoint("/admin/users/{name}/role", auth.Admin, app.SetRoleHandler, adminResponse).Methods("PUT")
+	app.addEndpoint("/admin/projects", auth.Admin, app.ListProjectsHandler, adminResponse).Methods("GET")
+	app.addEndpoint("/admin/projects", auth.Admin, app.CreateProjectHandler, adminResponse).Methods("POST")
+	app.addEndpoint("/admin/projects/{name}", auth.Admin, app.GetProjectHandler, adminResponse).Methods("GET")
+	app.addEndpoint("/admin/projects/{name}", auth.Admin, app.UpdateProjectHandler, adminResponse).Methods("PUT")
+	app.addEndpoint("/admin/projects/{name}", auth.Admin, app.DeleteProjectHandler, adminResponse).Methods("DELETE")
+	app.addEndpoint("/admin/projects/{name}/move", auth.Admin, app.MoveProjectHandler, adminResponse).Methods("POST")
+	app.addEndpoint("/admin/projects/{name}/permissions", auth.Admin, app.ListPermissionsHandler, adminResponse).Methods("GET")
+	app.addEndpoint("/admin/projects/{name}/permissions/{user}", auth.Admin, app.SetPermissionHandler, adminResponse).Methods("PUT")
+	app.addEndpoint("/admin/projects/{name}/permissions/{user}", auth.Admin, app.DeletePermissionHandler, adminResponse).Methods("DELETE")
+	app.addEndpoint("/admin/audit", auth.Admin, app.AuditHandler, adminResponse).Methods("GET")
+	app.addEndpoint("/admin/usage", auth.Admin, app.UsageHandler, adminResponse).Methods("GET")
+	app.addEndpoint("/admin/usage/projects", auth.Admin, app.ListProjectUsageHandler, adminResponse).Methods("GET")
+	app.addEndpoint("/admin/usage/projects/{name}", auth.Admin, app.GetProjectUsageHandler, adminResponse).Methods("GET")
+	app.addEndpoint("/admin/objects", auth.Admin, app.ListObjectsHandler, adminResponse).Methods("GET")
+	app.addEndpoint("/admin/objects/{oid}", auth.Admin, app.GetObjectHandler, adminResponse).Methods("GET")
+
+	app.addEndpoint("/user", auth.Account, app.AccountHandler, accountResponse).Methods("GET")
+	app.addEndpoint("/user", auth.Account, app.UpdateAccountHandler, accountResponse).Methods("PUT")
+	app.addEndpoint("/user/password", auth.Account, app.ChangePasswordHandler, accountResponse).Methods("PUT")
+
+	app.addEndpoint("/admin/ui/", auth.Admin, app.UIOverviewHandler, adminResponse).Methods("GET")
+	app.addEndpoint("/admin/ui/namespaces", auth.Admin, app.UINamespacesHandler, adminResponse).Methods("GET")
+	app.addEndpoint("/admin/ui/projects", auth.Admin, app.UIProjectsHandler, adminResponse).Methods("GET")
+	app.addEndpoint("/admin/ui/projects/{name}", auth.Admin, app.UIProjectHandler, adminResponse).Methods("GET")
+	app.addEndpoint("/admin/ui/objects", auth.Admin, app.UIObjectsHandler, adminResponse).Methods("GET")
+	app.addEndpoint("/admin/ui/users", auth.Admin, app.UIUsersHandler, adminResponse).Methods("GET")
+	app.addEndpoint("/admin/ui/users", auth.Admin, app.UICreateUserHandler, adminResponse).Methods("POST")
+	app.addEndpoint("/admin/ui/users/{name}/delete", auth.Admin, app.UIDeleteUserHandler, adminResponse).Methods("POST")
+	app.addEndpoint("/admin/ui/users/{name}/role", auth.Admin, app.UISetRoleHandler, adminResponse).Methods("POST")
+	app.addEndpoint("/admin/ui/users/{name}/password", auth.Admin, app.UIResetPasswordHandler, adminResponse).Methods("POST")
+	app.addEndpoint("/admin/ui/users/{name}/disabled", auth.Admin, app.UISetDisabledHandler, adminResponse).Methods("POST")
+	app.addEndpoint("/admin/ui/tokens", auth.Admin, app.UITokensHandler, adminResponse).Methods("GET")
+	app.addEndpoint("/admin/ui/tokens", auth.Admin, app.UICreateTokenHandler, adminResponse).Methods("POST")
+	app.addEndpoint("/admin/ui/tokens/{id}/revoke", auth.Admin, app.UIRevokeTokenHandler, adminResponse).Methods("POST")
+	app.router.Handle("/admin/ui", http.RedirectHandler("/admin/ui/", http.StatusMovedPermanently))
 
 	route := "/{namespace}/{repo}/objects/{oid}"
 
-	app.addEndpoint(route, app.GetMetaHandler, metaResponse).Methods("GET", "HEAD").MatcherFunc(MetaMatcher)
-	app.addEndpoint(route, app.GetContentHandler, downloadResponse).Methods("GET", "HEAD").MatcherFunc(ContentMatcher)
-	app.addEndpoint(route, app.PutHandler, uploadResponse).Methods("PUT").MatcherFunc(ContentMatcher)
+	app.addEndpoint(route, auth.Read, app.GetMetaHandler, metaResponse).Methods("GET", "HEAD").MatcherFunc(MetaMatcher)
+	app.addEndpoint(route, auth.Read, app.GetContentHandler, downloadResponse).Methods("GET", "HEAD").MatcherFunc(ContentMatcher)
+	app.addEndpoint(route, auth.Write, app.PutHandler, uploadResponse).Methods("PUT").MatcherFunc(ContentMatcher)
 
 	return app
 }
@@ -89,14 +212,8 @@ func (a *App) Serve() error {
 	if a.config.UseTLS() {
 		log.Println("Using TLS")
 
-		tlsCfg := &tls.Config{
-			NextProtos:   []string{"http/1.1"},
-			Certificates: make([]tls.Certificate, 1),
-		}
-
-		if pair, err := tls.LoadX509KeyPair(a.config.Cert, a.config.Key); err == nil {
-			tlsCfg.Certificates[0] = pair
-		} else {
+		tlsCfg, err := a.newTLSConfig()
+		if err != nil {
 			log.Fatal(err)
 		}
 
@@ -106,14 +223,56 @@ func (a *App) Serve() error {
 	return gracehttp.Serve(srv)
 }
 
+func (a *App) newTLSConfig() (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		NextProtos:   []string{"http/1.1"},
+		Certificates: make([]tls.Certificate, 1),
+	}
+
+	pair, err := tls.LoadX509KeyPair(a.config.Cert, a.config.Key)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg.Certificates[0] = pair
+
+	if a.config.VerifyClientCerts() {
+		log.Println("Verifying client certificates")
+
+		pem, err := ioutil.ReadFile(a.config.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", a.config.ClientCA)
+		}
+		tlsCfg.ClientCAs = pool
+
+		// without RequireClient clients may still use other credentials
+		if a.config.RequireClient {
+			tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return tlsCfg, nil
+}
+
 // GetContentHandler gets the content from the content store
 func (a *App) GetContentHandler(w http.ResponseWriter, r *http.Request) int {
 	rv := unpack(r)
+	e := setAudit(r, audit.Download, rv.Oid)
+
 	m, err := a.metaStore.Get(rv)
 	if err != nil {
 		log.Println(err)
 		return notFound(w, r)
 	}
+	if !inProject(m, rv.Repo) {
+		return notFound(w, r)
+	}
 
 	reader, err := a.contentStore.Get(m)
 	if err != nil {
@@ -122,7 +281,7 @@ func (a *App) GetContentHandler(w http.ResponseWriter, r *http.Request) int {
 	}
 	defer reader.Close()
 
-	io.Copy(w, reader)
+	e.Bytes, _ = io.Copy(w, reader)
 
 	return http.StatusOK
 }
@@ -147,6 +306,9 @@ func (a *App) GetMetaHandler(w http.ResponseWriter, r *http.Request) int {
 		log.Println(err)
 		return notFound(w, r)
 	}
+	if !inProject(m, rv.Repo) {
+		return notFound(w, r)
+	}
 
 	w.Header().Set("Content-Type", metaMediaType)
 
@@ -161,7 +323,23 @@ func (a *App) GetMetaHandler(w http.ResponseWriter, r *http.Request) int {
 // PostHandler instructs the client how to upload data (legacy API)
 func (a *App) PostHandler(w http.ResponseWriter, r *http.Request) int {
 	rv := unpack(r)
-	m, err := a.metaStore.Put(rv)
+
+	project, err := a.uploadProject(rv.Repo)
+	if err != nil {
+		log.Println(err)
+		if err == meta.ErrProjectNotFound {
+			writeMessage(w, r, http.StatusNotFound, err.Error())
+			return http.StatusNotFound
+		}
+		return internalError(w, r, err)
+	}
+
+	if message := exceedsLimit(project, rv.Size); message != "" {
+		writeMessage(w, r, http.StatusUnprocessableEntity, message)
+		return http.StatusUnprocessableEntity
+	}
+
+	m, present, err := a.putObject(r, rv)
 	if err != nil {
 		log.Println(err)
 		return notFound(w, r)
@@ -170,13 +348,13 @@ func (a *App) PostHandler(w http.ResponseWriter, r *http.Request) int {
 	w.Header().Set("Content-Type", metaMediaType)
 
 	sentStatus := 202
-	if m.Existing && a.contentStore.Exists(m) {
+	if present && a.contentStore.Exists(m) {
 		sentStatus = 200
 	}
 	w.WriteHeader(sentStatus)
 
 	enc := json.NewEncoder(w)
-	enc.Encode(a.Represent(rv, m, m.Existing, true, true))
+	enc.Encode(a.Represent(rv, m, present, true, true))
 
 	if !m.Existing {
 		go metaPending.Add(1)
@@ -189,20 +367,76 @@ func (a *App) PostHandler(w http.ResponseWriter, r *http.Request) int {
 func (a *App) BatchHandler(w http.ResponseWriter, r *http.Request) int {
 	bv := unpackbatch(r)
 
+	download := bv.Operation == "download"
+
+	if !download {
+		ok, err := a.authorize(r, auth.Write)
+		if err != nil {
+			log.Println(err)
+			writeStatus(w, r, http.StatusInternalServerError)
+			return http.StatusInternalServerError
+		}
+		if !ok {
+			if identity(r) == nil {
+				// anonymous download of a public project, ask for credentials
+				return requireAuth(w, r)
+			}
+			return forbidden(w, r)
+		}
+	}
+
+	var project *meta.Project
+
+	if !download {
+		var err error
+		project, err = a.uploadProject(mux.Vars(r)["repo"])
+		if err != nil {
+			log.Println(err)
+			if err == meta.ErrProjectNotFound {
+				writeMessage(w, r, http.StatusNotFound, err.Error())
+				return http.StatusNotFound
+			}
+			return internalError(w, r, err)
+		}
+	}
+
 	var responseObjects []*Representation
 
 	for _, object := range bv.Objects {
-		// Put() checks if the object already exists in the meta store and
-		// returns it if it does
-		m, err := a.metaStore.Put(object)
+		if download {
+			m, err := a.metaStore.Get(object)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			// objects of other projects are left out like missing ones
+			if !inProject(m, object.Repo) {
+				continue
+			}
+
+			responseObjects = append(responseObjects, a.Represent(object, m, true, false, false))
+			continue
+		}
+
+		if message := exceedsLimit(project, object.Size); message != "" {
+			responseObjects = append(responseObjects, &Representation{
+				Oid:   object.Oid,
+				Size:  object.Size,
+				Error: &objectError{http.StatusUnprocessableEntity, message},
+			})
+			continue
+		}
+
+		m, present, err := a.putObject(r, object)
 		if err != nil {
 			log.Println(err)
 			continue
 		}
 
+		// objects that are present are left out of the upload
 		responseObjects = append(
 			responseObjects,
-			a.Represent(object, m, m.Existing, !m.Existing, true),
+			a.Represent(object, m, present, !present, true),
 		)
 
 		if !m.Existing {
@@ -227,13 +461,21 @@ func (a *App) BatchHandler(w http.ResponseWriter, r *http.Request) int {
 // PutHandler receives data from the client and puts it into the content store
 func (a *App) PutHandler(w http.ResponseWriter, r *http.Request) int {
 	rv := unpack(r)
+	e := setAudit(r, audit.Upload, rv.Oid)
+
+	body := &countingReader{Reader: r.Body}
+	defer func() { e.Bytes = body.n }()
+
 	m, err := a.metaStore.GetPending(rv)
+	if meta.IsObjectNotFound(err) {
+		return a.linkUploaded(w, r, rv, body)
+	}
 	if err != nil {
 		log.Println(err)
 		return notFound(w, r)
 	}
 
-	if err := a.contentStore.Put(m, r.Body); err != nil {
+	if err := a.contentStore.Put(m, body); err != nil {
 		log.Println(err)
 
 		return http.StatusInternalServerError
@@ -258,6 +500,9 @@ func (a *App) VerifyHandler(w http.ResponseWriter, r *http.Request) int {
 		log.Println(err)
 		return notFound(w, r)
 	}
+	if !inProject(m, rv.Repo) {
+		return notFound(w, r)
+	}
 
 	w.Header().Set("Content-Type", metaMediaType)
 
@@ -314,18 +559,164 @@ func (a *App) Represent(rv *meta.RequestVars, m *meta.Object, download, upload,
 	return rep
 }
 
-func (a *App) authenticate(r *http.Request) (bool, error) {
-	user, pass, ok := r.BasicAuth()
+// uploadProject returns the project uploads to repo go to, nil if it will be
+// created by the upload. With StrictProjects uploads can only go to existing
+// projects and meta.ErrProjectNotFound is returned.
+func (a *App) uploadProject(repo string) (*meta.Project, error) {
+	project, err := a.metaStore.GetProject(repo)
+	if err == meta.ErrProjectNotFound && !a.config.StrictProjects {
+		return nil, nil
+	}
+
+	return project, err
+}
 
-	if !ok {
-		return false, nil
+// putObject creates the object a client is about to upload, unless the meta
+// store has it already. It returns true if the object is present in the
+// project and needn't be uploaded: committed objects are linked to the
+// project if the user can read one of the projects that have them. Others
+// are only linked once the client uploads them, to show it has their
+// content.
+func (a *App) putObject(r *http.Request, rv *meta.RequestVars) (*meta.Object, bool, error) {
+	m, err := a.metaStore.Get(rv)
+	if meta.IsObjectNotFound(err) {
+		// Put() returns the object if it was created in the meantime
+		m, err = a.metaStore.Put(rv)
+		if err != nil {
+			return nil, false, err
+		}
+		return m, m.Existing, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if inProject(m, rv.Repo) {
+		return m, true, nil
+	}
+
+	if m.Size != rv.Size {
+		return m, false, nil
+	}
+
+	for _, name := range m.ProjectNames {
+		ok, err := a.canRead(r, name)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			continue
+		}
+
+		if m, err = a.metaStore.Link(rv); err != nil {
+			return nil, false, err
+		}
+
+		go metaMounted.Add(1)
+		return m, true, nil
+	}
+
+	return m, false, nil
+}
+
+// inProject returns true if the object belongs to the project, or if no
+// project is given
+func inProject(m *meta.Object, project string) bool {
+	if project == "" {
+		return true
+	}
+	for _, name := range m.ProjectNames {
+		if name == project {
+			return true
+		}
+	}
+
+	return false
+}
+
+// linkUploaded handles uploads of objects that are already stored but not
+// linked to the project. The content isn't stored again, it only has to
+// match the object.
+func (a *App) linkUploaded(w http.ResponseWriter, r *http.Request, rv *meta.RequestVars, body io.Reader) int {
+	m, err := a.metaStore.Get(rv)
+	if err != nil {
+		log.Println(err)
+		return notFound(w, r)
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, body)
+	if err != nil {
+		log.Println(err)
+		return http.StatusInternalServerError
+	}
+
+	if n != m.Size || hex.EncodeToString(hash.Sum(nil)) != m.Oid {
+		writeMessage(w, r, http.StatusUnprocessableEntity, "Content doesn't match the object")
+		return http.StatusUnprocessableEntity
+	}
+
+	if _, err := a.metaStore.Link(rv); err != nil {
+		return internalError(w, r, err)
+	}
+
+	return http.StatusOK
+}
+
+// exceedsLimit returns an error message if an object of size is too large
+// to be uploaded to project
+func exceedsLimit(project *meta.Project, size int64) string {
+	if project == nil || project.MaxObjectSize <= 0 || size <= project.MaxObjectSize {
+		return ""
+	}
+
+	return fmt.Sprintf("Object is larger than the %d bytes allowed in project %s", project.MaxObjectSize, project.Name)
+}
+
+// cacheInvalidatingMetaStore makes sure that removed and updated users can't
+// keep using cached credentials.
+type cacheInvalidatingMetaStore struct {
+	meta.GenericMetaStore
+	cache *auth.CredentialCache
+}
+
+func (s *cacheInvalidatingMetaStore) DeleteUser(user string) error {
+	err := s.GenericMetaStore.DeleteUser(user)
+	s.cache.Invalidate(user)
+	return err
+}
+
+// UpdateUser forgets cached credentials, old passwords and disabled users
+// must stop working right away
+func (s *cacheInvalidatingMetaStore) UpdateUser(user string, update *meta.UserUpdate) error {
+	err := s.GenericMetaStore.UpdateUser(user, update)
+	s.cache.Invalidate(user)
+	return err
+}
+
+// newPasswordPolicy returns the configured password policy, the zero policy
+// if there is none
+func newPasswordPolicy(cfg *config.Configuration) auth.PasswordPolicy {
+	if cfg.Password == nil {
+		return auth.PasswordPolicy{}
 	}
 
-	if a.config.Ldap.Enabled {
-		return ldap.AuthenticateLdap(a.config.Ldap, user, pass)
+	return auth.PasswordPolicy{
+		MinLength:  cfg.Password.MinLength,
+		MinClasses: cfg.Password.MinClasses,
 	}
+}
 
-	return a.metaStore.Authenticate(user, pass)
+// parseDuration parses a configured duration, falling back to def if it is
+// missing or invalid.
+func parseDuration(name, value string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s %q, defaulting to %s", name, value, def)
+		return def
+	}
+
+	return d
 }
 
 // ContentMatcher provides a mux.MatcherFunc that only allows requests that contain
@@ -344,6 +735,12 @@ func MetaMatcher(r *http.Request, m *mux.RouteMatch) bool {
 	return mt == metaMediaType
 }
 
+// identity returns the authenticated user of the request, if there is one
+func identity(r *http.Request) *auth.Identity {
+	id, _ := context.Get(r, "Identity").(*auth.Identity)
+	return id
+}
+
 func unpack(r *http.Request) *meta.RequestVars {
 	vars := mux.Vars(r)
 	rv := &meta.RequestVars{
@@ -353,6 +750,10 @@ func unpack(r *http.Request) *meta.RequestVars {
 		Authorization: r.Header.Get("Authorization"),
 	}
 
+	if id := identity(r); id != nil {
+		rv.User = id.Name
+	}
+
 	if r.Method == "POST" { // Maybe also check if +json
 		var p meta.RequestVars
 		dec := json.NewDecoder(r.Body)
@@ -380,32 +781,50 @@ func unpackbatch(r *http.Request) *meta.BatchVars {
 		return &bv
 	}
 
+	var user string
+	if id := identity(r); id != nil {
+		user = id.Name
+	}
+
 	for i := 0; i < len(bv.Objects); i++ {
 		bv.Objects[i].Namespace = vars["namespace"]
 		bv.Objects[i].Repo = vars["repo"]
 		bv.Objects[i].Authorization = r.Header.Get("Authorization")
+		bv.Objects[i].User = user
 	}
 
 	return &bv
 }
 
 func logRequest(r *http.Request, status int) {
+	user := "-"
+	if id := identity(r); id != nil {
+		user = id.Name + "@" + id.Source
+	}
+
 	log.Printf(
-		"rid=%s status=%d method=%s url=%s",
+		"rid=%s status=%d method=%s url=%s user=%s",
 		context.Get(r, "RequestID"),
 		status,
 		r.Method,
 		r.URL,
+		user,
 	)
 }
 
 func writeStatus(w http.ResponseWriter, r *http.Request, status int) {
-	message := http.StatusText(status)
+	writeMessage(w, r, status, http.StatusText(status))
+}
 
+// writeMessage responds with an error message, in the LFS JSON error format
+// if the client accepts JSON.
+func writeMessage(w http.ResponseWriter, r *http.Request, status int, message string) {
 	mediaParts := strings.Split(r.Header.Get("Accept"), ";")
 	mt := mediaParts[0]
-	if strings.HasSuffix(mt, "+json") {
-		message = `{"message":"` + message + `"}`
+	if strings.HasSuffix(mt, "+json") || mt == "application/json" {
+		if b, err := json.Marshal(map[string]string{"message": message}); err == nil {
+			message = string(b)
+		}
 	}
 
 	w.WriteHeader(status)
@@ -417,29 +836,296 @@ func notFound(w http.ResponseWriter, r *http.Request) int {
 	return http.StatusNotFound
 }
 
+func badRequest(w http.ResponseWriter, r *http.Request, message string) int {
+	writeMessage(w, r, http.StatusBadRequest, message)
+	return http.StatusBadRequest
+}
+
+func conflict(w http.ResponseWriter, r *http.Request, message string) int {
+	writeMessage(w, r, http.StatusConflict, message)
+	return http.StatusConflict
+}
+
+func internalError(w http.ResponseWriter, r *http.Request, err error) int {
+	log.Println(err)
+	writeStatus(w, r, http.StatusInternalServerError)
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) int {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+	return status
+}
+
+func forbidden(w http.ResponseWriter, r *http.Request) int {
+	writeStatus(w, r, http.StatusForbidden)
+	return http.StatusForbidden
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) int {
+	// round up, "0" would invite an immediate retry
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	writeStatus(w, r, http.StatusTooManyRequests)
+	return http.StatusTooManyRequests
+}
+
 func requireAuth(w http.ResponseWriter, r *http.Request) int {
 	w.Header().Set("Lfs-Authenticate", "Basic realm=lfs-server-go")
+	// browsers only ask for credentials for the standard header, git-lfs
+	// would stop trying its credential helpers on it
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("WWW-Authenticate", "Basic realm=lfs-server-go")
+	}
 	writeStatus(w, r, http.StatusUnauthorized)
 	return http.StatusUnauthorized
 }
 
-func (a *App) addEndpoint(path string, f func(http.ResponseWriter, *http.Request) int, exp *expvar.Map) *mux.Route {
+// isPublicRead returns true if anybody may download from the repository the
+// request is for, because it matches PublicRead or the project is public.
+func (a *App) isPublicRead(r *http.Request) bool {
+	vars := mux.Vars(r)
+	if vars["namespace"] == "" || vars["repo"] == "" {
+		return false
+	}
+
+	if a.matchesPublicRead(vars["namespace"], vars["repo"]) {
+		return true
+	}
+
+	if a.metaStore == nil {
+		return false
+	}
+
+	p, err := a.metaStore.GetProject(vars["repo"])
+	if err != nil {
+		if err != meta.ErrProjectNotFound {
+			log.Println(err)
+		}
+		return false
+	}
+
+	return p.IsPublic()
+}
+
+// resolveAlias points requests for the old name of a renamed project at the
+// project, in the namespace it is in now. Everything after it, including
+// authorization and the links handed out, sees the new location.
+func (a *App) resolveAlias(r *http.Request) error {
+	vars := mux.Vars(r)
+	if vars["repo"] == "" || a.metaStore == nil {
+		return nil
+	}
+
+	target, err := a.metaStore.ProjectAlias(vars["repo"])
+	switch {
+	case err == meta.ErrProjectNotFound:
+		return nil
+	case err != nil:
+		return err
+	}
+
+	vars["repo"] = target
+
+	project, err := a.metaStore.GetProject(target)
+	switch {
+	case err == meta.ErrProjectNotFound:
+		return nil
+	case err != nil:
+		return err
+	}
+
+	if project.Namespace != "" {
+		vars["namespace"] = project.Namespace
+	}
+
+	return nil
+}
+
+// inProjectNamespace returns false if the request names a project under a
+// namespace other than the one the project belongs to. Projects are keyed
+// by name alone, so without this check a namespace the user may access
+// would open any project. Projects without a namespace, stored before
+// namespaces were, can't be reached until an admin gives them one.
+func (a *App) inProjectNamespace(r *http.Request) (bool, error) {
+	vars := mux.Vars(r)
+	if vars["repo"] == "" || a.metaStore == nil {
+		return true, nil
+	}
+
+	p, err := a.metaStore.GetProject(vars["repo"])
+	switch {
+	case err == meta.ErrProjectNotFound:
+		return true, nil
+	case err != nil:
+		return false, err
+	}
+
+	return p.Namespace == vars["namespace"], nil
+}
+
+// matchesPublicRead returns true if namespace/repo matches PublicRead
+func (a *App) matchesPublicRead(namespace, repo string) bool {
+	for _, pattern := range a.publicRead {
+		if ok, _ := path.Match(pattern, namespace+"/"+repo); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// canRead returns true if the user of the request may download from the
+// project, in the namespace it was created in
+func (a *App) canRead(r *http.Request, name string) (bool, error) {
+	if a.config.IsPublic() {
+		return true, nil
+	}
+
+	p, err := a.metaStore.GetProject(name)
+	if err != nil {
+		if err == meta.ErrProjectNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if p.IsPublic() || a.matchesPublicRead(p.Namespace, p.Name) {
+		return true, nil
+	}
+
+	ok, err := a.authorizer.Authorize(identity(r), p.Namespace, p.Name, auth.Read)
+	if ok || err != nil {
+		return ok, err
+	}
+
+	return a.permitted(identity(r), p.Name, auth.Read)
+}
+
+// permitted returns true if a permission of the project lets the user
+// perform op. Permissions add to what the authorizer allows.
+func (a *App) permitted(id *auth.Identity, name string, op auth.Operation) (bool, error) {
+	if id == nil || name == "" || a.metaStore == nil {
+		return false, nil
+	}
+
+	permissions, err := a.metaStore.Permissions(name)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range permissions {
+		if p.User == id.Name {
+			return op == auth.Read || p.CanWrite(), nil
+		}
+	}
+
+	return false, nil
+}
+
+// authorize checks if the authenticated user may perform op on the
+// repository the request is for.
+func (a *App) authorize(r *http.Request, op auth.Operation) (bool, error) {
+	switch {
+	case op == auth.Admin:
+		return a.isAdmin(identity(r)), nil
+	case op == auth.Account:
+		return identity(r) != nil, nil
+	case a.config.IsPublic():
+		return true, nil
+	}
+
+	vars := mux.Vars(r)
+	ok, err := a.authorizer.Authorize(identity(r), vars["namespace"], vars["repo"], op)
+	if !ok && op == auth.Read && a.isPublicRead(r) {
+		// public projects stay readable even if the authorizer fails
+		return true, nil
+	}
+	if ok || err != nil {
+		return ok, err
+	}
+
+	return a.permitted(identity(r), vars["repo"], op)
+}
+
+func (a *App) addEndpoint(path string, op auth.Operation, f func(http.ResponseWriter, *http.Request) int, exp *expvar.Map) *mux.Route {
 	wrapped := func(w http.ResponseWriter, r *http.Request) {
-		if !a.config.IsPublic() {
-			ok, err := a.authenticate(r)
+		// administration and accounts require authentication even on
+		// public servers
+		authenticate := !a.config.IsPublic() || op == auth.Admin || op == auth.Account
+
+		var authErr error
+		if authenticate {
+			// credentials are still checked for public downloads, so that
+			// batch uploads know who they're dealing with
+			id, err := a.authenticator.Authenticate(r)
+			if err == nil {
+				context.Set(r, "Identity", id)
+			}
+			authErr = err
+		}
+
+		// projects are only looked up for known users and for downloads
+		// that may be public, anonymous callers must not learn which
+		// projects exist and where
+		if authErr == nil || op == auth.Read {
+			if err := a.resolveAlias(r); err != nil {
+				log.Println(err)
+				writeStatus(w, r, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		switch {
+		case authErr == nil:
+		case op == auth.Read && a.isPublicRead(r):
+			if !auth.IsUnauthorized(authErr) {
+				log.Println(authErr)
+			}
+		case auth.IsUnauthorized(authErr):
+			a.recordAudit(r, &audit.Event{Action: audit.AuthFailure}, requireAuth(w, r))
+			return
+		case auth.IsLockedOut(authErr):
+			status := tooManyRequests(w, r, authErr.(*auth.LockedOutError).RetryAfter)
+			a.recordAudit(r, &audit.Event{Action: audit.LockedOut}, status)
+			return
+		default:
+			log.Println(authErr)
+			writeStatus(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		// the authorizer is asked about the namespace of the URL, which
+		// has to be the one of the project
+		inNamespace, err := a.inProjectNamespace(r)
+		if err != nil {
+			log.Println(err)
+			writeStatus(w, r, http.StatusInternalServerError)
+			return
+		}
+		if !inNamespace {
+			a.recordAudit(r, &audit.Event{Action: audit.Forbidden}, notFound(w, r))
+			return
+		}
+
+		if authenticate {
+			ok, err := a.authorize(r, op)
 			if err != nil {
 				log.Println(err)
 				writeStatus(w, r, http.StatusInternalServerError)
 				return
 			}
 			if !ok {
-				requireAuth(w, r)
+				a.recordAudit(r, &audit.Event{Action: audit.Forbidden}, forbidden(w, r))
 				return
 			}
 		}
 
 		status := f(w, r)
 		logRequest(r, status)
+		a.recordAudit(r, auditEvent(r, op), status)
 		go exp.Add(strconv.Itoa(status), 1)
 	}
 
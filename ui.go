@@ -0,0 +1,663 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/ksurent/lfs-server-go/meta"
+
+	"github.com/gorilla/mux"
+)
+
+// The management UI is rendered on the server from the templates below, it
+// works without JavaScript. Forms post back to the UI and redirect.
+
+var uiTemplates = template.Must(template.New("layout").Funcs(template.FuncMap{
+	"bytes": formatBytes,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}} - lfs-server-go</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+nav a { margin-right: 1em; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { border-bottom: 1px solid #ddd; padding: 0.3em 0.8em; text-align: left; }
+td.num { text-align: right; }
+.pending { color: #a60; }
+.error { color: #a00; }
+form.inline { display: inline; }
+</style>
+</head>
+<body>
+<nav>
+<a href="/admin/ui/">Overview</a>
+<a href="/admin/ui/namespaces">Namespaces</a>
+<a href="/admin/ui/projects">Projects</a>
+<a href="/admin/ui/objects">Objects</a>
+<a href="/admin/ui/users">Users</a>
+<a href="/admin/ui/tokens">Tokens</a>
+</nav>
+<h1>{{.Title}}</h1>
+{{with .Error}}<p class="error">{{.}}</p>{{end}}
+{{template "content" .}}
+</body>
+</html>
+`))
+
+var uiPages = map[string]*template.Template{
+	"overview": uiPage(`
+<table>
+<tr><td>Objects</td><td class="num">{{.Data.Usage.Objects}} ({{bytes .Data.Usage.Bytes}})</td></tr>
+<tr><td>Pending objects</td><td class="num">{{.Data.Usage.PendingObjects}} ({{bytes .Data.Usage.PendingBytes}})</td></tr>
+<tr><td>Shared objects</td><td class="num">{{.Data.Usage.SharedObjects}} ({{bytes .Data.Usage.SharedBytes}})</td></tr>
+<tr><td>Users</td><td class="num">{{.Data.Users}}</td></tr>
+</table>
+<h2>Counters</h2>
+<table>
+{{range .Data.Vars}}<tr><td>{{.Key}}</td><td><code>{{.Value}}</code></td></tr>
+{{end}}</table>
+`),
+	"namespaces": uiPage(`
+<table>
+<tr><th>Namespace</th><th>Projects</th><th>Objects</th><th>Size</th><th>Pending</th></tr>
+{{range .Data}}<tr>
+<td><a href="/admin/ui/projects?namespace={{.Name}}">{{or .Name "(none)"}}</a></td>
+<td class="num">{{.Projects}}</td>
+<td class="num">{{.Objects}}</td>
+<td class="num">{{bytes .Bytes}}</td>
+<td class="num">{{.PendingObjects}}</td>
+</tr>
+{{else}}<tr><td colspan="5">No namespaces</td></tr>
+{{end}}</table>
+`),
+	"projects": uiPage(`
+<table>
+<tr><th>Project</th><th>Namespace</th><th>Description</th><th>Owner</th><th>Visibility</th><th>Objects</th><th>Size</th><th>Pending</th></tr>
+{{range .Data.Projects}}<tr>
+<td><a href="/admin/ui/projects/{{.Name}}">{{.Name}}</a></td>
+<td>{{with .Namespace}}<a href="/admin/ui/projects?namespace={{.}}">{{.}}</a>{{end}}</td>
+<td>{{.Description}}</td>
+<td>{{.Owner}}</td>
+<td>{{.Visibility}}</td>
+<td class="num">{{.Objects}}</td>
+<td class="num">{{bytes .Bytes}}</td>
+<td class="num">{{.PendingObjects}}</td>
+</tr>
+{{else}}<tr><td colspan="8">No projects</td></tr>
+{{end}}</table>
+{{with .Data.Next}}<p><a href="{{.}}">Next page</a></p>{{end}}
+`),
+	"objects": uiPage(`
+<table>
+<tr><th>OID</th><th>Size</th><th>State</th><th>Projects</th></tr>
+{{range .Data.Objects}}<tr>
+<td><code>{{.Oid}}</code></td>
+<td class="num">{{bytes .Size}}</td>
+<td>{{if .Pending}}<span class="pending">pending</span>{{else}}committed{{end}}</td>
+<td>{{range $i, $p := .ProjectNames}}{{if $i}}, {{end}}<a href="/admin/ui/projects/{{$p}}">{{$p}}</a>{{end}}</td>
+</tr>
+{{else}}<tr><td colspan="4">No objects</td></tr>
+{{end}}</table>
+{{with .Data.Next}}<p><a href="{{.}}">Next page</a></p>{{end}}
+`),
+	"users": uiPage(`
+<table>
+<tr><th>User</th><th>Name</th><th>Email</th><th>Role</th><th>Password</th><th></th></tr>
+{{range .Data}}<tr>
+<td>{{.Name}}{{if .Disabled}} <span class="pending">disabled</span>{{end}}</td>
+<td>{{.DisplayName}}</td>
+<td>{{.Email}}</td>
+<td>
+<form class="inline" method="POST" action="/admin/ui/users/{{.Name}}/role">
+<select name="role">
+<option value="user"{{if eq .Role "user"}} selected{{end}}>user</option>
+<option value="admin"{{if eq .Role "admin"}} selected{{end}}>admin</option>
+</select>
+<button type="submit">Change</button>
+</form>
+</td>
+<td>
+<form class="inline" method="POST" action="/admin/ui/users/{{.Name}}/password">
+<input name="password" type="password" placeholder="new password" required>
+<button type="submit">Reset</button>
+</form>
+</td>
+<td>
+<form class="inline" method="POST" action="/admin/ui/users/{{.Name}}/disabled">
+<input type="hidden" name="disabled" value="{{not .Disabled}}">
+<button type="submit">{{if .Disabled}}Enable{{else}}Disable{{end}}</button>
+</form>
+<form class="inline" method="POST" action="/admin/ui/users/{{.Name}}/delete">
+<button type="submit">Delete</button>
+</form>
+</td>
+</tr>
+{{else}}<tr><td colspan="6">No users</td></tr>
+{{end}}</table>
+<h2>Add user</h2>
+<form method="POST" action="/admin/ui/users">
+<input name="name" placeholder="name" required>
+<input name="password" type="password" placeholder="password" required>
+<input name="display_name" placeholder="display name">
+<input name="email" type="email" placeholder="email">
+<select name="role"><option value="user">user</option><option value="admin">admin</option></select>
+<button type="submit">Add</button>
+</form>
+`),
+	"tokens": uiPage(`
+{{with .Data.Created}}<p>Token <code>{{.ID}}</code> of {{.User}} was created, its secret is
+<code>{{.Secret}}</code>. Copy it now, it won't be shown again.</p>{{end}}
+<table>
+<tr><th>ID</th><th>User</th><th>Name</th><th>Created</th><th></th></tr>
+{{range .Data.Tokens}}<tr>
+<td><code>{{.ID}}</code></td>
+<td>{{.User}}</td>
+<td>{{.Name}}</td>
+<td>{{.CreatedAt.Format "2006-01-02 15:04:05"}}</td>
+<td>
+<form class="inline" method="POST" action="/admin/ui/tokens/{{.ID}}/revoke">
+<button type="submit">Revoke</button>
+</form>
+</td>
+</tr>
+{{else}}<tr><td colspan="5">No tokens</td></tr>
+{{end}}</table>
+<h2>Create token</h2>
+<form method="POST" action="/admin/ui/tokens">
+<input name="user" placeholder="user" required>
+<input name="name" placeholder="name">
+<button type="submit">Create</button>
+</form>
+`),
+}
+
+func uiPage(content string) *template.Template {
+	return template.Must(template.Must(uiTemplates.Clone()).New("content").Parse(content))
+}
+
+type uiPageData struct {
+	Title string
+	Error string
+	Data  interface{}
+}
+
+type uiProject struct {
+	*meta.Project
+	meta.Usage
+}
+
+// renderUI renders a page, along with the error passed on by uiRedirect if
+// a form post failed
+func (a *App) renderUI(w http.ResponseWriter, r *http.Request, page, title string, data interface{}) int {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY")
+
+	err := uiPages[page].Execute(w, &uiPageData{
+		Title: title,
+		Error: r.URL.Query().Get("error"),
+		Data:  data,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+
+	return http.StatusOK
+}
+
+// UIOverviewHandler shows totals and the expvar counters. Projects aren't
+// counted, that would take going through all of them.
+func (a *App) UIOverviewHandler(w http.ResponseWriter, r *http.Request) int {
+	users, err := a.metaStore.Users()
+	if err != nil {
+		return internalError(w, r, err)
+	}
+
+	var data struct {
+		Users int
+		Usage *meta.Usage
+		Vars  []expvar.KeyValue
+	}
+
+	data.Users = len(users)
+
+	if data.Usage, err = a.metaStore.GetUsage(meta.TotalUsage); err != nil {
+		return internalError(w, r, err)
+	}
+
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "memstats" || kv.Key == "cmdline" {
+			return
+		}
+		data.Vars = append(data.Vars, kv)
+	})
+
+	return a.renderUI(w, r, "overview", "Overview", &data)
+}
+
+// uiNamespace is a row of the namespaces page
+type uiNamespace struct {
+	Name     string
+	Projects int
+	meta.Usage
+}
+
+// UINamespacesHandler lists the namespaces with their number of projects and
+// the storage they use
+func (a *App) UINamespacesHandler(w http.ResponseWriter, r *http.Request) int {
+	byName := make(map[string]*uiNamespace)
+
+	err := a.metaStore.ForEachProject("", func(p *meta.Project) error {
+		if byName[p.Namespace] == nil {
+			byName[p.Namespace] = &uiNamespace{Name: p.Namespace}
+		}
+		byName[p.Namespace].Projects++
+		return nil
+	})
+	if err != nil {
+		return internalError(w, r, err)
+	}
+
+	report, err := newUsageReport(a.metaStore)
+	if err != nil {
+		return internalError(w, r, err)
+	}
+
+	for name, u := range report.Namespaces {
+		if byName[name] == nil {
+			byName[name] = &uiNamespace{Name: name}
+		}
+		byName[name].Usage = *u
+	}
+
+	list := make([]*uiNamespace, 0, len(byName))
+	for _, n := range byName {
+		list = append(list, n)
+	}
+	sort.Sort(uiNamespacesByName(list))
+
+	return a.renderUI(w, r, "namespaces", "Namespaces", list)
+}
+
+// uiProjects is the data of the projects page, Next is the URI of the
+// following page if there is one
+type uiProjects struct {
+	Projects []*uiProject
+	Next     string
+}
+
+// UIProjectsHandler lists the projects with their number of objects and
+// total size, a page at a time, only those of a namespace if one is given in
+// the query
+func (a *App) UIProjectsHandler(w http.ResponseWriter, r *http.Request) int {
+	after, limit, err := pageParams(r)
+	if err != nil {
+		return badRequest(w, r, err.Error())
+	}
+
+	namespace, filter := r.URL.Query()["namespace"]
+
+	var data uiProjects
+	err = a.metaStore.ForEachProject(after, func(p *meta.Project) error {
+		if filter && p.Namespace != namespace[0] {
+			return nil
+		}
+
+		usage, err := a.metaStore.GetUsage(p.Name)
+		if err != nil {
+			return err
+		}
+
+		// only the totals are shown, there is no need to hold on to the OIDs
+		p.Oids = nil
+		data.Projects = append(data.Projects, &uiProject{Project: p, Usage: *usage})
+		return pageDone(len(data.Projects), limit)
+	})
+	switch err {
+	case nil:
+	case errPageDone:
+		data.Next = nextPage(r, data.Projects[len(data.Projects)-1].Name, limit)
+	default:
+		return internalError(w, r, err)
+	}
+
+	title := "Projects"
+	if filter {
+		title = "Projects in " + namespace[0]
+	}
+
+	return a.renderUI(w, r, "projects", title, &data)
+}
+
+// uiObjects is the data of the objects page, Next is the URI of the
+// following page if there is one
+type uiObjects struct {
+	Objects []*adminObject
+	Next    string
+}
+
+// UIProjectHandler lists the objects of a project, a page at a time
+func (a *App) UIProjectHandler(w http.ResponseWriter, r *http.Request) int {
+	after, limit, err := pageParams(r)
+	if err != nil {
+		return badRequest(w, r, err.Error())
+	}
+
+	name := mux.Vars(r)["name"]
+
+	var data uiObjects
+	err = a.metaStore.ForEachObject(after, func(m *meta.Object) error {
+		for _, p := range m.ProjectNames {
+			if p == name {
+				data.Objects = append(data.Objects, newAdminObject(m))
+				return pageDone(len(data.Objects), limit)
+			}
+		}
+		return nil
+	})
+	switch err {
+	case nil:
+	case errPageDone:
+		data.Next = nextPage(r, data.Objects[len(data.Objects)-1].Oid, limit)
+	default:
+		return internalError(w, r, err)
+	}
+
+	return a.renderUI(w, r, "objects", "Project "+name, &data)
+}
+
+// UIObjectsHandler lists all objects, a page at a time
+func (a *App) UIObjectsHandler(w http.ResponseWriter, r *http.Request) int {
+	after, limit, err := pageParams(r)
+	if err != nil {
+		return badRequest(w, r, err.Error())
+	}
+
+	var data uiObjects
+	var next string
+	data.Objects, next, err = a.objectPage(after, limit)
+	if err != nil {
+		return internalError(w, r, err)
+	}
+	if next != "" {
+		data.Next = nextPage(r, next, limit)
+	}
+
+	return a.renderUI(w, r, "objects", "Objects", &data)
+}
+
+// UIUsersHandler lists the meta store users with forms to manage them
+func (a *App) UIUsersHandler(w http.ResponseWriter, r *http.Request) int {
+	users, err := a.metaStore.Users()
+	if err != nil {
+		return internalError(w, r, err)
+	}
+
+	list := make([]*adminUser, 0, len(users))
+	for _, user := range users {
+		list = append(list, newAdminUser(user))
+	}
+	sort.Sort(adminUsersByName(list))
+
+	return a.renderUI(w, r, "users", "Users", list)
+}
+
+// UICreateUserHandler adds a user from the form on the users page
+func (a *App) UICreateUserHandler(w http.ResponseWriter, r *http.Request) int {
+	if !sameOrigin(r) {
+		return forbidden(w, r)
+	}
+
+	name, pass, role := r.PostFormValue("name"), r.PostFormValue("password"), r.PostFormValue("role")
+	displayName, email := r.PostFormValue("display_name"), r.PostFormValue("email")
+
+	if name == "" || pass == "" {
+		return uiRedirect(w, r, "/admin/ui/users", "User name and password are required")
+	}
+
+	if err := a.passwordPolicy.Check(name, pass); err != nil {
+		return uiRedirect(w, r, "/admin/ui/users", err.Error())
+	}
+
+	switch _, err := a.metaStore.GetUser(name); {
+	case !meta.ValidRole(role):
+		return uiRedirect(w, r, "/admin/ui/users", meta.ErrInvalidRole.Error())
+	case err == nil:
+		return uiRedirect(w, r, "/admin/ui/users", "User already exists")
+	case err != meta.ErrUserNotFound:
+		return internalError(w, r, err)
+	}
+
+	if err := a.metaStore.AddUser(name, pass); err != nil {
+		return internalError(w, r, err)
+	}
+
+	if err := a.metaStore.SetRole(name, role); err != nil {
+		return internalError(w, r, err)
+	}
+
+	if displayName != "" || email != "" {
+		update := &meta.UserUpdate{DisplayName: &displayName, Email: &email}
+		if err := a.metaStore.UpdateUser(name, update); err != nil {
+			return internalError(w, r, err)
+		}
+	}
+
+	return uiRedirect(w, r, "/admin/ui/users", "")
+}
+
+// UIDeleteUserHandler removes a user from the users page
+func (a *App) UIDeleteUserHandler(w http.ResponseWriter, r *http.Request) int {
+	if !sameOrigin(r) {
+		return forbidden(w, r)
+	}
+
+	if err := a.metaStore.DeleteUser(mux.Vars(r)["name"]); err != nil {
+		return internalError(w, r, err)
+	}
+
+	return uiRedirect(w, r, "/admin/ui/users", "")
+}
+
+// UISetRoleHandler changes the role of a user from the users page
+func (a *App) UISetRoleHandler(w http.ResponseWriter, r *http.Request) int {
+	if !sameOrigin(r) {
+		return forbidden(w, r)
+	}
+
+	role := r.PostFormValue("role")
+	if !meta.ValidRole(role) {
+		return uiRedirect(w, r, "/admin/ui/users", meta.ErrInvalidRole.Error())
+	}
+
+	name := mux.Vars(r)["name"]
+
+	if _, err := a.metaStore.GetUser(name); err != nil {
+		if err == meta.ErrUserNotFound {
+			return uiRedirect(w, r, "/admin/ui/users", err.Error())
+		}
+		return internalError(w, r, err)
+	}
+
+	if err := a.metaStore.SetRole(name, role); err != nil {
+		return internalError(w, r, err)
+	}
+
+	return uiRedirect(w, r, "/admin/ui/users", "")
+}
+
+// UIResetPasswordHandler sets a new password for a user
+func (a *App) UIResetPasswordHandler(w http.ResponseWriter, r *http.Request) int {
+	if !sameOrigin(r) {
+		return forbidden(w, r)
+	}
+
+	name, pass := mux.Vars(r)["name"], r.PostFormValue("password")
+
+	if err := a.passwordPolicy.Check(name, pass); err != nil {
+		return uiRedirect(w, r, "/admin/ui/users", err.Error())
+	}
+
+	return a.uiUpdateUser(w, r, name, &meta.UserUpdate{Password: &pass})
+}
+
+// UISetDisabledHandler disables or enables a user
+func (a *App) UISetDisabledHandler(w http.ResponseWriter, r *http.Request) int {
+	if !sameOrigin(r) {
+		return forbidden(w, r)
+	}
+
+	disabled := r.PostFormValue("disabled") == "true"
+
+	return a.uiUpdateUser(w, r, mux.Vars(r)["name"], &meta.UserUpdate{Disabled: &disabled})
+}
+
+// uiTokens is the data of the tokens page, Created is the token that was
+// just created, the only time its secret is shown
+type uiTokens struct {
+	Tokens  []*meta.Token
+	Created *newToken
+}
+
+// UITokensHandler lists the access tokens of all users
+func (a *App) UITokensHandler(w http.ResponseWriter, r *http.Request) int {
+	return a.renderTokens(w, r, nil)
+}
+
+// UICreateTokenHandler creates an access token from the form on the tokens
+// page. The page is rendered right away instead of redirecting so that the
+// secret doesn't end up in a URL.
+func (a *App) UICreateTokenHandler(w http.ResponseWriter, r *http.Request) int {
+	if !sameOrigin(r) {
+		return forbidden(w, r)
+	}
+
+	user := r.PostFormValue("user")
+
+	if _, err := a.metaStore.GetUser(user); err != nil {
+		if err == meta.ErrUserNotFound {
+			return uiRedirect(w, r, "/admin/ui/tokens", err.Error())
+		}
+		return internalError(w, r, err)
+	}
+
+	token, secret, err := meta.NewToken(user, r.PostFormValue("name"))
+	if err != nil {
+		return internalError(w, r, err)
+	}
+
+	if err := a.metaStore.AddToken(token); err != nil {
+		return internalError(w, r, err)
+	}
+
+	return a.renderTokens(w, r, &newToken{token, secret})
+}
+
+// UIRevokeTokenHandler revokes an access token from the tokens page
+func (a *App) UIRevokeTokenHandler(w http.ResponseWriter, r *http.Request) int {
+	if !sameOrigin(r) {
+		return forbidden(w, r)
+	}
+
+	if err := a.metaStore.RevokeToken(mux.Vars(r)["id"]); err != nil {
+		if err == meta.ErrTokenNotFound {
+			return uiRedirect(w, r, "/admin/ui/tokens", err.Error())
+		}
+		return internalError(w, r, err)
+	}
+
+	return uiRedirect(w, r, "/admin/ui/tokens", "")
+}
+
+func (a *App) renderTokens(w http.ResponseWriter, r *http.Request, created *newToken) int {
+	tokens, err := a.metaStore.Tokens("")
+	if err != nil {
+		return internalError(w, r, err)
+	}
+	sort.Sort(tokensByUser(tokens))
+
+	return a.renderUI(w, r, "tokens", "Tokens", &uiTokens{tokens, created})
+}
+
+func (a *App) uiUpdateUser(w http.ResponseWriter, r *http.Request, name string, update *meta.UserUpdate) int {
+	if err := a.metaStore.UpdateUser(name, update); err != nil {
+		if err == meta.ErrUserNotFound {
+			return uiRedirect(w, r, "/admin/ui/users", err.Error())
+		}
+		return internalError(w, r, err)
+	}
+
+	return uiRedirect(w, r, "/admin/ui/users", "")
+}
+
+// uiRedirect sends the browser back to a page after a form post, passing
+// on the error if there was one
+func uiRedirect(w http.ResponseWriter, r *http.Request, page, message string) int {
+	if message != "" {
+		page += "?error=" + url.QueryEscape(message)
+	}
+
+	http.Redirect(w, r, page, http.StatusSeeOther)
+	return http.StatusSeeOther
+}
+
+// sameOrigin returns true if a form was posted from the UI itself. Browsers
+// send credentials along with cross-site posts, other sites must not be able
+// to make changes on behalf of a logged in admin.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || origin == "" {
+		return false
+	}
+
+	return u.Host == r.Host
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+type uiNamespacesByName []*uiNamespace
+
+func (s uiNamespacesByName) Len() int           { return len(s) }
+func (s uiNamespacesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s uiNamespacesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type adminUsersByName []*adminUser
+
+func (s adminUsersByName) Len() int           { return len(s) }
+func (s adminUsersByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s adminUsersByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type tokensByUser []*meta.Token
+
+func (s tokensByUser) Len() int { return len(s) }
+func (s tokensByUser) Less(i, j int) bool {
+	if s[i].User != s[j].User {
+		return s[i].User < s[j].User
+	}
+	return s[i].CreatedAt.Before(s[j].CreatedAt)
+}
+func (s tokensByUser) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/ksurent/lfs-server-go/meta"
+
+	"github.com/gorilla/mux"
+)
+
+// usageReport is the storage used by all projects and by each namespace.
+// DeduplicatedBytes is what storing shared objects only once saves.
+type usageReport struct {
+	Total             *meta.Usage            `json:"total"`
+	Namespaces        map[string]*meta.Usage `json:"namespaces"`
+	DeduplicatedBytes int64                  `json:"deduplicated_bytes"`
+}
+
+// projectUsage is the storage used by a single project
+type projectUsage struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	meta.Usage
+}
+
+// forEachProjectUsage calls fn with the usage counters of every project.
+// Projects that only have pending objects may not have a namespace yet.
+func forEachProjectUsage(store meta.GenericMetaStore, fn func(*projectUsage) error) error {
+	namespaces := map[string]string{}
+	err := store.ForEachProject("", func(p *meta.Project) error {
+		namespaces[p.Name] = p.Namespace
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return store.ForEachUsage(func(name string, u *meta.Usage) error {
+		return fn(&projectUsage{name, namespaces[name], *u})
+	})
+}
+
+// newUsageReport sums the usage counters of the projects by namespace, it
+// doesn't look at the objects
+func newUsageReport(store meta.GenericMetaStore) (*usageReport, error) {
+	total, err := store.GetUsage(meta.TotalUsage)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &usageReport{Total: total, Namespaces: map[string]*meta.Usage{}}
+
+	var projectBytes int64
+	err = forEachProjectUsage(store, func(p *projectUsage) error {
+		if report.Namespaces[p.Namespace] == nil {
+			report.Namespaces[p.Namespace] = &meta.Usage{}
+		}
+		report.Namespaces[p.Namespace].Add(&p.Usage)
+		projectBytes += p.Bytes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report.DeduplicatedBytes = projectBytes - total.Bytes
+
+	return report, nil
+}
+
+// UsageHandler reports the total storage used and the usage of every namespace
+func (a *App) UsageHandler(w http.ResponseWriter, r *http.Request) int {
+	report, err := newUsageReport(a.metaStore)
+	if err != nil {
+		return internalError(w, r, err)
+	}
+
+	return writeJSON(w, http.StatusOK, report)
+}
+
+// ListProjectUsageHandler reports the storage used by every project, or by
+// the projects of the namespace given in the query
+func (a *App) ListProjectUsageHandler(w http.ResponseWriter, r *http.Request) int {
+	namespace, filter := r.URL.Query()["namespace"]
+
+	list := []*projectUsage{}
+	err := forEachProjectUsage(a.metaStore, func(p *projectUsage) error {
+		if !filter || p.Namespace == namespace[0] {
+			list = append(list, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return internalError(w, r, err)
+	}
+
+	return writeJSON(w, http.StatusOK, list)
+}
+
+// GetProjectUsageHandler reports the storage used by a single project
+func (a *App) GetProjectUsageHandler(w http.ResponseWriter, r *http.Request) int {
+	name := mux.Vars(r)["name"]
+
+	usage, err := a.metaStore.GetUsage(name)
+	if err != nil {
+		return internalError(w, r, err)
+	}
+
+	project, err := a.metaStore.GetProject(name)
+	switch {
+	case err == nil:
+		return writeJSON(w, http.StatusOK, &projectUsage{name, project.Namespace, *usage})
+	case err != meta.ErrProjectNotFound:
+		return internalError(w, r, err)
+	case *usage != meta.Usage{}:
+		// a project that only has pending objects
+		return writeJSON(w, http.StatusOK, &projectUsage{Name: name, Usage: *usage})
+	default:
+		return notFound(w, r)
+	}
+}
+
+// usageVar publishes the total usage of the meta store of the most recent
+// App. It is read whenever /debug/vars is, so it doesn't go through the
+// projects, the breakdown by namespace is left to /admin/usage.
+type usageVar struct {
+	mu    sync.RWMutex
+	store meta.GenericMetaStore
+}
+
+func (v *usageVar) set(store meta.GenericMetaStore) {
+	v.mu.Lock()
+	v.store = store
+	v.mu.Unlock()
+}
+
+func (v *usageVar) get() meta.GenericMetaStore {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.store
+}
+
+func (v *usageVar) String() string {
+	store := v.get()
+	if store == nil {
+		return "null"
+	}
+
+	total, err := store.GetUsage(meta.TotalUsage)
+	if err != nil {
+		log.Println("Could not read the storage usage:", err)
+		return "null"
+	}
+
+	b, _ := json.Marshal(total)
+	return string(b)
+}
+
+// total returns an expvar with a single field of the total usage, for
+// graphite
+func (v *usageVar) total(field func(*meta.Usage) int64) expvar.Var {
+	return expvar.Func(func() interface{} {
+		store := v.get()
+		if store == nil {
+			return 0
+		}
+
+		total, err := store.GetUsage(meta.TotalUsage)
+		if err != nil {
+			log.Println("Could not read the storage usage:", err)
+			return 0
+		}
+
+		return field(total)
+	})
+}